@@ -0,0 +1,195 @@
+// Command oidc-stub is a minimal OpenID Connect issuer for trying single
+// sign-on locally. It signs everyone in without a password: as -email, or
+// as the login_hint of the authorization request.
+//
+//	go run ./cmd/oidc-stub -email dev@example.com
+//	OIDC_ISSUER=http://localhost:9000 OIDC_CLIENT_ID=afterrun APP_URL=http://localhost:8080 go run .
+//
+// Never expose it beyond localhost.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const keyID = "stub-1"
+
+type authCode struct {
+	ClientID    string
+	RedirectURI string
+	Nonce       string
+	Challenge   string
+	Email       string
+	ExpiresAt   time.Time
+}
+
+type stub struct {
+	issuer   string
+	clientID string
+	email    string
+	key      *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authCode
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:9000", "listen address")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer URL")
+	clientID := flag.String("client-id", "afterrun", "accepted client id")
+	email := flag.String("email", "dev@example.com", "email to sign in as, unless login_hint is given")
+	flag.Parse()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &stub{issuer: *issuer, clientID: *clientID, email: *email, key: key, codes: map[string]authCode{}}
+
+	http.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	http.HandleFunc("/authorize", s.authorize)
+	http.HandleFunc("/token", s.token)
+	http.HandleFunc("/jwks", s.jwks)
+
+	log.Printf("OIDC stub issuer %s listening on %s", *issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *stub) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.issuer,
+		"authorization_endpoint":                s.issuer + "/authorize",
+		"token_endpoint":                        s.issuer + "/token",
+		"jwks_uri":                              s.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// authorize approves every request right away and redirects back with a code.
+func (s *stub) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("redirect_uri") == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" || q.Get("client_id") != s.clientID ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "expected response_type=code, a known client_id and an S256 code_challenge", http.StatusBadRequest)
+		return
+	}
+
+	email := s.email
+	if hint := q.Get("login_hint"); hint != "" {
+		email = hint
+	}
+	code := randomString()
+	s.mu.Lock()
+	s.codes[code] = authCode{
+		ClientID:    q.Get("client_id"),
+		RedirectURI: q.Get("redirect_uri"),
+		Nonce:       q.Get("nonce"),
+		Challenge:   q.Get("code_challenge"),
+		Email:       email,
+		ExpiresAt:   time.Now().Add(time.Minute),
+	}
+	s.mu.Unlock()
+
+	back := redirectURI.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirectURI.RawQuery = back.Encode()
+	log.Printf("authorized %s", email)
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *stub) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	s.mu.Lock()
+	ac, ok := s.codes[r.PostForm.Get("code")]
+	delete(s.codes, r.PostForm.Get("code")) // single use
+	s.mu.Unlock()
+
+	clientID := r.PostForm.Get("client_id")
+	if user, _, hasBasic := r.BasicAuth(); hasBasic {
+		clientID, _ = url.QueryUnescape(user)
+	}
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || time.Now().After(ac.ExpiresAt) || ac.ClientID != clientID ||
+		ac.RedirectURI != r.PostForm.Get("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != ac.Challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            s.issuer,
+		"sub":            "stub|" + ac.Email,
+		"aud":            ac.ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          ac.Nonce,
+		"email":          ac.Email,
+		"email_verified": true,
+	})
+	idToken.Header["kid"] = keyID
+	signed, err := idToken.SignedString(s.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signed,
+	})
+}
+
+func (s *stub) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := s.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
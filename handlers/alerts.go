@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"cronmonitor/services"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const alertColumns = `
+	a.id, a.job_id, j.name, a.run_id, a.rule_id, a.rule_version, a.message, a.status, a.sent_at,
+	a.acknowledged_at, a.acknowledged_by, a.snoozed_until, a.resolved_at, a.resolved_by`
+
+func scanAlert(row interface{ Scan(...interface{}) error }) (models.Alert, error) {
+	var a models.Alert
+	err := row.Scan(&a.ID, &a.JobID, &a.JobName, &a.RunID, &a.RuleID, &a.RuleVersion, &a.Message, &a.Status, &a.SentAt,
+		&a.AcknowledgedAt, &a.AcknowledgedBy, &a.SnoozedUntil, &a.ResolvedAt, &a.ResolvedBy)
+	return a, err
+}
+
+// loadAlert fetches an alert of a job in one of the user's orgs.
+func loadAlert(alertID string, userID interface{}) (models.Alert, error) {
+	return scanAlert(db.GetDB().QueryRow(`
+		SELECT `+alertColumns+`
+		FROM alerts a
+		JOIN jobs j ON j.id = a.job_id
+		WHERE a.id = $1 AND j.org_id IN (SELECT org_id FROM org_members WHERE user_id = $2)
+	`, alertID, userID))
+}
+
+// ListAlerts returns the latest alerts across the jobs of the user's orgs.
+// Optional filters: ?status=open|acknowledged|resolved and ?job_id=.
+func ListAlerts(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	status := c.Query("status")
+	jobID := c.Query("job_id")
+
+	switch status {
+	case "", services.AlertOpen, services.AlertAcknowledged, services.AlertResolved:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be open, acknowledged or resolved"})
+		return
+	}
+
+	rows, err := db.GetDB().Query(`
+		SELECT `+alertColumns+`
+		FROM alerts a
+		JOIN jobs j ON j.id = a.job_id
+		WHERE j.org_id IN (SELECT org_id FROM org_members WHERE user_id = $1)
+		AND ($2 = '' OR a.status = $2)
+		AND ($3 = '' OR a.job_id::text = $3)
+		ORDER BY a.sent_at DESC
+		LIMIT 100
+	`, userID, status, jobID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	alerts := []models.Alert{}
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			continue
+		}
+		alerts = append(alerts, a)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"alerts": alerts})
+}
+
+// AckAlert acknowledges an alert. The optional body snoozes it:
+// {"snooze_minutes": 60} or {"snooze_until": "2024-01-01T10:00:00Z"}.
+func AckAlert(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	userEmail := c.GetString("userEmail")
+	id := c.Param("id")
+
+	var req struct {
+		SnoozeMinutes int        `json:"snooze_minutes"`
+		SnoozeUntil   *time.Time `json:"snooze_until"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+			return
+		}
+	}
+	if req.SnoozeMinutes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "snooze_minutes must be >= 0"})
+		return
+	}
+	if req.SnoozeMinutes > 0 && req.SnoozeUntil != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Use either snooze_minutes or snooze_until, not both"})
+		return
+	}
+	if req.SnoozeMinutes > 0 {
+		until := time.Now().Add(time.Duration(req.SnoozeMinutes) * time.Minute)
+		req.SnoozeUntil = &until
+	}
+	if req.SnoozeUntil != nil && !req.SnoozeUntil.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "snooze_until must be in the future"})
+		return
+	}
+
+	a, err := loadAlert(id, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert not found"})
+		return
+	}
+	if !authorizeJob(c, a.JobID, services.RoleEditor) {
+		return
+	}
+
+	ok, err := services.AcknowledgeAlert(id, userEmail, req.SnoozeUntil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Alert is already resolved"})
+		return
+	}
+
+	respondAlert(c, id, userID)
+}
+
+func ResolveAlert(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	userEmail := c.GetString("userEmail")
+	id := c.Param("id")
+
+	a, err := loadAlert(id, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert not found"})
+		return
+	}
+	if !authorizeJob(c, a.JobID, services.RoleEditor) {
+		return
+	}
+
+	ok, err := services.ResolveAlert(id, userEmail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Alert is already resolved"})
+		return
+	}
+
+	respondAlert(c, id, userID)
+}
+
+func respondAlert(c *gin.Context, id string, userID interface{}) {
+	a, err := loadAlert(id, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+// ShowAckAlertLink handles the signed one-click links in email and Slack.
+// It only shows the alert and a confirmation button: link unfurlers, mail
+// scanners and prefetchers open these links, and must not acknowledge
+// (and so silence) the alert. The button posts to AckAlertLink.
+func ShowAckAlertLink(c *gin.Context) {
+	token := c.Query("token")
+	a, ok := loadAckLinkAlert(c, token)
+	if !ok {
+		return
+	}
+	c.HTML(http.StatusOK, "alert_ack.html", gin.H{"Title": "Acknowledge alert", "Alert": a, "Token": token})
+}
+
+// AckAlertLink acknowledges the alert of a signed link. The token is the
+// credential; no session (and no second factor) is needed, so that an
+// on-call recipient can ack from their phone. In exchange the link is
+// limited: it expires after a day, only does a plain acknowledgement
+// (snoozing needs a session, see AckAlert), and the alert records the
+// recipient it was sent to, marked "(link)", as the acknowledger.
+func AckAlertLink(c *gin.Context) {
+	a, ok := loadAckLinkAlert(c, c.PostForm("token"))
+	if !ok {
+		return
+	}
+	alertID, by, _ := services.ParseAlertAckToken(c.PostForm("token"))
+
+	// Already acknowledged or resolved: nothing to do, show the current state
+	if a.Status == services.AlertOpen {
+		if _, err := services.AcknowledgeAlert(alertID, by+" (link)", nil); err != nil {
+			c.HTML(http.StatusInternalServerError, "alert_ack.html", gin.H{"Title": "Acknowledge alert", "Error": "Something went wrong. Please try again."})
+			return
+		}
+		a.Status = services.AlertAcknowledged
+	}
+
+	c.HTML(http.StatusOK, "alert_ack.html", gin.H{"Title": "Acknowledge alert", "Alert": a})
+}
+
+// loadAckLinkAlert verifies an ack link token and loads its alert,
+// rendering an error page if either fails.
+func loadAckLinkAlert(c *gin.Context, token string) (models.Alert, bool) {
+	alertID, _, err := services.ParseAlertAckToken(token)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "alert_ack.html", gin.H{"Title": "Acknowledge alert", "Error": "This link is invalid or has expired."})
+		return models.Alert{}, false
+	}
+
+	a, err := scanAlert(db.GetDB().QueryRow(`
+		SELECT `+alertColumns+`
+		FROM alerts a
+		JOIN jobs j ON j.id = a.job_id
+		WHERE a.id = $1
+	`, alertID))
+	if err == sql.ErrNoRows {
+		c.HTML(http.StatusNotFound, "alert_ack.html", gin.H{"Title": "Acknowledge alert", "Error": "This alert no longer exists."})
+		return a, false
+	} else if err != nil {
+		c.HTML(http.StatusInternalServerError, "alert_ack.html", gin.H{"Title": "Acknowledge alert", "Error": "Something went wrong. Please try again."})
+		return a, false
+	}
+	return a, true
+}
+
+// ListAlertDeliveries returns the outbox entries for an alert (one per
+// channel) with every delivery attempt made so far.
+func ListAlertDeliveries(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	alertID := c.Param("id")
+
+	if _, err := loadAlert(alertID, userID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert not found"})
+		return
+	}
+
+	rows, err := db.GetDB().Query(`
+		SELECT id, alert_id, channel_id, channel_type, status, attempts,
+			next_attempt_at, last_error, sent_at, created_at
+		FROM notification_outbox
+		WHERE alert_id = $1
+		ORDER BY created_at ASC
+	`, alertID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []models.Delivery{}
+	index := map[string]int{}
+	for rows.Next() {
+		var d models.Delivery
+		if err := rows.Scan(&d.ID, &d.AlertID, &d.ChannelID, &d.ChannelType, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.LastError, &d.SentAt, &d.CreatedAt); err != nil {
+			continue
+		}
+		if d.Status != "pending" {
+			d.NextAttemptAt = nil
+		}
+		d.AttemptLog = []models.DeliveryAttempt{}
+		index[d.ID] = len(deliveries)
+		deliveries = append(deliveries, d)
+	}
+
+	attemptRows, err := db.GetDB().Query(`
+		SELECT outbox_id, id, attempt, status_code, error, success, attempted_at
+		FROM notification_attempts
+		WHERE alert_id = $1
+		ORDER BY attempted_at ASC
+	`, alertID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer attemptRows.Close()
+
+	for attemptRows.Next() {
+		var outboxID string
+		var a models.DeliveryAttempt
+		if err := attemptRows.Scan(&outboxID, &a.ID, &a.Attempt, &a.StatusCode, &a.Error, &a.Success, &a.AttemptedAt); err != nil {
+			continue
+		}
+		if i, ok := index[outboxID]; ok {
+			deliveries[i].AttemptLog = append(deliveries[i].AttemptLog, a)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
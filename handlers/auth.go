@@ -4,6 +4,7 @@ import (
 	"cronmonitor/db"
 	"cronmonitor/models"
 	"cronmonitor/services"
+	"fmt"
 	"net/http"
 	"os"
 	"time"
@@ -33,17 +34,18 @@ func Signup(c *gin.Context) {
 		return
 	}
 
-	var userID string
-	err = db.GetDB().QueryRow(
-		`INSERT INTO users (email, password_hash) VALUES ($1, $2) RETURNING id`,
-		input.Email, string(hash),
-	).Scan(&userID)
-
+	// Also creates the user's personal org
+	userID, err := services.CreateUser(input.Email, string(hash))
 	if err != nil {
 		c.JSON(http.StatusConflict, gin.H{"error": "Email already exists"})
 		return
 	}
 
+	// Alerts are only emailed to verified addresses
+	if err := services.SendVerificationEmail(userID, input.Email); err != nil {
+		fmt.Printf("Error sending verification email to %s: %v\n", input.Email, err)
+	}
+
 	token, _ := generateToken(userID, input.Email)
 	setAuthCookie(c, token)
 	c.JSON(http.StatusCreated, gin.H{"token": token, "redirect": "/"})
@@ -72,6 +74,23 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	// With 2FA on, the password only earns a challenge for POST /api/auth/login/2fa
+	enabled, _, err := services.TOTPEnabled(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if enabled {
+		challenge, err := services.CreateLoginChallenge(user.ID, user.Email)
+		if err != nil {
+			fmt.Printf("Error creating login challenge: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"two_factor_required": true, "challenge_token": challenge})
+		return
+	}
+
 	token, _ := generateToken(user.ID, user.Email)
 	setAuthCookie(c, token)
 	c.JSON(http.StatusOK, gin.H{"token": token, "redirect": "/"})
@@ -80,17 +99,23 @@ func Login(c *gin.Context) {
 func Me(c *gin.Context) {
 	userID, _ := c.Get("userID")
 
-	// Complex Fetch with Counts
+	// Complex Fetch with Counts (plan and limits of the personal org)
 	var response struct {
 		models.User
-		JobCount int `json:"job_count"`
-		JobLimit int `json:"job_limit"`
+		EmailVerified     bool   `json:"email_verified"`
+		TwoFactorEnabled  bool   `json:"two_factor_enabled"`
+		RecoveryCodesLeft int    `json:"recovery_codes_left"`
+		OrgID             string `json:"org_id"`
+		JobCount          int    `json:"job_count"`
+		JobLimit          int    `json:"job_limit"`
 	}
 
-	err := db.GetDB().QueryRow(
-		`SELECT id, email, subscription_tier, subscription_status, created_at FROM users WHERE id = $1`,
-		userID,
-	).Scan(&response.ID, &response.Email, &response.SubscriptionTier, &response.SubscriptionStatus, &response.CreatedAt)
+	err := db.GetDB().QueryRow(`
+		SELECT u.id, u.email, u.email_verified_at IS NOT NULL, COALESCE(o.subscription_tier, 'free'), COALESCE(o.subscription_status, 'active'), u.created_at, o.id
+		FROM users u
+		JOIN organizations o ON o.personal_user_id = u.id
+		WHERE u.id = $1
+	`, userID).Scan(&response.ID, &response.Email, &response.EmailVerified, &response.SubscriptionTier, &response.SubscriptionStatus, &response.CreatedAt, &response.OrgID)
 
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
@@ -98,19 +123,121 @@ func Me(c *gin.Context) {
 	}
 
 	// Enrich with Counts
-	if err := db.GetDB().QueryRow("SELECT COUNT(*) FROM jobs WHERE user_id = $1", userID).Scan(&response.JobCount); err != nil {
+	if err := db.GetDB().QueryRow("SELECT COUNT(*) FROM jobs WHERE org_id = $1", response.OrgID).Scan(&response.JobCount); err != nil {
 		response.JobCount = 0
 	}
 
 	response.JobLimit = services.GetJobLimit(response.SubscriptionTier)
+	response.TwoFactorEnabled, response.RecoveryCodesLeft, _ = services.TOTPEnabled(response.ID)
 
 	c.JSON(http.StatusOK, response)
 }
 
+// ForgotPassword emails a reset link. The response is the same whether
+// or not the address has an account.
+func ForgotPassword(c *gin.Context) {
+	var input struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.RequestPasswordReset(input.Email); err != nil {
+		fmt.Printf("Error sending password reset: %v\n", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "If an account uses this address, a reset link is on its way"})
+}
+
+// ResetPassword sets a new password with the token from a reset link.
+// Other sessions of the account are signed out.
+func ResetPassword(c *gin.Context) {
+	var input struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required,min=8"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	err = services.ResetPassword(input.Token, string(hash))
+	if err == services.ErrAuthTokenInvalid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This reset link is invalid, expired or already used"})
+		return
+	} else if err != nil {
+		fmt.Printf("Error resetting password: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed, please log in", "redirect": "/login"})
+}
+
+// VerifyEmail confirms an account or email channel address with the
+// token from a verification link.
+func VerifyEmail(c *gin.Context) {
+	var input struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	purpose, err := services.VerifyEmail(input.Token)
+	if err == services.ErrAuthTokenInvalid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This link is invalid, expired or already used"})
+		return
+	} else if err != nil {
+		fmt.Printf("Error verifying email: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	message := "Email address confirmed"
+	if purpose == services.TokenVerifyChannel {
+		message = "Email address confirmed, alerts will be sent to it"
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message, "purpose": purpose})
+}
+
+// ResendVerification sends a new verification link to the caller.
+func ResendVerification(c *gin.Context) {
+	var email string
+	var verified bool
+	err := db.GetDB().QueryRow(
+		"SELECT email, email_verified_at IS NOT NULL FROM users WHERE id = $1", c.GetString("userID"),
+	).Scan(&email, &verified)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if verified {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email address is already confirmed"})
+		return
+	}
+
+	if err := services.SendVerificationEmail(c.GetString("userID"), email); err != nil {
+		fmt.Printf("Error sending verification email to %s: %v\n", email, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not send the email, try again later"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
 func generateToken(id, email string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"user_id": id,
 		"email":   email,
+		"iat":     time.Now().Unix(), // checked against password_changed_at
 		"exp":     time.Now().Add(time.Hour * 24 * 7).Unix(),
 	})
 	return token.SignedString(jwtSecret)
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/services"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authorize checks that the user has at least minRole in the org. It
+// responds 404 with notFound to non-members, so IDs of other orgs are not
+// revealed, and 403 to members with a lower role.
+func authorize(c *gin.Context, orgID, minRole, notFound string) bool {
+	role, err := services.OrgRole(c.GetString("userID"), orgID)
+	if err != nil {
+		fmt.Printf("Authorization error: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if role == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+		return false
+	}
+	if !services.RoleAtLeast(role, minRole) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Requires the %s role (you are %s)", minRole, role)})
+		return false
+	}
+	return true
+}
+
+// authorizeJob is authorize for the org that owns the job.
+func authorizeJob(c *gin.Context, jobID, minRole string) bool {
+	var orgID string
+	if err := db.GetDB().QueryRow("SELECT org_id FROM jobs WHERE id = $1", jobID).Scan(&orgID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return false
+	}
+	return authorize(c, orgID, minRole, "Job not found")
+}
+
+// targetOrg picks the org a new resource is created in: orgID, or the
+// user's personal org when empty.
+func targetOrg(c *gin.Context, orgID, minRole string) (string, bool) {
+	if orgID == "" {
+		personal, err := services.PersonalOrgID(c.GetString("userID"))
+		if err != nil {
+			fmt.Printf("Error loading personal org: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return "", false
+		}
+		return personal, true
+	}
+	return orgID, authorize(c, orgID, minRole, "Organization not found")
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"cronmonitor/services"
+	"net/http"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	testDB(t)
+	owner, admin, editor, viewer, outsider := testUser(t), testUser(t), testUser(t), testUser(t), testUser(t)
+	orgID := testOrg(t, owner, map[string]string{
+		admin: services.RoleAdmin, editor: services.RoleEditor, viewer: services.RoleViewer,
+	})
+
+	roles := []string{services.RoleViewer, services.RoleEditor, services.RoleAdmin, services.RoleOwner}
+	users := map[string]int{viewer: 0, editor: 1, admin: 2, owner: 3}
+	for userID, rank := range users {
+		for i, minRole := range roles {
+			c, w := testContext(userID)
+			got := authorize(c, orgID, minRole, "Organization not found")
+			want, status := i <= rank, http.StatusForbidden
+			if got != want || (!got && w.Code != status) {
+				t.Errorf("%s needing %s = %v (%d), want %v", roles[rank], minRole, got, w.Code, want)
+			}
+		}
+	}
+
+	// Non-members and unknown orgs look the same
+	for _, tt := range []struct{ userID, orgID string }{
+		{outsider, orgID},
+		{owner, "00000000-0000-0000-0000-000000000000"},
+		{owner, "not-a-uuid"},
+	} {
+		c, w := testContext(tt.userID)
+		if authorize(c, tt.orgID, services.RoleViewer, "Organization not found") || w.Code != http.StatusNotFound {
+			t.Errorf("%s in %s: status %d, want 404", tt.userID, tt.orgID, w.Code)
+		}
+	}
+}
+
+func TestCanManageMember(t *testing.T) {
+	testDB(t)
+	owner, owner2, admin, admin2, editor, viewer := testUser(t), testUser(t), testUser(t), testUser(t), testUser(t), testUser(t)
+	orgID := testOrg(t, owner, map[string]string{
+		owner2: services.RoleOwner, admin: services.RoleAdmin, admin2: services.RoleAdmin,
+		editor: services.RoleEditor, viewer: services.RoleViewer,
+	})
+
+	tests := []struct {
+		name           string
+		caller, member string
+		newRole        string
+		want           bool
+	}{
+		{"owner demotes owner", owner, owner2, services.RoleAdmin, true},
+		{"owner promotes to owner", owner, editor, services.RoleOwner, true},
+		{"owner removes admin", owner, admin, "", true},
+		{"admin promotes viewer to editor", admin, viewer, services.RoleEditor, true},
+		{"admin demotes editor", admin, editor, services.RoleViewer, true},
+		{"admin removes editor", admin, editor, "", true},
+		{"admin invites editor", admin, "", services.RoleEditor, true},
+		{"admin promotes to admin", admin, editor, services.RoleAdmin, false},
+		{"admin promotes to owner", admin, viewer, services.RoleOwner, false},
+		{"admin demotes admin", admin, admin2, services.RoleEditor, false},
+		{"admin removes admin", admin, admin2, "", false},
+		{"admin demotes owner", admin, owner, services.RoleViewer, false},
+		{"admin removes owner", admin, owner, "", false},
+		{"admin invites admin", admin, "", services.RoleAdmin, false},
+	}
+	for _, tt := range tests {
+		c, w := testContext(tt.caller)
+		got := canManageMember(c, orgID, tt.member, tt.newRole)
+		if got != tt.want || (!got && w.Code != http.StatusForbidden) {
+			t.Errorf("%s = %v (%d), want %v", tt.name, got, w.Code, tt.want)
+		}
+	}
+}
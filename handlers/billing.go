@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"cronmonitor/config"
-	"cronmonitor/db"
 	"cronmonitor/services"
 	"net/http"
 
@@ -17,9 +16,9 @@ func UpgradePlan(c *gin.Context) {
 		return
 	}
 
-	userID, _ := c.Get("userID")
 	var req struct {
-		Plan string `json:"plan"`
+		Plan  string `json:"plan"`
+		OrgID string `json:"org_id"` // default: personal org
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -32,18 +31,19 @@ func UpgradePlan(c *gin.Context) {
 		return
 	}
 
-	_, err := db.GetDB().Exec(
-		"UPDATE users SET subscription_tier = $1, subscription_status = 'active' WHERE id = $2",
-		req.Plan, userID,
-	)
+	orgID, ok := targetOrg(c, req.OrgID, services.RoleOwner)
+	if !ok {
+		return
+	}
 
-	if err != nil {
+	if err := services.SetOrgPlan(orgID, req.Plan, "active"); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":             "Upgraded successfully",
+		"org_id":              orgID,
 		"subscription_tier":   req.Plan,
 		"subscription_status": "active",
 	})
@@ -56,21 +56,30 @@ func DowngradePlan(c *gin.Context) {
 		return
 	}
 
-	userID, _ := c.Get("userID")
+	var req struct {
+		OrgID string `json:"org_id"` // default: personal org
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+			return
+		}
+	}
 
-	// Set to Free, status Cancelled (simulating end of paid period instantly for now)
-	_, err := db.GetDB().Exec(
-		"UPDATE users SET subscription_tier = 'free', subscription_status = 'cancelled' WHERE id = $1",
-		userID,
-	)
+	orgID, ok := targetOrg(c, req.OrgID, services.RoleOwner)
+	if !ok {
+		return
+	}
 
-	if err != nil {
+	// Set to Free, status Cancelled (simulating end of paid period instantly for now)
+	if err := services.SetOrgPlan(orgID, services.PlanFree, "cancelled"); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":             "Downgraded to free",
+		"org_id":              orgID,
 		"subscription_tier":   "free",
 		"subscription_status": "cancelled",
 	})
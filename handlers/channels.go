@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"cronmonitor/services"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type channelInput struct {
+	OrgID  string               `json:"org_id"` // create only; default: personal org
+	Type   string               `json:"type"`
+	Name   string               `json:"name"`
+	Config models.ChannelConfig `json:"config"`
+}
+
+func CreateChannel(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var req channelInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+
+	orgID, ok := targetOrg(c, req.OrgID, services.RoleEditor)
+	if !ok {
+		return
+	}
+
+	ch := models.NotificationChannel{OrgID: orgID, Type: req.Type, Name: req.Name, Config: req.Config}
+	if ch.Type == services.ChannelWebhook && ch.Config.Secret == "" {
+		secret, err := services.GenerateWebhookSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+			return
+		}
+		ch.Config.Secret = secret
+	}
+	if err := services.ValidateChannel(ch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	configJSON, _ := json.Marshal(ch.Config)
+	err := db.GetDB().QueryRow(`
+		INSERT INTO notification_channels (user_id, org_id, type, name, config)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, userID, orgID, ch.Type, ch.Name, configJSON).Scan(&ch.ID, &ch.CreatedAt)
+
+	if err != nil {
+		fmt.Printf("Error creating channel: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if err := services.StartChannelVerification(&ch, c.GetString("userID")); err != nil {
+		fmt.Printf("Error starting verification of channel %s: %v\n", ch.ID, err)
+	}
+
+	c.JSON(http.StatusCreated, ch)
+}
+
+func ListChannels(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	rows, err := db.GetDB().Query(`
+		SELECT id, org_id, type, name, config, created_at, verified_at
+		FROM notification_channels
+		WHERE org_id IN (SELECT org_id FROM org_members WHERE user_id = $1)
+		AND ($2 = '' OR org_id::text = $2)
+		ORDER BY created_at DESC
+	`, userID, c.Query("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	var channels []models.NotificationChannel
+	for rows.Next() {
+		ch, err := services.ScanChannel(rows)
+		if err != nil {
+			continue
+		}
+		channels = append(channels, redactChannel(ch))
+	}
+
+	if channels == nil {
+		channels = []models.NotificationChannel{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"channels": channels})
+}
+
+// loadChannel loads the :id channel if the user has at least minRole in
+// its org, responding 404 or 403 otherwise.
+func loadChannel(c *gin.Context, minRole string) (models.NotificationChannel, bool) {
+	ch, err := services.ScanChannel(db.GetDB().QueryRow(`
+		SELECT id, org_id, type, name, config, created_at, verified_at
+		FROM notification_channels
+		WHERE id::text = $1
+	`, c.Param("id")))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+		return ch, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return ch, false
+	}
+	return ch, authorize(c, ch.OrgID, minRole, "Channel not found")
+}
+
+func GetChannel(c *gin.Context) {
+	ch, ok := loadChannel(c, services.RoleViewer)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, redactChannel(ch))
+}
+
+// UpdateChannel replaces a channel's name and config. The type and org are fixed.
+func UpdateChannel(c *gin.Context) {
+	ch, ok := loadChannel(c, services.RoleEditor)
+	if !ok {
+		return
+	}
+
+	var req channelInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	if req.Type != "" && req.Type != ch.Type {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Channel type cannot be changed"})
+		return
+	}
+	if req.OrgID != "" && req.OrgID != ch.OrgID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Channel organization cannot be changed"})
+		return
+	}
+
+	addressChanged := !strings.EqualFold(req.Config.Email, ch.Config.Email)
+	ch.Name = req.Name
+	// Webhook secrets are write-only; omit to keep the current one
+	if req.Config.Secret == "" {
+		req.Config.Secret = ch.Config.Secret
+	}
+	req.Config.Headers = keepRedactedHeaders(req.Config.Headers, ch.Config.Headers)
+	ch.Config = req.Config
+	if err := services.ValidateChannel(ch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// A new email address has to be confirmed again
+	if ch.Type == services.ChannelEmail && addressChanged {
+		ch.VerifiedAt = nil
+	}
+
+	configJSON, _ := json.Marshal(ch.Config)
+	if _, err := db.GetDB().Exec(
+		"UPDATE notification_channels SET name = $1, config = $2, verified_at = $3 WHERE id = $4",
+		ch.Name, configJSON, ch.VerifiedAt, ch.ID,
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if ch.Type == services.ChannelEmail && addressChanged {
+		if err := services.StartChannelVerification(&ch, c.GetString("userID")); err != nil {
+			fmt.Printf("Error starting verification of channel %s: %v\n", ch.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, redactChannel(ch))
+}
+
+// ResendChannelVerification emails a new confirmation link for an
+// unconfirmed email channel.
+func ResendChannelVerification(c *gin.Context) {
+	ch, ok := loadChannel(c, services.RoleEditor)
+	if !ok {
+		return
+	}
+	if ch.Type != services.ChannelEmail || ch.VerifiedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Channel does not need confirmation"})
+		return
+	}
+
+	if err := services.StartChannelVerification(&ch, c.GetString("userID")); err != nil {
+		fmt.Printf("Error starting verification of channel %s: %v\n", ch.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not send the email, try again later"})
+		return
+	}
+	c.JSON(http.StatusOK, redactChannel(ch))
+}
+
+func DeleteChannel(c *gin.Context) {
+	ch, ok := loadChannel(c, services.RoleEditor)
+	if !ok {
+		return
+	}
+
+	res, err := db.GetDB().Exec("DELETE FROM notification_channels WHERE id = $1", ch.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Channel deleted"})
+}
+
+func ListJobChannels(c *gin.Context) {
+	jobID := c.Param("id")
+
+	// Verify Access
+	if !authorizeJob(c, jobID, services.RoleViewer) {
+		return
+	}
+
+	rows, err := db.GetDB().Query(`
+		SELECT c.id, c.org_id, c.type, c.name, c.config, c.created_at, c.verified_at
+		FROM notification_channels c
+		JOIN job_channels jc ON jc.channel_id = c.id
+		WHERE jc.job_id = $1
+	`, jobID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	var channels []models.NotificationChannel
+	for rows.Next() {
+		ch, err := services.ScanChannel(rows)
+		if err != nil {
+			continue
+		}
+		channels = append(channels, redactChannel(ch))
+	}
+
+	if channels == nil {
+		channels = []models.NotificationChannel{}
+	}
+
+	// An empty subscription list means "all of the org's channels"
+	c.JSON(http.StatusOK, gin.H{"channels": channels})
+}
+
+// SetJobChannels replaces the job's subscriptions.
+// An empty list restores the default (all of the org's channels).
+func SetJobChannels(c *gin.Context) {
+	jobID := c.Param("id")
+
+	// Verify Access
+	if !authorizeJob(c, jobID, services.RoleEditor) {
+		return
+	}
+
+	var req struct {
+		ChannelIDs []string `json:"channel_ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM job_channels WHERE job_id = $1", jobID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	for _, channelID := range req.ChannelIDs {
+		// Only channels of the job's org can be subscribed
+		res, err := tx.Exec(`
+			INSERT INTO job_channels (job_id, channel_id)
+			SELECT $1, id FROM notification_channels
+			WHERE id = $2 AND org_id = (SELECT org_id FROM jobs WHERE id = $1)
+			ON CONFLICT DO NOTHING
+		`, jobID, channelID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel id: " + channelID})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found: " + channelID})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"job_id": jobID, "channel_ids": req.ChannelIDs})
+}
+
+// redactedHeader replaces webhook header values in responses.
+const redactedHeader = "********"
+
+// redactChannel hides webhook secrets; they are only returned on create.
+// Header values (often API keys) are masked too, keeping their names.
+func redactChannel(ch models.NotificationChannel) models.NotificationChannel {
+	ch.Config.Secret = ""
+	if ch.Config.Headers != nil {
+		headers := make(map[string]string, len(ch.Config.Headers))
+		for name := range ch.Config.Headers {
+			headers[name] = redactedHeader
+		}
+		ch.Config.Headers = headers
+	}
+	return ch
+}
+
+// keepRedactedHeaders puts back the current value of headers sent as
+// redactedHeader, so a config read from the API can be sent back as is.
+// A masked header the channel does not have is dropped.
+func keepRedactedHeaders(headers, current map[string]string) map[string]string {
+	for name, value := range headers {
+		if value != redactedHeader {
+			continue
+		}
+		if old, ok := current[name]; ok {
+			headers[name] = old
+		} else {
+			delete(headers, name)
+		}
+	}
+	return headers
+}
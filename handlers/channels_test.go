@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"cronmonitor/models"
+	"reflect"
+	"testing"
+)
+
+func TestRedactChannel(t *testing.T) {
+	ch := models.NotificationChannel{Type: "webhook"}
+	ch.Config.WebhookURL = "https://events.example.com/hook"
+	ch.Config.Secret = "s3cret"
+	ch.Config.Headers = map[string]string{"Authorization": "Bearer abc", "X-Team": "data"}
+
+	got := redactChannel(ch)
+	if got.Config.Secret != "" {
+		t.Errorf("secret = %q", got.Config.Secret)
+	}
+	want := map[string]string{"Authorization": redactedHeader, "X-Team": redactedHeader}
+	if !reflect.DeepEqual(got.Config.Headers, want) {
+		t.Errorf("headers = %v, want %v", got.Config.Headers, want)
+	}
+	if got.Config.WebhookURL != ch.Config.WebhookURL {
+		t.Errorf("webhook_url = %q", got.Config.WebhookURL)
+	}
+	// The stored channel is left alone
+	if ch.Config.Headers["Authorization"] != "Bearer abc" {
+		t.Errorf("original headers changed: %v", ch.Config.Headers)
+	}
+
+	if got := redactChannel(models.NotificationChannel{Type: "email"}); got.Config.Headers != nil {
+		t.Errorf("headers = %v, want nil", got.Config.Headers)
+	}
+}
+
+func TestKeepRedactedHeaders(t *testing.T) {
+	current := map[string]string{"Authorization": "Bearer abc", "X-Team": "data"}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    map[string]string
+	}{
+		{"unchanged", map[string]string{"Authorization": redactedHeader, "X-Team": redactedHeader}, current},
+		{"one changed", map[string]string{"Authorization": redactedHeader, "X-Team": "ops"},
+			map[string]string{"Authorization": "Bearer abc", "X-Team": "ops"}},
+		{"one removed", map[string]string{"X-Team": redactedHeader}, map[string]string{"X-Team": "data"}},
+		{"new masked header", map[string]string{"X-New": redactedHeader}, map[string]string{}},
+		{"all removed", nil, nil},
+	}
+	for _, tt := range tests {
+		if got := keepRedactedHeaders(tt.headers, current); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: headers = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -21,25 +22,40 @@ func CreateJob(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if job.MaxRuntimeMinutes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_runtime_minutes must be >= 0"})
+		return
+	}
 
-	// Billing/Limit Check
-	features := config.LoadFeatures()
-	if features.BillingEnabled {
-		// 1. Get User's Tier
-		var tier string
-		if err := db.GetDB().QueryRow("SELECT COALESCE(subscription_tier, 'free') FROM users WHERE id = $1", userID).Scan(&tier); err != nil {
-			tier = "free" // Default safe
+	// Schedule Validation (used by missed run detection)
+	if job.Schedule != "" {
+		if _, err := services.ParseCron(job.Schedule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule: " + err.Error()})
+			return
 		}
+	}
+	if job.Timezone == "" {
+		job.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(job.Timezone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone: " + job.Timezone})
+		return
+	}
 
-		// 2. Count Existing Jobs
-		var count int
-		if err := db.GetDB().QueryRow("SELECT COUNT(*) FROM jobs WHERE user_id = $1", userID).Scan(&count); err != nil {
+	orgID, ok := targetOrg(c, job.OrgID, services.RoleEditor)
+	if !ok {
+		return
+	}
+	job.OrgID = orgID
+
+	// Billing/Limit Check (per org)
+	features := config.LoadFeatures()
+	if features.BillingEnabled {
+		tier, count, limit, err := services.OrgJobUsage(orgID)
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error checking limits"})
 			return
 		}
-
-		// 3. Compare
-		limit := services.GetJobLimit(tier)
 		if count >= limit {
 			c.JSON(http.StatusForbidden, gin.H{
 				"error":            "job_limit_reached",
@@ -63,10 +79,10 @@ func CreateJob(c *gin.Context) {
 
 	// Insert
 	err = db.GetDB().QueryRow(`
-		INSERT INTO jobs (name, ping_key, schedule, timezone, grace_minutes, user_id)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO jobs (name, ping_key, schedule, timezone, grace_minutes, max_runtime_minutes, user_id, org_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 		RETURNING id, created_at
-	`, job.Name, job.PingKey, job.Schedule, job.Timezone, job.GraceMinutes, userID).Scan(&job.ID, &job.CreatedAt)
+	`, job.Name, job.PingKey, job.Schedule, job.Timezone, job.GraceMinutes, job.MaxRuntimeMinutes, userID, orgID).Scan(&job.ID, &job.CreatedAt)
 
 	if err != nil {
 		fmt.Printf("Error creating job: %v\n", err)
@@ -83,11 +99,12 @@ func ListJobs(c *gin.Context) {
 	userID, _ := c.Get("userID")
 
 	rows, err := db.GetDB().Query(`
-		SELECT id, name, ping_key, schedule, timezone, grace_minutes, created_at 
+		SELECT id, org_id, name, ping_key, schedule, timezone, grace_minutes, COALESCE(max_runtime_minutes, 0), state, state_changed_at, streak, created_at 
 		FROM jobs 
-		WHERE user_id = $1
+		WHERE org_id IN (SELECT org_id FROM org_members WHERE user_id = $1)
+		AND ($2 = '' OR org_id::text = $2)
 		ORDER BY created_at DESC
-	`, userID)
+	`, userID, c.Query("org_id"))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
@@ -98,7 +115,7 @@ func ListJobs(c *gin.Context) {
 	for rows.Next() {
 		var j models.Job
 		// Handle simple fields
-		if err := rows.Scan(&j.ID, &j.Name, &j.PingKey, &j.Schedule, &j.Timezone, &j.GraceMinutes, &j.CreatedAt); err != nil {
+		if err := rows.Scan(&j.ID, &j.OrgID, &j.Name, &j.PingKey, &j.Schedule, &j.Timezone, &j.GraceMinutes, &j.MaxRuntimeMinutes, &j.State, &j.StateChangedAt, &j.Streak, &j.CreatedAt); err != nil {
 			continue
 		}
 
@@ -133,10 +150,13 @@ func ListJobs(c *gin.Context) {
 }
 
 func GetJob(c *gin.Context) {
-	userID, _ := c.Get("userID")
 	id := c.Param("id")
+	if !authorizeJob(c, id, services.RoleViewer) {
+		return
+	}
+
 	var job models.Job
-	err := db.GetDB().QueryRow("SELECT id, name, ping_key, schedule, timezone, grace_minutes, created_at FROM jobs WHERE id = $1 AND user_id = $2", id, userID).Scan(&job.ID, &job.Name, &job.PingKey, &job.Schedule, &job.Timezone, &job.GraceMinutes, &job.CreatedAt)
+	err := db.GetDB().QueryRow("SELECT id, org_id, name, ping_key, schedule, timezone, grace_minutes, COALESCE(max_runtime_minutes, 0), state, state_changed_at, streak, created_at FROM jobs WHERE id = $1", id).Scan(&job.ID, &job.OrgID, &job.Name, &job.PingKey, &job.Schedule, &job.Timezone, &job.GraceMinutes, &job.MaxRuntimeMinutes, &job.State, &job.StateChangedAt, &job.Streak, &job.CreatedAt)
 
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
@@ -148,22 +168,71 @@ func GetJob(c *gin.Context) {
 	}
 
 	job.PingURL = fmt.Sprintf("http://%s/ping/%s", c.Request.Host, job.PingKey)
+	job.Maintenance = services.CurrentOrNextMaintenance(job.ID, time.Now())
 
 	c.JSON(http.StatusOK, job)
 }
 
+func PauseJob(c *gin.Context) {
+	setJobPaused(c, true)
+}
+
+func ResumeJob(c *gin.Context) {
+	setJobPaused(c, false)
+}
+
+func setJobPaused(c *gin.Context, pause bool) {
+	id := c.Param("id")
+	if !authorizeJob(c, id, services.RoleEditor) {
+		return
+	}
+
+	var job models.Job
+	err := db.GetDB().QueryRow("SELECT id, name FROM jobs WHERE id = $1", id).Scan(&job.ID, &job.Name)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var changed bool
+	if pause {
+		changed, err = services.PauseJob(job, "paused via API")
+	} else {
+		changed, err = services.ResumeJob(job, "resumed via API")
+	}
+	if err != nil {
+		fmt.Printf("Error updating pause state: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if !changed && pause {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job is already paused"})
+		return
+	} else if !changed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job is not paused"})
+		return
+	}
+
+	state := services.JobStatePaused
+	if !pause {
+		state = services.JobStateNew
+	}
+	c.JSON(http.StatusOK, gin.H{"id": job.ID, "state": state})
+}
+
 func GetJobRuns(c *gin.Context) {
-	userID, _ := c.Get("userID")
 	jobID := c.Param("id")
-	// Verify ownership first
-	var dummyID string
-	if err := db.GetDB().QueryRow("SELECT id FROM jobs WHERE id = $1 AND user_id = $2", jobID, userID).Scan(&dummyID); err != nil {
-		c.Status(http.StatusNotFound)
+	// Verify access first
+	if !authorizeJob(c, jobID, services.RoleViewer) {
 		return
 	}
 
 	rows, err := db.GetDB().Query(`
-		SELECT id, status, duration_ms, created_at 
+		SELECT id, status, COALESCE(duration_ms, 0), exit_code, started_at, finished_at, created_at 
 		FROM job_runs 
 		WHERE job_id = $1 
 		ORDER BY created_at DESC 
@@ -180,7 +249,7 @@ func GetJobRuns(c *gin.Context) {
 	for rows.Next() {
 		var r models.JobRun
 		// metrics and stderr are not selected in the new query
-		if err := rows.Scan(&r.ID, &r.Status, &r.DurationMs, &r.CreatedAt); err != nil {
+		if err := rows.Scan(&r.ID, &r.Status, &r.DurationMs, &r.ExitCode, &r.StartedAt, &r.FinishedAt, &r.CreatedAt); err != nil {
 			continue
 		}
 		runs = append(runs, r)
@@ -193,10 +262,50 @@ func GetJobRuns(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"runs": runs})
 }
 
+func GetJobTransitions(c *gin.Context) {
+	jobID := c.Param("id")
+	// Verify access first
+	if !authorizeJob(c, jobID, services.RoleViewer) {
+		return
+	}
+
+	rows, err := db.GetDB().Query(`
+		SELECT id, from_state, to_state, COALESCE(reason, ''), run_id, created_at
+		FROM job_state_transitions
+		WHERE job_id = $1
+		ORDER BY created_at DESC
+		LIMIT 100
+	`, jobID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	var transitions []models.JobStateTransition
+	for rows.Next() {
+		var t models.JobStateTransition
+		if err := rows.Scan(&t.ID, &t.FromState, &t.ToState, &t.Reason, &t.RunID, &t.CreatedAt); err != nil {
+			continue
+		}
+		t.JobID = jobID
+		transitions = append(transitions, t)
+	}
+
+	if transitions == nil {
+		transitions = []models.JobStateTransition{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"transitions": transitions})
+}
+
 func DeleteJob(c *gin.Context) {
-	userID, _ := c.Get("userID")
 	id := c.Param("id")
-	result, err := db.GetDB().Exec("DELETE FROM jobs WHERE id = $1 AND user_id = $2", id, userID)
+	if !authorizeJob(c, id, services.RoleEditor) {
+		return
+	}
+
+	result, err := db.GetDB().Exec("DELETE FROM jobs WHERE id = $1", id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
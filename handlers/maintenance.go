@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"cronmonitor/services"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func CreateMaintenanceWindow(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var req struct {
+		OrgID           string     `json:"org_id"` // Org-level windows; default: personal org
+		JobID           *string    `json:"job_id"` // Omit for org-level
+		Name            string     `json:"name"`
+		StartsAt        *time.Time `json:"starts_at"`
+		EndsAt          *time.Time `json:"ends_at"`
+		Schedule        string     `json:"schedule"`
+		DurationMinutes int        `json:"duration_minutes"`
+		Timezone        string     `json:"timezone"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+
+	// Either one-off (starts_at + ends_at) or recurring (schedule + duration_minutes)
+	if req.Schedule != "" {
+		if req.StartsAt != nil || req.EndsAt != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Use either schedule or starts_at/ends_at, not both"})
+			return
+		}
+		if _, err := services.ParseCron(req.Schedule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule: " + err.Error()})
+			return
+		}
+		if req.DurationMinutes <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "duration_minutes must be > 0 for recurring windows"})
+			return
+		}
+		if req.Timezone == "" {
+			req.Timezone = "UTC"
+		}
+		if _, err := time.LoadLocation(req.Timezone); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone: " + req.Timezone})
+			return
+		}
+	} else {
+		if req.StartsAt == nil || req.EndsAt == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "starts_at and ends_at are required for one-off windows"})
+			return
+		}
+		if !req.EndsAt.After(*req.StartsAt) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ends_at must be after starts_at"})
+			return
+		}
+		req.DurationMinutes = 0
+		req.Timezone = ""
+	}
+
+	// Verify Access (job-level windows belong to the job's org)
+	var orgID string
+	if req.JobID != nil {
+		if !authorizeJob(c, *req.JobID, services.RoleEditor) {
+			return
+		}
+		if err := db.GetDB().QueryRow("SELECT org_id FROM jobs WHERE id = $1", *req.JobID).Scan(&orgID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if req.OrgID != "" && req.OrgID != orgID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "org_id does not match the job's organization"})
+			return
+		}
+	} else {
+		var ok bool
+		if orgID, ok = targetOrg(c, req.OrgID, services.RoleEditor); !ok {
+			return
+		}
+	}
+
+	w := models.MaintenanceWindow{
+		OrgID:           orgID,
+		JobID:           req.JobID,
+		Name:            req.Name,
+		StartsAt:        req.StartsAt,
+		EndsAt:          req.EndsAt,
+		Schedule:        req.Schedule,
+		DurationMinutes: req.DurationMinutes,
+		Timezone:        req.Timezone,
+	}
+
+	err := db.GetDB().QueryRow(`
+		INSERT INTO maintenance_windows (user_id, org_id, job_id, name, starts_at, ends_at, schedule, duration_minutes, timezone)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, 0), NULLIF($9, ''))
+		RETURNING id, created_at
+	`, userID, orgID, req.JobID, req.Name, req.StartsAt, req.EndsAt, req.Schedule, req.DurationMinutes, req.Timezone).Scan(&w.ID, &w.CreatedAt)
+
+	if err != nil {
+		fmt.Printf("Error creating maintenance window: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, w)
+}
+
+func ListMaintenanceWindows(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	rows, err := db.GetDB().Query(`
+		SELECT id, org_id, job_id, name, starts_at, ends_at,
+			COALESCE(schedule, ''), COALESCE(duration_minutes, 0), COALESCE(timezone, ''), created_at
+		FROM maintenance_windows
+		WHERE org_id IN (SELECT org_id FROM org_members WHERE user_id = $1)
+		AND ($2 = '' OR org_id::text = $2)
+		ORDER BY created_at DESC
+	`, userID, c.Query("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now()
+
+	var windows []models.MaintenanceWindow
+	for rows.Next() {
+		var w models.MaintenanceWindow
+		if err := rows.Scan(&w.ID, &w.OrgID, &w.JobID, &w.Name, &w.StartsAt, &w.EndsAt,
+			&w.Schedule, &w.DurationMinutes, &w.Timezone, &w.CreatedAt); err != nil {
+			continue
+		}
+
+		if p, ok := services.MaintenancePeriodAt(w, now); ok {
+			w.Period = &p
+		}
+		windows = append(windows, w)
+	}
+
+	if windows == nil {
+		windows = []models.MaintenanceWindow{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"maintenance_windows": windows})
+}
+
+func DeleteMaintenanceWindow(c *gin.Context) {
+	id := c.Param("id")
+
+	var orgID string
+	if err := db.GetDB().QueryRow("SELECT org_id FROM maintenance_windows WHERE id::text = $1", id).Scan(&orgID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Maintenance window not found"})
+		return
+	}
+	if !authorize(c, orgID, services.RoleEditor, "Maintenance window not found") {
+		return
+	}
+
+	res, err := db.GetDB().Exec("DELETE FROM maintenance_windows WHERE id = $1", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Maintenance window not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Maintenance window deleted"})
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"cronmonitor/services"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The state, nonce and PKCE verifier of a login in progress travel in a
+// short-lived signed cookie, scoped to the callback.
+const (
+	oidcCookie    = "afterrun_oidc"
+	oidcCookieTTL = 10 * time.Minute
+)
+
+// OIDCLogin redirects to the identity provider.
+func OIDCLogin(c *gin.Context) {
+	authURL, st, err := services.BeginOIDCLogin()
+	if err == services.ErrOIDCNotConfigured {
+		renderLogin(c, http.StatusNotFound, "Single sign-on is not configured", "")
+		return
+	} else if err != nil {
+		fmt.Printf("Error starting SSO login: %v\n", err)
+		renderLogin(c, http.StatusBadGateway, "The identity provider is unavailable, try again later", "")
+		return
+	}
+
+	cookie, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"purpose":       "oidc_login",
+		"state":         st.State,
+		"nonce":         st.Nonce,
+		"code_verifier": st.CodeVerifier,
+		"exp":           time.Now().Add(oidcCookieTTL).Unix(),
+	}).SignedString(jwtSecret)
+	if err != nil {
+		renderLogin(c, http.StatusInternalServerError, "Could not start single sign-on", "")
+		return
+	}
+	c.SetCookie(oidcCookie, cookie, int(oidcCookieTTL.Seconds()), services.OIDCCallbackPath, "", false, true)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback finishes an SSO login and starts the usual session (or
+// asks for the second factor if the account has 2FA).
+func OIDCCallback(c *gin.Context) {
+	raw, _ := c.Cookie(oidcCookie)
+	c.SetCookie(oidcCookie, "", -1, services.OIDCCallbackPath, "", false, true)
+
+	if e := c.Query("error"); e != "" {
+		fmt.Printf("SSO login failed at the identity provider: %s %s\n", e, c.Query("error_description"))
+		renderLogin(c, http.StatusUnauthorized, "Sign-in was cancelled or refused by the identity provider", "")
+		return
+	}
+
+	st, ok := parseOIDCCookie(raw)
+	if !ok || c.Query("code") == "" ||
+		subtle.ConstantTimeCompare([]byte(c.Query("state")), []byte(st.State)) != 1 {
+		renderLogin(c, http.StatusBadRequest, "Sign-in expired, please try again", "")
+		return
+	}
+
+	identity, err := services.CompleteOIDCLogin(c.Query("code"), st)
+	if err == services.ErrOIDCEmailMissing {
+		renderLogin(c, http.StatusForbidden, "Your identity provider did not share an email address", "")
+		return
+	} else if err != nil {
+		fmt.Printf("Error completing SSO login: %v\n", err)
+		renderLogin(c, http.StatusUnauthorized, "Sign-in failed, please try again", "")
+		return
+	}
+
+	userID, email, err := services.OIDCUser(identity)
+	if err == services.ErrOIDCEmailUnverified {
+		renderLogin(c, http.StatusForbidden, "Your identity provider has not verified your email address", "")
+		return
+	} else if err != nil {
+		fmt.Printf("Error signing in %s with SSO: %v\n", identity.Email, err)
+		renderLogin(c, http.StatusInternalServerError, "Sign-in failed, please try again", "")
+		return
+	}
+
+	enabled, _, err := services.TOTPEnabled(userID)
+	if err != nil {
+		renderLogin(c, http.StatusInternalServerError, "Sign-in failed, please try again", "")
+		return
+	}
+	if enabled {
+		challenge, err := services.CreateLoginChallenge(userID, email)
+		if err != nil {
+			fmt.Printf("Error creating login challenge: %v\n", err)
+			renderLogin(c, http.StatusInternalServerError, "Sign-in failed, please try again", "")
+			return
+		}
+		renderLogin(c, http.StatusOK, "", challenge)
+		return
+	}
+
+	token, _ := generateToken(userID, email)
+	setAuthCookie(c, token)
+	c.Redirect(http.StatusFound, "/")
+}
+
+func parseOIDCCookie(raw string) (services.OIDCLoginState, bool) {
+	var st services.OIDCLoginState
+	if raw == "" {
+		return st, false
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired())
+	if err != nil || claims["purpose"] != "oidc_login" {
+		return st, false
+	}
+	st.State, _ = claims["state"].(string)
+	st.Nonce, _ = claims["nonce"].(string)
+	st.CodeVerifier, _ = claims["code_verifier"].(string)
+	return st, st.State != "" && st.Nonce != "" && st.CodeVerifier != ""
+}
@@ -0,0 +1,333 @@
+package handlers
+
+import (
+	"cronmonitor/services"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func CreateOrg(c *gin.Context) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required (max 255 characters)"})
+		return
+	}
+
+	org, err := services.CreateOrg(c.GetString("userID"), req.Name)
+	if err != nil {
+		fmt.Printf("Error creating org: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, org)
+}
+
+// ListOrgs returns the user's orgs with their role in each.
+func ListOrgs(c *gin.Context) {
+	orgs, err := services.ListUserOrgs(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"orgs": orgs})
+}
+
+// GetOrg returns an org with its members and job usage.
+func GetOrg(c *gin.Context) {
+	orgID := c.Param("id")
+	if !authorize(c, orgID, services.RoleViewer, "Organization not found") {
+		return
+	}
+
+	org, err := services.LoadOrg(orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	org.Role, _ = services.OrgRole(c.GetString("userID"), orgID)
+
+	members, err := services.ListOrgMembers(orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	_, count, limit, err := services.OrgJobUsage(orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"org":       org,
+		"members":   members,
+		"job_count": count,
+		"job_limit": limit,
+	})
+}
+
+func RenameOrg(c *gin.Context) {
+	orgID := c.Param("id")
+	if !authorize(c, orgID, services.RoleAdmin, "Organization not found") {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required (max 255 characters)"})
+		return
+	}
+
+	if err := services.RenameOrg(orgID, req.Name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": orgID, "name": req.Name})
+}
+
+func DeleteOrg(c *gin.Context) {
+	orgID := c.Param("id")
+	if !authorize(c, orgID, services.RoleOwner, "Organization not found") {
+		return
+	}
+
+	err := services.DeleteOrg(orgID)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Organization deleted"})
+	case services.ErrPersonalOrg:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Personal organizations cannot be deleted"})
+	case services.ErrOrgHasJobs:
+		c.JSON(http.StatusConflict, gin.H{"error": "Delete the organization's jobs first"})
+	default:
+		fmt.Printf("Error deleting org: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// UpdateMember changes a member's role. Admins manage editors and
+// viewers; only owners can grant, change or revoke owner and admin.
+func UpdateMember(c *gin.Context) {
+	orgID := c.Param("id")
+	memberID := c.Param("user_id")
+	if !authorize(c, orgID, services.RoleAdmin, "Organization not found") {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	if !services.ValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, admin, editor or viewer"})
+		return
+	}
+	if !canManageMember(c, orgID, memberID, req.Role) {
+		return
+	}
+
+	ok, err := services.SetMemberRole(orgID, memberID, req.Role)
+	if !respondMemberChange(c, ok, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user_id": memberID, "role": req.Role})
+}
+
+// RemoveMember removes a member (admins), or lets any member leave.
+func RemoveMember(c *gin.Context) {
+	orgID := c.Param("id")
+	memberID := c.Param("user_id")
+
+	minRole := services.RoleAdmin
+	if memberID == c.GetString("userID") {
+		minRole = services.RoleViewer
+	}
+	if !authorize(c, orgID, minRole, "Organization not found") {
+		return
+	}
+	if memberID != c.GetString("userID") && !canManageMember(c, orgID, memberID, "") {
+		return
+	}
+
+	ok, err := services.RemoveMember(orgID, memberID)
+	if !respondMemberChange(c, ok, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+// canManageMember responds 403 if the caller is an admin touching an
+// owner or admin, or granting one of those roles.
+func canManageMember(c *gin.Context, orgID, memberID, newRole string) bool {
+	role, err := services.OrgRole(c.GetString("userID"), orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if role == services.RoleOwner {
+		return true
+	}
+
+	current, err := services.OrgRole(memberID, orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if services.RoleAtLeast(current, services.RoleAdmin) || services.RoleAtLeast(newRole, services.RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only owners can manage owners and admins"})
+		return false
+	}
+	return true
+}
+
+func respondMemberChange(c *gin.Context, ok bool, err error) bool {
+	switch {
+	case err == services.ErrLastOwner:
+		c.JSON(http.StatusConflict, gin.H{"error": "An organization needs at least one owner"})
+	case err == services.ErrPersonalOrg:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Members of a personal organization cannot be changed"})
+	case err != nil:
+		fmt.Printf("Error changing org member: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	case !ok:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+	default:
+		return true
+	}
+	return false
+}
+
+// CreateInvitation invites an email address to the org and emails them
+// the token. The token is also returned once, to share it by other means
+// when email is not configured.
+func CreateInvitation(c *gin.Context) {
+	orgID := c.Param("id")
+	if !authorize(c, orgID, services.RoleAdmin, "Organization not found") {
+		return
+	}
+
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+		Role  string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A valid email is required"})
+		return
+	}
+	if req.Role == "" {
+		req.Role = services.RoleViewer
+	}
+	if !services.ValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, admin, editor or viewer"})
+		return
+	}
+	if !canManageMember(c, orgID, "", req.Role) {
+		return
+	}
+
+	org, err := services.LoadOrg(orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if org.Personal {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Personal organizations cannot be shared"})
+		return
+	}
+
+	invitedBy := c.GetString("userEmail")
+	inv, err := services.CreateInvitation(orgID, req.Email, req.Role, invitedBy)
+	if err != nil {
+		fmt.Printf("Error creating invitation: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	emailSent := true
+	if err := services.SendInvitationEmail(inv, org.Name, invitedBy); err != nil {
+		fmt.Printf("Error sending invitation to %s: %v\n", inv.Email, err)
+		emailSent = false
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"invitation": inv, "email_sent": emailSent})
+}
+
+func ListInvitations(c *gin.Context) {
+	orgID := c.Param("id")
+	if !authorize(c, orgID, services.RoleAdmin, "Organization not found") {
+		return
+	}
+
+	invitations, err := services.ListInvitations(orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"invitations": invitations})
+}
+
+func RevokeInvitation(c *gin.Context) {
+	orgID := c.Param("id")
+	if !authorize(c, orgID, services.RoleAdmin, "Organization not found") {
+		return
+	}
+
+	ok, err := services.RevokeInvitation(orgID, c.Param("invitation_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked"})
+}
+
+// AcceptInvitation joins the org of an invitation sent to the caller's
+// email address.
+func AcceptInvitation(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+
+	org, err := services.AcceptInvitation(req.Token, c.GetString("userID"), c.GetString("userEmail"))
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, org)
+	case services.ErrInvitationInvalid, sql.ErrNoRows:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation is invalid, expired or already used"})
+	case services.ErrInvitationEmail:
+		c.JSON(http.StatusForbidden, gin.H{"error": "This invitation was sent to a different email address"})
+	case services.ErrAlreadyMember:
+		c.JSON(http.StatusConflict, gin.H{"error": "You are already a member of this organization"})
+	default:
+		fmt.Printf("Error accepting invitation: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
@@ -3,106 +3,340 @@ package handlers
 import (
 	"cronmonitor/db"
 	"cronmonitor/models"
+	"cronmonitor/services"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"reflect"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// ruleRequest is the JSON body of a rule definition.
+type ruleRequest struct {
+	RuleType         string   `json:"rule_type"`
+	Target           string   `json:"target"`
+	MetricName       string   `json:"metric_name"`
+	Operator         string   `json:"operator"`
+	ThresholdValue   float64  `json:"threshold_value"`
+	ThresholdHigh    *float64 `json:"threshold_high"`
+	ThresholdText    *string  `json:"threshold_text"`
+	Expression       string   `json:"expression"`
+	Consecutive      int      `json:"consecutive"`
+	WindowViolations int      `json:"window_violations"`
+	WindowRuns       int      `json:"window_runs"`
+	WindowMinutes    int      `json:"window_minutes"`
+	Baseline         string   `json:"baseline"`
+	Factor           float64  `json:"factor"`
+	BaselineRuns     int      `json:"baseline_runs"`
+	MinSamples       int      `json:"min_samples"`
+	Seasonality      string   `json:"seasonality"`
+	Severity         string   `json:"severity"`
+	Enabled          *bool    `json:"enabled"` // default true
+}
+
+// rule builds the rule with defaults applied (not yet validated).
+func (req ruleRequest) rule(jobID string) models.Rule {
+	rule := models.Rule{
+		JobID:            jobID,
+		RuleType:         req.RuleType,
+		Target:           req.Target,
+		MetricName:       req.MetricName,
+		Operator:         req.Operator,
+		ThresholdValue:   req.ThresholdValue,
+		ThresholdHigh:    req.ThresholdHigh,
+		ThresholdText:    req.ThresholdText,
+		Expression:       req.Expression,
+		Consecutive:      req.Consecutive,
+		WindowViolations: req.WindowViolations,
+		WindowRuns:       req.WindowRuns,
+		WindowMinutes:    req.WindowMinutes,
+		Baseline:         req.Baseline,
+		BaselineFactor:   req.Factor,
+		BaselineRuns:     req.BaselineRuns,
+		MinSamples:       req.MinSamples,
+		Seasonality:      req.Seasonality,
+		Severity:         req.Severity,
+		Enabled:          req.Enabled == nil || *req.Enabled,
+	}
+	if rule.RuleType == "" {
+		rule.RuleType = services.RuleThreshold
+	}
+	if rule.Target == "" {
+		rule.Target = services.TargetMetric
+	}
+	if rule.RuleType == services.RuleBaseline {
+		if rule.MinSamples == 0 {
+			rule.MinSamples = services.DefaultBaselineMinSamples
+		}
+		if rule.Baseline == services.BaselineMAD {
+			if rule.BaselineRuns == 0 {
+				rule.BaselineRuns = services.DefaultBaselineRuns
+			}
+			if rule.Operator == "" {
+				rule.Operator = "outside"
+			}
+		}
+	}
+	return rule
+}
+
+// validateRuleRequest responds 400 (with the column of expression errors)
+// if the rule is invalid.
+func validateRuleRequest(c *gin.Context, rule models.Rule) bool {
+	err := services.ValidateRule(rule)
+	if err == nil {
+		return true
+	}
+	var exprErr *services.ExprError
+	if errors.As(err, &exprErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expression: " + err.Error(), "position": exprErr.Pos})
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	return false
+}
+
 func CreateRule(c *gin.Context) {
-	userID, _ := c.Get("userID")
 	jobID := c.Param("id")
 
-	// Verify Ownership
-	var dummyID string
-	if err := db.GetDB().QueryRow("SELECT id FROM jobs WHERE id = $1 AND user_id = $2", jobID, userID).Scan(&dummyID); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+	// Verify Access
+	if !authorizeJob(c, jobID, services.RoleEditor) {
 		return
 	}
 
-	var req struct {
-		MetricName     string  `json:"metric_name"`
-		Operator       string  `json:"operator"`
-		ThresholdValue float64 `json:"threshold_value"`
-		Severity       string  `json:"severity"`
+	var req ruleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+
+	rule := req.rule(jobID)
+	if !validateRuleRequest(c, rule) {
+		return
+	}
+	if err := services.CheckRuleFeatures(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.InsertRule(&rule, c.GetString("userEmail")); err != nil {
+		fmt.Printf("Error creating rule: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create rule (Job might not exist or DB error)"})
+		return
 	}
 
+	c.JSON(http.StatusCreated, rule)
+}
+
+// BacktestRule replays an unsaved rule over the job's past runs
+// (default: the last 30 days) without creating alerts.
+func BacktestRule(c *gin.Context) {
+	jobID := c.Param("id")
+
+	// Verify Access
+	if !authorizeJob(c, jobID, services.RoleViewer) {
+		return
+	}
+
+	var req struct {
+		ruleRequest
+		From *time.Time `json:"from"`
+		To   *time.Time `json:"to"`
+	}
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON (from/to must be RFC 3339 timestamps)"})
+		return
+	}
+
+	rule := req.rule(jobID)
+	if !validateRuleRequest(c, rule) {
 		return
 	}
 
-	var ruleID string
-	var createdAt string
-	err := db.GetDB().QueryRow(`
-		INSERT INTO rules (job_id, metric_name, operator, threshold_value, severity)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id, created_at
-	`, jobID, req.MetricName, req.Operator, req.ThresholdValue, req.Severity).Scan(&ruleID, &createdAt)
+	to := time.Now()
+	if req.To != nil {
+		to = *req.To
+	}
+	from := to.AddDate(0, 0, -services.DefaultBacktestDays)
+	if req.From != nil {
+		from = *req.From
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
 
+	result, err := services.BacktestRule(jobID, rule, from, to)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create rule (Job might not exist or DB error)"})
+		fmt.Printf("Backtest error: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"id":              ruleID,
-		"job_id":          jobID,
-		"metric_name":     req.MetricName,
-		"operator":        req.Operator,
-		"threshold_value": req.ThresholdValue,
-		"severity":        req.Severity,
-		"created_at":      createdAt,
+	c.JSON(http.StatusOK, gin.H{
+		"rule":   rule,
+		"result": result,
 	})
 }
 
 func ListRules(c *gin.Context) {
-	userID, _ := c.Get("userID")
 	jobID := c.Param("id")
 
-	// Verify Ownership
-	var dummyID string
-	if err := db.GetDB().QueryRow("SELECT id FROM jobs WHERE id = $1 AND user_id = $2", jobID, userID).Scan(&dummyID); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+	// Verify Access
+	if !authorizeJob(c, jobID, services.RoleViewer) {
 		return
 	}
 
-	rows, err := db.GetDB().Query(`
-		SELECT id, metric_name, operator, threshold_value, severity, created_at 
-		FROM rules 
-		WHERE job_id = $1
-	`, jobID)
+	rules, err := services.LoadJobRules(jobID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
-	defer rows.Close()
-
-	var rules []models.Rule
-	for rows.Next() {
-		var r models.Rule
-		if err := rows.Scan(&r.ID, &r.MetricName, &r.Operator, &r.ThresholdValue, &r.Severity, &r.CreatedAt); err != nil {
-			continue
-		}
-		rules = append(rules, r)
-	}
 
 	if rules == nil {
 		rules = []models.Rule{}
 	}
 
+	for i := range rules {
+		if streak, err := services.RuleStreak(rules[i].ID); err == nil {
+			rules[i].Streak = &streak
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{"rules": rules})
 }
 
+// ListRuleEvaluations returns the latest per-run results of a rule.
+func ListRuleEvaluations(c *gin.Context) {
+	rule, ok := loadOwnedRule(c, services.RoleViewer)
+	if !ok {
+		return
+	}
+
+	evaluations, err := services.ListRuleEvaluations(rule.ID, 100)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"evaluations": evaluations})
+}
+
+// loadOwnedRule loads the :id rule if the user has at least minRole in
+// the org of its job, responding 404 or 403 otherwise.
+func loadOwnedRule(c *gin.Context, minRole string) (models.Rule, bool) {
+	rule, err := services.LoadRule(c.Param("id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return rule, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return rule, false
+	}
+
+	var orgID string
+	if err := db.GetDB().QueryRow("SELECT org_id FROM jobs WHERE id = $1", rule.JobID).Scan(&orgID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return rule, false
+	}
+	return rule, authorize(c, orgID, minRole, "Rule not found")
+}
+
+// UpdateRule changes a rule in place (PATCH semantics: only the fields
+// sent are changed; null clears threshold_high / threshold_text).
+// rule_type, target and baseline are fixed; create a new rule instead.
+// Every change is saved as a new version.
+func UpdateRule(c *gin.Context) {
+	rule, ok := loadOwnedRule(c, services.RoleEditor)
+	if !ok {
+		return
+	}
+
+	var patch map[string]json.RawMessage
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+
+	updated := rule
+	fields := map[string]interface{}{
+		"metric_name":       &updated.MetricName,
+		"operator":          &updated.Operator,
+		"threshold_value":   &updated.ThresholdValue,
+		"threshold_high":    &updated.ThresholdHigh,
+		"threshold_text":    &updated.ThresholdText,
+		"expression":        &updated.Expression,
+		"consecutive":       &updated.Consecutive,
+		"window_violations": &updated.WindowViolations,
+		"window_runs":       &updated.WindowRuns,
+		"window_minutes":    &updated.WindowMinutes,
+		"factor":            &updated.BaselineFactor,
+		"baseline_runs":     &updated.BaselineRuns,
+		"min_samples":       &updated.MinSamples,
+		"seasonality":       &updated.Seasonality,
+		"severity":          &updated.Severity,
+		"enabled":           &updated.Enabled,
+	}
+	for key, raw := range patch {
+		field, ok := fields[key]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s cannot be changed", key)})
+			return
+		}
+		if err := json.Unmarshal(raw, field); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s", key)})
+			return
+		}
+	}
+
+	if reflect.DeepEqual(rule, updated) {
+		c.JSON(http.StatusOK, rule)
+		return
+	}
+	if !validateRuleRequest(c, updated) {
+		return
+	}
+
+	err := services.UpdateRule(rule, &updated, c.GetString("userEmail"))
+	if err == services.ErrRuleVersionConflict {
+		c.JSON(http.StatusConflict, gin.H{"error": "Rule was changed by someone else, reload and try again"})
+		return
+	} else if err != nil {
+		fmt.Printf("Error updating rule: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// ListRuleRevisions returns the rule's definition at every version.
+func ListRuleRevisions(c *gin.Context) {
+	rule, ok := loadOwnedRule(c, services.RoleViewer)
+	if !ok {
+		return
+	}
+
+	revisions, err := services.ListRuleRevisions(rule.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revisions": revisions})
+}
+
 func DeleteRule(c *gin.Context) {
-	userID, _ := c.Get("userID")
-	id := c.Param("id")
-
-	// Verify Ownership via Join (Rule -> Job -> User)
-	res, err := db.GetDB().Exec(`
-		DELETE FROM rules 
-		WHERE id = $1 
-		AND job_id IN (SELECT id FROM jobs WHERE user_id = $2)
-	`, id, userID)
+	rule, ok := loadOwnedRule(c, services.RoleEditor)
+	if !ok {
+		return
+	}
+
+	res, err := db.GetDB().Exec("DELETE FROM rules WHERE id = $1", rule.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
@@ -110,7 +344,7 @@ func DeleteRule(c *gin.Context) {
 
 	rowsAffected, _ := res.RowsAffected()
 	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found or permission denied"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
 		return
 	}
 
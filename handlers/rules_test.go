@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"cronmonitor/models"
+	"cronmonitor/services"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCreatePercentileRuleNeedsBaselines(t *testing.T) {
+	testDB(t)
+	userID := testUser(t)
+	jobID, _ := testJob(t, userID)
+	body := `{"rule_type":"baseline","target":"duration","baseline":"p95","operator":">","factor":1.5}`
+
+	for _, tt := range []struct {
+		enabled string
+		status  int
+	}{
+		{"", http.StatusBadRequest},
+		{"true", http.StatusCreated},
+	} {
+		t.Setenv("BASELINES_ENABLED", tt.enabled)
+		c, w := testContext(userID)
+		c.Params = gin.Params{{Key: "id", Value: jobID}}
+		c.Request = httptest.NewRequest("POST", "/", strings.NewReader(body))
+		CreateRule(c)
+		if w.Code != tt.status {
+			t.Errorf("BASELINES_ENABLED=%q: status %d, want %d (%s)", tt.enabled, w.Code, tt.status, w.Body)
+		}
+	}
+}
+
+// Existing percentile rules stay editable and backtestable with the
+// worker off; only new ones are refused.
+func TestPercentileRuleWithoutBaselines(t *testing.T) {
+	testDB(t)
+	userID := testUser(t)
+	jobID, _ := testJob(t, userID)
+	body := `{"rule_type":"baseline","target":"duration","baseline":"p95","operator":">","factor":1.5}`
+
+	request := func(handler gin.HandlerFunc, id, body string) *httptest.ResponseRecorder {
+		c, w := testContext(userID)
+		c.Params = gin.Params{{Key: "id", Value: id}}
+		c.Request = httptest.NewRequest("POST", "/", strings.NewReader(body))
+		handler(c)
+		return w
+	}
+
+	t.Setenv("BASELINES_ENABLED", "true")
+	w := request(CreateRule, jobID, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var rule models.Rule
+	if err := json.Unmarshal(w.Body.Bytes(), &rule); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("BASELINES_ENABLED", "")
+	for _, patch := range []string{`{"enabled":false}`, `{"factor":2}`} {
+		if w := request(UpdateRule, rule.ID, patch); w.Code != http.StatusOK {
+			t.Errorf("PATCH %s: %d %s", patch, w.Code, w.Body)
+		}
+	}
+	if w := request(BacktestRule, jobID, body); w.Code != http.StatusOK {
+		t.Errorf("backtest: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUpdateRuleCreatesRevision(t *testing.T) {
+	testDB(t)
+	userID := testUser(t)
+	jobID, _ := testJob(t, userID)
+
+	request := func(handler gin.HandlerFunc, id, body string) *httptest.ResponseRecorder {
+		c, w := testContext(userID)
+		c.Set("userEmail", "editor@example.com")
+		c.Params = gin.Params{{Key: "id", Value: id}}
+		c.Request = httptest.NewRequest("POST", "/", strings.NewReader(body))
+		handler(c)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder, v interface{}) {
+		t.Helper()
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%v (%s)", err, w.Body)
+		}
+	}
+
+	w := request(CreateRule, jobID, `{"metric_name":"rows","operator":"<","threshold_value":10}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var created models.Rule
+	decode(w, &created)
+
+	// Only the fields sent change
+	w = request(UpdateRule, created.ID, `{"threshold_value":5,"consecutive":2}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("patch: %d %s", w.Code, w.Body)
+	}
+	var updated models.Rule
+	decode(w, &updated)
+	if updated.Version != created.Version+1 || updated.ThresholdValue != 5 || updated.Consecutive != 2 ||
+		updated.Operator != "<" || updated.MetricName != "rows" || !updated.Enabled {
+		t.Errorf("updated = %+v", updated)
+	}
+
+	// Unchanged values don't make a new version
+	w = request(UpdateRule, created.ID, `{"threshold_value":5}`)
+	var same models.Rule
+	decode(w, &same)
+	if w.Code != http.StatusOK || same.Version != updated.Version {
+		t.Errorf("no-op patch: %d, version %d, want %d", w.Code, same.Version, updated.Version)
+	}
+
+	// Fixed and invalid fields are rejected without a new version
+	for _, body := range []string{`{"rule_type":"absent"}`, `{"operator":"between"}`, `{"consecutive":"two"}`} {
+		if w := request(UpdateRule, created.ID, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, w.Code)
+		}
+	}
+
+	revisions, err := services.ListRuleRevisions(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("%d revisions, want 2", len(revisions))
+	}
+	newest, oldest := revisions[0], revisions[1]
+	if newest.Version != updated.Version || newest.Rule.ThresholdValue != 5 ||
+		newest.ChangedBy == nil || *newest.ChangedBy != "editor@example.com" {
+		t.Errorf("newest revision = %+v", newest)
+	}
+	if oldest.Version != created.Version || oldest.Rule.ThresholdValue != 10 || oldest.Rule.Consecutive != 0 {
+		t.Errorf("oldest revision = %+v", oldest)
+	}
+
+	// Saving over a stale copy is a conflict
+	stale := created
+	stale.ThresholdValue = 1
+	if err := services.UpdateRule(created, &stale, ""); err != services.ErrRuleVersionConflict {
+		t.Errorf("stale update: %v, want ErrRuleVersionConflict", err)
+	}
+}
@@ -1,8 +1,13 @@
 package handlers
 
 import (
+	"cronmonitor/config"
 	"cronmonitor/db"
+	"cronmonitor/models"
+	"cronmonitor/services"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -22,16 +27,16 @@ func GetStatsOverview(c *gin.Context) {
 	userID, _ := c.Get("userID")
 
 	// 1. Counts
-	_ = dbConn.QueryRow("SELECT COUNT(*) FROM jobs WHERE user_id = $1", userID).Scan(&stats.TotalJobs)
-	_ = dbConn.QueryRow("SELECT COUNT(*) FROM job_runs WHERE job_id IN (SELECT id FROM jobs WHERE user_id = $1)", userID).Scan(&stats.TotalRuns)
-	_ = dbConn.QueryRow("SELECT COUNT(*) FROM alerts WHERE job_id IN (SELECT id FROM jobs WHERE user_id = $1)", userID).Scan(&stats.TotalAlerts)
+	_ = dbConn.QueryRow("SELECT COUNT(*) FROM jobs WHERE org_id IN (SELECT org_id FROM org_members WHERE user_id = $1)", userID).Scan(&stats.TotalJobs)
+	_ = dbConn.QueryRow("SELECT COUNT(*) FROM job_runs WHERE job_id IN (SELECT id FROM jobs WHERE org_id IN (SELECT org_id FROM org_members WHERE user_id = $1))", userID).Scan(&stats.TotalRuns)
+	_ = dbConn.QueryRow("SELECT COUNT(*) FROM alerts WHERE job_id IN (SELECT id FROM jobs WHERE org_id IN (SELECT org_id FROM org_members WHERE user_id = $1))", userID).Scan(&stats.TotalAlerts)
 
 	// 2. Success Runs
-	_ = dbConn.QueryRow("SELECT COUNT(*) FROM job_runs WHERE status = 'ok' AND job_id IN (SELECT id FROM jobs WHERE user_id = $1)", userID).Scan(&stats.SuccessRuns)
+	_ = dbConn.QueryRow("SELECT COUNT(*) FROM job_runs WHERE status = 'ok' AND job_id IN (SELECT id FROM jobs WHERE org_id IN (SELECT org_id FROM org_members WHERE user_id = $1))", userID).Scan(&stats.SuccessRuns)
 
 	// 3. Avg Duration (handle NULL if no runs)
 	var avgDuration *float64
-	_ = dbConn.QueryRow("SELECT AVG(duration_ms) FROM job_runs WHERE duration_ms IS NOT NULL AND job_id IN (SELECT id FROM jobs WHERE user_id = $1)", userID).Scan(&avgDuration)
+	_ = dbConn.QueryRow("SELECT AVG(duration_ms) FROM job_runs WHERE duration_ms IS NOT NULL AND job_id IN (SELECT id FROM jobs WHERE org_id IN (SELECT org_id FROM org_members WHERE user_id = $1))", userID).Scan(&avgDuration)
 	if avgDuration != nil {
 		stats.AvgDurationMs = *avgDuration
 	}
@@ -49,28 +54,27 @@ func GetStatsOverview(c *gin.Context) {
 // Read-only job stats
 func GetJobStats(c *gin.Context) {
 	jobID := c.Param("id")
-	userID, _ := c.Get("userID")
 
 	dbConn := db.GetDB()
 
-	// Verify Ownership
-	var dummyID string
-	if err := dbConn.QueryRow("SELECT id FROM jobs WHERE id = $1 AND user_id = $2", jobID, userID).Scan(&dummyID); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+	// Verify Access
+	if !authorizeJob(c, jobID, services.RoleViewer) {
 		return
 	}
 
 	var stats struct {
-		RunCount      int     `json:"run_count"`
-		SuccessCount  int     `json:"success_count"`
-		FailureCount  int     `json:"failure_count"`
-		AvgDurationMs float64 `json:"avg_duration_ms"`
-		P50DurationMs float64 `json:"p50_duration_ms"` // Ad-hoc percentile
-		P95DurationMs float64 `json:"p95_duration_ms"` // Ad-hoc percentile
+		RunCount           int        `json:"run_count"`
+		SuccessCount       int        `json:"success_count"`
+		FailureCount       int        `json:"failure_count"`
+		AvgDurationMs      float64    `json:"avg_duration_ms"`
+		P50DurationMs      float64    `json:"p50_duration_ms"`
+		P95DurationMs      float64    `json:"p95_duration_ms"`
+		P99DurationMs      float64    `json:"p99_duration_ms"`
+		PercentileSource   string     `json:"percentile_source"` // "baseline" or "runs"
+		BaselineSampleSize int        `json:"baseline_sample_size"`
+		BaselineUpdatedAt  *time.Time `json:"baseline_updated_at"` // nil unless the percentiles come from a baseline
 	}
 
-	// dbConn := db.GetDB() // Already declared above
-
 	// 1. Basic Counts
 	_ = dbConn.QueryRow("SELECT COUNT(*) FROM job_runs WHERE job_id = $1", jobID).Scan(&stats.RunCount)
 	if stats.RunCount == 0 {
@@ -89,19 +93,55 @@ func GetJobStats(c *gin.Context) {
 		stats.AvgDurationMs = *avg
 	}
 
-	// 3. Percentiles (Ad-hoc Query)
-	// NOTE: Percentiles are computed from historical job_runs at query time.
-	// These are NOT baselines yet. Baselines will be precomputed in Phase 8.
-
-	// We use Postgres PERCENTILE_CONT if available (PG 9.4+), simplified here for standard SQL or simple averaging if needed.
-	// Docker uses PG 15, so PERCENTILE_CONT is safe.
-	_ = dbConn.QueryRow(`
-		SELECT 
-			PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY duration_ms),
-			PERCENTILE_CONT(0.95) WITHIN GROUP (ORDER BY duration_ms)
-		FROM job_runs 
-		WHERE job_id = $1 AND duration_ms IS NOT NULL
-	`, jobID).Scan(&stats.P50DurationMs, &stats.P95DurationMs)
+	// 3. Percentiles: the stored duration baseline (successful runs of the
+	// baseline window) when the worker maintains one, otherwise computed
+	// over every run at query time
+	var baseline *models.Baseline
+	if config.LoadFeatures().BaselinesEnabled {
+		var err error
+		if baseline, err = services.LoadBaseline(jobID, services.BaselineDuration, ""); err != nil {
+			fmt.Printf("Error loading duration baseline: %v\n", err)
+		}
+	}
+	if baseline != nil {
+		stats.PercentileSource = "baseline"
+		stats.P50DurationMs = baseline.P50
+		stats.P95DurationMs = baseline.P95
+		stats.P99DurationMs = baseline.P99
+		stats.BaselineSampleSize = baseline.SampleSize
+		stats.BaselineUpdatedAt = &baseline.UpdatedAt
+	} else {
+		stats.PercentileSource = "runs"
+		_ = dbConn.QueryRow(`
+			SELECT
+				COALESCE(PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY duration_ms), 0),
+				COALESCE(PERCENTILE_CONT(0.95) WITHIN GROUP (ORDER BY duration_ms), 0),
+				COALESCE(PERCENTILE_CONT(0.99) WITHIN GROUP (ORDER BY duration_ms), 0)
+			FROM job_runs
+			WHERE job_id = $1 AND duration_ms IS NOT NULL
+		`, jobID).Scan(&stats.P50DurationMs, &stats.P95DurationMs, &stats.P99DurationMs)
+	}
 
 	c.JSON(http.StatusOK, stats)
 }
+
+// GetJobBaselines lists the precomputed per-metric baselines of a job.
+func GetJobBaselines(c *gin.Context) {
+	jobID := c.Param("id")
+
+	// Verify Access
+	if !authorizeJob(c, jobID, services.RoleViewer) {
+		return
+	}
+
+	baselines, err := services.LoadJobBaselines(jobID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"baselines": baselines,
+		"enabled":   config.LoadFeatures().BaselinesEnabled,
+	})
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"cronmonitor/db"
+	"encoding/json"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetJobStatsWithoutBaselines(t *testing.T) {
+	testDB(t)
+	t.Setenv("BASELINES_ENABLED", "")
+	userID := testUser(t)
+	jobID, _ := testJob(t, userID)
+	for _, d := range []int{100, 200, 300, 400, 500} {
+		if _, err := db.GetDB().Exec(
+			"INSERT INTO job_runs (job_id, status, duration_ms) VALUES ($1, 'ok', $2)", jobID, d,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, w := testContext(userID)
+	c.Params = gin.Params{{Key: "id", Value: jobID}}
+	GetJobStats(c)
+
+	var stats struct {
+		RunCount int     `json:"run_count"`
+		P50      float64 `json:"p50_duration_ms"`
+		P95      float64 `json:"p95_duration_ms"`
+		Source   string  `json:"percentile_source"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.RunCount != 5 || stats.P50 != 300 || stats.P95 != 480 || stats.Source != "runs" {
+		t.Errorf("stats = %+v, want p50 300, p95 480 from runs", stats)
+	}
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/services"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tests that need Postgres run against TEST_DATABASE_URL, as in the
+// services package, and are skipped without it.
+var (
+	testDBOnce sync.Once
+	testDBErr  error
+)
+
+func testDB(t *testing.T) {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	testDBOnce.Do(func() {
+		if db.DB, testDBErr = sql.Open("postgres", url); testDBErr != nil {
+			return
+		}
+		schema, err := os.ReadFile("../schema.sql")
+		if err != nil {
+			testDBErr = err
+			return
+		}
+		_, testDBErr = db.DB.Exec(string(schema))
+	})
+	if testDBErr != nil {
+		t.Fatalf("test database: %v", testDBErr)
+	}
+}
+
+// testUser creates a user, deleted again when the test ends.
+func testUser(t *testing.T) string {
+	t.Helper()
+	b := make([]byte, 6)
+	rand.Read(b)
+	userID, err := services.CreateUser("u"+hex.EncodeToString(b)+"@example.com", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.GetDB().Exec("DELETE FROM users WHERE id = $1", userID) })
+	return userID
+}
+
+// testOrg creates a shared org owned by ownerID with members at the
+// given roles.
+func testOrg(t *testing.T, ownerID string, members map[string]string) string {
+	t.Helper()
+	org, err := services.CreateOrg(ownerID, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.GetDB().Exec("DELETE FROM organizations WHERE id = $1", org.ID) })
+	for userID, role := range members {
+		if _, err := db.GetDB().Exec(
+			"INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)", org.ID, userID, role,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return org.ID
+}
+
+// testContext returns a request context for userID and its recorder.
+func testContext(userID string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	c.Set("userID", userID)
+	return c, w
+}
+
+// testJob creates a job owned by userID in their personal org and
+// returns its id and ping key.
+func testJob(t *testing.T, userID string) (jobID, pingKey string) {
+	t.Helper()
+	b := make([]byte, 16)
+	rand.Read(b)
+	pingKey = hex.EncodeToString(b)
+	err := db.GetDB().QueryRow(`
+		INSERT INTO jobs (name, ping_key, user_id, org_id)
+		VALUES ('test', $1, $2, (SELECT id FROM organizations WHERE personal_user_id = $2))
+		RETURNING id
+	`, pingKey, userID).Scan(&jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.GetDB().Exec("DELETE FROM jobs WHERE id = $1", jobID) })
+	return jobID, pingKey
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"cronmonitor/services"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateToken issues an API token. The token is only shown in this
+// response; afterwards only its prefix is listed.
+func CreateToken(c *gin.Context) {
+	userID := c.GetString("userID")
+
+	var req struct {
+		Name          string     `json:"name"`
+		Scopes        []string   `json:"scopes"`
+		ExpiresAt     *time.Time `json:"expires_at"`
+		ExpiresInDays int        `json:"expires_in_days"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required (max 100 characters)"})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{services.ScopeRead}
+	}
+	if err := services.ValidateAPITokenScopes(req.Scopes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	expiresAt := req.ExpiresAt
+	if req.ExpiresInDays < 0 || (req.ExpiresInDays > 0 && expiresAt != nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Use either expires_at or a positive expires_in_days"})
+		return
+	}
+	if req.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &t
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	token, err := services.CreateAPIToken(userID, req.Name, req.Scopes, expiresAt)
+	if err != nil {
+		fmt.Printf("Error creating API token: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, token)
+}
+
+func ListTokens(c *gin.Context) {
+	tokens, err := services.ListAPITokens(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// RevokeToken disables a token immediately. It stays listed with revoked_at.
+func RevokeToken(c *gin.Context) {
+	ok, err := services.RevokeAPIToken(c.GetString("userID"), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/services"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type codeInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// LoginTwoFactor completes a login with the challenge token from Login
+// and a TOTP or recovery code.
+func LoginTwoFactor(c *gin.Context) {
+	var input struct {
+		ChallengeToken string `json:"challenge_token" binding:"required"`
+		Code           string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, email, err := services.CompleteLoginChallenge(input.ChallengeToken, input.Code)
+	switch err {
+	case nil:
+	case services.ErrChallengeInvalid, services.ErrTOTPNotEnabled:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, please log in again"})
+		return
+	case services.ErrInvalidCode:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	case services.ErrSecondFactorLocked:
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many wrong codes, try again in 15 minutes"})
+		return
+	default:
+		fmt.Printf("Error completing login challenge: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	token, _ := generateToken(userID, email)
+	setAuthCookie(c, token)
+	c.JSON(http.StatusOK, gin.H{"token": token, "redirect": "/"})
+}
+
+// SetupTOTP starts enrollment: it returns a new secret and its otpauth://
+// URI to show as a QR code. 2FA is off until EnableTOTP.
+func SetupTOTP(c *gin.Context) {
+	secret, uri, err := services.BeginTOTPSetup(c.GetString("userID"), c.GetString("userEmail"))
+	if err == services.ErrTOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	} else if err != nil {
+		fmt.Printf("Error starting 2FA setup: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_uri": uri})
+}
+
+// EnableTOTP confirms enrollment with a code from the app and returns the
+// recovery codes, once.
+func EnableTOTP(c *gin.Context) {
+	var input codeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := services.EnableTOTP(c.GetString("userID"), input.Code)
+	if !respondTOTPError(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"two_factor_enabled": true, "recovery_codes": codes})
+}
+
+// DisableTOTP turns 2FA off. It needs the password and a current code.
+func DisableTOTP(c *gin.Context) {
+	var input struct {
+		Password string `json:"password" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var hash string
+	err := db.GetDB().QueryRow("SELECT password_hash FROM users WHERE id = $1", c.GetString("userID")).Scan(&hash)
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(hash), []byte(input.Password)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	if !respondTOTPError(c, services.DisableTOTP(c.GetString("userID"), input.Code)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"two_factor_enabled": false})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes; earlier ones stop working.
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var input codeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := services.RegenerateRecoveryCodes(c.GetString("userID"), input.Code)
+	if !respondTOTPError(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+func respondTOTPError(c *gin.Context, err error) bool {
+	switch err {
+	case nil:
+		return true
+	case services.ErrInvalidCode:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+	case services.ErrTOTPEnabled:
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+	case services.ErrTOTPNotEnabled:
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+	case services.ErrTOTPNotSetUp:
+		c.JSON(http.StatusConflict, gin.H{"error": "Start with POST /api/auth/2fa/setup"})
+	default:
+		fmt.Printf("Two-factor error: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+	return false
+}
@@ -8,18 +8,43 @@ import (
 	"database/sql"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 func ShowLogin(c *gin.Context) {
-	c.HTML(http.StatusOK, "login.html", gin.H{})
+	renderLogin(c, http.StatusOK, "", "")
+}
+
+// renderLogin shows the login page with an error, or with a 2FA
+// challenge to complete (after single sign-on).
+func renderLogin(c *gin.Context, status int, errMsg, challenge string) {
+	c.HTML(status, "login.html", gin.H{
+		"SSO":       services.OIDCEnabled(),
+		"Error":     errMsg,
+		"Challenge": challenge,
+	})
 }
 
 func ShowSignup(c *gin.Context) {
 	c.HTML(http.StatusOK, "signup.html", gin.H{})
 }
 
+func ShowForgotPassword(c *gin.Context) {
+	c.HTML(http.StatusOK, "forgot_password.html", gin.H{})
+}
+
+// ShowResetPassword and ShowVerifyEmail are the targets of emailed links;
+// the page posts the token, so link previews do not use it up.
+func ShowResetPassword(c *gin.Context) {
+	c.HTML(http.StatusOK, "reset_password.html", gin.H{"Token": c.Query("token")})
+}
+
+func ShowVerifyEmail(c *gin.Context) {
+	c.HTML(http.StatusOK, "verify_email.html", gin.H{"Token": c.Query("token")})
+}
+
 func ShowJobs(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	userEmail, _ := c.Get("userEmail") // for header
@@ -32,9 +57,9 @@ func ShowJobs(c *gin.Context) {
 	}
 
 	rows, err := db.GetDB().Query(`
-		SELECT id, name, ping_key, schedule, timezone, grace_minutes, created_at 
+		SELECT id, org_id, name, ping_key, schedule, timezone, grace_minutes, COALESCE(max_runtime_minutes, 0), state, state_changed_at, streak, created_at 
 		FROM jobs 
-		WHERE user_id = $1
+		WHERE org_id IN (SELECT org_id FROM org_members WHERE user_id = $1)
 		ORDER BY created_at DESC
 	`, userID)
 	if err != nil {
@@ -46,19 +71,20 @@ func ShowJobs(c *gin.Context) {
 	var jobs []models.Job
 	for rows.Next() {
 		var j models.Job
-		// Fix Mismatch: Scan all 7 selected columns
-		if err := rows.Scan(&j.ID, &j.Name, &j.PingKey, &j.Schedule, &j.Timezone, &j.GraceMinutes, &j.CreatedAt); err != nil {
+		// Fix Mismatch: Scan all 12 selected columns
+		if err := rows.Scan(&j.ID, &j.OrgID, &j.Name, &j.PingKey, &j.Schedule, &j.Timezone, &j.GraceMinutes, &j.MaxRuntimeMinutes, &j.State, &j.StateChangedAt, &j.Streak, &j.CreatedAt); err != nil {
 			fmt.Println("Scan error:", err) // Debug log
 			continue
 		}
 
 		// Calculate Ping URL since it's used in the modal now
 		j.PingURL = fmt.Sprintf("http://%s/ping/%s", c.Request.Host, j.PingKey)
+		j.Maintenance = services.CurrentOrNextMaintenance(j.ID, time.Now())
 
 		// N+1 for Last Run (Acceptable for MVP UI)
 		var lastRun models.JobRun
 		err := db.GetDB().QueryRow(`
-			SELECT status, duration_ms, created_at 
+			SELECT status, COALESCE(duration_ms, 0), created_at 
 			FROM job_runs 
 			WHERE job_id = $1 
 			ORDER BY created_at DESC 
@@ -76,15 +102,14 @@ func ShowJobs(c *gin.Context) {
 		jobs = append(jobs, j)
 	}
 
-	// Billing Info
-	var tier string
-	if err := db.GetDB().QueryRow("SELECT COALESCE(subscription_tier, 'free') FROM users WHERE id = $1", userID).Scan(&tier); err != nil {
-		tier = "free"
+	// Billing Info (personal org; shared orgs are listed via /api/orgs)
+	tier, count, limit := "free", 0, services.GetJobLimit("free")
+	if orgID, err := services.PersonalOrgID(fmt.Sprint(userID)); err == nil {
+		if t, n, l, err := services.OrgJobUsage(orgID); err == nil {
+			tier, count, limit = t, n, l
+		}
 	}
 
-	count := len(jobs) // We just fetched them, so Count = len(jobs) is accurate for the view
-	limit := services.GetJobLimit(tier)
-
 	features := config.LoadFeatures()
 
 	c.HTML(http.StatusOK, "jobs.html", gin.H{
@@ -105,7 +130,7 @@ func ShowJobDetail(c *gin.Context) {
 	userID, _ := c.Get("userID")
 	userEmail, _ := c.Get("userEmail")
 
-	err := db.GetDB().QueryRow("SELECT id, name, ping_key, COALESCE(schedule, ''), COALESCE(timezone, 'UTC'), COALESCE(grace_minutes, 30), created_at FROM jobs WHERE id = $1 AND user_id = $2", id, userID).Scan(&job.ID, &job.Name, &job.PingKey, &job.Schedule, &job.Timezone, &job.GraceMinutes, &job.CreatedAt)
+	err := db.GetDB().QueryRow("SELECT id, org_id, name, ping_key, COALESCE(schedule, ''), COALESCE(timezone, 'UTC'), COALESCE(grace_minutes, 30), COALESCE(max_runtime_minutes, 0), state, state_changed_at, streak, created_at FROM jobs WHERE id = $1 AND org_id IN (SELECT org_id FROM org_members WHERE user_id = $2)", id, userID).Scan(&job.ID, &job.OrgID, &job.Name, &job.PingKey, &job.Schedule, &job.Timezone, &job.GraceMinutes, &job.MaxRuntimeMinutes, &job.State, &job.StateChangedAt, &job.Streak, &job.CreatedAt)
 
 	if err == sql.ErrNoRows {
 		c.HTML(http.StatusNotFound, "error.html", gin.H{"error": "Job not found"})
@@ -116,9 +141,10 @@ func ShowJobDetail(c *gin.Context) {
 	}
 
 	job.PingURL = fmt.Sprintf("http://%s/ping/%s", c.Request.Host, job.PingKey)
+	job.Maintenance = services.CurrentOrNextMaintenance(job.ID, time.Now())
 
 	// Fetch Runs (Limit 50)
-	rows, err := db.GetDB().Query("SELECT id, status, duration_ms, created_at FROM job_runs WHERE job_id = $1 ORDER BY created_at DESC LIMIT 50", id)
+	rows, err := db.GetDB().Query("SELECT id, status, COALESCE(duration_ms, 0), created_at FROM job_runs WHERE job_id = $1 ORDER BY created_at DESC LIMIT 50", id)
 	if err != nil {
 		fmt.Printf("Error fetching runs: %v\n", err)
 	} else {
@@ -7,7 +7,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
@@ -17,55 +19,106 @@ type PingRequest struct {
 	DurationMs int                    `json:"duration_ms"`
 	Metrics    map[string]interface{} `json:"metrics"`
 	Stderr     string                 `json:"stderr"`
+	RunID      string                 `json:"run_id"` // Optional idempotency key
 }
 
 func PingHandler(c *gin.Context) {
 	fmt.Println("HANDLER v2: Received ping")
-	pingKey := c.Param("ping_key")
+	recordPing(c, "", nil)
+}
 
-	var job models.Job
-	err := db.GetDB().QueryRow("SELECT id, name, ping_key FROM jobs WHERE ping_key = $1", pingKey).Scan(&job.ID, &job.Name, &job.PingKey)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
-		return
-	} else if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+// FailPingHandler records a failed run regardless of the body's status.
+func FailPingHandler(c *gin.Context) {
+	recordPing(c, "fail", nil)
+}
+
+// ExitCodePingHandler supports `cmd; curl .../ping/KEY/$?`.
+// 0 records "ok", anything else records "fail".
+func ExitCodePingHandler(c *gin.Context) {
+	exitCode, err := strconv.Atoi(c.Param("exit_code"))
+	if err != nil || exitCode < 0 || exitCode > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Exit code must be an integer between 0 and 255"})
 		return
 	}
 
-	// Phase 1.4: Idempotency Check
-	// Prevent duplicate pings within 10 seconds of the last run
-	var dummy int
-	err = db.GetDB().QueryRow(`
-		SELECT 1 FROM job_runs 
-		WHERE job_id = $1 AND created_at > NOW() - INTERVAL '10 seconds' 
-		LIMIT 1
-	`, job.ID).Scan(&dummy)
-
-	if err == nil {
-		fmt.Println("Duplicate ping suppressed")
-		c.Status(http.StatusOK)
+	status := "ok"
+	if exitCode != 0 {
+		status = "fail"
+	}
+	recordPing(c, status, &exitCode)
+}
+
+// recordPing stores a completed run. A non-empty status overrides the
+// body's status (used by the /fail and /:exit_code variants).
+func recordPing(c *gin.Context, status string, exitCode *int) {
+	job, ok := lookupPingJob(c)
+	if !ok {
 		return
-	} else if err != sql.ErrNoRows {
-		// Log error but continue (fail-open)
-		fmt.Printf("Error checking for duplicates: %v\n", err)
 	}
 
-	var req PingRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
+	req, err := bindPingRequest(c)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
 		return
 	}
+	if status != "" {
+		req.Status = status
+	}
+
+	runKey, ok := pingRunKey(c, req)
+	if !ok {
+		return
+	}
 
 	metricsJSON, _ := json.Marshal(req.Metrics)
 
-	// Insert Job Run
-	var runID string
+	run := models.JobRun{
+		JobID:    job.ID,
+		Status:   req.Status,
+		ExitCode: exitCode,
+		Metrics:  req.Metrics,
+		Stderr:   req.Stderr,
+	}
+
+	// Close the open run if a start ping was sent (the one with the same
+	// run key, or the latest one when no key is given).
+	// Duration is measured by the server, not trusted from the client.
 	err = db.GetDB().QueryRow(`
-		INSERT INTO job_runs (job_id, status, duration_ms, metrics, stderr)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id
-	`, job.ID, req.Status, req.DurationMs, metricsJSON, req.Stderr).Scan(&runID)
+		UPDATE job_runs
+		SET status = $2,
+			duration_ms = (EXTRACT(EPOCH FROM (NOW() - started_at)) * 1000)::int,
+			metrics = $3,
+			stderr = $4,
+			exit_code = $5,
+			finished_at = NOW()
+		WHERE id = (
+			SELECT id FROM job_runs
+			WHERE job_id = $1 AND status = 'running'
+			AND ($6::text IS NULL OR idempotency_key = $6)
+			ORDER BY started_at DESC LIMIT 1
+		)
+		AND status = 'running'
+		RETURNING id, duration_ms, created_at
+	`, job.ID, req.Status, metricsJSON, req.Stderr, exitCode, runKey).Scan(&run.ID, &run.DurationMs, &run.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		// No start ping: record a completed run with the client's duration.
+		// A repeated run key hits the unique index and inserts nothing.
+		run.DurationMs = req.DurationMs
+		err = db.GetDB().QueryRow(`
+			INSERT INTO job_runs (job_id, status, duration_ms, metrics, stderr, exit_code, idempotency_key, finished_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+			ON CONFLICT (job_id, idempotency_key) DO NOTHING
+			RETURNING id, created_at
+		`, job.ID, req.Status, req.DurationMs, metricsJSON, req.Stderr, exitCode, runKey).Scan(&run.ID, &run.CreatedAt)
+
+		if err == sql.ErrNoRows && runKey != nil {
+			// Phase 1.4: Idempotency
+			// Retry of a run we already recorded: return it, don't re-evaluate rules
+			respondDuplicateRun(c, job, *runKey)
+			return
+		}
+	}
 
 	if err != nil {
 		fmt.Printf("Error saving run: %v\n", err)
@@ -73,37 +126,186 @@ func PingHandler(c *gin.Context) {
 		return
 	}
 
-	run := models.JobRun{
-		ID:         runID,
-		JobID:      job.ID,
-		Status:     req.Status,
-		DurationMs: req.DurationMs,
-		Metrics:    req.Metrics,
-		Stderr:     req.Stderr,
-	}
-
 	// Verify Rules
 	go func() {
-		rows, err := db.GetDB().Query("SELECT id, metric_name, operator, threshold_value FROM rules WHERE job_id = $1", job.ID)
+		// Paused jobs and maintenance windows: record, evaluate, but don't alert
+		suppressed := services.AlertsSuppressed(job.ID)
+		if suppressed {
+			fmt.Println("Alerts suppressed (paused or in maintenance)")
+		}
+
+		violations := 0
+		unhealthy := run.Status == "fail"
+		statusRuleMatched := false
+		defer func() {
+			services.UpdateJobStreak(job.ID, unhealthy)
+
+			// Lifecycle: a failed run or any violated rule marks the job down
+			// (rules with a repeat threshold only once it is reached, and a
+			// matching status rule decides for a failed run)
+			switch {
+			case run.Status == "fail" && !statusRuleMatched:
+				services.TransitionJobState(job, services.JobStateDown, "run reported failure", &run)
+			case violations > 0:
+				services.TransitionJobState(job, services.JobStateDown, "rule violated", &run)
+			case unhealthy:
+				services.TransitionJobState(job, services.JobStateUp, "violation below rule threshold", &run)
+			default:
+				services.TransitionJobState(job, services.JobStateUp, "run ok", &run)
+			}
+		}()
+
+		rules, err := services.LoadJobRules(job.ID)
 		if err != nil {
 			fmt.Printf("Error fetching rules: %v\n", err)
-			return
 		}
-		defer rows.Close()
 
-		for rows.Next() {
-			var rule models.Rule
-			if err := rows.Scan(&rule.ID, &rule.MetricName, &rule.Operator, &rule.ThresholdValue); err != nil {
+		for _, rule := range rules {
+			if !rule.Enabled {
 				continue
 			}
-			rule.JobID = job.ID
-
-			violated, val := services.EvaluateRule(req.Metrics, rule)
+			violated, val := services.EvaluateRule(run, rule)
 			if violated {
+				unhealthy = true
+				if rule.Target == services.TargetStatus {
+					statusRuleMatched = true
+				}
+			}
+			met, alert := services.RecordRuleEvaluation(run, rule, violated, val)
+			if !met {
+				continue
+			}
+			violations++
+			if alert && !suppressed {
 				services.SendAlert(job, run, rule, val, req.Stderr)
 			}
 		}
+
+		// Explicit failures alert on their own, no rule required
+		// (unless a status rule matched this run and decides on its own)
+		if run.Status == "fail" && !statusRuleMatched && !suppressed {
+			services.SendFailureAlert(job, run)
+		}
 	}()
 
-	c.Status(http.StatusOK)
+	c.JSON(http.StatusOK, gin.H{"run_id": run.ID})
+}
+
+// StartPingHandler opens a run in the 'running' state.
+// The next regular ping closes it; if none arrives within the job's
+// max_runtime_minutes, CheckForHungRuns raises an alert.
+func StartPingHandler(c *gin.Context) {
+	job, ok := lookupPingJob(c)
+	if !ok {
+		return
+	}
+
+	req, err := bindPingRequest(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+
+	runKey, ok := pingRunKey(c, req)
+	if !ok {
+		return
+	}
+
+	var runID string
+	err = db.GetDB().QueryRow(`
+		INSERT INTO job_runs (job_id, status, started_at, idempotency_key)
+		VALUES ($1, 'running', NOW(), $2)
+		ON CONFLICT (job_id, idempotency_key) DO NOTHING
+		RETURNING id
+	`, job.ID, runKey).Scan(&runID)
+
+	if err == sql.ErrNoRows && runKey != nil {
+		respondDuplicateRun(c, job, *runKey)
+		return
+	}
+
+	if err != nil {
+		fmt.Printf("Error saving run start: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save run"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"run_id": runID})
+}
+
+// Max length of a client-supplied run key (matches the column)
+const maxRunKeyLength = 255
+
+// pingRunKey returns the optional client-supplied run key, taken from the
+// Idempotency-Key header, the body's run_id or the run_id query parameter.
+// Pings without a key are always recorded.
+func pingRunKey(c *gin.Context, req PingRequest) (*string, bool) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		key = req.RunID
+	}
+	if key == "" {
+		key = c.Query("run_id")
+	}
+	if key == "" {
+		return nil, true
+	}
+	if len(key) > maxRunKeyLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "run_id must be at most 255 characters"})
+		return nil, false
+	}
+	return &key, true
+}
+
+func respondDuplicateRun(c *gin.Context, job models.Job, runKey string) {
+	var run models.JobRun
+	err := db.GetDB().QueryRow(`
+		SELECT id, status, COALESCE(duration_ms, 0), exit_code, started_at, finished_at, created_at
+		FROM job_runs
+		WHERE job_id = $1 AND idempotency_key = $2
+	`, job.ID, runKey).Scan(&run.ID, &run.Status, &run.DurationMs, &run.ExitCode, &run.StartedAt, &run.FinishedAt, &run.CreatedAt)
+	if err != nil {
+		fmt.Printf("Error loading duplicate run: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	run.JobID = job.ID
+
+	fmt.Println("Duplicate ping suppressed")
+	c.JSON(http.StatusOK, gin.H{"run_id": run.ID, "duplicate": true, "run": run})
+}
+
+// lookupPingJob loads the full job row: the rule and notification
+// goroutine needs its org, timezone and state, not just the id.
+func lookupPingJob(c *gin.Context) (models.Job, bool) {
+	pingKey := c.Param("ping_key")
+
+	var job models.Job
+	err := db.GetDB().QueryRow(`
+		SELECT id, org_id, name, ping_key, COALESCE(schedule, ''), COALESCE(timezone, 'UTC'), COALESCE(grace_minutes, 30),
+			COALESCE(max_runtime_minutes, 0), state, state_changed_at, streak, created_at
+		FROM jobs WHERE ping_key = $1
+	`, pingKey).Scan(&job.ID, &job.OrgID, &job.Name, &job.PingKey, &job.Schedule, &job.Timezone, &job.GraceMinutes,
+		&job.MaxRuntimeMinutes, &job.State, &job.StateChangedAt, &job.Streak, &job.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return job, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return job, false
+	}
+	return job, true
+}
+
+// bindPingRequest parses the optional JSON body.
+// GET/HEAD pings from plain curl/wget have no body and count as "ok".
+func bindPingRequest(c *gin.Context) (PingRequest, error) {
+	var req PingRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		return req, err
+	}
+	if req.Status == "" {
+		req.Status = "ok"
+	}
+	return req, nil
 }
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"cronmonitor/db"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func pingRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/ping/:ping_key", PingHandler)
+	r.POST("/ping/:ping_key/start", StartPingHandler)
+	r.POST("/ping/:ping_key/fail", FailPingHandler)
+	r.POST("/ping/:ping_key/:exit_code", ExitCodePingHandler)
+	return r
+}
+
+type pingResponse struct {
+	RunID     string `json:"run_id"`
+	Duplicate bool   `json:"duplicate"`
+	Error     string `json:"error"`
+}
+
+func sendPing(t *testing.T, r *gin.Engine, path, body string, header map[string]string) (int, pingResponse) {
+	t.Helper()
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var resp pingResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s: %v (%s)", path, err, w.Body)
+	}
+	return w.Code, resp
+}
+
+func TestPingRunKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		query  string
+		want   string // "" for no key
+		ok     bool
+	}{
+		{name: "none", ok: true},
+		{name: "header", header: "h", body: "b", query: "q", want: "h", ok: true},
+		{name: "body", body: "b", query: "q", want: "b", ok: true},
+		{name: "query", query: "q", want: "q", ok: true},
+		{name: "max length", header: strings.Repeat("k", maxRunKeyLength), want: strings.Repeat("k", maxRunKeyLength), ok: true},
+		{name: "too long", body: strings.Repeat("k", maxRunKeyLength+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/ping/x?run_id="+tt.query, nil)
+			if tt.header != "" {
+				c.Request.Header.Set("Idempotency-Key", tt.header)
+			}
+
+			key, ok := pingRunKey(c, PingRequest{RunID: tt.body})
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("status = %d, want 400", w.Code)
+				}
+				return
+			}
+			got := ""
+			if key != nil {
+				got = *key
+			}
+			if got != tt.want || (key == nil) != (tt.want == "") {
+				t.Errorf("key = %v, want %q", key, tt.want)
+			}
+		})
+	}
+}
+
+func TestPingDuplicateRunKey(t *testing.T) {
+	testDB(t)
+	_, pingKey := testJob(t, testUser(t))
+	r := pingRouter()
+
+	for _, tt := range []struct {
+		name   string
+		path   string
+		header map[string]string
+		body   string
+	}{
+		{"header", "/ping/" + pingKey, map[string]string{"Idempotency-Key": "run-h"}, ""},
+		{"body", "/ping/" + pingKey, nil, `{"run_id":"run-b"}`},
+		{"query", "/ping/" + pingKey + "?run_id=run-q", nil, ""},
+		{"start", "/ping/" + pingKey + "/start", nil, `{"run_id":"run-s"}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			status, first := sendPing(t, r, tt.path, tt.body, tt.header)
+			if status != http.StatusOK || first.RunID == "" || first.Duplicate {
+				t.Fatalf("first ping: %d %+v", status, first)
+			}
+			status, second := sendPing(t, r, tt.path, tt.body, tt.header)
+			if status != http.StatusOK || !second.Duplicate || second.RunID != first.RunID {
+				t.Errorf("retry: %d %+v, want duplicate of %s", status, second, first.RunID)
+			}
+		})
+	}
+}
+
+// Exit codes are checked before the job is looked up
+func TestExitCodePingInvalid(t *testing.T) {
+	r := pingRouter()
+	for _, code := range []string{"-1", "256", "1.5", "abc", "0x1"} {
+		status, resp := sendPing(t, r, "/ping/nokey/"+code, "", nil)
+		if status != http.StatusBadRequest || resp.Error == "" {
+			t.Errorf("exit code %s: status %d, error %q", code, status, resp.Error)
+		}
+	}
+}
+
+func TestPingStartFinish(t *testing.T) {
+	testDB(t)
+	jobID, pingKey := testJob(t, testUser(t))
+	r := pingRouter()
+
+	_, start := sendPing(t, r, "/ping/"+pingKey+"/start", `{"run_id":"nightly-1"}`, nil)
+	if start.RunID == "" {
+		t.Fatalf("start: %+v", start)
+	}
+	// Pretend the run started five seconds ago
+	if _, err := db.GetDB().Exec(
+		"UPDATE job_runs SET started_at = NOW() - INTERVAL '5 seconds' WHERE id = $1", start.RunID,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client's duration is ignored when a start ping was recorded
+	_, finish := sendPing(t, r, "/ping/"+pingKey, `{"run_id":"nightly-1","duration_ms":1}`, nil)
+	if finish.RunID != start.RunID {
+		t.Fatalf("finish closed run %s, want %s", finish.RunID, start.RunID)
+	}
+
+	var status string
+	var durationMs int
+	if err := db.GetDB().QueryRow(
+		"SELECT status, duration_ms FROM job_runs WHERE id = $1", start.RunID,
+	).Scan(&status, &durationMs); err != nil {
+		t.Fatal(err)
+	}
+	if status != "ok" || durationMs < 5000 || durationMs > 60000 {
+		t.Errorf("run status %q duration %dms, want ok and about 5000ms", status, durationMs)
+	}
+
+	// Without a key the latest open run is closed
+	_, start2 := sendPing(t, r, "/ping/"+pingKey+"/start", "", nil)
+	_, finish2 := sendPing(t, r, "/ping/"+pingKey+"/0", "", nil)
+	if finish2.RunID != start2.RunID {
+		t.Errorf("keyless finish closed %s, want %s", finish2.RunID, start2.RunID)
+	}
+
+	var runs int
+	db.GetDB().QueryRow("SELECT COUNT(*) FROM job_runs WHERE job_id = $1", jobID).Scan(&runs)
+	if runs != 2 {
+		t.Errorf("%d runs recorded, want 2", runs)
+	}
+}
+
+func TestLookupPingJobLoadsFullRow(t *testing.T) {
+	testDB(t)
+	jobID, pingKey := testJob(t, testUser(t))
+	if _, err := db.GetDB().Exec(
+		"UPDATE jobs SET timezone = 'Europe/Berlin', grace_minutes = 7 WHERE id = $1", jobID,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Params = gin.Params{{Key: "ping_key", Value: pingKey}}
+	job, ok := lookupPingJob(c)
+	if !ok {
+		t.Fatal("job not found")
+	}
+	if job.ID != jobID || job.OrgID == "" || job.Timezone != "Europe/Berlin" || job.GraceMinutes != 7 || job.State == "" {
+		t.Errorf("job = %+v", job)
+	}
+}
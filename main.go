@@ -56,10 +56,32 @@ func main() {
 					}
 				}()
 				services.CheckForMissedRuns()
+				services.CheckForHungRuns()
 			}()
 		}
 	}()
 
+	// Notification Outbox Dispatcher
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			services.DispatchOutbox()
+		}
+	}()
+
+	// Phase 8: Baselines (rolling percentiles per job and metric)
+	if features.BaselinesEnabled {
+		go func() {
+			services.RecomputeBaselines()
+			ticker := time.NewTicker(10 * time.Minute)
+			defer ticker.Stop()
+			for range ticker.C {
+				services.RecomputeBaselines()
+			}
+		}()
+	}
+
 	r := gin.Default()
 	r.LoadHTMLGlob("templates/*")
 	r.Static("/static", "./static")
@@ -70,11 +92,33 @@ func main() {
 	r.GET("/ping/:ping_key", handlers.PingHandler)
 	r.HEAD("/ping/:ping_key", handlers.PingHandler)
 
+	// Start pings open a run; the regular ping above closes it
+	r.POST("/ping/:ping_key/start", handlers.StartPingHandler)
+	r.GET("/ping/:ping_key/start", handlers.StartPingHandler)
+	r.HEAD("/ping/:ping_key/start", handlers.StartPingHandler)
+
+	// Explicit failure / exit code (e.g. `cmd; curl .../ping/KEY/$?`)
+	r.POST("/ping/:ping_key/fail", handlers.FailPingHandler)
+	r.GET("/ping/:ping_key/fail", handlers.FailPingHandler)
+	r.HEAD("/ping/:ping_key/fail", handlers.FailPingHandler)
+	r.POST("/ping/:ping_key/:exit_code", handlers.ExitCodePingHandler)
+	r.GET("/ping/:ping_key/:exit_code", handlers.ExitCodePingHandler)
+	r.HEAD("/ping/:ping_key/:exit_code", handlers.ExitCodePingHandler)
+
 	// Auth Routes (Public)
 	api := r.Group("/api")
 	api.POST("/auth/signup", handlers.Signup)
 	api.POST("/auth/login", handlers.Login)
 	api.GET("/auth/me", middleware.AuthRequired(), handlers.Me)
+	api.POST("/auth/forgot", handlers.ForgotPassword)
+	api.POST("/auth/reset", handlers.ResetPassword)
+	api.POST("/auth/verify", handlers.VerifyEmail)
+	api.POST("/auth/verify/resend", middleware.AuthRequired(), handlers.ResendVerification)
+	api.POST("/auth/login/2fa", handlers.LoginTwoFactor)
+	api.POST("/auth/2fa/setup", middleware.AuthRequired(), handlers.SetupTOTP)
+	api.POST("/auth/2fa/enable", middleware.AuthRequired(), handlers.EnableTOTP)
+	api.POST("/auth/2fa/disable", middleware.AuthRequired(), handlers.DisableTOTP)
+	api.POST("/auth/2fa/recovery-codes", middleware.AuthRequired(), handlers.RegenerateRecoveryCodes)
 
 	// Billing Routes (Simulated)
 	api.POST("/billing/upgrade", middleware.AuthRequired(), handlers.UpgradePlan)
@@ -91,7 +135,16 @@ func main() {
 
 	// Open UI Routes
 	r.GET("/login", handlers.ShowLogin)
+	r.GET("/auth/oidc/login", handlers.OIDCLogin)
+	r.GET(services.OIDCCallbackPath, handlers.OIDCCallback)
 	r.GET("/signup", handlers.ShowSignup)
+	r.GET("/forgot-password", handlers.ShowForgotPassword)
+	r.GET("/reset-password", handlers.ShowResetPassword)
+	r.GET("/verify-email", handlers.ShowVerifyEmail)
+
+	// One-click ack links from email/Slack (signed token, no session)
+	r.GET("/alerts/ack", handlers.ShowAckAlertLink)
+	r.POST("/alerts/ack", handlers.AckAlertLink)
 
 	// Protected API Routes
 	protected := api.Group("/")
@@ -101,16 +154,63 @@ func main() {
 		protected.GET("/jobs", handlers.ListJobs)
 		protected.GET("/jobs/:id", handlers.GetJob)
 		protected.DELETE("/jobs/:id", handlers.DeleteJob)
+		protected.POST("/jobs/:id/pause", handlers.PauseJob)
+		protected.POST("/jobs/:id/resume", handlers.ResumeJob)
 
 		protected.GET("/jobs/:id/runs", handlers.GetJobRuns)
+		protected.GET("/jobs/:id/transitions", handlers.GetJobTransitions)
 
 		protected.POST("/jobs/:id/rules", handlers.CreateRule)
 		protected.GET("/jobs/:id/rules", handlers.ListRules)
+		protected.POST("/jobs/:id/rules/backtest", handlers.BacktestRule)
+		protected.PATCH("/rules/:id", handlers.UpdateRule)
+		protected.GET("/rules/:id/revisions", handlers.ListRuleRevisions)
+		protected.GET("/rules/:id/evaluations", handlers.ListRuleEvaluations)
 		protected.DELETE("/rules/:id", handlers.DeleteRule)
 
+		// Notification channels
+		protected.POST("/channels", handlers.CreateChannel)
+		protected.GET("/channels", handlers.ListChannels)
+		protected.GET("/channels/:id", handlers.GetChannel)
+		protected.PUT("/channels/:id", handlers.UpdateChannel)
+		protected.POST("/channels/:id/verify", handlers.ResendChannelVerification)
+		protected.DELETE("/channels/:id", handlers.DeleteChannel)
+		protected.GET("/jobs/:id/channels", handlers.ListJobChannels)
+		protected.PUT("/jobs/:id/channels", handlers.SetJobChannels)
+
+		// Maintenance windows (job-level or account-level)
+		protected.POST("/maintenance-windows", handlers.CreateMaintenanceWindow)
+		protected.GET("/maintenance-windows", handlers.ListMaintenanceWindows)
+		protected.DELETE("/maintenance-windows/:id", handlers.DeleteMaintenanceWindow)
+
 		// Phase 3.5: Stats (Read-Only)
 		protected.GET("/stats/overview", handlers.GetStatsOverview)
 		protected.GET("/stats/job/:id", handlers.GetJobStats)
+		protected.GET("/jobs/:id/baselines", handlers.GetJobBaselines)
+
+		// Organizations
+		protected.POST("/orgs", handlers.CreateOrg)
+		protected.GET("/orgs", handlers.ListOrgs)
+		protected.GET("/orgs/:id", handlers.GetOrg)
+		protected.PATCH("/orgs/:id", handlers.RenameOrg)
+		protected.DELETE("/orgs/:id", handlers.DeleteOrg)
+		protected.PUT("/orgs/:id/members/:user_id", handlers.UpdateMember)
+		protected.DELETE("/orgs/:id/members/:user_id", handlers.RemoveMember)
+		protected.POST("/orgs/:id/invitations", handlers.CreateInvitation)
+		protected.GET("/orgs/:id/invitations", handlers.ListInvitations)
+		protected.DELETE("/orgs/:id/invitations/:invitation_id", handlers.RevokeInvitation)
+		protected.POST("/invitations/accept", handlers.AcceptInvitation)
+
+		// API tokens (session login only, see middleware.requiredScope)
+		protected.POST("/tokens", handlers.CreateToken)
+		protected.GET("/tokens", handlers.ListTokens)
+		protected.DELETE("/tokens/:id", handlers.RevokeToken)
+
+		// Alerts
+		protected.GET("/alerts", handlers.ListAlerts)
+		protected.POST("/alerts/:id/ack", handlers.AckAlert)
+		protected.POST("/alerts/:id/resolve", handlers.ResolveAlert)
+		protected.GET("/alerts/:id/deliveries", handlers.ListAlertDeliveries)
 	}
 
 	// DEBUG: Explicitly check if we can read the file
@@ -3,6 +3,7 @@ package middleware
 import (
 	"cronmonitor/config"
 	"cronmonitor/db"
+	"cronmonitor/services"
 	"fmt"
 	"net/http"
 	"os"
@@ -23,14 +24,14 @@ func AuthRequired() gin.HandlerFunc {
 		if !features.AuthEnabled {
 			// Backward Compatibility: Inject System User
 			var systemID string
-			err := db.GetDB().QueryRow("SELECT id FROM users WHERE email = 'system@afterrun.internal'").Scan(&systemID)
+			err := db.GetDB().QueryRow("SELECT id FROM users WHERE email = $1", services.SystemUserEmail).Scan(&systemID)
 			if err != nil {
 				// Fallback if migration hasn't run yet (should verify in Verify steps)
 				c.Set("userID", "system-placeholder")
 			} else {
 				c.Set("userID", systemID)
 			}
-			c.Set("userEmail", "system@afterrun.internal")
+			c.Set("userEmail", services.SystemUserEmail)
 			c.Next()
 			return
 		}
@@ -57,6 +58,12 @@ func AuthRequired() gin.HandlerFunc {
 			return
 		}
 
+		// API tokens (scripts, CI): scoped instead of full access
+		if services.IsAPIToken(tokenString) {
+			authenticateAPIToken(c, tokenString)
+			return
+		}
+
 		// 3. Validation
 		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -80,6 +87,19 @@ func AuthRequired() gin.HandlerFunc {
 				}
 			}
 
+			// Sessions end when the password is reset
+			userID, _ := claims["user_id"].(string)
+			issuedAt, _ := claims["iat"].(float64)
+			valid, err := services.SessionValid(userID, int64(issuedAt))
+			if err != nil {
+				fmt.Printf("Session check error: %v\n", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			} else if !valid {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Session expired, please log in again"})
+				return
+			}
+
 			c.Set("userID", claims["user_id"])
 			c.Set("userEmail", claims["email"])
 			c.Next()
@@ -88,3 +108,59 @@ func AuthRequired() gin.HandlerFunc {
 		}
 	}
 }
+
+func authenticateAPIToken(c *gin.Context, token string) {
+	userID, email, scopes, err := services.AuthenticateAPIToken(token)
+	switch err {
+	case nil:
+	case services.ErrAPITokenInvalid:
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	case services.ErrAPITokenExpired:
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token expired"})
+		return
+	default:
+		fmt.Printf("API token lookup error: %v\n", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	scope, allowed := requiredScope(c.Request.Method, c.FullPath())
+	if !allowed {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Not available to API tokens"})
+		return
+	}
+	if !services.HasScope(scopes, scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token lacks scope " + scope})
+		return
+	}
+
+	c.Set("userID", userID)
+	c.Set("userEmail", email)
+	c.Set("authMethod", "api_token")
+	c.Set("tokenScopes", scopes)
+	c.Next()
+}
+
+// requiredScope maps a route to the API token scope it needs. Reads need
+// only read; rule changes need rules:write and every other change
+// jobs:write. Tokens cannot manage tokens, billing, org membership or
+// the account itself (2FA, verification).
+func requiredScope(method, path string) (string, bool) {
+	if strings.HasPrefix(path, "/api/tokens") || strings.HasPrefix(path, "/api/billing") {
+		return "", false
+	}
+	switch {
+	case method == http.MethodGet || method == http.MethodHead:
+		return services.ScopeRead, true
+	case strings.HasPrefix(path, "/api/orgs") || strings.HasPrefix(path, "/api/invitations") ||
+		strings.HasPrefix(path, "/api/auth"):
+		return "", false
+	case strings.HasSuffix(path, "/rules/backtest"):
+		return services.ScopeRead, true // replays only, writes nothing
+	case strings.HasPrefix(path, "/api/rules") || strings.HasSuffix(path, "/rules"):
+		return services.ScopeRulesWrite, true
+	default:
+		return services.ScopeJobsWrite, true
+	}
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"cronmonitor/services"
+	"net/http"
+	"testing"
+)
+
+func TestRequiredScope(t *testing.T) {
+	const denied = ""
+	tests := []struct {
+		method, path string
+		want         string // denied = not available to API tokens
+	}{
+		// Reads
+		{http.MethodGet, "/api/jobs", services.ScopeRead},
+		{http.MethodGet, "/api/jobs/:id", services.ScopeRead},
+		{http.MethodHead, "/api/jobs/:id/runs", services.ScopeRead},
+		{http.MethodGet, "/api/jobs/:id/rules", services.ScopeRead},
+		{http.MethodGet, "/api/rules/:id/revisions", services.ScopeRead},
+		{http.MethodGet, "/api/channels/:id", services.ScopeRead},
+		{http.MethodGet, "/api/alerts", services.ScopeRead},
+		{http.MethodGet, "/api/stats/overview", services.ScopeRead},
+		{http.MethodGet, "/api/orgs", services.ScopeRead},
+		{http.MethodGet, "/api/orgs/:id/invitations", services.ScopeRead},
+		{http.MethodGet, "/api/auth/me", services.ScopeRead},
+
+		// Rule changes
+		{http.MethodPost, "/api/jobs/:id/rules", services.ScopeRulesWrite},
+		{http.MethodPatch, "/api/rules/:id", services.ScopeRulesWrite},
+		{http.MethodDelete, "/api/rules/:id", services.ScopeRulesWrite},
+		{http.MethodPost, "/api/jobs/:id/rules/backtest", services.ScopeRead},
+
+		// Other changes
+		{http.MethodPost, "/api/jobs", services.ScopeJobsWrite},
+		{http.MethodDelete, "/api/jobs/:id", services.ScopeJobsWrite},
+		{http.MethodPost, "/api/jobs/:id/pause", services.ScopeJobsWrite},
+		{http.MethodPut, "/api/jobs/:id/channels", services.ScopeJobsWrite},
+		{http.MethodPost, "/api/channels", services.ScopeJobsWrite},
+		{http.MethodPut, "/api/channels/:id", services.ScopeJobsWrite},
+		{http.MethodPost, "/api/maintenance-windows", services.ScopeJobsWrite},
+		{http.MethodPost, "/api/alerts/:id/ack", services.ScopeJobsWrite},
+
+		// Never with a token, whatever the method
+		{http.MethodGet, "/api/tokens", denied},
+		{http.MethodPost, "/api/tokens", denied},
+		{http.MethodDelete, "/api/tokens/:id", denied},
+		{http.MethodPost, "/api/billing/upgrade", denied},
+		{http.MethodPost, "/api/orgs", denied},
+		{http.MethodPatch, "/api/orgs/:id", denied},
+		{http.MethodPut, "/api/orgs/:id/members/:user_id", denied},
+		{http.MethodDelete, "/api/orgs/:id/members/:user_id", denied},
+		{http.MethodPost, "/api/orgs/:id/invitations", denied},
+		{http.MethodPost, "/api/invitations/accept", denied},
+		{http.MethodPost, "/api/auth/2fa/disable", denied},
+		{http.MethodPost, "/api/auth/verify/resend", denied},
+	}
+	for _, tt := range tests {
+		scope, allowed := requiredScope(tt.method, tt.path)
+		if tt.want == denied {
+			if allowed {
+				t.Errorf("%s %s: allowed with scope %q, want denied", tt.method, tt.path, scope)
+			}
+			continue
+		}
+		if !allowed || scope != tt.want {
+			t.Errorf("%s %s = %q, %v; want %q", tt.method, tt.path, scope, allowed, tt.want)
+		}
+	}
+}
@@ -12,3 +12,50 @@ type User struct {
 	SubscriptionStatus string    `json:"subscription_status"`
 	CreatedAt          time.Time `json:"created_at"`
 }
+
+// APIToken is a long-lived credential for scripts and CI. Only a hash is
+// stored; Token is set once, in the response that creates it.
+type APIToken struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // first characters, to recognize the token
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Token      string     `json:"token,omitempty"`
+}
+
+// Org owns jobs, channels and maintenance windows. Every user has a
+// personal org; plans and job limits apply per org.
+type Org struct {
+	ID                 string    `json:"id"`
+	Name               string    `json:"name"`
+	Personal           bool      `json:"personal"`
+	SubscriptionTier   string    `json:"subscription_tier"`
+	SubscriptionStatus string    `json:"subscription_status"`
+	Role               string    `json:"role,omitempty"` // the caller's role
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+type OrgMember struct {
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"` // owner | admin | editor | viewer
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OrgInvitation is a pending invite. Token is only set when it is created.
+type OrgInvitation struct {
+	ID         string     `json:"id"`
+	OrgID      string     `json:"org_id"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	InvitedBy  *string    `json:"invited_by,omitempty"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Token      string     `json:"token,omitempty"`
+}
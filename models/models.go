@@ -5,16 +5,23 @@ import (
 )
 
 type Job struct {
-	ID           string    `json:"id"`
-	Name         string    `json:"name"`
-	PingKey      string    `json:"ping_key"`
-	Schedule     string    `json:"schedule"`
-	Timezone     string    `json:"timezone"`
-	GraceMinutes int       `json:"grace_minutes"`
-	PingURL      string    `json:"ping_url,omitempty"` // Computed field
-	CreatedAt    time.Time `json:"created_at"`
-	LastRun      *JobRun   `json:"last_run,omitempty"` // For list view
-	JobRuns      []JobRun  `json:"job_runs,omitempty"` // For UI Detail View
+	ID                string             `json:"id"`
+	OrgID             string             `json:"org_id"` // Defaults to the creator's personal org
+	Name              string             `json:"name"`
+	PingKey           string             `json:"ping_key"`
+	Schedule          string             `json:"schedule"`
+	Timezone          string             `json:"timezone"`
+	GraceMinutes      int                `json:"grace_minutes"`
+	MaxRuntimeMinutes int                `json:"max_runtime_minutes"` // 0 = no hung-run detection
+	State             string             `json:"state"`
+	Streak            int                `json:"streak"` // Consecutive unhealthy runs
+	StateChangedAt    *time.Time         `json:"state_changed_at,omitempty"`
+	ResumedAt         *time.Time         `json:"resumed_at,omitempty"`
+	Maintenance       *MaintenancePeriod `json:"maintenance,omitempty"` // Computed: active or next window
+	PingURL           string             `json:"ping_url,omitempty"`    // Computed field
+	CreatedAt         time.Time          `json:"created_at"`
+	LastRun           *JobRun            `json:"last_run,omitempty"` // For list view
+	JobRuns           []JobRun           `json:"job_runs,omitempty"` // For UI Detail View
 }
 
 type JobRun struct {
@@ -22,25 +29,204 @@ type JobRun struct {
 	JobID      string                 `json:"job_id"`
 	Status     string                 `json:"status"`
 	DurationMs int                    `json:"duration_ms"`
+	ExitCode   *int                   `json:"exit_code,omitempty"`
 	Metrics    map[string]interface{} `json:"metrics"`
 	Stderr     string                 `json:"stderr"`
+	StartedAt  *time.Time             `json:"started_at,omitempty"`
+	FinishedAt *time.Time             `json:"finished_at,omitempty"`
 	CreatedAt  time.Time              `json:"created_at"`
 }
 
+type JobStateTransition struct {
+	ID        string    `json:"id"`
+	JobID     string    `json:"job_id"`
+	FromState string    `json:"from_state"`
+	ToState   string    `json:"to_state"`
+	Reason    string    `json:"reason"`
+	RunID     *string   `json:"run_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MaintenanceWindow silences alerts for one job, or for every job of the
+// org when JobID is nil. One-off windows set StartsAt/EndsAt; recurring
+// windows set Schedule (cron), DurationMinutes and Timezone.
+type MaintenanceWindow struct {
+	ID              string             `json:"id"`
+	OrgID           string             `json:"org_id"`
+	JobID           *string            `json:"job_id,omitempty"`
+	Name            string             `json:"name"`
+	StartsAt        *time.Time         `json:"starts_at,omitempty"`
+	EndsAt          *time.Time         `json:"ends_at,omitempty"`
+	Schedule        string             `json:"schedule,omitempty"`
+	DurationMinutes int                `json:"duration_minutes,omitempty"`
+	Timezone        string             `json:"timezone,omitempty"`
+	CreatedAt       time.Time          `json:"created_at"`
+	Period          *MaintenancePeriod `json:"period,omitempty"` // Computed: active or next occurrence
+}
+
+// MaintenancePeriod is a concrete occurrence of a maintenance window.
+type MaintenancePeriod struct {
+	WindowID string    `json:"window_id"`
+	Name     string    `json:"name"`
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+	Active   bool      `json:"active"`
+}
+
+// NotificationChannel is an org-owned alert destination.
+type NotificationChannel struct {
+	ID        string        `json:"id"`
+	OrgID     string        `json:"org_id"`
+	Type      string        `json:"type"` // email | slack
+	Name      string        `json:"name"`
+	Config    ChannelConfig `json:"config"`
+	CreatedAt time.Time     `json:"created_at"`
+	// Email channels only receive alerts once their address is confirmed
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+// ChannelConfig holds the per-type settings of a channel (stored as JSONB).
+type ChannelConfig struct {
+	Email      string            `json:"email,omitempty"`       // email
+	WebhookURL string            `json:"webhook_url,omitempty"` // slack, webhook
+	Template   string            `json:"template,omitempty"`    // webhook: text/template body (default: JSON)
+	Headers    map[string]string `json:"headers,omitempty"`     // webhook
+	Secret     string            `json:"secret,omitempty"`      // webhook: HMAC-SHA256 key, only returned on create
+}
+
+// Delivery is one queued notification (alert x channel) in the outbox.
+type Delivery struct {
+	ID            string            `json:"id"`
+	AlertID       *string           `json:"alert_id,omitempty"`
+	ChannelID     *string           `json:"channel_id,omitempty"` // nil for env fallback
+	ChannelType   string            `json:"channel_type"`
+	Status        string            `json:"status"` // pending | sent | failed
+	Attempts      int               `json:"attempts"`
+	NextAttemptAt *time.Time        `json:"next_attempt_at,omitempty"`
+	LastError     *string           `json:"last_error,omitempty"`
+	SentAt        *time.Time        `json:"sent_at,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	AttemptLog    []DeliveryAttempt `json:"attempt_log"`
+}
+
+type DeliveryAttempt struct {
+	ID          string    `json:"id"`
+	Attempt     int       `json:"attempt"`
+	StatusCode  *int      `json:"status_code,omitempty"`
+	Error       *string   `json:"error,omitempty"`
+	Success     bool      `json:"success"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// Rule describes the condition that makes a run unhealthy.
+// Threshold rules compare MetricName (a key or dotted path) with Operator;
+// between/outside use ThresholdValue as the lower and ThresholdHigh as the
+// upper bound. ThresholdText replaces ThresholdValue for string, boolean
+// and regex (=~, !~) comparisons.
+// Target selects a built-in value (duration_ms, status, stderr) instead of
+// a metric. Absent rules fire when the metric is not reported. Expression rules
+// fire when Expression (over the whole run) is true. Baseline rules compare
+// with the job's own history (percentile x factor, or median +/- MAD).
+// Consecutive or WindowViolations (within WindowRuns or WindowMinutes)
+// hold the alert back until a violation repeats; zero alerts every time.
 type Rule struct {
-	ID             string    `json:"id"`
-	JobID          string    `json:"job_id"`
-	MetricName     string    `json:"metric_name"`
-	Operator       string    `json:"operator"`
-	ThresholdValue float64   `json:"threshold_value"`
-	Severity       string    `json:"severity"`
-	CreatedAt      time.Time `json:"created_at"`
+	ID               string     `json:"id"`
+	JobID            string     `json:"job_id"`
+	RuleType         string     `json:"rule_type"` // threshold | absent | expression | baseline
+	Target           string     `json:"target"`    // metric | duration | status | stderr
+	MetricName       string     `json:"metric_name"`
+	Operator         string     `json:"operator,omitempty"`
+	ThresholdValue   float64    `json:"threshold_value"`
+	ThresholdHigh    *float64   `json:"threshold_high,omitempty"`
+	ThresholdText    *string    `json:"threshold_text,omitempty"` // string/bool equality or regex
+	Expression       string     `json:"expression,omitempty"`     // expression rules
+	Consecutive      int        `json:"consecutive,omitempty"`
+	WindowViolations int        `json:"window_violations,omitempty"`
+	WindowRuns       int        `json:"window_runs,omitempty"`
+	WindowMinutes    int        `json:"window_minutes,omitempty"`
+	Baseline         string     `json:"baseline,omitempty"` // baseline rules: p50 | p95 | p99 | mad
+	BaselineFactor   float64    `json:"factor,omitempty"`
+	BaselineRuns     int        `json:"baseline_runs,omitempty"` // mad: runs the median is taken over
+	MinSamples       int        `json:"min_samples,omitempty"`   // skip until the baseline has this many samples
+	Seasonality      string     `json:"seasonality,omitempty"`   // weekday | hour | day_of_month
+	Severity         string     `json:"severity"`
+	Enabled          bool       `json:"enabled"`
+	Version          int        `json:"version"`          // bumped on every change
+	Streak           *int       `json:"streak,omitempty"` // Computed: consecutive violations so far
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        *time.Time `json:"updated_at,omitempty"`
+}
+
+// RuleRevision is a snapshot of a rule as of one version.
+type RuleRevision struct {
+	ID        string    `json:"id"`
+	RuleID    string    `json:"rule_id"`
+	Version   int       `json:"version"`
+	Rule      Rule      `json:"rule"`
+	ChangedBy *string   `json:"changed_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RuleEvaluation is the outcome of one rule for one run.
+type RuleEvaluation struct {
+	ID           string    `json:"id"`
+	RuleID       string    `json:"rule_id"`
+	RunID        string    `json:"run_id"`
+	Violated     bool      `json:"violated"`
+	ThresholdMet bool      `json:"threshold_met"`
+	ActualValue  *string   `json:"actual_value,omitempty"`
+	EvaluatedAt  time.Time `json:"evaluated_at"`
 }
 
+// BacktestResult reports how often a rule would have fired over past runs.
+type BacktestResult struct {
+	From           time.Time       `json:"from"`
+	To             time.Time       `json:"to"`
+	RunsEvaluated  int             `json:"runs_evaluated"`
+	Truncated      bool            `json:"truncated"` // more runs in range than were replayed
+	Skipped        int             `json:"skipped"`   // baseline rules without enough samples
+	Violations     int             `json:"violations"`
+	AlertCount     int             `json:"alert_count"`
+	ViolationTimes []time.Time     `json:"violation_times"`
+	Matches        []BacktestMatch `json:"matches"`
+}
+
+// BacktestMatch is a past run that violated the rule.
+type BacktestMatch struct {
+	RunID       string      `json:"run_id"`
+	Status      string      `json:"status"`
+	CreatedAt   time.Time   `json:"created_at"`
+	ActualValue interface{} `json:"actual_value,omitempty"`
+	Alert       bool        `json:"alert"` // would have sent an alert
+}
+
+// Alert lifecycle: open -> acknowledged -> resolved (or open -> resolved).
 type Alert struct {
-	ID      string    `json:"id"`
-	JobID   string    `json:"job_id"`
-	RunID   string    `json:"run_id"`
-	Message string    `json:"message"`
-	SentAt  time.Time `json:"sent_at"`
+	ID             string     `json:"id"`
+	JobID          string     `json:"job_id"`
+	JobName        string     `json:"job_name,omitempty"`
+	RunID          *string    `json:"run_id,omitempty"`  // nil for missed runs
+	RuleID         *string    `json:"rule_id,omitempty"` // set for rule violations
+	RuleVersion    *int       `json:"rule_version,omitempty"`
+	Message        string     `json:"message"`
+	Status         string     `json:"status"`
+	SentAt         time.Time  `json:"sent_at"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy *string    `json:"acknowledged_by,omitempty"`
+	SnoozedUntil   *time.Time `json:"snoozed_until,omitempty"` // acknowledgement lapses after this
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy     *string    `json:"resolved_by,omitempty"`
+}
+
+// Baseline summarizes recent successful runs of a job for one metric
+// (or duration_ms), across all runs or for one seasonal bucket.
+type Baseline struct {
+	JobID      string    `json:"job_id"`
+	MetricName string    `json:"metric_name"`
+	Bucket     string    `json:"bucket,omitempty"` // e.g. weekday:1; empty for the global baseline
+	P50        float64   `json:"p50"`
+	P95        float64   `json:"p95"`
+	P99        float64   `json:"p99"`
+	SampleSize int       `json:"sample_size"`
+	UpdatedAt  time.Time `json:"updated_at"`
 }
@@ -22,6 +22,20 @@ CREATE TABLE IF NOT EXISTS users (
     created_at TIMESTAMP DEFAULT NOW()
 );
 
+-- API Tokens (only the SHA-256 of the token is stored)
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(20) NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    scopes TEXT[] NOT NULL,
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
 -- Phase 3.5: Job User Relationship
 ALTER TABLE jobs ADD COLUMN IF NOT EXISTS user_id UUID REFERENCES users(id) ON DELETE CASCADE;
 
@@ -36,6 +50,8 @@ CREATE TABLE IF NOT EXISTS baselines (
     sample_size INT,
     updated_at TIMESTAMP DEFAULT NOW()
 );
+ALTER TABLE baselines ALTER COLUMN metric_name TYPE VARCHAR(255); -- dotted paths
+ALTER TABLE baselines ADD COLUMN IF NOT EXISTS bucket VARCHAR(20) NOT NULL DEFAULT ''; -- seasonal bucket, '' = all runs
 
 -- Job Runs Table
 CREATE TABLE IF NOT EXISTS job_runs (
@@ -48,6 +64,27 @@ CREATE TABLE IF NOT EXISTS job_runs (
     created_at TIMESTAMP DEFAULT NOW()
 );
 
+-- Start/Finish Pings
+-- A start ping opens a 'running' run; the finishing ping closes it and
+-- the server computes duration_ms from started_at.
+ALTER TABLE job_runs ADD COLUMN IF NOT EXISTS started_at TIMESTAMP;
+ALTER TABLE job_runs ADD COLUMN IF NOT EXISTS finished_at TIMESTAMP;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS max_runtime_minutes INT;
+
+-- Exit Code Pings (/ping/:key/:exit_code)
+ALTER TABLE job_runs ADD COLUMN IF NOT EXISTS exit_code INT;
+
+-- Idempotent Pings (run_id / Idempotency-Key)
+-- NULL keys never conflict, so pings without a key are always recorded.
+ALTER TABLE job_runs ADD COLUMN IF NOT EXISTS idempotency_key VARCHAR(255);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_job_runs_idempotency_key ON job_runs(job_id, idempotency_key);
+
+-- Job Lifecycle State (new / up / late / down / paused)
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS state VARCHAR(20) NOT NULL DEFAULT 'new';
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS state_changed_at TIMESTAMP;
+-- Fire times before a resume are not expected (like jobs created later)
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS resumed_at TIMESTAMP;
+
 -- Rules Table
 CREATE TABLE IF NOT EXISTS rules (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
@@ -58,6 +95,33 @@ CREATE TABLE IF NOT EXISTS rules (
     severity VARCHAR(20) DEFAULT 'critical',
     created_at TIMESTAMP DEFAULT NOW()
 );
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS rule_type VARCHAR(20) NOT NULL DEFAULT 'threshold';
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS threshold_high FLOAT; -- upper bound for between/outside
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS threshold_text TEXT; -- string/bool equality and regex
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS expression TEXT; -- rule_type 'expression'
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS target VARCHAR(20) NOT NULL DEFAULT 'metric'; -- metric | duration | status | stderr
+ALTER TABLE rules ALTER COLUMN metric_name TYPE VARCHAR(255); -- dotted paths
+
+-- Rule thresholds: N consecutive violations, or K violations in the last M runs / minutes
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS consecutive INT NOT NULL DEFAULT 0;
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS window_violations INT NOT NULL DEFAULT 0;
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS window_runs INT NOT NULL DEFAULT 0;
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS window_minutes INT NOT NULL DEFAULT 0;
+
+-- Baseline rules: percentile x factor or median +/- factor x MAD
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS baseline_stat VARCHAR(10);
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS baseline_factor FLOAT NOT NULL DEFAULT 0;
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS baseline_runs INT NOT NULL DEFAULT 0;
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS min_samples INT NOT NULL DEFAULT 0;
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS seasonality VARCHAR(20); -- weekday | hour | day_of_month
+
+-- Rule versioning (bumped on every change, see rule_revisions)
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS enabled BOOLEAN NOT NULL DEFAULT true;
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE rules ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP;
+
+-- Consecutive unhealthy runs (failed or violated a rule)
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS streak INT NOT NULL DEFAULT 0;
 
 -- Alerts Table
 CREATE TABLE IF NOT EXISTS alerts (
@@ -68,9 +132,236 @@ CREATE TABLE IF NOT EXISTS alerts (
     sent_at TIMESTAMP DEFAULT NOW()
 );
 
+-- Alert lifecycle (open -> acknowledged -> resolved)
+ALTER TABLE alerts ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'open';
+ALTER TABLE alerts ADD COLUMN IF NOT EXISTS acknowledged_at TIMESTAMP;
+ALTER TABLE alerts ADD COLUMN IF NOT EXISTS acknowledged_by VARCHAR(255);
+ALTER TABLE alerts ADD COLUMN IF NOT EXISTS snoozed_until TIMESTAMPTZ;
+ALTER TABLE alerts ADD COLUMN IF NOT EXISTS resolved_at TIMESTAMP;
+ALTER TABLE alerts ADD COLUMN IF NOT EXISTS resolved_by VARCHAR(255);
+ALTER TABLE alerts ADD COLUMN IF NOT EXISTS rule_id UUID REFERENCES rules(id) ON DELETE SET NULL;
+ALTER TABLE alerts ADD COLUMN IF NOT EXISTS rule_version INT;
+
+-- Rule Revisions (snapshot of the rule definition per version)
+CREATE TABLE IF NOT EXISTS rule_revisions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    rule_id UUID REFERENCES rules(id) ON DELETE CASCADE,
+    version INT NOT NULL,
+    definition JSONB NOT NULL,
+    changed_by VARCHAR(255),
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (rule_id, version)
+);
+
+-- Rule Evaluations (one row per rule per run)
+CREATE TABLE IF NOT EXISTS rule_evaluations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    rule_id UUID REFERENCES rules(id) ON DELETE CASCADE,
+    job_id UUID REFERENCES jobs(id) ON DELETE CASCADE,
+    run_id UUID REFERENCES job_runs(id) ON DELETE CASCADE,
+    violated BOOLEAN NOT NULL,
+    threshold_met BOOLEAN NOT NULL DEFAULT false,
+    actual_value TEXT,
+    evaluated_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Job State History
+CREATE TABLE IF NOT EXISTS job_state_transitions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    job_id UUID REFERENCES jobs(id) ON DELETE CASCADE,
+    from_state VARCHAR(20) NOT NULL,
+    to_state VARCHAR(20) NOT NULL,
+    reason TEXT,
+    run_id UUID REFERENCES job_runs(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Maintenance Windows
+-- job_id NULL = applies to every job of the org (org level).
+-- One-off: starts_at/ends_at. Recurring: schedule (cron) + duration_minutes + timezone.
+-- TIMESTAMPTZ because the times are user-supplied instants, not NOW() defaults.
+CREATE TABLE IF NOT EXISTS maintenance_windows (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+    job_id UUID REFERENCES jobs(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    starts_at TIMESTAMPTZ,
+    ends_at TIMESTAMPTZ,
+    schedule VARCHAR(100),
+    duration_minutes INT,
+    timezone VARCHAR(50) DEFAULT 'UTC',
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Notification Channels (per-org alert destinations)
+CREATE TABLE IF NOT EXISTS notification_channels (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+    type VARCHAR(20) NOT NULL,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    config JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Job Subscriptions (no rows = all of the org's channels)
+CREATE TABLE IF NOT EXISTS job_channels (
+    job_id UUID REFERENCES jobs(id) ON DELETE CASCADE,
+    channel_id UUID REFERENCES notification_channels(id) ON DELETE CASCADE,
+    PRIMARY KEY (job_id, channel_id)
+);
+
+-- Notification Outbox (durable delivery queue)
+-- channel_config is a snapshot so env fallbacks without a channel row work too.
+CREATE TABLE IF NOT EXISTS notification_outbox (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    alert_id UUID REFERENCES alerts(id) ON DELETE CASCADE,
+    job_id UUID REFERENCES jobs(id) ON DELETE CASCADE,
+    channel_id UUID REFERENCES notification_channels(id) ON DELETE SET NULL,
+    channel_type VARCHAR(20) NOT NULL,
+    channel_config JSONB NOT NULL DEFAULT '{}',
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP DEFAULT NOW(),
+    last_error TEXT,
+    sent_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Delivery Log (one row per attempt)
+CREATE TABLE IF NOT EXISTS notification_attempts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    outbox_id UUID REFERENCES notification_outbox(id) ON DELETE CASCADE,
+    alert_id UUID REFERENCES alerts(id) ON DELETE CASCADE,
+    attempt INT NOT NULL,
+    status_code INT,
+    error TEXT,
+    success BOOLEAN NOT NULL,
+    attempted_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Organizations (own jobs, channels and maintenance windows; plans apply per org)
+-- Every user has a personal org (personal_user_id) that cannot be shared.
+CREATE TABLE IF NOT EXISTS organizations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(255) NOT NULL,
+    personal_user_id UUID UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    subscription_tier VARCHAR(50) DEFAULT 'free',
+    subscription_status VARCHAR(50) DEFAULT 'active',
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Org Members (role: owner | admin | editor | viewer)
+CREATE TABLE IF NOT EXISTS org_members (
+    org_id UUID REFERENCES organizations(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (org_id, user_id)
+);
+
+-- Org Invitations (single-use, only the SHA-256 of the token is stored)
+CREATE TABLE IF NOT EXISTS org_invitations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    org_id UUID REFERENCES organizations(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(20) NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    invited_by VARCHAR(255),
+    expires_at TIMESTAMPTZ NOT NULL,
+    accepted_at TIMESTAMPTZ,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Org ownership (user_id stays as the creator)
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS org_id UUID REFERENCES organizations(id) ON DELETE CASCADE;
+ALTER TABLE notification_channels ADD COLUMN IF NOT EXISTS org_id UUID REFERENCES organizations(id) ON DELETE CASCADE;
+ALTER TABLE maintenance_windows ADD COLUMN IF NOT EXISTS org_id UUID REFERENCES organizations(id) ON DELETE CASCADE;
+
+-- Email Verification
+-- Added with DEFAULT NOW() so accounts and email channels that existed
+-- before verification count as verified; new rows start unverified.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ DEFAULT NOW();
+ALTER TABLE users ALTER COLUMN email_verified_at DROP DEFAULT;
+ALTER TABLE notification_channels ADD COLUMN IF NOT EXISTS verified_at TIMESTAMPTZ DEFAULT NOW();
+ALTER TABLE notification_channels ALTER COLUMN verified_at DROP DEFAULT;
+-- Sessions issued before a password change are rejected
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_changed_at TIMESTAMPTZ;
+
+-- Auth Tokens (email verification and password reset links)
+-- Single-use (used_at) and expiring; only the SHA-256 of the token is stored.
+-- email is the address the link was sent to.
+CREATE TABLE IF NOT EXISTS auth_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    purpose VARCHAR(20) NOT NULL, -- verify_email | verify_channel | reset_password | login_2fa
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    channel_id UUID REFERENCES notification_channels(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+-- Login challenges (purpose login_2fa) allow a few wrong codes
+ALTER TABLE auth_tokens ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+
+-- Two-Factor Authentication (TOTP)
+-- totp_secret is set on setup and only enforced once totp_enabled_at is set.
+-- totp_last_step is the 30-second step of the last accepted code; codes
+-- for that step or earlier are rejected, so a code cannot be replayed.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT;
+
+-- Wrong login codes in a row, across challenges; reaching the limit sets
+-- totp_locked_until and starts the count again. Cleared on success.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_failed_attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_locked_until TIMESTAMPTZ;
+
+-- Recovery codes (single-use, only the SHA-256 is stored)
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Single Sign-On Identities (OIDC issuer + subject, linked to an account)
+CREATE TABLE IF NOT EXISTS user_identities (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255), -- from the ID token when the identity was linked
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (issuer, subject)
+);
+
 -- Indexes (Idempotent via IF NOT EXISTS)
 CREATE INDEX IF NOT EXISTS idx_job_runs_job_id ON job_runs(job_id);
 CREATE INDEX IF NOT EXISTS idx_job_runs_created_at ON job_runs(created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_job_state_transitions_job_id ON job_state_transitions(job_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_maintenance_windows_user_id ON maintenance_windows(user_id);
+CREATE INDEX IF NOT EXISTS idx_notification_channels_user_id ON notification_channels(user_id);
+CREATE INDEX IF NOT EXISTS idx_alerts_job_status ON alerts(job_id, status);
+CREATE INDEX IF NOT EXISTS idx_notification_outbox_due ON notification_outbox(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_notification_attempts_alert_id ON notification_attempts(alert_id);
+CREATE INDEX IF NOT EXISTS idx_rule_evaluations_rule_id ON rule_evaluations(rule_id, evaluated_at DESC);
+CREATE INDEX IF NOT EXISTS idx_alerts_rule_id ON alerts(rule_id) WHERE rule_id IS NOT NULL;
+DROP INDEX IF EXISTS idx_baselines_job_metric;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_baselines_job_metric_bucket ON baselines(job_id, metric_name, bucket);
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_job_runs_running ON job_runs(job_id) WHERE status = 'running';
+CREATE INDEX IF NOT EXISTS idx_org_members_user_id ON org_members(user_id);
+CREATE INDEX IF NOT EXISTS idx_org_invitations_org_id ON org_invitations(org_id);
+CREATE INDEX IF NOT EXISTS idx_jobs_org_id ON jobs(org_id);
+CREATE INDEX IF NOT EXISTS idx_notification_channels_org_id ON notification_channels(org_id);
+CREATE INDEX IF NOT EXISTS idx_maintenance_windows_org_id ON maintenance_windows(org_id);
+CREATE INDEX IF NOT EXISTS idx_auth_tokens_user_id ON auth_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_auth_tokens_channel_id ON auth_tokens(channel_id);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes(user_id);
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);
 
 -- Phase 4: Data Migration (System User)
 INSERT INTO users (email, password_hash, subscription_tier, subscription_status)
@@ -85,10 +376,33 @@ WHERE user_id IS NULL;
 -- Enforce Ownership
 ALTER TABLE jobs ALTER COLUMN user_id SET NOT NULL;
 
+-- Personal Organizations (one per user, carrying over the user's plan)
+INSERT INTO organizations (name, personal_user_id, subscription_tier, subscription_status)
+SELECT email, id, subscription_tier, subscription_status FROM users
+ON CONFLICT (personal_user_id) DO NOTHING;
+
+INSERT INTO org_members (org_id, user_id, role)
+SELECT id, personal_user_id, 'owner' FROM organizations WHERE personal_user_id IS NOT NULL
+ON CONFLICT (org_id, user_id) DO NOTHING;
+
+-- Move existing resources into their creator's personal org
+UPDATE jobs SET org_id = o.id
+FROM organizations o WHERE jobs.org_id IS NULL AND o.personal_user_id = jobs.user_id;
+UPDATE notification_channels SET org_id = o.id
+FROM organizations o WHERE notification_channels.org_id IS NULL AND o.personal_user_id = notification_channels.user_id;
+UPDATE maintenance_windows SET org_id = o.id
+FROM organizations o WHERE maintenance_windows.org_id IS NULL AND o.personal_user_id = maintenance_windows.user_id;
+
+ALTER TABLE jobs ALTER COLUMN org_id SET NOT NULL;
+ALTER TABLE notification_channels ALTER COLUMN org_id SET NOT NULL;
+ALTER TABLE maintenance_windows ALTER COLUMN org_id SET NOT NULL;
+
 -- Test Data (Only if empty, linked to system user)
-INSERT INTO jobs (name, ping_key, user_id) 
-SELECT 'Test Backup Job', 'test123', (SELECT id FROM users WHERE email = 'system@afterrun.internal')
-WHERE NOT EXISTS (SELECT 1 FROM jobs WHERE ping_key = 'test123');
+INSERT INTO jobs (name, ping_key, user_id, org_id)
+SELECT 'Test Backup Job', 'test123', u.id, o.id
+FROM users u JOIN organizations o ON o.personal_user_id = u.id
+WHERE u.email = 'system@afterrun.internal'
+AND NOT EXISTS (SELECT 1 FROM jobs WHERE ping_key = 'test123');
 
 INSERT INTO rules (job_id, metric_name, operator, threshold_value)
 SELECT id, 'rows_processed', '==', 0
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Alert lifecycle states.
+const (
+	AlertOpen         = "open"
+	AlertAcknowledged = "acknowledged"
+	AlertResolved     = "resolved"
+)
+
+// Ack links are signed with the session secret. Anyone holding one can
+// acknowledge the alert without signing in, so they expire after a day.
+const alertAckLinkTTL = 24 * time.Hour
+
+var alertLinkSecret = []byte(os.Getenv("JWT_SECRET"))
+
+// AcknowledgeAlert marks an open (or re-acknowledges an acknowledged)
+// alert. With snoozeUntil set, the acknowledgement lapses at that time.
+// Returns false if the alert is already resolved.
+func AcknowledgeAlert(alertID, by string, snoozeUntil *time.Time) (bool, error) {
+	res, err := db.GetDB().Exec(`
+		UPDATE alerts
+		SET status = 'acknowledged', acknowledged_at = NOW(), acknowledged_by = $2, snoozed_until = $3
+		WHERE id = $1 AND status <> 'resolved'
+	`, alertID, by, snoozeUntil)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// ResolveAlert closes an alert. Returns false if it was already resolved.
+func ResolveAlert(alertID, by string) (bool, error) {
+	res, err := db.GetDB().Exec(`
+		UPDATE alerts
+		SET status = 'resolved', resolved_at = NOW(), resolved_by = $2
+		WHERE id = $1 AND status <> 'resolved'
+	`, alertID, by)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// resolveJobAlerts closes every unresolved alert of a job (on recovery).
+func resolveJobAlerts(jobID, by string) {
+	_, err := db.GetDB().Exec(`
+		UPDATE alerts
+		SET status = 'resolved', resolved_at = NOW(), resolved_by = $2
+		WHERE job_id = $1 AND status <> 'resolved'
+	`, jobID, by)
+	if err != nil {
+		fmt.Printf("Error resolving alerts for job %s: %v\n", jobID, err)
+	}
+}
+
+// AlertAckURL returns a signed one-click acknowledgement link, or "" when
+// APP_URL is not configured. by records who the link was sent to.
+func AlertAckURL(alertID, by string) string {
+	base := strings.TrimRight(os.Getenv("APP_URL"), "/")
+	if base == "" || alertID == "" {
+		return ""
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"alert_id": alertID,
+		"purpose":  "alert_ack",
+		"by":       by,
+		"exp":      time.Now().Add(alertAckLinkTTL).Unix(),
+	})
+	signed, err := token.SignedString(alertLinkSecret)
+	if err != nil {
+		fmt.Printf("Error signing ack link: %v\n", err)
+		return ""
+	}
+	return base + "/alerts/ack?token=" + url.QueryEscape(signed)
+}
+
+// ParseAlertAckToken verifies an ack link token and returns the alert
+// and recipient it was issued for.
+func ParseAlertAckToken(tokenString string) (alertID, by string, err error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return alertLinkSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return "", "", fmt.Errorf("invalid or expired link")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != "alert_ack" {
+		return "", "", fmt.Errorf("invalid link")
+	}
+	alertID, _ = claims["alert_id"].(string)
+	by, _ = claims["by"].(string)
+	if alertID == "" {
+		return "", "", fmt.Errorf("invalid link")
+	}
+	return alertID, by, nil
+}
+
+// withAckLink adds the one-click ack link for this channel's recipient.
+func withAckLink(n Notification, recipient string) Notification {
+	link := AlertAckURL(n.AlertID, recipient)
+	if link == "" {
+		return n
+	}
+	n.AckURL = link
+	n.Body += "\n\nAcknowledge this alert:\n" + link
+	n.Text += "\n\nAcknowledge: " + link
+	return n
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAlertAckToken(t *testing.T) {
+	t.Setenv("APP_URL", "https://afterrun.test/")
+
+	link := AlertAckURL("alert-1", "ops@example.com")
+	if !strings.HasPrefix(link, "https://afterrun.test/alerts/ack?token=") {
+		t.Fatalf("AlertAckURL = %q", link)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alertID, by, err := ParseAlertAckToken(u.Query().Get("token"))
+	if err != nil || alertID != "alert-1" || by != "ops@example.com" {
+		t.Fatalf("ParseAlertAckToken = %q, %q, %v", alertID, by, err)
+	}
+
+	// Links work without a session, so they are short-lived
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(u.Query().Get("token"), claims); err != nil {
+		t.Fatal(err)
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil || time.Until(exp.Time) > 24*time.Hour {
+		t.Errorf("link expires at %v, want within 24h", exp)
+	}
+}
+
+func TestAlertAckTokenRejects(t *testing.T) {
+	sign := func(claims jwt.MapClaims, key []byte) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"garbage", "not-a-token"},
+		{"wrong key", sign(jwt.MapClaims{"alert_id": "a", "purpose": "alert_ack", "exp": exp}, []byte("other"+string(alertLinkSecret)))},
+		{"expired", sign(jwt.MapClaims{"alert_id": "a", "purpose": "alert_ack", "exp": time.Now().Add(-time.Minute).Unix()}, alertLinkSecret)},
+		{"other purpose", sign(jwt.MapClaims{"alert_id": "a", "purpose": "oidc_login", "exp": exp}, alertLinkSecret)},
+		{"session token", sign(jwt.MapClaims{"user_id": "u", "exp": exp}, alertLinkSecret)},
+		{"no alert", sign(jwt.MapClaims{"purpose": "alert_ack", "exp": exp}, alertLinkSecret)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := ParseAlertAckToken(tt.token); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -3,19 +3,21 @@ package services
 import (
 	"cronmonitor/db"
 	"cronmonitor/models"
+	"database/sql"
 	"encoding/json"
 	"fmt"
-	"os"
 	"time"
-
-	"github.com/sendgrid/sendgrid-go"
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
-func SendAlert(job models.Job, run models.JobRun, rule models.Rule, actualValue float64, stderr string) {
+func SendAlert(job models.Job, run models.JobRun, rule models.Rule, actualValue interface{}, stderr string) {
 	// 1. Prepare Alert Message
-	alertMessage := fmt.Sprintf("%s %s %f (actual: %f)",
-		rule.MetricName, rule.Operator, rule.ThresholdValue, actualValue)
+	alertMessage := fmt.Sprintf("%s (actual: %s)", DescribeRule(rule), FormatMetricValue(actualValue))
+	if rule.RuleType == RuleAbsent {
+		alertMessage = DescribeRule(rule)
+	}
+	if check, ok := actualValue.(BaselineCheck); ok {
+		alertMessage = fmt.Sprintf("%s (actual: %s; baseline %s)", DescribeRule(rule), formatNumber(check.Value), check.DescribeBaseline())
+	}
 
 	if run.ID == "" {
 		fmt.Println("Error: run.ID is empty, cannot save alert")
@@ -23,10 +25,12 @@ func SendAlert(job models.Job, run models.JobRun, rule models.Rule, actualValue
 	}
 
 	// 2. Write alert to DB FIRST (Source of Truth)
-	_, err := db.GetDB().Exec(`
-		INSERT INTO alerts (job_id, run_id, message)
-		VALUES ($1, $2, $3)
-	`, job.ID, run.ID, alertMessage)
+	var alertID string
+	err := db.GetDB().QueryRow(`
+		INSERT INTO alerts (job_id, run_id, rule_id, rule_version, message)
+		VALUES ($1, $2, NULLIF($3, '')::uuid, NULLIF($4, 0), $5)
+		RETURNING id
+	`, job.ID, run.ID, rule.ID, rule.Version, alertMessage).Scan(&alertID)
 	if err != nil {
 		fmt.Printf("Error saving alert: %v\n", err)
 		// We continue to try sending email even if DB fails?
@@ -38,62 +42,139 @@ func SendAlert(job models.Job, run models.JobRun, rule models.Rule, actualValue
 	}
 	fmt.Println("Alert validated & saved to DB.")
 
-	// Fire-and-forget Slack alert (Non-blocking)
-	go SendSlackAlert(job, run, alertMessage)
+	// Subject Logic
+	var subject string
+	if run.Status == "fail" {
+		subject = fmt.Sprintf("[CRITICAL] %s failed", job.Name)
+	} else {
+		subject = fmt.Sprintf("[WARNING] %s ran but produced suspicious output", job.Name)
+	}
+	// Append metric context if short enough
+	subjectName := RuleSubject(rule)
+	if subjectName != "" && len(subject)+len(subjectName)+10 < 80 {
+		subject += fmt.Sprintf(" (%s)", subjectName)
+	}
+
+	// Human Explanation
+	explanation := ruleExplanation(run, rule, actualValue)
+
+	lastSuccess := lastSuccessfulRun(job.ID, run.CreatedAt)
+	NotifyJob(Notification{
+		AlertID:     alertID,
+		Job:         job,
+		Run:         &run,
+		Rule:        &rule,
+		ActualValue: actualValue,
+		LastSuccess: lastSuccess,
+		Subject:     subject,
+		Body:        runAlertBody(job, run, lastSuccess, subject, explanation, alertMessage, FormatMetricValue(actualValue), stderr),
+		Text:        slackAlertText(job, run, alertMessage),
+	})
+}
+
+// SendFailureAlert alerts on a run that explicitly reported failure
+// (status "fail", /fail or a non-zero exit code). No rule is required.
+func SendFailureAlert(job models.Job, run models.JobRun) {
+	alertMessage := "Job reported failure"
+	actual := "status fail"
+	if run.ExitCode != nil {
+		alertMessage = fmt.Sprintf("Job exited with code %d", *run.ExitCode)
+		actual = fmt.Sprintf("exit code %d", *run.ExitCode)
+	}
 
-	// 3. Check Email Config
-	apiKey := os.Getenv("SENDGRID_API_KEY")
-	alertEmail := os.Getenv("ALERT_EMAIL")
+	if run.ID == "" {
+		fmt.Println("Error: run.ID is empty, cannot save alert")
+		return
+	}
 
-	if apiKey == "" || alertEmail == "" {
-		fmt.Println("Missing SendGrid config, skipping email")
+	// DB First (Source of Truth)
+	var alertID string
+	err := db.GetDB().QueryRow(`
+		INSERT INTO alerts (job_id, run_id, message)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, job.ID, run.ID, alertMessage).Scan(&alertID)
+	if err != nil {
+		fmt.Printf("Error saving alert: %v\n", err)
 		return
 	}
 
-	// 4. Gather Context (Last Successful Run)
-	var lastStatusInfo string
+	subject := fmt.Sprintf("[CRITICAL] %s failed", job.Name)
+	explanation := fmt.Sprintf("The job reported that it failed (%s).", actual)
+	lastSuccess := lastSuccessfulRun(job.ID, run.CreatedAt)
+	NotifyJob(Notification{
+		AlertID:     alertID,
+		Job:         job,
+		Run:         &run,
+		LastSuccess: lastSuccess,
+		Subject:     subject,
+		Body:        runAlertBody(job, run, lastSuccess, subject, explanation, alertMessage, actual, run.Stderr),
+		Text:        slackAlertText(job, run, alertMessage),
+	})
+}
 
-	var lastRunTime time.Time
-	var lastDuration int
-	var lastMetricsRaw []byte
+// ruleExplanation says in plain words why the rule fired for this run.
+func ruleExplanation(run models.JobRun, rule models.Rule, actualValue interface{}) string {
+	switch {
+	case rule.Target == TargetStatus && run.Status == "fail":
+		return fmt.Sprintf("The job reported that it failed, and your rule alerts when %s.", DescribeRule(rule))
+	case rule.Target == TargetStatus:
+		return fmt.Sprintf("The job reported status %q, and your rule alerts when %s.", run.Status, DescribeRule(rule))
+	case run.Status == "fail":
+		return fmt.Sprintf("The job failed to complete successfully (Status: %s).", run.Status)
+	case rule.RuleType == RuleBaseline:
+		check, _ := actualValue.(BaselineCheck)
+		return fmt.Sprintf("This job ran successfully, but %s was %s, unusual compared with its recent runs.\nYour rule alerts when %s.\nBaseline: %s",
+			RuleSubject(rule), formatNumber(check.Value), DescribeRule(rule), check.DescribeBaseline())
+	case rule.RuleType == RuleExpression:
+		return fmt.Sprintf("This job ran successfully, but the output indicates a problem.\nYour rule alerts when %s.\nValues: %s",
+			rule.Expression, FormatMetricValue(actualValue))
+	case rule.Target == TargetDuration:
+		return fmt.Sprintf("This job took %dms to run, and your rule alerts when %s.", run.DurationMs, DescribeRule(rule))
+	case rule.Target == TargetStderr:
+		return fmt.Sprintf("The job's error output matched your rule (%s).\nMatching line: %s", DescribeRule(rule), FormatMetricValue(actualValue))
+	case rule.RuleType == RuleAbsent:
+		return fmt.Sprintf("This job ran successfully, but it did not report the metric %s.", rule.MetricName)
+	default:
+		return fmt.Sprintf("This job ran successfully, but the output indicates a problem.\nIt returned %s %s, and your rule alerts when %s.",
+			rule.MetricName, FormatMetricValue(actualValue), DescribeRule(rule))
+	}
+}
 
-	err = db.GetDB().QueryRow(`
-		SELECT created_at, duration_ms, metrics 
+// lastSuccessfulRun returns the latest OK run before t, or nil.
+func lastSuccessfulRun(jobID string, before time.Time) *models.JobRun {
+	var run models.JobRun
+	var metricsRaw []byte
+	err := db.GetDB().QueryRow(`
+		SELECT id, created_at, COALESCE(duration_ms, 0), metrics
 		FROM job_runs 
 		WHERE job_id = $1 AND status = 'ok' AND created_at < $2 
 		ORDER BY created_at DESC LIMIT 1
-	`, job.ID, run.CreatedAt).Scan(&lastRunTime, &lastDuration, &lastMetricsRaw)
-
+	`, jobID, before).Scan(&run.ID, &run.CreatedAt, &run.DurationMs, &metricsRaw)
 	if err != nil {
-		lastStatusInfo = "None found (this job has never succeeded)"
-	} else {
-		// Pretty print last metrics
-		// Create a temporary map to marshal/unmarshal for pretty printing if needed, or just print string
-		// But JSONB comes out as bytes.
-		lastStatusInfo = fmt.Sprintf("Time: %s\nDuration: %dms\nMetrics: %s",
-			lastRunTime.Format(time.RFC3339),
-			lastDuration,
-			string(lastMetricsRaw))
+		if err != sql.ErrNoRows {
+			fmt.Printf("Error fetching last successful run: %v\n", err)
+		}
+		return nil
 	}
-
-	// 5. Construct Email Content
-	// Subject Logic
-	var subject string
-	if run.Status == "fail" {
-		subject = fmt.Sprintf("[CRITICAL] %s failed", job.Name)
-	} else {
-		subject = fmt.Sprintf("[WARNING] %s ran but produced suspicious output", job.Name)
-	}
-	// Append metric context if short enough
-	if len(subject)+len(rule.MetricName)+10 < 80 {
-		subject += fmt.Sprintf(" (%s)", rule.MetricName)
+	run.JobID = jobID
+	run.Status = "ok"
+	if len(metricsRaw) > 0 {
+		_ = json.Unmarshal(metricsRaw, &run.Metrics)
 	}
+	return &run
+}
 
-	// Human Explanation
-	explanation := fmt.Sprintf("This job ran successfully, but the output indicates a problem.\nIt returned %s %f, while your rule expects %s %s %f.",
-		rule.MetricName, actualValue, rule.MetricName, rule.Operator, rule.ThresholdValue)
-	if run.Status == "fail" {
-		explanation = fmt.Sprintf("The job failed to complete successfully (Status: %s).", run.Status)
+// runAlertBody renders the plain-text alert for a specific run,
+// including the last successful run for context.
+func runAlertBody(job models.Job, run models.JobRun, lastSuccess *models.JobRun, subject, explanation, alertMessage, actualValue, stderr string) string {
+	lastStatusInfo := "None found (this job has never succeeded)"
+	if lastSuccess != nil {
+		lastMetricsJSON, _ := json.Marshal(lastSuccess.Metrics)
+		lastStatusInfo = fmt.Sprintf("Time: %s\nDuration: %dms\nMetrics: %s",
+			lastSuccess.CreatedAt.Format(time.RFC3339),
+			lastSuccess.DurationMs,
+			string(lastMetricsJSON))
 	}
 
 	metricsJSON, _ := json.MarshalIndent(run.Metrics, "", "  ")
@@ -109,7 +190,7 @@ Time: %s
 
 WHAT WENT WRONG:
 Rule violated: %s
-Actual value: %f
+Actual value: %s
 
 LAST SUCCESSFUL RUN:
 %s
@@ -137,15 +218,5 @@ Run ID: %s`,
 		run.ID,
 	)
 
-	from := mail.NewEmail("CronMonitor", alertEmail)
-	to := mail.NewEmail("Admin", alertEmail)
-	message := mail.NewSingleEmail(from, subject, to, plainTextContent, plainTextContent)
-	client := sendgrid.NewSendClient(apiKey)
-
-	response, err := client.Send(message)
-	if err != nil {
-		fmt.Printf("Error sending email: %v\n", err)
-	} else {
-		fmt.Printf("Email sent. Status Code: %d\n", response.StatusCode)
-	}
+	return plainTextContent
 }
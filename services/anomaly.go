@@ -0,0 +1,393 @@
+package services
+
+import (
+	"cronmonitor/config"
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// RuleBaseline compares a run with the job's own history instead of a
+// fixed threshold:
+//
+//	p50 | p95 | p99  value <op> stored percentile x factor (see baselines.go)
+//	mad              value deviates more than factor x MAD from the median
+//	                 of the last baseline_runs successful runs
+const RuleBaseline = "baseline"
+
+// Baseline statistics.
+const (
+	BaselineP50 = "p50"
+	BaselineP95 = "p95"
+	BaselineP99 = "p99"
+	BaselineMAD = "mad"
+)
+
+// Defaults and limits for baseline rules.
+const (
+	DefaultBaselineMinSamples = 10
+	DefaultBaselineRuns       = 30
+	maxBaselineRuns           = 1000
+)
+
+// BaselineCheck is the value a baseline rule reports: the run's value and
+// the baseline it was compared with. Skipped is set while the job has
+// fewer than min_samples samples. Bucket is the seasonal bucket used, or
+// empty when the rule fell back to (or only uses) the global baseline.
+type BaselineCheck struct {
+	Value      float64  `json:"value"`
+	Stat       string   `json:"stat"`
+	Bucket     string   `json:"bucket,omitempty"`
+	Baseline   float64  `json:"baseline"` // the percentile, or the median for mad
+	MAD        *float64 `json:"mad,omitempty"`
+	Low        *float64 `json:"low,omitempty"` // alert bounds
+	High       *float64 `json:"high,omitempty"`
+	SampleSize int      `json:"sample_size"`
+	Skipped    bool     `json:"skipped,omitempty"`
+	MinSamples int      `json:"min_samples,omitempty"`
+}
+
+func (c BaselineCheck) String() string {
+	if c.Skipped {
+		return fmt.Sprintf("skipped: %d of %d samples", c.SampleSize, c.MinSamples)
+	}
+	return FormatMetricValue(c.Value)
+}
+
+// DescribeBaseline renders the baseline used, e.g.
+// "p95 = 600000 over 42 runs (limit 900000)".
+func (c BaselineCheck) DescribeBaseline() string {
+	var limits string
+	switch {
+	case c.Low != nil && c.High != nil:
+		limits = fmt.Sprintf("expected %s to %s", formatNumber(*c.Low), formatNumber(*c.High))
+	case c.High != nil:
+		limits = fmt.Sprintf("limit %s", formatNumber(*c.High))
+	case c.Low != nil:
+		limits = fmt.Sprintf("limit %s", formatNumber(*c.Low))
+	}
+	runs := fmt.Sprintf("%d runs", c.SampleSize)
+	if c.Bucket != "" {
+		runs += " on " + DescribeBucket(c.Bucket)
+	}
+	if c.Stat == BaselineMAD {
+		return fmt.Sprintf("median = %s, MAD = %s over %s (%s)", formatNumber(c.Baseline), formatNumber(*c.MAD), runs, limits)
+	}
+	return fmt.Sprintf("%s = %s over %s (%s)", c.Stat, formatNumber(c.Baseline), runs, limits)
+}
+
+func formatNumber(f float64) string {
+	return fmt.Sprintf("%g", f)
+}
+
+// validateBaselineRule checks a rule_type baseline rule (after defaults).
+func validateBaselineRule(rule models.Rule) error {
+	switch rule.Target {
+	case "", TargetMetric, TargetDuration:
+	default:
+		return fmt.Errorf("baseline rules need target metric or duration")
+	}
+	if rule.ThresholdHigh != nil || rule.ThresholdText != nil {
+		return fmt.Errorf("baseline rules take factor instead of thresholds")
+	}
+	if rule.BaselineFactor <= 0 {
+		return fmt.Errorf("baseline rules need a positive factor")
+	}
+	if rule.MinSamples < 1 {
+		return fmt.Errorf("min_samples must be at least 1")
+	}
+	if rule.Seasonality != "" && !validSeasonality(rule.Seasonality) {
+		return fmt.Errorf("unknown seasonality %q (expected weekday, hour or day_of_month)", rule.Seasonality)
+	}
+
+	switch rule.Baseline {
+	case BaselineP50, BaselineP95, BaselineP99:
+		if rule.Operator != ">" && rule.Operator != "<" {
+			return fmt.Errorf("percentile baselines use > or <")
+		}
+		if rule.BaselineRuns != 0 {
+			return fmt.Errorf("baseline_runs is only used by mad (percentiles come from the job's baselines)")
+		}
+	case BaselineMAD:
+		if rule.Operator != ">" && rule.Operator != "<" && rule.Operator != "outside" {
+			return fmt.Errorf("mad baselines use >, < or outside")
+		}
+		if rule.BaselineRuns < 2 || rule.BaselineRuns > maxBaselineRuns {
+			return fmt.Errorf("baseline_runs must be between 2 and %d", maxBaselineRuns)
+		}
+		if rule.MinSamples > rule.BaselineRuns {
+			return fmt.Errorf("min_samples must be <= baseline_runs")
+		}
+	default:
+		return fmt.Errorf("unknown baseline %q (expected p50, p95, p99 or mad)", rule.Baseline)
+	}
+	return nil
+}
+
+// describeBaselineCondition renders e.g. "duration_ms > p95 x 1.5" or
+// "rows outside median +/- 3 MAD".
+func describeBaselineCondition(rule models.Rule) string {
+	subject := RuleSubject(rule)
+	if rule.Baseline == BaselineMAD {
+		switch rule.Operator {
+		case ">":
+			return fmt.Sprintf("%s > median + %g MAD", subject, rule.BaselineFactor)
+		case "<":
+			return fmt.Sprintf("%s < median - %g MAD", subject, rule.BaselineFactor)
+		default:
+			return fmt.Sprintf("%s outside median +/- %g MAD", subject, rule.BaselineFactor)
+		}
+	}
+	return fmt.Sprintf("%s %s %s x %g", subject, rule.Operator, rule.Baseline, rule.BaselineFactor)
+}
+
+// CheckRuleFeatures reports whether the features a new rule depends on
+// are turned on. Without the worker no percentile baseline is ever
+// stored, so a new p50/p95/p99 rule would be skipped on every run.
+// Existing rules can still be edited and backtested (backtests compute
+// their own baselines).
+func CheckRuleFeatures(rule models.Rule) error {
+	if isPercentileRule(rule) && !config.LoadFeatures().BaselinesEnabled {
+		return fmt.Errorf("percentile baselines need BASELINES_ENABLED=true (mad reads past runs directly)")
+	}
+	return nil
+}
+
+func isPercentileRule(rule models.Rule) bool {
+	if rule.RuleType != RuleBaseline {
+		return false
+	}
+	switch rule.Baseline {
+	case BaselineP50, BaselineP95, BaselineP99:
+		return true
+	}
+	return false
+}
+
+// evaluateBaselineRule fails open like threshold rules: a missing value or
+// too few samples never fires. Percentile rules are skipped while the
+// worker is off, since the stored baselines are no longer refreshed.
+func evaluateBaselineRule(run models.JobRun, rule models.Rule) (bool, interface{}) {
+	if isPercentileRule(rule) && !config.LoadFeatures().BaselinesEnabled {
+		fmt.Printf("Rule %s: skipped, percentile baselines need BASELINES_ENABLED=true\n", rule.ID)
+		return false, nil
+	}
+	return evaluateBaselineRuleWith(run, rule, &storedBaselines{run: run, rule: rule})
+}
+
+// baselineSource is the history a run is compared with: the stored
+// baselines and past runs (storedBaselines), or the ones a backtest
+// replays in memory (see baselineHistory).
+type baselineSource interface {
+	// location is the job's timezone, for seasonal buckets
+	location() *time.Location
+	// baseline returns the percentiles of bucket ("" for all runs), or
+	// nil if there are none
+	baseline(bucket string) *models.Baseline
+	// samples returns the rule's values of the last baseline_runs
+	// successful runs before the run, newest first; with bucket set, only
+	// those in the bucket among the last baselineMaxRuns runs
+	samples(bucket string) []float64
+}
+
+// storedBaselines reads the history of run from the database.
+type storedBaselines struct {
+	run  models.JobRun
+	rule models.Rule
+	loc  *time.Location
+}
+
+func (s *storedBaselines) location() *time.Location {
+	if s.loc == nil {
+		s.loc = jobLocation(s.run.JobID)
+	}
+	return s.loc
+}
+
+func (s *storedBaselines) baseline(bucket string) *models.Baseline {
+	return loadRuleBaseline(s.run.JobID, s.rule, bucket)
+}
+
+func (s *storedBaselines) samples(bucket string) []float64 {
+	var match func(time.Time) bool
+	if bucket != "" {
+		loc := s.location()
+		match = func(t time.Time) bool {
+			return seasonBucket(s.rule.Seasonality, t.In(loc)) == bucket
+		}
+	}
+	return loadRuleSamples(s.run, s.rule, match)
+}
+
+// evaluateBaselineRuleWith compares the run with the history in src.
+func evaluateBaselineRuleWith(run models.JobRun, rule models.Rule, src baselineSource) (bool, interface{}) {
+	value, ok := ruleValue(run, rule)
+	if !ok || value == nil {
+		return false, nil
+	}
+	numValue, ok := toFloat64(value)
+	if !ok {
+		return false, value
+	}
+
+	if rule.Baseline == BaselineMAD {
+		return evaluateMADRule(run, rule, numValue, src)
+	}
+
+	check := BaselineCheck{Value: numValue, Stat: rule.Baseline, MinSamples: rule.MinSamples}
+	var baseline *models.Baseline
+	if rule.Seasonality != "" {
+		check.Bucket = seasonBucket(rule.Seasonality, run.CreatedAt.In(src.location()))
+		baseline = src.baseline(check.Bucket)
+	}
+	if baseline == nil || baseline.SampleSize < rule.MinSamples {
+		// Bucket too thin (or no seasonality): use the global baseline
+		check.Bucket = ""
+		baseline = src.baseline("")
+	}
+	if baseline != nil {
+		check.SampleSize = baseline.SampleSize
+	}
+	if baseline == nil || baseline.SampleSize < rule.MinSamples {
+		check.Skipped = true
+		return false, check
+	}
+	check.MinSamples = 0
+
+	switch rule.Baseline {
+	case BaselineP50:
+		check.Baseline = baseline.P50
+	case BaselineP95:
+		check.Baseline = baseline.P95
+	case BaselineP99:
+		check.Baseline = baseline.P99
+	}
+	limit := check.Baseline * rule.BaselineFactor
+	if rule.Operator == "<" {
+		check.Low = &limit
+		return numValue < limit, check
+	}
+	check.High = &limit
+	return numValue > limit, check
+}
+
+func loadRuleBaseline(jobID string, rule models.Rule, bucket string) *models.Baseline {
+	baseline, err := LoadBaseline(jobID, RuleSubject(rule), bucket)
+	if err != nil {
+		fmt.Printf("Rule %s: loading baseline: %v\n", rule.ID, err)
+	}
+	return baseline
+}
+
+// evaluateMADRule compares the value with the median absolute deviation
+// of the last baseline_runs successful runs before this one.
+func evaluateMADRule(run models.JobRun, rule models.Rule, numValue float64, src baselineSource) (bool, interface{}) {
+	check := BaselineCheck{Value: numValue, Stat: BaselineMAD, MinSamples: rule.MinSamples}
+
+	var samples []float64
+	if rule.Seasonality != "" {
+		check.Bucket = seasonBucket(rule.Seasonality, run.CreatedAt.In(src.location()))
+		samples = src.samples(check.Bucket)
+	}
+	if len(samples) < rule.MinSamples {
+		// Bucket too thin (or no seasonality): use the last runs overall
+		check.Bucket = ""
+		samples = src.samples("")
+	}
+	check.SampleSize = len(samples)
+	if len(samples) < rule.MinSamples {
+		check.Skipped = true
+		return false, check
+	}
+	check.MinSamples = 0
+
+	median, mad := medianAbsoluteDeviation(samples)
+	check.Baseline = median
+	check.MAD = &mad
+	low := median - rule.BaselineFactor*mad
+	high := median + rule.BaselineFactor*mad
+
+	switch rule.Operator {
+	case ">":
+		check.High = &high
+		return numValue > high, check
+	case "<":
+		check.Low = &low
+		return numValue < low, check
+	default:
+		check.Low, check.High = &low, &high
+		return numValue < low || numValue > high, check
+	}
+}
+
+// medianAbsoluteDeviation returns the median of samples and the median
+// of their distances from it. samples is sorted in place.
+func medianAbsoluteDeviation(samples []float64) (median, mad float64) {
+	sort.Float64s(samples)
+	median = percentile(samples, 0.5)
+	deviations := make([]float64, len(samples))
+	for i, s := range samples {
+		deviations[i] = math.Abs(s - median)
+	}
+	sort.Float64s(deviations)
+	return median, percentile(deviations, 0.5)
+}
+
+func loadRuleSamples(run models.JobRun, rule models.Rule, match func(time.Time) bool) []float64 {
+	samples, err := recentRuleSamples(run, rule, match)
+	if err != nil {
+		fmt.Printf("Rule %s: loading samples: %v\n", rule.ID, err)
+	}
+	return samples
+}
+
+// recentRuleSamples reads the rule's value from the last baseline_runs
+// successful runs created before run. With match set, only runs whose
+// time matches count (scanning at most baselineMaxRuns runs).
+func recentRuleSamples(run models.JobRun, rule models.Rule, match func(time.Time) bool) ([]float64, error) {
+	limit := rule.BaselineRuns
+	if match != nil {
+		limit = baselineMaxRuns
+	}
+	rows, err := db.GetDB().Query(`
+		SELECT duration_ms, metrics, created_at
+		FROM job_runs
+		WHERE job_id = $1 AND status = 'ok' AND id::text <> $2
+		AND created_at <= $3
+		ORDER BY created_at DESC
+		LIMIT $4
+	`, run.JobID, run.ID, run.CreatedAt, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var samples []float64
+	for rows.Next() && len(samples) < rule.BaselineRuns {
+		var past models.JobRun
+		var duration *int
+		var metricsJSON []byte
+		if err := rows.Scan(&duration, &metricsJSON, &past.CreatedAt); err != nil {
+			return nil, err
+		}
+		if match != nil && !match(past.CreatedAt) {
+			continue
+		}
+		if duration != nil {
+			past.DurationMs = *duration
+		} else if rule.Target == TargetDuration {
+			continue
+		}
+		if len(metricsJSON) > 0 {
+			_ = json.Unmarshal(metricsJSON, &past.Metrics)
+		}
+		if f, ok := ruleSample(past, rule); ok {
+			samples = append(samples, f)
+		}
+	}
+	return samples, rows.Err()
+}
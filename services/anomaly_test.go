@@ -0,0 +1,123 @@
+package services
+
+import (
+	"cronmonitor/models"
+	"strings"
+	"testing"
+)
+
+func TestValidateBaselineRule(t *testing.T) {
+	p95 := models.Rule{RuleType: RuleBaseline, Target: TargetDuration, Baseline: BaselineP95, Operator: ">", BaselineFactor: 1.5, MinSamples: 10}
+	mad := models.Rule{RuleType: RuleBaseline, MetricName: "rows", Baseline: BaselineMAD, Operator: "outside", BaselineFactor: 3, BaselineRuns: 30, MinSamples: 10}
+	with := func(r models.Rule, f func(*models.Rule)) models.Rule { f(&r); return r }
+
+	tests := []struct {
+		name      string
+		rule      models.Rule
+		baselines bool // BASELINES_ENABLED
+		err       string
+	}{
+		{"percentile", p95, true, ""},
+		{"percentile without worker", p95, false, ""}, // only CreateRule needs the worker
+		{"mad without worker", mad, false, ""},
+		{"mad", mad, true, ""},
+		{"seasonal", with(p95, func(r *models.Rule) { r.Seasonality = SeasonWeekday }), true, ""},
+		{"bad seasonality", with(p95, func(r *models.Rule) { r.Seasonality = "month" }), true, "unknown seasonality"},
+		{"unknown stat", with(p95, func(r *models.Rule) { r.Baseline = "p90" }), true, "unknown baseline"},
+		{"no factor", with(p95, func(r *models.Rule) { r.BaselineFactor = 0 }), true, "positive factor"},
+		{"percentile outside", with(p95, func(r *models.Rule) { r.Operator = "outside" }), true, "use > or <"},
+		{"percentile runs", with(p95, func(r *models.Rule) { r.BaselineRuns = 10 }), true, "only used by mad"},
+		{"stderr target", with(p95, func(r *models.Rule) { r.Target = TargetStderr }), true, "target metric or duration"},
+		{"thresholds", with(p95, func(r *models.Rule) { r.ThresholdHigh = float(1) }), true, "factor instead of thresholds"},
+		{"mad one run", with(mad, func(r *models.Rule) { r.BaselineRuns, r.MinSamples = 1, 1 }), true, "baseline_runs must be between"},
+		{"mad min above runs", with(mad, func(r *models.Rule) { r.MinSamples = 31 }), true, "min_samples must be <= baseline_runs"},
+		{"mad ==", with(mad, func(r *models.Rule) { r.Operator = "==" }), true, "mad baselines use"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.baselines {
+				t.Setenv("BASELINES_ENABLED", "true")
+			} else {
+				t.Setenv("BASELINES_ENABLED", "")
+			}
+			err := ValidateRule(tt.rule)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCheckRuleFeatures(t *testing.T) {
+	p95 := models.Rule{RuleType: RuleBaseline, Target: TargetDuration, Baseline: BaselineP95, Operator: ">", BaselineFactor: 1.5, MinSamples: 10}
+	mad := models.Rule{RuleType: RuleBaseline, MetricName: "rows", Baseline: BaselineMAD, Operator: "outside", BaselineFactor: 3, BaselineRuns: 30, MinSamples: 10}
+	threshold := models.Rule{RuleType: RuleThreshold, MetricName: "rows", Operator: ">", ThresholdValue: 1}
+
+	t.Setenv("BASELINES_ENABLED", "")
+	if err := CheckRuleFeatures(p95); err == nil || !strings.Contains(err.Error(), "BASELINES_ENABLED=true") {
+		t.Errorf("percentile without worker: err = %v", err)
+	}
+	for _, rule := range []models.Rule{mad, threshold} {
+		if err := CheckRuleFeatures(rule); err != nil {
+			t.Errorf("%s rule: %v", rule.RuleType, err)
+		}
+	}
+	// Existing percentile rules are skipped instead of using stale baselines
+	if violated, value := evaluateBaselineRule(models.JobRun{DurationMs: 1}, p95); violated || value != nil {
+		t.Errorf("evaluate without worker = %v, %v", violated, value)
+	}
+
+	t.Setenv("BASELINES_ENABLED", "true")
+	if err := CheckRuleFeatures(p95); err != nil {
+		t.Errorf("percentile with worker: %v", err)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 0.5, 0},
+		{[]float64{}, 0.95, 0},
+		{[]float64{7}, 0.5, 7},
+		{[]float64{7}, 0.99, 7},
+		{[]float64{1, 2}, 0.5, 1.5},
+		{[]float64{1, 2, 3}, 0.5, 2},
+		{[]float64{1, 2, 3, 4}, 0.5, 2.5},
+		{[]float64{100, 200, 300, 400, 500}, 0.95, 480},
+		{[]float64{100, 200, 300, 400, 500}, 0, 100},
+		{[]float64{100, 200, 300, 400, 500}, 1, 500},
+		{[]float64{5, 5, 5}, 0.99, 5},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.sorted, tt.p); got != tt.want {
+			t.Errorf("percentile(%v, %g) = %g, want %g", tt.sorted, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestMedianAbsoluteDeviation(t *testing.T) {
+	tests := []struct {
+		name        string
+		samples     []float64
+		median, mad float64
+	}{
+		{"empty", nil, 0, 0},
+		{"single", []float64{42}, 42, 0},
+		{"constant", []float64{10, 10, 10, 10}, 10, 0},
+		{"one outlier", []float64{10, 10, 10, 10, 1000}, 10, 0},
+		{"unsorted", []float64{9, 1, 5, 3, 7}, 5, 2},
+		{"even count", []float64{1, 2, 3, 4}, 2.5, 1},
+	}
+	for _, tt := range tests {
+		median, mad := medianAbsoluteDeviation(append([]float64(nil), tt.samples...))
+		if median != tt.median || mad != tt.mad {
+			t.Errorf("%s: median, MAD = %g, %g; want %g, %g", tt.name, median, mad, tt.median, tt.mad)
+		}
+	}
+}
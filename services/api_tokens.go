@@ -0,0 +1,165 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// API tokens look like "ar_<64 hex chars>". The prefix (the first
+// apiTokenPrefixLength characters) is stored in clear so users can tell
+// tokens apart; the token itself only as a SHA-256 hash.
+const (
+	APITokenPrefix       = "ar_"
+	apiTokenPrefixLength = 11
+)
+
+// API token scopes. Every token can read; writes need the matching scope.
+const (
+	ScopeRead       = "read"
+	ScopeJobsWrite  = "jobs:write"
+	ScopeRulesWrite = "rules:write"
+)
+
+var apiTokenScopes = map[string]bool{ScopeRead: true, ScopeJobsWrite: true, ScopeRulesWrite: true}
+
+// Errors returned by AuthenticateAPIToken.
+var (
+	ErrAPITokenInvalid = errors.New("invalid API token")
+	ErrAPITokenExpired = errors.New("API token expired")
+)
+
+// ValidateAPITokenScopes checks that scopes is a non-empty list of known scopes.
+func ValidateAPITokenScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required (read, jobs:write, rules:write)")
+	}
+	for _, s := range scopes {
+		if !apiTokenScopes[s] {
+			return fmt.Errorf("unknown scope %q (expected read, jobs:write or rules:write)", s)
+		}
+	}
+	return nil
+}
+
+// HasScope reports whether scopes grants scope (read is always granted).
+func HasScope(scopes []string, scope string) bool {
+	if scope == ScopeRead {
+		return true
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// hashToken is the stored form of a random token (API tokens,
+// invitations, auth links).
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIToken stores a new token for the user and returns it with the
+// plaintext Token set. The plaintext is not kept anywhere.
+func CreateAPIToken(userID, name string, scopes []string, expiresAt *time.Time) (models.APIToken, error) {
+	t := models.APIToken{UserID: userID, Name: name, Scopes: scopes, ExpiresAt: expiresAt}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return t, err
+	}
+	t.Token = APITokenPrefix + hex.EncodeToString(b)
+	t.Prefix = t.Token[:apiTokenPrefixLength]
+
+	err := db.GetDB().QueryRow(`
+		INSERT INTO api_tokens (user_id, name, prefix, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, userID, name, t.Prefix, hashToken(t.Token), pq.Array(scopes), expiresAt).Scan(&t.ID, &t.CreatedAt)
+	return t, err
+}
+
+// ListAPITokens returns the user's tokens (without secrets), newest first.
+func ListAPITokens(userID string) ([]models.APIToken, error) {
+	rows, err := db.GetDB().Query(`
+		SELECT id, name, prefix, scopes, expires_at, last_used_at, revoked_at, created_at
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		t := models.APIToken{UserID: userID}
+		if err := rows.Scan(&t.ID, &t.Name, &t.Prefix, pq.Array(&t.Scopes), &t.ExpiresAt, &t.LastUsedAt, &t.RevokedAt, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken disables a token. Returns false if the user has no such
+// active token.
+func RevokeAPIToken(userID, id string) (bool, error) {
+	res, err := db.GetDB().Exec(`
+		UPDATE api_tokens SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// IsAPIToken reports whether a bearer credential is an API token (not a JWT).
+func IsAPIToken(token string) bool {
+	return strings.HasPrefix(token, APITokenPrefix)
+}
+
+// AuthenticateAPIToken resolves a token to its user and scopes and
+// records the use (at most once a minute per token).
+func AuthenticateAPIToken(token string) (userID, email string, scopes []string, err error) {
+	var expiresAt *time.Time
+	var tokenID string
+	err = db.GetDB().QueryRow(`
+		SELECT t.id, t.user_id, u.email, t.scopes, t.expires_at
+		FROM api_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND t.revoked_at IS NULL
+	`, hashToken(token)).Scan(&tokenID, &userID, &email, pq.Array(&scopes), &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", "", nil, ErrAPITokenInvalid
+	} else if err != nil {
+		return "", "", nil, err
+	}
+	if expiresAt != nil && time.Now().After(*expiresAt) {
+		return "", "", nil, ErrAPITokenExpired
+	}
+
+	_, err = db.GetDB().Exec(`
+		UPDATE api_tokens SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+	`, tokenID)
+	if err != nil {
+		fmt.Printf("Error updating API token last use: %v\n", err)
+	}
+	return userID, email, scopes, nil
+}
@@ -0,0 +1,57 @@
+package services
+
+import "testing"
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		scope  string
+		want   bool
+	}{
+		{nil, ScopeRead, true},
+		{[]string{ScopeRead}, ScopeRead, true},
+		{[]string{ScopeRead}, ScopeJobsWrite, false},
+		{[]string{ScopeRead}, ScopeRulesWrite, false},
+		{[]string{ScopeJobsWrite}, ScopeJobsWrite, true},
+		{[]string{ScopeJobsWrite}, ScopeRulesWrite, false},
+		{[]string{ScopeRulesWrite}, ScopeJobsWrite, false},
+		{[]string{ScopeRead, ScopeRulesWrite}, ScopeRulesWrite, true},
+		{[]string{"*"}, ScopeJobsWrite, false},
+	}
+	for _, tt := range tests {
+		if got := HasScope(tt.scopes, tt.scope); got != tt.want {
+			t.Errorf("HasScope(%v, %s) = %v, want %v", tt.scopes, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestValidateAPITokenScopes(t *testing.T) {
+	for _, scopes := range [][]string{
+		{ScopeRead},
+		{ScopeJobsWrite, ScopeRulesWrite},
+	} {
+		if err := ValidateAPITokenScopes(scopes); err != nil {
+			t.Errorf("%v: %v", scopes, err)
+		}
+	}
+	for _, scopes := range [][]string{
+		nil,
+		{},
+		{"admin"},
+		{ScopeRead, "jobs:delete"},
+		{"READ"},
+	} {
+		if err := ValidateAPITokenScopes(scopes); err == nil {
+			t.Errorf("%v accepted", scopes)
+		}
+	}
+}
+
+func TestIsAPIToken(t *testing.T) {
+	if !IsAPIToken(APITokenPrefix + "abc") {
+		t.Error("API token not recognized")
+	}
+	if IsAPIToken("eyJhbGciOiJIUzI1NiJ9.e30.sig") {
+		t.Error("JWT taken for an API token")
+	}
+}
@@ -0,0 +1,299 @@
+package services
+
+import (
+	"bytes"
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Auth token purposes.
+const (
+	TokenVerifyEmail    = "verify_email"   // a user's account address
+	TokenVerifyChannel  = "verify_channel" // an email channel's address
+	TokenResetPassword  = "reset_password"
+	TokenLoginChallenge = "login_2fa" // between password and second factor
+)
+
+const (
+	verifyTokenTTL = 48 * time.Hour
+	resetTokenTTL  = time.Hour
+	// At most one reset email per account per resetThrottle
+	resetThrottle = time.Minute
+)
+
+var ErrAuthTokenInvalid = errors.New("link is invalid, expired or already used")
+
+// Email templates. Links point at the pages in templates/, which post the
+// token to /api/auth/verify or /api/auth/reset.
+var authEmails = template.Must(template.New("").Parse(`
+{{define "verify_email_subject"}}Confirm your AfterRun email address{{end}}
+{{define "verify_email"}}Welcome to AfterRun!
+
+Please confirm {{.Email}} by opening this link:
+
+{{.URL}}
+
+The link expires in 48 hours. Until you confirm, alerts are not emailed
+to this address.
+{{end}}
+{{define "verify_channel_subject"}}Confirm alerts to {{.Email}}{{end}}
+{{define "verify_channel"}}Someone added {{.Email}} as an alert channel on AfterRun.
+
+To start receiving alerts at this address, open this link:
+
+{{.URL}}
+
+The link expires in 48 hours. If you did not expect this, ignore this
+email and no alerts will be sent to you.
+{{end}}
+{{define "reset_password_subject"}}Reset your AfterRun password{{end}}
+{{define "reset_password"}}Someone asked to reset the password of your AfterRun account ({{.Email}}).
+
+Choose a new password here:
+
+{{.URL}}
+
+The link expires in 1 hour and works once. If you did not ask for this,
+ignore this email; your password stays the same.
+{{end}}
+`))
+
+// authTokenPages maps a purpose to the page its link opens.
+var authTokenPages = map[string]string{
+	TokenVerifyEmail:   "/verify-email",
+	TokenVerifyChannel: "/verify-email",
+	TokenResetPassword: "/reset-password",
+}
+
+// issueAuthToken stores a new token and sends its link. Earlier unused
+// tokens for the same purpose and user/channel stop working. Links are
+// built from APP_URL only, never from the request's Host header, so a
+// forged Host cannot redirect reset links.
+func issueAuthToken(purpose, userID, channelID, email string, ttl time.Duration) error {
+	base := strings.TrimRight(os.Getenv("APP_URL"), "/")
+	if base == "" {
+		return fmt.Errorf("APP_URL not set, cannot build the %s link", purpose)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		UPDATE auth_tokens SET used_at = NOW()
+		WHERE purpose = $1 AND used_at IS NULL
+		AND (user_id::text = $2 OR channel_id::text = $3)
+	`, purpose, userID, channelID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO auth_tokens (purpose, user_id, channel_id, email, token_hash, expires_at)
+		VALUES ($1, NULLIF($2, '')::uuid, NULLIF($3, '')::uuid, $4, $5, $6)
+	`, purpose, userID, channelID, email, hashToken(token), time.Now().Add(ttl)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	data := struct{ Email, URL string }{email, base + authTokenPages[purpose] + "?token=" + token}
+	var subject, body bytes.Buffer
+	if err := authEmails.ExecuteTemplate(&subject, purpose+"_subject", data); err != nil {
+		return err
+	}
+	if err := authEmails.ExecuteTemplate(&body, purpose, data); err != nil {
+		return err
+	}
+	_, err = SendEmail(email, subject.String(), body.String())
+	return err
+}
+
+type authToken struct {
+	ID        string
+	Purpose   string
+	UserID    sql.NullString
+	ChannelID sql.NullString
+	Email     string
+}
+
+// consumeAuthToken marks a valid token as used and returns it.
+func consumeAuthToken(tx *sql.Tx, token string, purposes ...string) (authToken, error) {
+	var t authToken
+	err := tx.QueryRow(`
+		UPDATE auth_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING id, purpose, user_id, channel_id, email
+	`, hashToken(token)).Scan(&t.ID, &t.Purpose, &t.UserID, &t.ChannelID, &t.Email)
+	if err == sql.ErrNoRows {
+		return t, ErrAuthTokenInvalid
+	} else if err != nil {
+		return t, err
+	}
+	for _, p := range purposes {
+		if t.Purpose == p {
+			return t, nil
+		}
+	}
+	return t, ErrAuthTokenInvalid
+}
+
+// SendVerificationEmail emails the user a link to confirm their address.
+func SendVerificationEmail(userID, email string) error {
+	return issueAuthToken(TokenVerifyEmail, userID, "", email, verifyTokenTTL)
+}
+
+// SendChannelVerificationEmail emails a link that enables an email channel.
+func SendChannelVerificationEmail(channelID, email string) error {
+	return issueAuthToken(TokenVerifyChannel, "", channelID, email, verifyTokenTTL)
+}
+
+// VerifyEmail confirms the address a verification link was sent to.
+// The account or channel must still use that address.
+func VerifyEmail(token string) (purpose string, err error) {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	t, err := consumeAuthToken(tx, token, TokenVerifyEmail, TokenVerifyChannel)
+	if err != nil {
+		return "", err
+	}
+
+	var res sql.Result
+	if t.Purpose == TokenVerifyEmail {
+		res, err = tx.Exec(`
+			UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW())
+			WHERE id = $1 AND lower(email) = lower($2)
+		`, t.UserID, t.Email)
+	} else {
+		res, err = tx.Exec(`
+			UPDATE notification_channels SET verified_at = COALESCE(verified_at, NOW())
+			WHERE id = $1 AND lower(config->>'email') = lower($2)
+		`, t.ChannelID, t.Email)
+	}
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", ErrAuthTokenInvalid // address changed since
+	}
+	return t.Purpose, tx.Commit()
+}
+
+// RequestPasswordReset emails a reset link if an account uses email.
+// Unknown addresses are not an error, so callers cannot tell them apart.
+func RequestPasswordReset(email string) error {
+	var userID, accountEmail string
+	var recent bool
+	err := db.GetDB().QueryRow(`
+		SELECT u.id, u.email, EXISTS (
+			SELECT 1 FROM auth_tokens t
+			WHERE t.user_id = u.id AND t.purpose = $2 AND t.created_at > NOW() - $3 * INTERVAL '1 second'
+		)
+		FROM users u
+		WHERE lower(u.email) = lower($1)
+	`, email, TokenResetPassword, int(resetThrottle.Seconds())).Scan(&userID, &accountEmail, &recent)
+	if err == sql.ErrNoRows || recent {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return issueAuthToken(TokenResetPassword, userID, "", accountEmail, resetTokenTTL)
+}
+
+// ResetPassword sets a new password with a reset token. Sessions issued
+// before the change stop working. Receiving the link also proves the
+// address, so it is marked verified.
+func ResetPassword(token, passwordHash string) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	t, err := consumeAuthToken(tx, token, TokenResetPassword)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`
+		UPDATE users
+		SET password_hash = $2, password_changed_at = NOW(),
+			email_verified_at = CASE WHEN lower(email) = lower($3) THEN COALESCE(email_verified_at, NOW()) ELSE email_verified_at END
+		WHERE id = $1
+	`, t.UserID, passwordHash, t.Email)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAuthTokenInvalid
+	}
+	return tx.Commit()
+}
+
+// SessionValid reports whether a session issued at issuedAt (Unix
+// seconds) is still valid, i.e. does not predate the user's last
+// password change.
+func SessionValid(userID string, issuedAt int64) (bool, error) {
+	var changedAt sql.NullTime
+	err := db.GetDB().QueryRow("SELECT password_changed_at FROM users WHERE id::text = $1", userID).Scan(&changedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !changedAt.Valid || changedAt.Time.Unix() <= issuedAt, nil
+}
+
+// isOwnVerifiedEmail reports whether email is the verified address of
+// the user, who then needs no link to confirm it for a channel.
+func isOwnVerifiedEmail(userID, email string) (bool, error) {
+	var ok bool
+	err := db.GetDB().QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM users
+			WHERE id::text = $1 AND lower(email) = lower($2) AND email_verified_at IS NOT NULL
+		)
+	`, userID, email).Scan(&ok)
+	return ok, err
+}
+
+// StartChannelVerification confirms a new or changed email channel right
+// away when its address is the verified email of userID, the user adding
+// it, and otherwise emails a confirmation link. Another account's address
+// is not enough: its owner has to consent. Until then the channel
+// receives no alerts.
+func StartChannelVerification(ch *models.NotificationChannel, userID string) error {
+	if ch.Type != ChannelEmail {
+		return nil
+	}
+	ok, err := isOwnVerifiedEmail(userID, ch.Config.Email)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return SendChannelVerificationEmail(ch.ID, ch.Config.Email)
+	}
+	return db.GetDB().QueryRow(
+		"UPDATE notification_channels SET verified_at = NOW() WHERE id = $1 RETURNING verified_at", ch.ID,
+	).Scan(&ch.VerifiedAt)
+}
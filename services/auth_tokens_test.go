@@ -0,0 +1,194 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyEmailLink(t *testing.T) {
+	testDB(t)
+	emails := smtpSink(t)
+	t.Setenv("APP_URL", "https://afterrun.test/")
+
+	userID, email := testUser(t, "example.com", false)
+	if err := SendVerificationEmail(userID, email); err != nil {
+		t.Fatal(err)
+	}
+	e := nextEmail(t, emails)
+	if e.To != email || !strings.Contains(e.Data, "https://afterrun.test/verify-email?token=") {
+		t.Fatalf("email to %s: %q", e.To, e.Data)
+	}
+	token := emailToken(t, e)
+
+	purpose, err := VerifyEmail(token)
+	if err != nil || purpose != TokenVerifyEmail {
+		t.Fatalf("VerifyEmail = %q, %v", purpose, err)
+	}
+	var verified bool
+	db.GetDB().QueryRow("SELECT email_verified_at IS NOT NULL FROM users WHERE id = $1", userID).Scan(&verified)
+	if !verified {
+		t.Error("email not verified")
+	}
+	if _, err := VerifyEmail(token); err != ErrAuthTokenInvalid {
+		t.Errorf("second use: err = %v, want ErrAuthTokenInvalid", err)
+	}
+	if err := ResetPassword(token, "x"); err != ErrAuthTokenInvalid {
+		t.Errorf("as reset token: err = %v, want ErrAuthTokenInvalid", err)
+	}
+}
+
+func TestVerifyEmailSuperseded(t *testing.T) {
+	testDB(t)
+	emails := smtpSink(t)
+	t.Setenv("APP_URL", "https://afterrun.test")
+
+	userID, email := testUser(t, "example.com", false)
+	SendVerificationEmail(userID, email)
+	first := emailToken(t, nextEmail(t, emails))
+	SendVerificationEmail(userID, email)
+	second := emailToken(t, nextEmail(t, emails))
+
+	if _, err := VerifyEmail(first); err != ErrAuthTokenInvalid {
+		t.Errorf("earlier link: err = %v, want ErrAuthTokenInvalid", err)
+	}
+	if _, err := VerifyEmail(second); err != nil {
+		t.Errorf("latest link: %v", err)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	testDB(t)
+	emails := smtpSink(t)
+	t.Setenv("APP_URL", "https://afterrun.test")
+
+	userID, email := testUser(t, "example.com", false)
+	issuedAt := time.Now().Add(-time.Hour).Unix()
+
+	if err := RequestPasswordReset(strings.ToUpper(email)); err != nil {
+		t.Fatal(err)
+	}
+	e := nextEmail(t, emails)
+	if e.To != email || !strings.Contains(e.Data, "https://afterrun.test/reset-password?token=") {
+		t.Fatalf("email to %s: %q", e.To, e.Data)
+	}
+	token := emailToken(t, e)
+
+	// Throttled, and unknown addresses get nothing
+	if err := RequestPasswordReset(email); err != nil {
+		t.Fatal(err)
+	}
+	if err := RequestPasswordReset("nobody-" + randomHex(t, 4) + "@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	noEmail(t, emails)
+
+	if err := ResetPassword(token, "new-hash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResetPassword(token, "other-hash"); err != ErrAuthTokenInvalid {
+		t.Errorf("second use: err = %v, want ErrAuthTokenInvalid", err)
+	}
+
+	var hash string
+	var verified bool
+	db.GetDB().QueryRow(
+		"SELECT password_hash, email_verified_at IS NOT NULL FROM users WHERE id = $1", userID,
+	).Scan(&hash, &verified)
+	if hash != "new-hash" || !verified {
+		t.Errorf("password_hash = %q, verified = %v", hash, verified)
+	}
+
+	if ok, _ := SessionValid(userID, issuedAt); ok {
+		t.Error("session issued before the reset is still valid")
+	}
+	if ok, _ := SessionValid(userID, time.Now().Add(time.Minute).Unix()); !ok {
+		t.Error("session issued after the reset is invalid")
+	}
+}
+
+func testEmailChannel(t *testing.T, userID, email string) models.NotificationChannel {
+	t.Helper()
+	ch := models.NotificationChannel{Type: ChannelEmail, Name: "test"}
+	ch.Config.Email = email
+	err := db.GetDB().QueryRow(`
+		INSERT INTO notification_channels (user_id, org_id, type, name, config)
+		VALUES ($1, $2, 'email', 'test', jsonb_build_object('email', $3::text))
+		RETURNING id
+	`, userID, personalOrg(t, userID), email).Scan(&ch.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func TestStartChannelVerification(t *testing.T) {
+	testDB(t)
+	emails := smtpSink(t)
+	t.Setenv("APP_URL", "https://afterrun.test")
+
+	userID, email := testUser(t, "example.com", true)
+	_, otherEmail := testUser(t, "example.com", true)
+	unverifiedID, unverifiedEmail := testUser(t, "example.com", false)
+
+	t.Run("own verified address", func(t *testing.T) {
+		ch := testEmailChannel(t, userID, strings.ToUpper(email))
+		if err := StartChannelVerification(&ch, userID); err != nil {
+			t.Fatal(err)
+		}
+		if ch.VerifiedAt == nil {
+			t.Error("channel not verified")
+		}
+		noEmail(t, emails)
+	})
+
+	t.Run("another account's address", func(t *testing.T) {
+		ch := testEmailChannel(t, userID, otherEmail)
+		if err := StartChannelVerification(&ch, userID); err != nil {
+			t.Fatal(err)
+		}
+		if ch.VerifiedAt != nil {
+			t.Error("channel verified without the address owner's consent")
+		}
+		e := nextEmail(t, emails)
+		if e.To != otherEmail {
+			t.Fatalf("confirmation sent to %s", e.To)
+		}
+
+		purpose, err := VerifyEmail(emailToken(t, e))
+		if err != nil || purpose != TokenVerifyChannel {
+			t.Fatalf("VerifyEmail = %q, %v", purpose, err)
+		}
+		var verified bool
+		db.GetDB().QueryRow("SELECT verified_at IS NOT NULL FROM notification_channels WHERE id = $1", ch.ID).Scan(&verified)
+		if !verified {
+			t.Error("channel not verified by its link")
+		}
+	})
+
+	t.Run("own unverified address", func(t *testing.T) {
+		ch := testEmailChannel(t, unverifiedID, unverifiedEmail)
+		if err := StartChannelVerification(&ch, unverifiedID); err != nil {
+			t.Fatal(err)
+		}
+		if ch.VerifiedAt != nil {
+			t.Error("channel verified")
+		}
+		if e := nextEmail(t, emails); e.To != unverifiedEmail {
+			t.Fatalf("confirmation sent to %s", e.To)
+		}
+	})
+
+	t.Run("address changed after the link was sent", func(t *testing.T) {
+		ch := testEmailChannel(t, userID, otherEmail)
+		StartChannelVerification(&ch, userID)
+		token := emailToken(t, nextEmail(t, emails))
+
+		db.GetDB().Exec(`UPDATE notification_channels SET config = '{"email":"changed@example.com"}' WHERE id = $1`, ch.ID)
+		if _, err := VerifyEmail(token); err != ErrAuthTokenInvalid {
+			t.Errorf("err = %v, want ErrAuthTokenInvalid", err)
+		}
+	})
+}
@@ -0,0 +1,313 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Backtest limits.
+const (
+	DefaultBacktestDays = 30
+	backtestMaxRuns     = 10000
+	backtestMaxMatches  = 500 // listed; counts cover every run
+)
+
+// BacktestRule replays a rule over the job's finished runs in [from, to)
+// and reports when it would have fired. Nothing is written: no alerts,
+// no rule evaluations. Repeat thresholds are simulated in memory; a
+// thresholded rule counts one alert per episode, until a run no longer
+// meets the threshold. Baseline rules are replayed from the runs before
+// each run (read once, see baselineHistory), not from today's stored
+// baselines.
+func BacktestRule(jobID string, rule models.Rule, from, to time.Time) (models.BacktestResult, error) {
+	result := models.BacktestResult{
+		From:           from,
+		To:             to,
+		ViolationTimes: []time.Time{},
+		Matches:        []models.BacktestMatch{},
+	}
+
+	rows, err := db.GetDB().Query(`
+		SELECT id, status, COALESCE(duration_ms, 0), duration_ms IS NOT NULL, exit_code, metrics, COALESCE(stderr, ''), created_at
+		FROM job_runs
+		WHERE job_id = $1 AND status <> 'running'
+		AND created_at >= $2 AND created_at < $3
+		ORDER BY created_at
+		LIMIT $4
+	`, jobID, from, to, backtestMaxRuns+1)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	var history *baselineHistory
+	if rule.RuleType == RuleBaseline {
+		if history, err = loadBaselineHistory(jobID, rule, from); err != nil {
+			return result, err
+		}
+	}
+
+	tracker := backtestTracker{rule: rule}
+	for rows.Next() {
+		if result.RunsEvaluated == backtestMaxRuns {
+			result.Truncated = true
+			break
+		}
+
+		run := models.JobRun{JobID: jobID}
+		var hasDuration bool
+		var metricsJSON []byte
+		if err := rows.Scan(&run.ID, &run.Status, &run.DurationMs, &hasDuration, &run.ExitCode, &metricsJSON, &run.Stderr, &run.CreatedAt); err != nil {
+			return result, err
+		}
+		if len(metricsJSON) > 0 {
+			_ = json.Unmarshal(metricsJSON, &run.Metrics)
+		}
+		result.RunsEvaluated++
+
+		var violated bool
+		var val interface{}
+		if history != nil {
+			violated, val = evaluateBaselineRuleWith(run, rule, historyAt{history, run.CreatedAt})
+			if run.Status == "ok" {
+				history.add(run, hasDuration)
+			}
+		} else {
+			violated, val = EvaluateRule(run, rule)
+		}
+		if check, ok := val.(BaselineCheck); ok && check.Skipped {
+			result.Skipped++
+		}
+		alert := tracker.record(violated, run.CreatedAt)
+		if !violated {
+			continue
+		}
+
+		result.Violations++
+		result.ViolationTimes = append(result.ViolationTimes, run.CreatedAt)
+		if alert {
+			result.AlertCount++
+		}
+		if len(result.Matches) < backtestMaxMatches {
+			result.Matches = append(result.Matches, models.BacktestMatch{
+				RunID:       run.ID,
+				Status:      run.Status,
+				CreatedAt:   run.CreatedAt,
+				ActualValue: val,
+				Alert:       alert,
+			})
+		}
+	}
+	return result, rows.Err()
+}
+
+// baselineHistory holds the successful runs a backtest compares each
+// replayed run with, so that a baseline rule costs no query per run.
+// For percentile rules it replays the baselines worker: the baseline of
+// a run is computed from the successful runs of the baseline window
+// before it (newest baselineMaxRuns at most), as the worker would have
+// stored it at the time. For mad rules it reads the same runs as
+// recentRuleSamples.
+type baselineHistory struct {
+	rule   models.Rule
+	loc    *time.Location
+	window time.Duration // 0 for mad, which has no window
+	runs   []historyRun  // oldest first
+}
+
+// historyAt is the baselineSource of a replayed run at time t.
+type historyAt struct {
+	h *baselineHistory
+	t time.Time
+}
+
+func (a historyAt) location() *time.Location { return a.h.loc }
+
+func (a historyAt) baseline(bucket string) *models.Baseline { return a.h.baselineAt(a.t, bucket) }
+
+func (a historyAt) samples(bucket string) []float64 { return a.h.samplesAt(a.t, bucket) }
+
+type historyRun struct {
+	at     time.Time
+	value  float64
+	ok     bool   // the run has the rule's value
+	bucket string // seasonal bucket, if the rule has seasonality
+}
+
+// loadBaselineHistory reads the runs before from that the baselines of
+// the first replayed runs are built from.
+func loadBaselineHistory(jobID string, rule models.Rule, from time.Time) (*baselineHistory, error) {
+	h := &baselineHistory{rule: rule, loc: jobLocation(jobID)}
+	var since *time.Time
+	if rule.Baseline != BaselineMAD {
+		h.window = time.Duration(baselineWindowDays()) * 24 * time.Hour
+		t := from.Add(-h.window)
+		since = &t
+	}
+
+	rows, err := db.GetDB().Query(`
+		SELECT duration_ms, metrics, created_at
+		FROM job_runs
+		WHERE job_id = $1 AND status = 'ok'
+		AND ($2::timestamptz IS NULL OR created_at > $2) AND created_at < $3
+		ORDER BY created_at DESC
+		LIMIT $4
+	`, jobID, since, from, baselineMaxRuns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var run models.JobRun
+		var duration *int
+		var metricsJSON []byte
+		if err := rows.Scan(&duration, &metricsJSON, &run.CreatedAt); err != nil {
+			return nil, err
+		}
+		if duration != nil {
+			run.DurationMs = *duration
+		}
+		if len(metricsJSON) > 0 {
+			_ = json.Unmarshal(metricsJSON, &run.Metrics)
+		}
+		h.add(run, duration != nil)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Read newest first for the limit
+	for i, j := 0, len(h.runs)-1; i < j; i, j = i+1, j-1 {
+		h.runs[i], h.runs[j] = h.runs[j], h.runs[i]
+	}
+	return h, nil
+}
+
+// add appends a successful run. Runs are kept oldest first.
+func (h *baselineHistory) add(run models.JobRun, hasDuration bool) {
+	e := historyRun{at: run.CreatedAt}
+	if hasDuration || h.rule.Target != TargetDuration {
+		e.value, e.ok = ruleSample(run, h.rule)
+	}
+	if h.rule.Seasonality != "" {
+		e.bucket = seasonBucket(h.rule.Seasonality, run.CreatedAt.In(h.loc))
+	}
+	h.runs = append(h.runs, e)
+}
+
+// baselineAt returns the baseline of bucket ("" for all runs) from the
+// runs before t, or nil if there are none.
+func (h *baselineHistory) baselineAt(t time.Time, bucket string) *models.Baseline {
+	lo := sort.Search(len(h.runs), func(i int) bool { return h.runs[i].at.After(t.Add(-h.window)) })
+	hi := sort.Search(len(h.runs), func(i int) bool { return !h.runs[i].at.Before(t) })
+	if hi-lo > baselineMaxRuns {
+		lo = hi - baselineMaxRuns
+	}
+
+	var values []float64
+	for _, e := range h.runs[lo:hi] {
+		if e.ok && (bucket == "" || e.bucket == bucket) {
+			values = append(values, e.value)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Float64s(values)
+	return &models.Baseline{
+		MetricName: RuleSubject(h.rule),
+		Bucket:     bucket,
+		P50:        percentile(values, 0.5),
+		P95:        percentile(values, 0.95),
+		P99:        percentile(values, 0.99),
+		SampleSize: len(values),
+		UpdatedAt:  t,
+	}
+}
+
+// samplesAt returns the values recentRuleSamples would read for a run at
+// t: those of the last baseline_runs runs up to t, newest first, or with
+// bucket set, those in the bucket among the last baselineMaxRuns runs.
+func (h *baselineHistory) samplesAt(t time.Time, bucket string) []float64 {
+	hi := sort.Search(len(h.runs), func(i int) bool { return h.runs[i].at.After(t) })
+	limit := h.rule.BaselineRuns
+	if bucket != "" {
+		limit = baselineMaxRuns
+	}
+	lo := hi - limit
+	if lo < 0 {
+		lo = 0
+	}
+
+	var samples []float64
+	for i := hi - 1; i >= lo && len(samples) < h.rule.BaselineRuns; i-- {
+		if e := h.runs[i]; e.ok && (bucket == "" || e.bucket == bucket) {
+			samples = append(samples, e.value)
+		}
+	}
+	return samples
+}
+
+// backtestTracker mirrors RecordRuleEvaluation without the database.
+type backtestTracker struct {
+	rule      models.Rule
+	history   []backtestEvaluation
+	alertOpen bool
+}
+
+type backtestEvaluation struct {
+	violated bool
+	at       time.Time
+}
+
+// record adds an evaluation and reports whether it would alert.
+func (t *backtestTracker) record(violated bool, at time.Time) bool {
+	t.history = append(t.history, backtestEvaluation{violated, at})
+	if !hasRuleThreshold(t.rule) {
+		return violated
+	}
+
+	met := violated && t.thresholdMet(at)
+	if !met {
+		t.alertOpen = false
+		return false
+	}
+	if t.alertOpen {
+		return false
+	}
+	t.alertOpen = true
+	return true
+}
+
+func (t *backtestTracker) thresholdMet(at time.Time) bool {
+	count := 0
+	switch {
+	case t.rule.Consecutive > 1:
+		for i := len(t.history) - 1; i >= 0 && t.history[i].violated; i-- {
+			count++
+		}
+		return count >= t.rule.Consecutive
+	case t.rule.WindowRuns > 0:
+		start := len(t.history) - t.rule.WindowRuns
+		if start < 0 {
+			start = 0
+		}
+		for _, e := range t.history[start:] {
+			if e.violated {
+				count++
+			}
+		}
+	case t.rule.WindowMinutes > 0:
+		since := at.Add(-time.Duration(t.rule.WindowMinutes) * time.Minute)
+		for _, e := range t.history {
+			if e.violated && e.at.After(since) {
+				count++
+			}
+		}
+	}
+	return count >= t.rule.WindowViolations
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"testing"
+	"time"
+)
+
+func TestBaselineHistoryBaselineAt(t *testing.T) {
+	rule := models.Rule{RuleType: RuleBaseline, Target: TargetDuration, Baseline: BaselineP95, Seasonality: SeasonWeekday}
+	h := &baselineHistory{rule: rule, loc: time.UTC, window: 30 * 24 * time.Hour}
+
+	// One run a day at 02:00 from 2026-05-01 (a Friday); durations count up
+	start := time.Date(2026, 5, 1, 2, 0, 0, 0, time.UTC)
+	for i := 0; i < 60; i++ {
+		h.add(models.JobRun{DurationMs: (i + 1) * 100, CreatedAt: start.AddDate(0, 0, i)}, true)
+	}
+	// A run without a duration is not a sample
+	h.add(models.JobRun{CreatedAt: start.AddDate(0, 0, 60)}, false)
+
+	tests := []struct {
+		name   string
+		at     time.Time
+		bucket string
+		size   int
+		p50    float64
+	}{
+		{"before any run", start, "", 0, 0},
+		{"only earlier runs", start.AddDate(0, 0, 3), "", 3, 200},
+		{"excludes the run at t", start.AddDate(0, 0, 10), "", 10, 550},
+		{"window drops old runs", start.AddDate(0, 0, 45), "", 29, 3100},
+		{"weekday bucket", start.AddDate(0, 0, 21), "weekday:5", 3, 800},
+		{"empty bucket", start.AddDate(0, 0, 3), "weekday:1", 0, 0},
+		{"null duration", start.AddDate(0, 0, 61), "", 28, 4650},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := h.baselineAt(tt.at, tt.bucket)
+			if tt.size == 0 {
+				if b != nil {
+					t.Errorf("baseline = %+v, want none", b)
+				}
+				return
+			}
+			if b == nil || b.SampleSize != tt.size || b.P50 != tt.p50 {
+				t.Errorf("baseline = %+v, want %d samples, p50 %g", b, tt.size, tt.p50)
+			}
+		})
+	}
+}
+
+// A run is compared with the baseline of the runs before it, not with
+// one that already includes the runs after it.
+func TestBacktestPercentileNoLookahead(t *testing.T) {
+	testDB(t)
+	t.Setenv("BASELINES_ENABLED", "true")
+	userID, _ := testUser(t, "example.com", true)
+	jobID := testJob(t, userID, personalOrg(t, userID))
+
+	// Ten quick runs, then the job slows down for good
+	now := time.Now().UTC().Truncate(time.Second)
+	from := now.Add(-10 * time.Hour)
+	for i := 0; i < 20; i++ {
+		duration := 100
+		at := from.Add(time.Duration(i-10) * time.Hour)
+		if i >= 10 {
+			duration = 1000
+		}
+		if _, err := db.GetDB().Exec(
+			"INSERT INTO job_runs (job_id, status, duration_ms, created_at) VALUES ($1, 'ok', $2, $3)", jobID, duration, at,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Today's stored baseline already only knows slow runs
+	if err := RecomputeJobBaselines(jobID); err != nil {
+		t.Fatal(err)
+	}
+
+	rule := models.Rule{
+		JobID: jobID, RuleType: RuleBaseline, Target: TargetDuration,
+		Baseline: BaselineP95, Operator: ">", BaselineFactor: 2, MinSamples: 5,
+	}
+	result, err := BacktestRule(jobID, rule, from, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RunsEvaluated != 10 || len(result.Matches) == 0 {
+		t.Fatalf("result = %+v, want the first slow run to violate", result)
+	}
+	first := result.Matches[0]
+	if !first.CreatedAt.Equal(from) {
+		t.Errorf("first match at %v, want %v", first.CreatedAt, from)
+	}
+	if check, ok := first.ActualValue.(BaselineCheck); !ok || check.Baseline != 100 || check.SampleSize != 10 {
+		t.Errorf("first match compared with %+v, want p95 100 over 10 runs", first.ActualValue)
+	}
+}
+
+func TestBaselineHistorySamplesAt(t *testing.T) {
+	rule := models.Rule{RuleType: RuleBaseline, Target: TargetDuration, Baseline: BaselineMAD, BaselineRuns: 5, Seasonality: SeasonWeekday}
+	h := &baselineHistory{rule: rule, loc: time.UTC}
+
+	// One run a day at 02:00 from 2026-05-01 (a Friday); durations count up
+	start := time.Date(2026, 5, 1, 2, 0, 0, 0, time.UTC)
+	for i := 0; i < 30; i++ {
+		h.add(models.JobRun{DurationMs: (i + 1) * 100, CreatedAt: start.AddDate(0, 0, i)}, true)
+	}
+	// A run without a duration takes a slot but is not a sample
+	h.add(models.JobRun{CreatedAt: start.AddDate(0, 0, 30)}, false)
+
+	tests := []struct {
+		name   string
+		at     time.Time
+		bucket string
+		want   []float64
+	}{
+		{"before any run", start.Add(-time.Hour), "", nil},
+		{"fewer than baseline_runs", start.AddDate(0, 0, 2).Add(-time.Hour), "", []float64{200, 100}},
+		{"last baseline_runs, newest first", start.AddDate(0, 0, 10).Add(-time.Hour), "", []float64{1000, 900, 800, 700, 600}},
+		{"includes a run at t", start.AddDate(0, 0, 1), "", []float64{200, 100}},
+		{"null duration", start.AddDate(0, 0, 31), "", []float64{3000, 2900, 2800, 2700}},
+		{"weekday bucket", start.AddDate(0, 0, 29), "weekday:5", []float64{2900, 2200, 1500, 800, 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := h.samplesAt(tt.at, tt.bucket)
+			if len(got) != len(tt.want) {
+				t.Fatalf("samples = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("samples = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// A mad rule is compared with the runs before each replayed run, read
+// once, not with the runs that came after it.
+func TestBacktestMADNoLookahead(t *testing.T) {
+	testDB(t)
+	userID, _ := testUser(t, "example.com", true)
+	jobID := testJob(t, userID, personalOrg(t, userID))
+
+	// Ten steady runs, then the job slows down for good
+	now := time.Now().UTC().Truncate(time.Second)
+	from := now.Add(-10 * time.Hour)
+	for i := 0; i < 20; i++ {
+		duration := 100 + i%2
+		at := from.Add(time.Duration(i-10) * time.Hour)
+		if i >= 10 {
+			duration = 1000 + i%2
+		}
+		if _, err := db.GetDB().Exec(
+			"INSERT INTO job_runs (job_id, status, duration_ms, created_at) VALUES ($1, 'ok', $2, $3)", jobID, duration, at,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rule := models.Rule{
+		JobID: jobID, RuleType: RuleBaseline, Target: TargetDuration,
+		Baseline: BaselineMAD, Operator: ">", BaselineFactor: 3, BaselineRuns: 10, MinSamples: 5,
+	}
+	result, err := BacktestRule(jobID, rule, from, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RunsEvaluated != 10 || len(result.Matches) == 0 {
+		t.Fatalf("result = %+v, want the first slow run to violate", result)
+	}
+	first := result.Matches[0]
+	if !first.CreatedAt.Equal(from) {
+		t.Errorf("first match at %v, want %v", first.CreatedAt, from)
+	}
+	if check, ok := first.ActualValue.(BaselineCheck); !ok || check.Baseline != 100.5 || check.SampleSize != 10 {
+		t.Errorf("first match compared with %+v, want median 100.5 over 10 runs", first.ActualValue)
+	}
+	// Once the slow runs fill baseline_runs they are the new normal
+	if last := result.Matches[len(result.Matches)-1]; !last.CreatedAt.Before(from.Add(5 * time.Hour)) {
+		t.Errorf("still violating at %v", last.CreatedAt)
+	}
+}
+
+func TestBacktestTracker(t *testing.T) {
+	start := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		rule     models.Rule
+		violated []bool
+		alerts   []bool
+		minutes  int // between evaluations (default 10)
+	}{
+		{
+			name:     "no threshold",
+			rule:     models.Rule{},
+			violated: []bool{true, true, false, true},
+			alerts:   []bool{true, true, false, true},
+		},
+		{
+			name:     "no evaluations",
+			rule:     models.Rule{Consecutive: 2},
+			violated: []bool{},
+			alerts:   []bool{},
+		},
+		{
+			name:     "consecutive alerts once per episode",
+			rule:     models.Rule{Consecutive: 3},
+			violated: []bool{true, true, true, true, false, true, true, true},
+			alerts:   []bool{false, false, true, false, false, false, false, true},
+		},
+		{
+			name:     "2 of the last 3 runs",
+			rule:     models.Rule{WindowViolations: 2, WindowRuns: 3},
+			violated: []bool{true, false, true, true, false, false, true},
+			alerts:   []bool{false, false, true, false, false, false, false},
+		},
+		{
+			name:     "window restarts the episode",
+			rule:     models.Rule{WindowViolations: 2, WindowRuns: 2},
+			violated: []bool{true, true, false, true, true},
+			alerts:   []bool{false, true, false, false, true},
+		},
+		{
+			name:     "2 within 30 minutes",
+			rule:     models.Rule{WindowViolations: 2, WindowMinutes: 30},
+			violated: []bool{true, false, false, true, true},
+			alerts:   []bool{false, false, false, false, true},
+			minutes:  20,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			minutes := tt.minutes
+			if minutes == 0 {
+				minutes = 10
+			}
+			tracker := backtestTracker{rule: tt.rule}
+			for i, violated := range tt.violated {
+				at := start.Add(time.Duration(i*minutes) * time.Minute)
+				if got := tracker.record(violated, at); got != tt.alerts[i] {
+					t.Errorf("evaluation %d: alert = %v, want %v", i+1, got, tt.alerts[i])
+				}
+			}
+		})
+	}
+}
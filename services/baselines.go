@@ -0,0 +1,271 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Baselines are recomputed from the successful runs of the last
+// BASELINE_WINDOW_DAYS days (default 30), newest baselineMaxRuns at most.
+const (
+	defaultBaselineWindowDays = 30
+	baselineMaxRuns           = 5000
+	baselineMaxMetrics        = 200 // per job
+	baselineMaxDepth          = 8   // nesting depth of metric objects
+)
+
+// BaselineDuration is the pseudo metric holding run durations.
+const BaselineDuration = "duration_ms"
+
+func baselineWindowDays() int {
+	if days, err := strconv.Atoi(os.Getenv("BASELINE_WINDOW_DAYS")); err == nil && days > 0 {
+		return days
+	}
+	return defaultBaselineWindowDays
+}
+
+// RecomputeBaselines refreshes the baselines of every job.
+func RecomputeBaselines() {
+	// Safety: Never panic
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("RecomputeBaselines panic: %v\n", r)
+		}
+	}()
+
+	rows, err := db.GetDB().Query("SELECT id FROM jobs")
+	if err != nil {
+		fmt.Printf("Error fetching jobs for baselines: %v\n", err)
+		return
+	}
+	var jobIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			jobIDs = append(jobIDs, id)
+		}
+	}
+	rows.Close()
+
+	for _, jobID := range jobIDs {
+		if err := RecomputeJobBaselines(jobID); err != nil {
+			fmt.Printf("Error computing baselines for job %s: %v\n", jobID, err)
+		}
+	}
+}
+
+// RecomputeJobBaselines replaces a job's baselines with percentiles of
+// duration_ms and every numeric metric over the rolling window. Values
+// read by seasonal baseline rules are also bucketed (see seasonality.go).
+func RecomputeJobBaselines(jobID string) error {
+	seasonal, err := seasonalBaselineRules(jobID)
+	if err != nil {
+		return err
+	}
+	loc := jobLocation(jobID)
+
+	rows, err := db.GetDB().Query(`
+		SELECT duration_ms, metrics, created_at
+		FROM job_runs
+		WHERE job_id = $1 AND status = 'ok'
+		AND created_at > NOW() - make_interval(days => $2)
+		ORDER BY created_at DESC
+		LIMIT $3
+	`, jobID, baselineWindowDays(), baselineMaxRuns)
+	if err != nil {
+		return err
+	}
+
+	samples := map[string][]float64{}
+	bucketed := map[baselineKey][]float64{}
+	for rows.Next() {
+		var run models.JobRun
+		var duration *int
+		var metricsJSON []byte
+		if err := rows.Scan(&duration, &metricsJSON, &run.CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		if duration != nil {
+			run.DurationMs = *duration
+			samples[BaselineDuration] = append(samples[BaselineDuration], float64(*duration))
+		}
+		if len(metricsJSON) > 0 && json.Unmarshal(metricsJSON, &run.Metrics) == nil {
+			collectMetricSamples(samples, "", run.Metrics, 0)
+		}
+
+		for _, rule := range seasonal {
+			if rule.Target == TargetDuration && duration == nil {
+				continue
+			}
+			if f, ok := ruleSample(run, rule); ok {
+				key := baselineKey{RuleSubject(rule), seasonBucket(rule.Seasonality, run.CreatedAt.In(loc))}
+				bucketed[key] = append(bucketed[key], f)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for name, values := range samples {
+		bucketed[baselineKey{name, ""}] = values
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Metrics that disappeared from the window lose their baseline
+	if _, err := tx.Exec("DELETE FROM baselines WHERE job_id = $1", jobID); err != nil {
+		return err
+	}
+	for key, values := range bucketed {
+		sort.Float64s(values)
+		_, err := tx.Exec(`
+			INSERT INTO baselines (job_id, metric_name, bucket, p50, p95, p99, sample_size, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		`, jobID, key.metric, key.bucket, percentile(values, 0.5), percentile(values, 0.95), percentile(values, 0.99), len(values))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// baselineKey identifies a baseline row; bucket is empty for the global one.
+type baselineKey struct {
+	metric, bucket string
+}
+
+// seasonalBaselineRules returns one baseline rule per (value, seasonality)
+// the job's rules ask for.
+func seasonalBaselineRules(jobID string) ([]models.Rule, error) {
+	rules, err := LoadJobRules(jobID)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[baselineKey]bool{}
+	var seasonal []models.Rule
+	for _, rule := range rules {
+		if !rule.Enabled || rule.RuleType != RuleBaseline || rule.Seasonality == "" {
+			continue
+		}
+		key := baselineKey{RuleSubject(rule), rule.Seasonality}
+		if !seen[key] {
+			seen[key] = true
+			seasonal = append(seasonal, rule)
+		}
+	}
+	return seasonal, nil
+}
+
+// ruleSample reads the numeric value a baseline rule checks.
+func ruleSample(run models.JobRun, rule models.Rule) (float64, bool) {
+	value, ok := ruleValue(run, rule)
+	if !ok || value == nil {
+		return 0, false
+	}
+	return toFloat64(value)
+}
+
+// collectMetricSamples adds every numeric leaf of a metrics object under
+// its path (see LookupMetric). Arrays are skipped.
+func collectMetricSamples(samples map[string][]float64, prefix string, node map[string]interface{}, depth int) {
+	if depth >= baselineMaxDepth {
+		return
+	}
+	for key, v := range node {
+		path := key
+		switch {
+		case prefix == "":
+			// Top-level keys match exactly, dots included
+			if key == BaselineDuration {
+				continue
+			}
+		case strings.ContainsAny(key, `"]`):
+			continue // not addressable as a path
+		case strings.ContainsAny(key, ".["):
+			path = prefix + `["` + key + `"]`
+		default:
+			path = prefix + "." + key
+		}
+
+		if child, ok := v.(map[string]interface{}); ok {
+			collectMetricSamples(samples, path, child, depth+1)
+			continue
+		}
+		f, ok := toFloat64(v)
+		if !ok {
+			continue
+		}
+		if _, seen := samples[path]; !seen && len(samples) >= baselineMaxMetrics {
+			continue
+		}
+		samples[path] = append(samples[path], f)
+	}
+}
+
+// percentile interpolates linearly between the closest ranks of sorted
+// values, like Postgres PERCENTILE_CONT.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
+
+// LoadJobBaselines returns the stored baselines of a job by metric name.
+func LoadJobBaselines(jobID string) ([]models.Baseline, error) {
+	rows, err := db.GetDB().Query(`
+		SELECT metric_name, bucket, p50, p95, p99, sample_size, updated_at
+		FROM baselines
+		WHERE job_id = $1
+		ORDER BY metric_name, bucket
+	`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	baselines := []models.Baseline{}
+	for rows.Next() {
+		b := models.Baseline{JobID: jobID}
+		if err := rows.Scan(&b.MetricName, &b.Bucket, &b.P50, &b.P95, &b.P99, &b.SampleSize, &b.UpdatedAt); err != nil {
+			return nil, err
+		}
+		baselines = append(baselines, b)
+	}
+	return baselines, rows.Err()
+}
+
+// LoadBaseline returns the stored baseline of one metric, or nil.
+// An empty bucket selects the global baseline.
+func LoadBaseline(jobID, metricName, bucket string) (*models.Baseline, error) {
+	b := models.Baseline{JobID: jobID, MetricName: metricName, Bucket: bucket}
+	err := db.GetDB().QueryRow(`
+		SELECT p50, p95, p99, sample_size, updated_at
+		FROM baselines
+		WHERE job_id = $1 AND metric_name = $2 AND bucket = $3
+	`, jobID, metricName, bucket).Scan(&b.P50, &b.P95, &b.P99, &b.SampleSize, &b.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectMetricSamples(t *testing.T) {
+	// nested returns {"l0": {"l1": ... {"leaf": 1}}} with depth objects
+	nested := func(depth int) map[string]interface{} {
+		node := map[string]interface{}{"leaf": float64(1)}
+		for i := depth - 1; i >= 0; i-- {
+			node = map[string]interface{}{fmt.Sprintf("l%d", i): node}
+		}
+		return node
+	}
+	deepPath := func(depth int) string {
+		var parts []string
+		for i := 0; i < depth; i++ {
+			parts = append(parts, fmt.Sprintf("l%d", i))
+		}
+		return strings.Join(append(parts, "leaf"), ".")
+	}
+
+	tests := []struct {
+		name    string
+		metrics string
+		want    map[string]float64 // path -> only sample
+	}{
+		{
+			name:    "numbers and numeric strings",
+			metrics: `{"rows": 42, "ratio": "0.5", "env": "prod", "ok": true, "none": null, "nan": "NaN"}`,
+			want:    map[string]float64{"rows": 42, "ratio": 0.5},
+		},
+		{
+			name:    "dotted top-level key matches exactly",
+			metrics: `{"db.rows": 7}`,
+			want:    map[string]float64{"db.rows": 7},
+		},
+		{
+			name:    "nested objects",
+			metrics: `{"db": {"rows": 7, "replica": {"lag": 1.5}}}`,
+			want:    map[string]float64{"db.rows": 7, "db.replica.lag": 1.5},
+		},
+		{
+			name:    "nested keys with dots or brackets",
+			metrics: `{"tables": {"users.v2": 3, "shard[0": 4}}`,
+			want:    map[string]float64{`tables["users.v2"]`: 3, `tables["shard[0"]`: 4},
+		},
+		{
+			name:    "unaddressable keys are skipped",
+			metrics: `{"db": {"say \"hi\"": 1, "x]": 2, "ok": 3}}`,
+			want:    map[string]float64{"db.ok": 3},
+		},
+		{
+			name:    "arrays are skipped",
+			metrics: `{"tables": [1, 2], "db": {"shards": [3]}}`,
+			want:    map[string]float64{},
+		},
+		{
+			name:    "duration_ms is reserved at the top level only",
+			metrics: `{"duration_ms": 5, "step": {"duration_ms": 6}}`,
+			want:    map[string]float64{"step.duration_ms": 6},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var metrics map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.metrics), &metrics); err != nil {
+				t.Fatal(err)
+			}
+			samples := map[string][]float64{}
+			collectMetricSamples(samples, "", metrics, 0)
+			if len(samples) != len(tt.want) {
+				t.Errorf("samples = %v, want %v", samples, tt.want)
+			}
+			for path, want := range tt.want {
+				if got := samples[path]; len(got) != 1 || got[0] != want {
+					t.Errorf("%s = %v, want [%g]", path, got, want)
+				}
+				// Rules read the baseline under the same name
+				if v, ok := LookupMetric(metrics, path); !ok {
+					t.Errorf("LookupMetric(%s) found nothing", path)
+				} else if f, _ := toFloat64(v); f != want {
+					t.Errorf("LookupMetric(%s) = %v, want %g", path, v, want)
+				}
+			}
+		})
+	}
+
+	t.Run("depth limit", func(t *testing.T) {
+		samples := map[string][]float64{}
+		collectMetricSamples(samples, "", nested(baselineMaxDepth-1), 0)
+		if _, ok := samples[deepPath(baselineMaxDepth-1)]; !ok || len(samples) != 1 {
+			t.Errorf("depth %d: samples = %v", baselineMaxDepth-1, samples)
+		}
+		samples = map[string][]float64{}
+		collectMetricSamples(samples, "", nested(baselineMaxDepth), 0)
+		if len(samples) != 0 {
+			t.Errorf("depth %d: samples = %v, want none", baselineMaxDepth, samples)
+		}
+	})
+
+	t.Run("metric limit", func(t *testing.T) {
+		metrics := map[string]interface{}{}
+		for i := 0; i < baselineMaxMetrics+50; i++ {
+			metrics[fmt.Sprintf("m%d", i)] = float64(i)
+		}
+		samples := map[string][]float64{}
+		collectMetricSamples(samples, "", metrics, 0)
+		if len(samples) != baselineMaxMetrics {
+			t.Fatalf("%d metrics, want %d", len(samples), baselineMaxMetrics)
+		}
+		// Metrics already tracked keep getting samples from later runs
+		collectMetricSamples(samples, "", metrics, 0)
+		for path, values := range samples {
+			if len(values) != 2 {
+				t.Errorf("%s has %d samples after two runs, want 2", path, len(values))
+			}
+		}
+	})
+}
+
+func TestRecomputeJobBaselines(t *testing.T) {
+	testDB(t)
+	t.Setenv("BASELINE_WINDOW_DAYS", "") // 30
+	userID, _ := testUser(t, "example.com", true)
+	jobID := testJob(t, userID, personalOrg(t, userID))
+
+	insertRun := func(status string, duration int, metrics string, age time.Duration) {
+		t.Helper()
+		if _, err := db.GetDB().Exec(`
+			INSERT INTO job_runs (job_id, status, duration_ms, metrics, created_at)
+			VALUES ($1, $2, $3, $4, $5)
+		`, jobID, status, duration, metrics, time.Now().Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	baselines := func() map[string]models.Baseline {
+		t.Helper()
+		list, err := LoadJobBaselines(jobID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byName := map[string]models.Baseline{}
+		for _, b := range list {
+			byName[b.MetricName] = b
+		}
+		return byName
+	}
+
+	for i := 1; i <= 5; i++ {
+		insertRun("ok", i*100, fmt.Sprintf(`{"rows": %d, "db": {"lag": %d}}`, i, i*10), time.Duration(i)*time.Hour)
+	}
+	// Failed runs and runs outside the window are not samples
+	insertRun("failed", 99999, `{"rows": 1000}`, time.Hour)
+	insertRun("ok", 99999, `{"rows": 1000, "old": 1}`, 40*24*time.Hour)
+
+	if err := RecomputeJobBaselines(jobID); err != nil {
+		t.Fatal(err)
+	}
+	got := baselines()
+	for name, want := range map[string]float64{BaselineDuration: 300, "rows": 3, "db.lag": 30} {
+		if b, ok := got[name]; !ok || b.P50 != want || b.SampleSize != 5 {
+			t.Errorf("%s = %+v, want p50 %g over 5 runs", name, b, want)
+		}
+	}
+	if len(got) != 3 {
+		t.Errorf("baselines = %v", got)
+	}
+
+	// Once the runs reporting db.lag leave the window, its baseline goes
+	if _, err := db.GetDB().Exec(
+		"UPDATE job_runs SET created_at = created_at - INTERVAL '40 days' WHERE job_id = $1", jobID,
+	); err != nil {
+		t.Fatal(err)
+	}
+	insertRun("ok", 100, `{"rows": 1}`, time.Hour)
+	if err := RecomputeJobBaselines(jobID); err != nil {
+		t.Fatal(err)
+	}
+	got = baselines()
+	if _, ok := got["db.lag"]; ok || len(got) != 2 {
+		t.Errorf("baselines after db.lag left the window = %v", got)
+	}
+	if b := got["rows"]; b.SampleSize != 1 || b.P50 != 1 {
+		t.Errorf("rows = %+v, want p50 1 over 1 run", b)
+	}
+}
@@ -0,0 +1,351 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression.
+// Supports 5-field (minute hour dom month dow) and 6-field (second first)
+// syntax, @macros, named months/weekdays, lists, ranges and steps.
+type CronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+
+	// Vixie semantics: if either day field is restricted (not '*'),
+	// a day matches when EITHER field matches.
+	domStar, dowStar bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	fieldSecond = cronField{"second", 0, 59, nil}
+	fieldMinute = cronField{"minute", 0, 59, nil}
+	fieldHour   = cronField{"hour", 0, 23, nil}
+	fieldDom    = cronField{"day-of-month", 1, 31, nil}
+	fieldMonth  = cronField{"month", 1, 12, cronMonthNames}
+	fieldDow    = cronField{"day-of-week", 0, 7, cronDayNames} // 7 = Sunday
+)
+
+// Search horizon for Next/Prev. Expressions like "0 0 30 2 *" never fire.
+const cronSearchYears = 5
+
+func ParseCron(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, fmt.Errorf("empty cron expression")
+	}
+
+	if strings.HasPrefix(expr, "@") {
+		macro, ok := cronMacros[strings.ToLower(expr)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cron macro %q", expr)
+		}
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+		// Seconds already first
+	default:
+		return nil, fmt.Errorf("expected 5 or 6 fields, got %d", len(fields))
+	}
+
+	s := &CronSchedule{}
+	var err error
+	if s.second, err = parseCronField(fields[0], fieldSecond); err != nil {
+		return nil, err
+	}
+	if s.minute, err = parseCronField(fields[1], fieldMinute); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[2], fieldHour); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[3], fieldDom); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[4], fieldMonth); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[5], fieldDow); err != nil {
+		return nil, err
+	}
+
+	// Fold 7 (Sunday) onto 0
+	if s.dow&(1<<7) != 0 {
+		s.dow = (s.dow &^ (1 << 7)) | 1
+	}
+
+	s.domStar = strings.HasPrefix(fields[3], "*") || fields[3] == "?"
+	s.dowStar = strings.HasPrefix(fields[5], "*") || fields[5] == "?"
+
+	return s, nil
+}
+
+func parseCronField(raw string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(raw, ",") {
+		if part == "" {
+			return 0, fmt.Errorf("%s: empty list element in %q", f.name, raw)
+		}
+
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			rangePart = part[:i]
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("%s: invalid step in %q", f.name, part)
+			}
+			step = n
+		}
+
+		var lo, hi int
+		switch {
+		case rangePart == "*" || rangePart == "?":
+			lo, hi = f.min, f.max
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = parseCronValue(bounds[0], f); err != nil {
+				return 0, err
+			}
+			if hi, err = parseCronValue(bounds[1], f); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("%s: range start exceeds end in %q", f.name, part)
+			}
+		default:
+			v, err := parseCronValue(rangePart, f)
+			if err != nil {
+				return 0, err
+			}
+			lo, hi = v, v
+			// "5/15" means "starting at 5, every 15"
+			if step > 1 {
+				hi = f.max
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(raw string, f cronField) (int, error) {
+	if f.names != nil {
+		if v, ok := f.names[strings.ToLower(raw)]; ok {
+			return v, nil
+		}
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid value %q", f.name, raw)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s: value %d out of range [%d-%d]", f.name, v, f.min, f.max)
+	}
+	return v, nil
+}
+
+// Next returns the first activation strictly after t, evaluated in t's location.
+// Returns the zero time if nothing fires within the search horizon.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+
+	for t.Before(limit) {
+		if !has(s.month, int(t.Month())) {
+			t = forward(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = forward(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !has(s.hour, t.Hour()) {
+			t = startOfHour(t).Add(time.Hour)
+			continue
+		}
+		if !has(s.minute, t.Minute()) {
+			t = startOfMinute(t).Add(time.Minute)
+			continue
+		}
+		if !has(s.second, t.Second()) {
+			if next := nextBit(s.second, t.Second()); next >= 0 {
+				t = t.Add(time.Duration(next-t.Second()) * time.Second)
+			} else {
+				t = startOfMinute(t).Add(time.Minute)
+			}
+			continue
+		}
+		if end, repeated := s.repeatedWallTime(t); repeated {
+			t = end
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Prev returns the latest activation at or before t, evaluated in t's location.
+// Returns the zero time if nothing fired within the search horizon.
+func (s *CronSchedule) Prev(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Second)
+	limit := t.AddDate(-cronSearchYears, 0, 0)
+
+	for t.After(limit) {
+		if !has(s.month, int(t.Month())) {
+			t = backward(t, time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = backward(t, time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc))
+			continue
+		}
+		if !has(s.hour, t.Hour()) {
+			t = startOfHour(t).Add(-time.Second)
+			continue
+		}
+		if !has(s.minute, t.Minute()) {
+			t = startOfMinute(t).Add(-time.Second)
+			continue
+		}
+		if !has(s.second, t.Second()) {
+			if prev := prevBit(s.second, t.Second()); prev >= 0 {
+				t = t.Add(-time.Duration(t.Second()-prev) * time.Second)
+			} else {
+				t = startOfMinute(t).Add(-time.Second)
+			}
+			continue
+		}
+		if _, repeated := s.repeatedWallTime(t); repeated {
+			start, _ := t.ZoneBounds()
+			t = start.Add(-time.Second)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := has(s.dom, t.Day())
+	dowMatch := has(s.dow, int(t.Weekday()))
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// repeatedWallTime reports whether t's wall clock already occurred earlier
+// (the second pass through an hour when DST ends). Like cron, jobs pinned
+// to specific hours fire on the first pass only; hourly-or-faster schedules
+// follow real time. Wall times skipped when DST starts never match at all.
+// When repeated, end is the first instant after the repeated span.
+func (s *CronSchedule) repeatedWallTime(t time.Time) (end time.Time, repeated bool) {
+	if s.hour == fullBits(fieldHour) {
+		return time.Time{}, false
+	}
+	start, _ := t.ZoneBounds()
+	if start.IsZero() {
+		return time.Time{}, false
+	}
+	_, offset := t.Zone()
+	_, prevOffset := start.Add(-time.Second).Zone()
+	if prevOffset <= offset {
+		return time.Time{}, false
+	}
+	end = start.Add(time.Duration(prevOffset-offset) * time.Second)
+	return end, t.Before(end)
+}
+
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
+
+func fullBits(f cronField) uint64 {
+	var bits uint64
+	for v := f.min; v <= f.max; v++ {
+		bits |= 1 << uint(v)
+	}
+	return bits
+}
+
+func nextBit(bits uint64, from int) int {
+	for v := from; v < 64; v++ {
+		if has(bits, v) {
+			return v
+		}
+	}
+	return -1
+}
+
+func prevBit(bits uint64, from int) int {
+	for v := from; v >= 0; v-- {
+		if has(bits, v) {
+			return v
+		}
+	}
+	return -1
+}
+
+func startOfMinute(t time.Time) time.Time {
+	return t.Add(-time.Duration(t.Second()) * time.Second)
+}
+
+// Computed from the instant rather than time.Date so it stays correct
+// inside a repeated DST hour.
+func startOfHour(t time.Time) time.Time {
+	return startOfMinute(t).Add(-time.Duration(t.Minute()) * time.Minute)
+}
+
+// forward/backward guard against time.Date normalizing a nonexistent
+// local midnight to the wrong side of t.
+func forward(t, candidate time.Time) time.Time {
+	if candidate.After(t) {
+		return candidate
+	}
+	return startOfHour(t).Add(time.Hour)
+}
+
+func backward(t, candidate time.Time) time.Time {
+	candidate = candidate.Add(-time.Second)
+	if candidate.Before(t) {
+		return candidate
+	}
+	return startOfHour(t).Add(-time.Second)
+}
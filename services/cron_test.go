@@ -0,0 +1,221 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+const cronTimeLayout = "2006-01-02 15:04:05 -0700"
+
+// cronTime parses a time with an explicit offset (so times inside a
+// repeated DST hour are unambiguous) and moves it to loc.
+func cronTime(t *testing.T, loc *time.Location, s string) time.Time {
+	t.Helper()
+	v, err := time.Parse(cronTimeLayout, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.In(loc)
+}
+
+func newYork(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no tzdata: %v", err)
+	}
+	return loc
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"   ",
+		"* * * *",
+		"* * * * * * *",
+		"@every",
+		"@fortnightly",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"60 * * * * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"1,,2 * * * *",
+		"a * * * *",
+		"* * * foo *",
+		"* * * * funday",
+		"* * * jan-foo *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	ny := newYork(t)
+	tests := []struct {
+		name string
+		expr string
+		loc  *time.Location
+		from string
+		want string // "" = never
+	}{
+		// Fields
+		{"every minute", "* * * * *", time.UTC, "2026-10-17 12:00:30 +0000", "2026-10-17 12:01:00 +0000"},
+		{"strictly after", "0 12 * * *", time.UTC, "2026-10-17 12:00:00 +0000", "2026-10-18 12:00:00 +0000"},
+		{"list", "0 9,17 * * *", time.UTC, "2026-10-17 10:00:00 +0000", "2026-10-17 17:00:00 +0000"},
+		{"range with step", "10-20/5 * * * *", time.UTC, "2026-10-17 10:16:00 +0000", "2026-10-17 10:20:00 +0000"},
+		{"start with step", "5/15 * * * *", time.UTC, "2026-10-17 10:06:00 +0000", "2026-10-17 10:20:00 +0000"},
+		{"month rollover", "0 0 1 * *", time.UTC, "2026-12-15 00:00:00 +0000", "2027-01-01 00:00:00 +0000"},
+		{"leap day", "0 0 29 2 *", time.UTC, "2026-03-01 00:00:00 +0000", "2028-02-29 00:00:00 +0000"},
+		{"never fires", "0 0 30 2 *", time.UTC, "2026-01-01 00:00:00 +0000", ""},
+
+		// 6 fields
+		{"seconds step", "*/15 * * * * *", time.UTC, "2026-10-17 10:00:07 +0000", "2026-10-17 10:00:15 +0000"},
+		{"seconds next minute", "10 * * * * *", time.UTC, "2026-10-17 10:00:11 +0000", "2026-10-17 10:01:10 +0000"},
+		{"seconds with hour", "30 0 9 * * *", time.UTC, "2026-10-17 09:00:30 +0000", "2026-10-18 09:00:30 +0000"},
+		{"sub-second from", "0 * * * * *", time.UTC, "2026-10-17 10:00:59 +0000", "2026-10-17 10:01:00 +0000"},
+
+		// Macros
+		{"@yearly", "@yearly", time.UTC, "2026-05-01 00:00:00 +0000", "2027-01-01 00:00:00 +0000"},
+		{"@annually", "@annually", time.UTC, "2026-05-01 00:00:00 +0000", "2027-01-01 00:00:00 +0000"},
+		{"@monthly", "@monthly", time.UTC, "2026-10-17 00:00:00 +0000", "2026-11-01 00:00:00 +0000"},
+		{"@weekly", "@weekly", time.UTC, "2026-10-17 12:00:00 +0000", "2026-10-18 00:00:00 +0000"},
+		{"@daily", "@daily", time.UTC, "2026-10-17 12:00:00 +0000", "2026-10-18 00:00:00 +0000"},
+		{"@midnight", "@MIDNIGHT", time.UTC, "2026-10-17 12:00:00 +0000", "2026-10-18 00:00:00 +0000"},
+		{"@hourly", "@hourly", time.UTC, "2026-10-17 12:34:00 +0000", "2026-10-17 13:00:00 +0000"},
+
+		// Names
+		{"weekday names", "0 9 * * mon-fri", time.UTC, "2026-10-16 10:00:00 +0000", "2026-10-19 09:00:00 +0000"},
+		{"name case", "0 0 * * SUN", time.UTC, "2026-10-17 00:00:00 +0000", "2026-10-18 00:00:00 +0000"},
+		{"sunday as 7", "0 0 * * 7", time.UTC, "2026-10-17 00:00:00 +0000", "2026-10-18 00:00:00 +0000"},
+		{"range to 7", "0 0 * * 6-7", time.UTC, "2026-10-18 00:00:00 +0000", "2026-10-24 00:00:00 +0000"},
+		{"month names", "0 9 * jan-mar mon-fri", time.UTC, "2026-03-31 10:00:00 +0000", "2027-01-01 09:00:00 +0000"},
+		{"month list", "0 0 1 Jun,DEC *", time.UTC, "2026-06-02 00:00:00 +0000", "2026-12-01 00:00:00 +0000"},
+
+		// DOM/DOW: either day field matches when both are restricted
+		{"dom or dow (dow)", "0 0 13 * fri", time.UTC, "2026-10-17 00:00:00 +0000", "2026-10-23 00:00:00 +0000"},
+		{"dom or dow (dom)", "0 0 13 * fri", time.UTC, "2026-11-07 00:00:00 +0000", "2026-11-13 00:00:00 +0000"},
+		{"dom or dow (first)", "0 0 1 * mon", time.UTC, "2026-10-27 00:00:00 +0000", "2026-11-01 00:00:00 +0000"},
+		{"dom only", "0 0 13 * *", time.UTC, "2026-10-17 00:00:00 +0000", "2026-11-13 00:00:00 +0000"},
+		{"dow only", "0 0 * * fri", time.UTC, "2026-10-17 00:00:00 +0000", "2026-10-23 00:00:00 +0000"},
+		{"dom ? dow", "0 0 ? * fri", time.UTC, "2026-10-17 00:00:00 +0000", "2026-10-23 00:00:00 +0000"},
+		{"starred step is and", "0 0 */2 * fri", time.UTC, "2026-10-17 00:00:00 +0000", "2026-10-23 00:00:00 +0000"},
+
+		// DST starts 2026-03-08 02:00 EST -> 03:00 EDT
+		{"skipped hour not run", "30 2 * * *", ny, "2026-03-07 12:00:00 -0500", "2026-03-09 02:30:00 -0400"},
+		{"hourly across gap", "0 * * * *", ny, "2026-03-08 01:00:00 -0500", "2026-03-08 03:00:00 -0400"},
+		{"minutely across gap", "*/30 * * * *", ny, "2026-03-08 01:45:00 -0500", "2026-03-08 03:00:00 -0400"},
+		{"daily after gap", "0 3 * * *", ny, "2026-03-08 01:00:00 -0500", "2026-03-08 03:00:00 -0400"},
+		{"midnight after gap", "@daily", ny, "2026-03-07 12:00:00 -0500", "2026-03-08 00:00:00 -0500"},
+
+		// DST ends 2026-11-01 02:00 EDT -> 01:00 EST
+		{"repeated hour first pass", "30 1 * * *", ny, "2026-11-01 00:00:00 -0400", "2026-11-01 01:30:00 -0400"},
+		{"repeated hour once", "30 1 * * *", ny, "2026-11-01 01:30:00 -0400", "2026-11-02 01:30:00 -0500"},
+		{"inside repeated hour", "30 1 * * *", ny, "2026-11-01 01:10:00 -0500", "2026-11-02 01:30:00 -0500"},
+		{"hour after repeat", "0 2 * * *", ny, "2026-11-01 01:30:00 -0400", "2026-11-01 02:00:00 -0500"},
+		{"hourly in repeat", "0 * * * *", ny, "2026-11-01 01:30:00 -0400", "2026-11-01 01:00:00 -0500"},
+		{"minutely in repeat", "*/30 * * * *", ny, "2026-11-01 01:30:00 -0400", "2026-11-01 01:00:00 -0500"},
+		{"range of hours", "0 1-3 * * *", ny, "2026-11-01 01:00:00 -0400", "2026-11-01 02:00:00 -0500"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := s.Next(cronTime(t, tt.loc, tt.from))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("Next = %s, want none", got.Format(cronTimeLayout))
+				}
+				return
+			}
+			if want := cronTime(t, tt.loc, tt.want); !got.Equal(want) || got.Location() != tt.loc {
+				t.Errorf("Next = %s, want %s", got.Format(cronTimeLayout), want.Format(cronTimeLayout))
+			}
+		})
+	}
+}
+
+func TestCronPrev(t *testing.T) {
+	ny := newYork(t)
+	tests := []struct {
+		name string
+		expr string
+		loc  *time.Location
+		from string
+		want string // "" = never
+	}{
+		{"at activation", "0 12 * * *", time.UTC, "2026-10-17 12:00:00 +0000", "2026-10-17 12:00:00 +0000"},
+		{"earlier today", "0 12 * * *", time.UTC, "2026-10-17 13:00:00 +0000", "2026-10-17 12:00:00 +0000"},
+		{"yesterday", "0 12 * * *", time.UTC, "2026-10-17 11:59:59 +0000", "2026-10-16 12:00:00 +0000"},
+		{"seconds", "*/15 * * * * *", time.UTC, "2026-10-17 10:00:14 +0000", "2026-10-17 10:00:00 +0000"},
+		{"weekday names", "0 9 * * mon-fri", time.UTC, "2026-10-18 12:00:00 +0000", "2026-10-16 09:00:00 +0000"},
+		{"month names", "0 0 1 feb *", time.UTC, "2026-01-15 00:00:00 +0000", "2025-02-01 00:00:00 +0000"},
+		{"@monthly", "@monthly", time.UTC, "2026-10-17 00:00:00 +0000", "2026-10-01 00:00:00 +0000"},
+		{"dom or dow", "0 0 13 * fri", time.UTC, "2026-11-12 00:00:00 +0000", "2026-11-06 00:00:00 +0000"},
+		{"dom only", "0 0 13 * *", time.UTC, "2026-11-12 00:00:00 +0000", "2026-10-13 00:00:00 +0000"},
+		{"never fires", "0 0 31 4 *", time.UTC, "2026-10-17 00:00:00 +0000", ""},
+
+		{"skipped hour not run", "30 2 * * *", ny, "2026-03-08 12:00:00 -0400", "2026-03-07 02:30:00 -0500"},
+		{"hourly across gap", "0 * * * *", ny, "2026-03-08 03:30:00 -0400", "2026-03-08 03:00:00 -0400"},
+		{"before gap", "0 * * * *", ny, "2026-03-08 03:00:00 -0400", "2026-03-08 03:00:00 -0400"},
+		{"repeated hour first pass", "30 1 * * *", ny, "2026-11-01 01:45:00 -0500", "2026-11-01 01:30:00 -0400"},
+		{"after repeat", "30 1 * * *", ny, "2026-11-01 03:00:00 -0500", "2026-11-01 01:30:00 -0400"},
+		{"hourly in repeat", "0 * * * *", ny, "2026-11-01 01:30:00 -0500", "2026-11-01 01:00:00 -0500"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := s.Prev(cronTime(t, tt.loc, tt.from))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("Prev = %s, want none", got.Format(cronTimeLayout))
+				}
+				return
+			}
+			if want := cronTime(t, tt.loc, tt.want); !got.Equal(want) {
+				t.Errorf("Prev = %s, want %s", got.Format(cronTimeLayout), want.Format(cronTimeLayout))
+			}
+		})
+	}
+}
+
+// Next and Prev agree: stepping forward from an activation and back
+// again returns to it, across both DST transitions.
+func TestCronNextPrevRoundTrip(t *testing.T) {
+	ny := newYork(t)
+	for _, expr := range []string{"*/20 * * * *", "30 1 * * *", "30 2 * * *", "0 */3 * * *", "0 0 13 * fri", "15 * * * * *"} {
+		s, err := ParseCron(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, from := range []string{"2026-03-07 20:00:00 -0500", "2026-10-31 20:00:00 -0400"} {
+			at := s.Next(cronTime(t, ny, from))
+			for i := 0; i < 50; i++ {
+				next := s.Next(at)
+				if !next.After(at) {
+					t.Fatalf("%s: Next(%s) = %s", expr, at.Format(cronTimeLayout), next.Format(cronTimeLayout))
+				}
+				if prev := s.Prev(next.Add(-time.Second)); !prev.Equal(at) {
+					t.Fatalf("%s: Prev before %s = %s, want %s", expr,
+						next.Format(cronTimeLayout), prev.Format(cronTimeLayout), at.Format(cronTimeLayout))
+				}
+				at = next
+			}
+		}
+	}
+}
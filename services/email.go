@@ -0,0 +1,78 @@
+package services
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sendgrid/sendgrid-go"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+// EmailNotifier sends through SendEmail.
+type EmailNotifier struct {
+	To string
+}
+
+func (e EmailNotifier) Notify(n Notification) (int, error) {
+	return SendEmail(e.To, n.Subject, n.Body)
+}
+
+// SendEmail delivers a plain-text email. With SMTP_ADDR set (host:port of
+// a local sink such as Mailpit, for development and tests) it is sent
+// there without authentication; otherwise through SendGrid
+// (SENDGRID_API_KEY). The sender is ALERT_FROM_EMAIL, falling back to
+// ALERT_EMAIL, then to.
+func SendEmail(to, subject, body string) (int, error) {
+	sender := os.Getenv("ALERT_FROM_EMAIL")
+	if sender == "" {
+		sender = os.Getenv("ALERT_EMAIL")
+	}
+	if sender == "" {
+		sender = to
+	}
+
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		return 0, sendSMTP(addr, sender, to, subject, body)
+	}
+
+	apiKey := os.Getenv("SENDGRID_API_KEY")
+	if apiKey == "" {
+		return 0, fmt.Errorf("SENDGRID_API_KEY not set")
+	}
+
+	from := mail.NewEmail("CronMonitor", sender)
+	toEmail := mail.NewEmail("", to)
+	message := mail.NewSingleEmail(from, subject, toEmail, body, body)
+	client := sendgrid.NewSendClient(apiKey)
+
+	response, err := client.Send(message)
+	if err != nil {
+		return 0, fmt.Errorf("sending email: %w", err)
+	}
+	if response.StatusCode >= 400 {
+		return response.StatusCode, fmt.Errorf("sendgrid error: status %d", response.StatusCode)
+	}
+	fmt.Printf("Email sent to %s. Status Code: %d\n", to, response.StatusCode)
+	return response.StatusCode, nil
+}
+
+func sendSMTP(addr, from, to, subject, body string) error {
+	// Header values must not smuggle in extra headers
+	clean := strings.NewReplacer("\r", " ", "\n", " ")
+	msg := "From: CronMonitor <" + clean.Replace(from) + ">\r\n" +
+		"To: " + clean.Replace(to) + "\r\n" +
+		"Subject: " + clean.Replace(subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+
+	if err := smtp.SendMail(addr, nil, from, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("sending email via %s: %w", addr, err)
+	}
+	fmt.Printf("Email sent to %s via %s\n", to, addr)
+	return nil
+}
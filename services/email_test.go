@@ -0,0 +1,140 @@
+package services
+
+import (
+	"bufio"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sunkEmail struct {
+	From, To, Data string
+}
+
+// smtpSink starts a minimal local SMTP server, points SMTP_ADDR at it
+// and returns the emails it receives.
+func smtpSink(t *testing.T) <-chan sunkEmail {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	t.Setenv("SMTP_ADDR", ln.Addr().String())
+
+	emails := make(chan sunkEmail, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, emails)
+		}
+	}()
+	return emails
+}
+
+func serveSMTP(conn net.Conn, emails chan<- sunkEmail) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+	var e sunkEmail
+	reply("220 sink")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+		switch verb := strings.ToUpper(strings.SplitN(cmd, " ", 2)[0]); verb {
+		case "EHLO", "HELO":
+			reply("250 sink")
+		case "MAIL":
+			e.From = strings.Trim(cmd[strings.Index(cmd, ":")+1:], "<> ")
+			reply("250 ok")
+		case "RCPT":
+			e.To = strings.Trim(cmd[strings.Index(cmd, ":")+1:], "<> ")
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			e.Data = data.String()
+			emails <- e
+			e = sunkEmail{}
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func nextEmail(t *testing.T, emails <-chan sunkEmail) sunkEmail {
+	t.Helper()
+	select {
+	case e := <-emails:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email received")
+		return sunkEmail{}
+	}
+}
+
+func noEmail(t *testing.T, emails <-chan sunkEmail) {
+	t.Helper()
+	select {
+	case e := <-emails:
+		t.Fatalf("unexpected email to %s: %q", e.To, e.Data)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+var linkToken = regexp.MustCompile(`\?token=([0-9a-f]{64})`)
+
+// emailToken returns the token of the link in an email.
+func emailToken(t *testing.T, e sunkEmail) string {
+	t.Helper()
+	m := linkToken.FindStringSubmatch(e.Data)
+	if m == nil {
+		t.Fatalf("no link in email: %q", e.Data)
+	}
+	return m[1]
+}
+
+func TestSendEmailSMTP(t *testing.T) {
+	emails := smtpSink(t)
+	t.Setenv("ALERT_FROM_EMAIL", "alerts@example.com")
+
+	if _, err := SendEmail("ops@example.com", "Job failed\r\nBcc: evil@example.com", "line 1\nline 2"); err != nil {
+		t.Fatal(err)
+	}
+	e := nextEmail(t, emails)
+	if e.From != "alerts@example.com" || e.To != "ops@example.com" {
+		t.Errorf("envelope = %s -> %s", e.From, e.To)
+	}
+	if !strings.Contains(e.Data, "Subject: Job failed  Bcc: evil@example.com\r\n") {
+		t.Errorf("subject header not sanitized: %q", e.Data)
+	}
+	if strings.Contains(e.Data, "\r\nBcc:") {
+		t.Errorf("header injected: %q", e.Data)
+	}
+	if !strings.HasSuffix(e.Data, "\r\n\r\nline 1\r\nline 2\r\n") {
+		t.Errorf("body = %q", e.Data)
+	}
+}
@@ -0,0 +1,1033 @@
+package services
+
+import (
+	"cronmonitor/models"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Expression rules: a small, side-effect-free language over a whole run.
+//
+//	metrics.rows_in > 0 && metrics.rows_out / metrics.rows_in < 0.9 || duration_ms > 600000
+//
+// Variables: metrics.<path> (any reported value, see LookupMetric),
+// duration_ms, exit_code, status, stderr.
+// Operators, lowest precedence first: ||, &&, == != =~ !~, < <= > >=,
+// + -, * / %, unary ! and -. Literals: numbers, "strings", true, false, null.
+// Functions: has(x), abs(n), min(a, b), max(a, b), len(x).
+//
+// Expressions are parsed and type-checked when the rule is created, and
+// compiled once per process (see compiledExpression).
+// Evaluation is pure: no loops, no I/O, bounded size and nesting, and
+// regexes are RE2 (linear time). Runtime errors such as a missing metric
+// in arithmetic or a division by zero make the rule not fire.
+const (
+	exprMaxLength = 2000
+	exprMaxDepth  = 64
+	// Compiled expressions kept by source; the cache starts over when full
+	exprCacheSize = 1024
+)
+
+// ExprError is a parse or type error; Pos is the 1-based column.
+type ExprError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ExprError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Pos, e.Msg)
+}
+
+func exprErrorf(pos int, format string, args ...interface{}) *ExprError {
+	return &ExprError{Pos: pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Expression is a parsed, type-checked rule expression.
+type Expression struct {
+	root exprNode
+}
+
+// CompileExpression parses and type-checks src. The result must be boolean.
+func CompileExpression(src string) (*Expression, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, &ExprError{Pos: 1, Msg: "expression is empty"}
+	}
+	if len(src) > exprMaxLength {
+		return nil, &ExprError{Pos: exprMaxLength, Msg: fmt.Sprintf("expression is longer than %d characters", exprMaxLength)}
+	}
+
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, exprErrorf(tok.pos, "unexpected %s", tok.describe())
+	}
+
+	t, err := checkExpr(root)
+	if err != nil {
+		return nil, err
+	}
+	if t != typeBool && t != typeAny {
+		return nil, exprErrorf(root.pos(), "expression must be a condition (true/false), got %s", t)
+	}
+	return &Expression{root: root}, nil
+}
+
+var exprCache = struct {
+	sync.Mutex
+	m map[string]*Expression
+}{m: map[string]*Expression{}}
+
+// compiledExpression returns the compiled src, compiling it only the
+// first time. Rules compile their expression when they are saved or
+// loaded, so evaluating a run does not parse it again. Compiled
+// expressions are immutable and safe to share.
+func compiledExpression(src string) (*Expression, error) {
+	exprCache.Lock()
+	e, ok := exprCache.m[src]
+	exprCache.Unlock()
+	if ok {
+		return e, nil
+	}
+
+	e, err := CompileExpression(src)
+	if err != nil {
+		return nil, err
+	}
+	exprCache.Lock()
+	if len(exprCache.m) >= exprCacheSize {
+		exprCache.m = map[string]*Expression{}
+	}
+	exprCache.m[src] = e
+	exprCache.Unlock()
+	return e, nil
+}
+
+// Eval runs the expression against a run. values holds every variable
+// that was read, for alert context.
+func (e *Expression) Eval(run models.JobRun) (violated bool, values map[string]interface{}, err error) {
+	env := &exprEnv{run: run, values: map[string]interface{}{}}
+	v, err := env.eval(e.root)
+	if err != nil {
+		return false, env.values, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, env.values, fmt.Errorf("expression returned %s, not true/false", describeValue(v))
+	}
+	return b, env.values, nil
+}
+
+// --- Lexer ---
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokDot
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string // operator / identifier text, or decoded string literal
+	num  float64
+	pos  int // byte offset
+}
+
+func (t token) describe() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+var exprOperators = []string{"||", "&&", "==", "!=", "=~", "!~", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "!"}
+
+func lexExpr(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		ch := src[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch >= '0' && ch <= '9':
+			start := i
+			for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+				i++
+			}
+			if i+1 < len(src) && src[i] == '.' && src[i+1] >= '0' && src[i+1] <= '9' {
+				i++
+				for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+					i++
+				}
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				j := i + 1
+				if j < len(src) && (src[j] == '+' || src[j] == '-') {
+					j++
+				}
+				if j < len(src) && src[j] >= '0' && src[j] <= '9' {
+					i = j
+					for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+						i++
+					}
+				}
+			}
+			f, err := strconv.ParseFloat(src[start:i], 64)
+			if err != nil {
+				return nil, exprErrorf(start, "invalid number %q", src[start:i])
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[start:i], num: f, pos: start})
+		case ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z'):
+			start := i
+			for i < len(src) && (src[i] == '_' || (src[i] >= 'a' && src[i] <= 'z') || (src[i] >= 'A' && src[i] <= 'Z') || (src[i] >= '0' && src[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[start:i], pos: start})
+		case ch == '"' || ch == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			closed := false
+			for i < len(src) {
+				c := src[i]
+				if c == ch {
+					closed = true
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(src) {
+					switch src[i+1] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					case '\\', '"', '\'':
+						sb.WriteByte(src[i+1])
+					default:
+						return nil, exprErrorf(i, "unknown escape \\%c", src[i+1])
+					}
+					i += 2
+					continue
+				}
+				sb.WriteByte(c)
+				i++
+			}
+			if !closed {
+				return nil, exprErrorf(start, "unterminated string")
+			}
+			tokens = append(tokens, token{kind: tokString, text: sb.String(), pos: start})
+		case ch == '(':
+			tokens = append(tokens, token{kind: tokLParen, text: "(", pos: i})
+			i++
+		case ch == ')':
+			tokens = append(tokens, token{kind: tokRParen, text: ")", pos: i})
+			i++
+		case ch == '[':
+			tokens = append(tokens, token{kind: tokLBracket, text: "[", pos: i})
+			i++
+		case ch == ']':
+			tokens = append(tokens, token{kind: tokRBracket, text: "]", pos: i})
+			i++
+		case ch == '.':
+			tokens = append(tokens, token{kind: tokDot, text: ".", pos: i})
+			i++
+		case ch == ',':
+			tokens = append(tokens, token{kind: tokComma, text: ",", pos: i})
+			i++
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				r, _ := utf8.DecodeRuneInString(src[i:])
+				return nil, exprErrorf(i, "unexpected character %q", r)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+// --- AST ---
+
+type exprNode interface {
+	pos() int
+}
+
+type literalNode struct {
+	at    int
+	value interface{} // float64, string, bool or nil
+}
+
+type varNode struct {
+	at   int
+	root string   // metrics, duration_ms, ...
+	path []string // metrics only
+	name string   // as written, for messages and alert context
+}
+
+type unaryNode struct {
+	at int
+	op string
+	x  exprNode
+}
+
+type binaryNode struct {
+	at   int
+	op   string
+	l, r exprNode
+	re   *regexp.Regexp // =~ / !~
+}
+
+type callNode struct {
+	at   int
+	fn   string
+	args []exprNode
+}
+
+func (n *literalNode) pos() int { return n.at }
+func (n *varNode) pos() int     { return n.at }
+func (n *unaryNode) pos() int   { return n.at }
+func (n *binaryNode) pos() int  { return n.at }
+func (n *callNode) pos() int    { return n.at }
+
+// --- Parser (precedence climbing) ---
+
+type exprParser struct {
+	tokens []token
+	i      int
+	depth  int
+}
+
+func (p *exprParser) peek() token { return p.tokens[p.i] }
+
+func (p *exprParser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *exprParser) acceptOp(ops ...string) (token, bool) {
+	t := p.peek()
+	if t.kind != tokOp {
+		return t, false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.i++
+			return t, true
+		}
+	}
+	return t, false
+}
+
+func (p *exprParser) binaryLevel(ops []string, operand func() (exprNode, error)) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.acceptOp(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{at: t.pos, op: t.text, l: left, r: right}
+	}
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > exprMaxDepth {
+		return nil, exprErrorf(p.peek().pos, "expression is nested too deeply")
+	}
+	return p.binaryLevel([]string{"||"}, p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.binaryLevel([]string{"&&"}, p.parseEquality)
+}
+
+func (p *exprParser) parseEquality() (exprNode, error) {
+	left, err := p.parseCompare()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.acceptOp("==", "!=", "=~", "!~")
+		if !ok {
+			return left, nil
+		}
+		if t.text == "=~" || t.text == "!~" {
+			// The pattern must be a literal so it is compiled (and checked) once
+			pat := p.next()
+			if pat.kind != tokString {
+				return nil, exprErrorf(pat.pos, "%s needs a string literal pattern, got %s", t.text, pat.describe())
+			}
+			re, err := regexp.Compile(pat.text)
+			if err != nil {
+				return nil, exprErrorf(pat.pos, "invalid regular expression: %v", err)
+			}
+			left = &binaryNode{at: t.pos, op: t.text, l: left, r: &literalNode{at: pat.pos, value: pat.text}, re: re}
+			continue
+		}
+		right, err := p.parseCompare()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{at: t.pos, op: t.text, l: left, r: right}
+	}
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) {
+	return p.binaryLevel([]string{"<=", ">=", "<", ">"}, p.parseAdd)
+}
+
+func (p *exprParser) parseAdd() (exprNode, error) {
+	return p.binaryLevel([]string{"+", "-"}, p.parseMul)
+}
+
+func (p *exprParser) parseMul() (exprNode, error) {
+	return p.binaryLevel([]string{"*", "/", "%"}, p.parseUnary)
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if t, ok := p.acceptOp("!", "-"); ok {
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > exprMaxDepth {
+			return nil, exprErrorf(t.pos, "expression is nested too deeply")
+		}
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{at: t.pos, op: t.text, x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+var exprRootVars = map[string]bool{
+	"metrics": true, "duration_ms": true, "exit_code": true, "status": true, "stderr": true,
+}
+
+var exprFuncArity = map[string]int{
+	"has": 1, "abs": 1, "len": 1, "min": 2, "max": 2,
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return &literalNode{at: t.pos, value: t.num}, nil
+	case tokString:
+		return &literalNode{at: t.pos, value: t.text}, nil
+	case tokLParen:
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokRParen {
+			return nil, exprErrorf(c.pos, "expected ) to close ( at column %d, got %s", t.pos+1, c.describe())
+		}
+		return x, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{at: t.pos, value: true}, nil
+		case "false":
+			return &literalNode{at: t.pos, value: false}, nil
+		case "null":
+			return &literalNode{at: t.pos, value: nil}, nil
+		}
+		if p.peek().kind == tokLParen {
+			return p.parseCall(t)
+		}
+		if !exprRootVars[t.text] {
+			return nil, exprErrorf(t.pos, "unknown variable %q (expected metrics.<name>, duration_ms, exit_code, status or stderr)", t.text)
+		}
+		return p.parseVar(t)
+	default:
+		return nil, exprErrorf(t.pos, "unexpected %s", t.describe())
+	}
+}
+
+func (p *exprParser) parseVar(root token) (exprNode, error) {
+	v := &varNode{at: root.pos, root: root.text}
+	name := root.text
+	for {
+		switch t := p.peek(); t.kind {
+		case tokDot:
+			p.next()
+			seg := p.next()
+			if seg.kind != tokIdent && seg.kind != tokNumber {
+				return nil, exprErrorf(seg.pos, "expected a name after '.', got %s", seg.describe())
+			}
+			v.path = append(v.path, seg.text)
+			name += "." + seg.text
+		case tokLBracket:
+			p.next()
+			seg := p.next()
+			switch seg.kind {
+			case tokString:
+				name += "[" + strconv.Quote(seg.text) + "]"
+			case tokNumber:
+				if seg.num != math.Trunc(seg.num) || seg.num < 0 {
+					return nil, exprErrorf(seg.pos, "index must be a non-negative integer")
+				}
+				name += "[" + seg.text + "]"
+			default:
+				return nil, exprErrorf(seg.pos, "expected a string key or index, got %s", seg.describe())
+			}
+			if c := p.next(); c.kind != tokRBracket {
+				return nil, exprErrorf(c.pos, "expected ], got %s", c.describe())
+			}
+			v.path = append(v.path, seg.text)
+		default:
+			if v.root != "metrics" && len(v.path) > 0 {
+				return nil, exprErrorf(root.pos, "%s has no fields", v.root)
+			}
+			v.name = name
+			return v, nil
+		}
+	}
+}
+
+func (p *exprParser) parseCall(fn token) (exprNode, error) {
+	arity, ok := exprFuncArity[fn.text]
+	if !ok {
+		return nil, exprErrorf(fn.pos, "unknown function %q (expected has, abs, len, min or max)", fn.text)
+	}
+	p.next() // (
+
+	call := &callNode{at: fn.pos, fn: fn.text}
+	if p.peek().kind != tokRParen {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next()
+		}
+	}
+	if c := p.next(); c.kind != tokRParen {
+		return nil, exprErrorf(c.pos, "expected ) after arguments to %s, got %s", fn.text, c.describe())
+	}
+	if len(call.args) != arity {
+		return nil, exprErrorf(fn.pos, "%s takes %d argument(s), got %d", fn.text, arity, len(call.args))
+	}
+	if fn.text == "has" {
+		if _, ok := call.args[0].(*varNode); !ok {
+			return nil, exprErrorf(call.args[0].pos(), "has() takes a variable such as metrics.rows")
+		}
+	}
+	return call, nil
+}
+
+// --- Type checking ---
+
+type exprType int
+
+const (
+	typeAny exprType = iota // metrics values: known only at run time
+	typeNumber
+	typeString
+	typeBool
+	typeNull
+)
+
+func (t exprType) String() string {
+	switch t {
+	case typeNumber:
+		return "number"
+	case typeString:
+		return "string"
+	case typeBool:
+		return "boolean"
+	case typeNull:
+		return "null"
+	default:
+		return "any"
+	}
+}
+
+func literalType(v interface{}) exprType {
+	switch v.(type) {
+	case float64:
+		return typeNumber
+	case string:
+		return typeString
+	case bool:
+		return typeBool
+	default:
+		return typeNull
+	}
+}
+
+func expectType(n exprNode, got exprType, want exprType, what string) error {
+	if got != typeAny && got != want {
+		return exprErrorf(n.pos(), "%s needs a %s, got %s", what, want, got)
+	}
+	return nil
+}
+
+func checkExpr(n exprNode) (exprType, error) {
+	switch n := n.(type) {
+	case *literalNode:
+		return literalType(n.value), nil
+
+	case *varNode:
+		switch n.root {
+		case "duration_ms":
+			return typeNumber, nil
+		case "status", "stderr":
+			return typeString, nil
+		default: // metrics.*, exit_code (may be null)
+			return typeAny, nil
+		}
+
+	case *unaryNode:
+		t, err := checkExpr(n.x)
+		if err != nil {
+			return 0, err
+		}
+		if n.op == "!" {
+			return typeBool, expectType(n.x, t, typeBool, "!")
+		}
+		return typeNumber, expectType(n.x, t, typeNumber, "unary -")
+
+	case *binaryNode:
+		lt, err := checkExpr(n.l)
+		if err != nil {
+			return 0, err
+		}
+		rt, err := checkExpr(n.r)
+		if err != nil {
+			return 0, err
+		}
+		switch n.op {
+		case "&&", "||":
+			if err := expectType(n.l, lt, typeBool, n.op); err != nil {
+				return 0, err
+			}
+			return typeBool, expectType(n.r, rt, typeBool, n.op)
+		case "+", "-", "*", "/", "%":
+			if err := expectType(n.l, lt, typeNumber, n.op); err != nil {
+				return 0, err
+			}
+			return typeNumber, expectType(n.r, rt, typeNumber, n.op)
+		case "<", "<=", ">", ">=":
+			if lt == typeString && rt == typeString {
+				return typeBool, nil
+			}
+			if lt == typeString || rt == typeString {
+				if lt != typeAny && rt != typeAny {
+					return 0, exprErrorf(n.at, "cannot compare %s with %s using %s", lt, rt, n.op)
+				}
+				return typeBool, nil
+			}
+			if err := expectType(n.l, lt, typeNumber, n.op); err != nil {
+				return 0, err
+			}
+			return typeBool, expectType(n.r, rt, typeNumber, n.op)
+		case "==", "!=":
+			if lt != typeAny && rt != typeAny && lt != typeNull && rt != typeNull && lt != rt {
+				return 0, exprErrorf(n.at, "cannot compare %s with %s using %s", lt, rt, n.op)
+			}
+			return typeBool, nil
+		case "=~", "!~":
+			return typeBool, expectType(n.l, lt, typeString, n.op)
+		}
+
+	case *callNode:
+		var types []exprType
+		for _, arg := range n.args {
+			t, err := checkExpr(arg)
+			if err != nil {
+				return 0, err
+			}
+			types = append(types, t)
+		}
+		switch n.fn {
+		case "has":
+			return typeBool, nil
+		case "len":
+			if types[0] != typeAny && types[0] != typeString {
+				return 0, exprErrorf(n.args[0].pos(), "len() needs a string or metric, got %s", types[0])
+			}
+			return typeNumber, nil
+		default: // abs, min, max
+			for i, t := range types {
+				if err := expectType(n.args[i], t, typeNumber, n.fn+"()"); err != nil {
+					return 0, err
+				}
+			}
+			return typeNumber, nil
+		}
+	}
+	return 0, exprErrorf(n.pos(), "unsupported expression")
+}
+
+// --- Evaluation ---
+
+type exprEnv struct {
+	run    models.JobRun
+	values map[string]interface{}
+}
+
+func (env *exprEnv) lookup(v *varNode) interface{} {
+	var value interface{}
+	switch v.root {
+	case "duration_ms":
+		value = float64(env.run.DurationMs)
+	case "status":
+		value = env.run.Status
+	case "stderr":
+		value = env.run.Stderr
+	case "exit_code":
+		if env.run.ExitCode != nil {
+			value = float64(*env.run.ExitCode)
+		}
+	case "metrics":
+		var current interface{} = env.run.Metrics
+		for _, seg := range v.path {
+			switch node := current.(type) {
+			case map[string]interface{}:
+				current = node[seg]
+			case []interface{}:
+				i, err := strconv.Atoi(seg)
+				if err != nil || i < 0 || i >= len(node) {
+					current = nil
+				} else {
+					current = node[i]
+				}
+			default:
+				current = nil
+			}
+		}
+		value = current
+	}
+	if v.root != "stderr" { // stderr can be large; keep alert context small
+		env.values[v.name] = value
+	}
+	return value
+}
+
+func (env *exprEnv) number(n exprNode) (float64, error) {
+	v, err := env.eval(n)
+	if err != nil {
+		return 0, err
+	}
+	f, ok := toFloat64(v)
+	if !ok {
+		return 0, fmt.Errorf("%s is %s, not a number", exprName(n), describeValue(v))
+	}
+	return f, nil
+}
+
+func (env *exprEnv) boolean(n exprNode) (bool, error) {
+	v, err := env.eval(n)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s is %s, not true/false", exprName(n), describeValue(v))
+	}
+	return b, nil
+}
+
+func (env *exprEnv) eval(n exprNode) (interface{}, error) {
+	switch n := n.(type) {
+	case *literalNode:
+		return n.value, nil
+
+	case *varNode:
+		return env.lookup(n), nil
+
+	case *unaryNode:
+		if n.op == "!" {
+			b, err := env.boolean(n.x)
+			return !b, err
+		}
+		f, err := env.number(n.x)
+		return -f, err
+
+	case *binaryNode:
+		switch n.op {
+		// An operand that can't be evaluated (missing metric) doesn't decide
+		// the result if the other one does: "false && x" is false and
+		// "true || x" is true either way round.
+		case "&&":
+			l, lerr := env.boolean(n.l)
+			if lerr == nil && !l {
+				return false, nil
+			}
+			r, rerr := env.boolean(n.r)
+			if rerr == nil && !r {
+				return false, nil
+			}
+			if lerr != nil {
+				return false, lerr
+			}
+			return r, rerr
+		case "||":
+			l, lerr := env.boolean(n.l)
+			if lerr == nil && l {
+				return true, nil
+			}
+			r, rerr := env.boolean(n.r)
+			if rerr == nil && r {
+				return true, nil
+			}
+			if lerr != nil {
+				return false, lerr
+			}
+			return false, rerr
+		case "+", "-", "*", "/", "%":
+			l, err := env.number(n.l)
+			if err != nil {
+				return nil, err
+			}
+			r, err := env.number(n.r)
+			if err != nil {
+				return nil, err
+			}
+			return arithmetic(n, l, r)
+		case "=~", "!~":
+			l, err := env.eval(n.l)
+			if err != nil {
+				return nil, err
+			}
+			str, ok := metricString(l)
+			if !ok {
+				return nil, fmt.Errorf("%s is %s, not a string", exprName(n.l), describeValue(l))
+			}
+			return n.re.MatchString(str) == (n.op == "=~"), nil
+		default: // comparisons
+			l, err := env.eval(n.l)
+			if err != nil {
+				return nil, err
+			}
+			r, err := env.eval(n.r)
+			if err != nil {
+				return nil, err
+			}
+			return compareValues(n, l, r)
+		}
+
+	case *callNode:
+		return env.call(n)
+	}
+	return nil, fmt.Errorf("unsupported expression")
+}
+
+func arithmetic(n *binaryNode, l, r float64) (interface{}, error) {
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero (%s is 0)", exprName(n.r))
+		}
+		return l / r, nil
+	default:
+		if r == 0 {
+			return nil, fmt.Errorf("modulo by zero (%s is 0)", exprName(n.r))
+		}
+		return math.Mod(l, r), nil
+	}
+}
+
+func compareValues(n *binaryNode, l, r interface{}) (interface{}, error) {
+	if n.op == "==" || n.op == "!=" {
+		equal, err := valuesEqual(l, r)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s %s: %v", exprName(n.l), n.op, exprName(n.r), err)
+		}
+		return equal == (n.op == "=="), nil
+	}
+
+	// Ordering: strings compare as strings, everything else numerically
+	ls, lIsString := l.(string)
+	rs, rIsString := r.(string)
+	var c int
+	if lIsString && rIsString {
+		c = strings.Compare(ls, rs)
+		if lf, lok := toFloat64(ls); lok {
+			if rf, rok := toFloat64(rs); rok {
+				c = compareFloats(lf, rf)
+			}
+		}
+	} else {
+		lf, ok := toFloat64(l)
+		if !ok {
+			return nil, fmt.Errorf("%s is %s, not a number", exprName(n.l), describeValue(l))
+		}
+		rf, ok := toFloat64(r)
+		if !ok {
+			return nil, fmt.Errorf("%s is %s, not a number", exprName(n.r), describeValue(r))
+		}
+		c = compareFloats(lf, rf)
+	}
+
+	switch n.op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// valuesEqual compares scalars; a number equals a numeric string with the
+// same value, as in threshold rules.
+func valuesEqual(l, r interface{}) (bool, error) {
+	if l == nil || r == nil {
+		return l == nil && r == nil, nil
+	}
+	_, lIsNum := l.(float64)
+	_, rIsNum := r.(float64)
+	if lIsNum || rIsNum {
+		lf, lok := toFloat64(l)
+		rf, rok := toFloat64(r)
+		return lok && rok && lf == rf, nil
+	}
+	switch lv := l.(type) {
+	case string:
+		rv, ok := r.(string)
+		return ok && lv == rv, nil
+	case bool:
+		rv, ok := r.(bool)
+		return ok && lv == rv, nil
+	}
+	return false, fmt.Errorf("cannot compare %s with %s", describeValue(l), describeValue(r))
+}
+
+func (env *exprEnv) call(n *callNode) (interface{}, error) {
+	switch n.fn {
+	case "has":
+		v, err := env.eval(n.args[0])
+		return v != nil, err
+	case "len":
+		v, err := env.eval(n.args[0])
+		if err != nil {
+			return nil, err
+		}
+		switch t := v.(type) {
+		case string:
+			return float64(utf8.RuneCountInString(t)), nil
+		case []interface{}:
+			return float64(len(t)), nil
+		case map[string]interface{}:
+			return float64(len(t)), nil
+		}
+		return nil, fmt.Errorf("len(%s): %s has no length", exprName(n.args[0]), describeValue(v))
+	case "abs":
+		f, err := env.number(n.args[0])
+		return math.Abs(f), err
+	default: // min, max
+		a, err := env.number(n.args[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := env.number(n.args[1])
+		if err != nil {
+			return nil, err
+		}
+		if n.fn == "min" {
+			return math.Min(a, b), nil
+		}
+		return math.Max(a, b), nil
+	}
+}
+
+// exprName names a node in runtime errors.
+func exprName(n exprNode) string {
+	switch n := n.(type) {
+	case *varNode:
+		return n.name
+	case *literalNode:
+		return describeValue(n.value)
+	default:
+		return fmt.Sprintf("the expression at column %d", n.pos()+1)
+	}
+}
+
+func describeValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "missing"
+	case string:
+		return strconv.Quote(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "a list"
+	default:
+		return fmt.Sprintf("%v", t)
+	}
+}
@@ -0,0 +1,299 @@
+package services
+
+import (
+	"cronmonitor/models"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func exprTestRun() models.JobRun {
+	exit := 2
+	return models.JobRun{
+		Status:     "fail",
+		DurationMs: 1500,
+		ExitCode:   &exit,
+		Stderr:     "ERROR: disk full\nretrying",
+		Metrics: map[string]interface{}{
+			"rows_in":  float64(100),
+			"rows_out": float64(80),
+			"zero":     float64(0),
+			"count":    "42",
+			"name":     "nightly",
+			"ok":       true,
+			"nothing":  nil,
+			"tables":   []interface{}{"users", "orders"},
+			"db":       map[string]interface{}{"primary": map[string]interface{}{"lag": float64(3)}},
+		},
+	}
+}
+
+func evalExpr(t *testing.T, src string) (bool, error) {
+	t.Helper()
+	e, err := CompileExpression(src)
+	if err != nil {
+		t.Fatalf("CompileExpression(%q): %v", src, err)
+	}
+	v, _, err := e.Eval(exprTestRun())
+	return v, err
+}
+
+func TestExprPrecedence(t *testing.T) {
+	for _, tt := range []struct {
+		src  string
+		want bool
+	}{
+		{"1 + 2 * 3 == 7", true},
+		{"(1 + 2) * 3 == 9", true},
+		{"10 - 4 - 3 == 3", true},
+		{"12 / 3 / 2 == 2", true},
+		{"2 * 3 % 4 == 2", true},
+		{"7 % 3 == 1", true},
+		{"-2 * 3 == -6", true},
+		{"- -1 == 1", true},
+		{"1 - -1 == 2", true},
+		{"1 + 2 < 4 && 2 * 2 >= 4", true},
+		{"1 < 2 == true", true},
+		{"1 > 2 == false", true},
+		{"true || false && false", true},
+		{"(true || false) && false", false},
+		{"false && true || true", true},
+		{"!false && false", false},
+		{"!(false && false)", true},
+		{"!!true", true},
+		{"1 == 1 != false", true},
+		{`"b" > "a" && "10" > "9"`, true},
+		{"metrics.rows_out / metrics.rows_in < 0.9", true},
+		{"metrics.rows_in > 0 && metrics.rows_out / metrics.rows_in < 0.5 || duration_ms > 1000", true},
+		{"metrics.rows_in > 0 && (metrics.rows_out / metrics.rows_in < 0.5 || duration_ms > 2000)", false},
+		{"metrics.db.primary.lag >= 3 && metrics.tables[1] == \"orders\"", true},
+		{`metrics["db"]["primary"]["lag"] == 3`, true},
+		{"metrics.count == 42 && metrics.count > 9", true},
+		{"metrics.ok && status == \"fail\" && exit_code == 2", true},
+		{"metrics.nothing == null && !has(metrics.nothing) && !has(metrics.missing) && has(metrics.name)", true},
+		{`stderr =~ "(?m)^ERROR" && metrics.name !~ "^weekly"`, true},
+		{"len(metrics.tables) == 2 && len(metrics.name) == 7 && len(metrics.db) == 1", true},
+		{"abs(-3) == 3 && min(1, 2) == 1 && max(1, 2) == 2", true},
+		{"min(metrics.rows_in, 10) + max(1, 2) * 2 == 14", true},
+	} {
+		got, err := evalExpr(t, tt.src)
+		if err != nil || got != tt.want {
+			t.Errorf("%s = %v, %v; want %v", tt.src, got, err, tt.want)
+		}
+	}
+}
+
+func TestExprCompileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		src string
+		pos int
+		msg string
+	}{
+		{"", 1, "empty"},
+		{"   ", 1, "empty"},
+		{strings.Repeat("1", exprMaxLength+1), exprMaxLength, "longer than"},
+		{strings.Repeat("!", exprMaxDepth+1) + "true", exprMaxDepth, "nested too deeply"},
+
+		// Syntax
+		{"(1 < 2", 7, "expected )"},
+		{"1 < 2)", 6, "unexpected"},
+		{"1 <", 4, "unexpected"},
+		{"foo > 1", 1, "unknown variable"},
+		{"bar(1) > 1", 1, "unknown function"},
+		{"min(1) > 0", 1, "takes 2 argument(s), got 1"},
+		{"has(1)", 5, "has() takes a variable"},
+		{"status.code == 1", 1, "has no fields"},
+		{`metrics.a =~ "("`, 14, "invalid regular expression"},
+		{"metrics.a =~ metrics.b", 14, "string literal pattern"},
+		{"metrics[1.5] == 1", 9, "non-negative integer"},
+
+		// Types
+		{"1 + 2", 3, "must be a condition"},
+		{"status", 1, "must be a condition"},
+		{`1 + "a" == 2`, 5, "+ needs a number, got string"},
+		{"!1", 2, "! needs a boolean, got number"},
+		{`-"a" < 0`, 2, "unary - needs a number"},
+		{`"a" < 1`, 5, "cannot compare string with number"},
+		{`1 == "a"`, 3, "cannot compare number with string"},
+		{"true == 1", 6, "cannot compare boolean with number"},
+		{"true && 1", 9, "&& needs a boolean, got number"},
+		{"duration_ms =~ \"x\"", 1, "=~ needs a string, got number"},
+		{"len(1) > 0", 5, "len() needs a string or metric"},
+		{`abs("x") > 0`, 5, "abs() needs a number"},
+		{"duration_ms && true", 1, "&& needs a boolean"},
+	} {
+		_, err := CompileExpression(tt.src)
+		var exprErr *ExprError
+		if !errors.As(err, &exprErr) {
+			t.Errorf("%q: err = %v, want *ExprError", tt.src, err)
+			continue
+		}
+		if exprErr.Pos != tt.pos || !strings.Contains(exprErr.Msg, tt.msg) {
+			t.Errorf("%q: err = %v, want column %d: ...%s...", tt.src, err, tt.pos, tt.msg)
+		}
+	}
+}
+
+func TestExprRuntimeErrors(t *testing.T) {
+	for _, tt := range []struct {
+		src string
+		msg string
+	}{
+		{"metrics.rows_in / metrics.zero > 1", "division by zero (metrics.zero is 0)"},
+		{"metrics.rows_in / 0 > 1", "division by zero"},
+		{"metrics.rows_in % metrics.zero == 0", "modulo by zero"},
+		{"metrics.rows_in / (metrics.rows_out - 80) > 1", "division by zero (the expression at column"},
+		{"metrics.missing / 2 > 1", "metrics.missing is missing, not a number"},
+		{"metrics.name > 1", `metrics.name is "nightly", not a number`},
+		{"metrics.ok =~ \"x\"", ""},
+		{"metrics.tables =~ \"x\"", "metrics.tables is a list, not a string"},
+		{"metrics.rows_in && true", "metrics.rows_in is 100, not true/false"},
+		{`metrics.tables == "x"`, "cannot compare"},
+		{"len(metrics.rows_in) > 0", "has no length"},
+		{"metrics.name", `expression returned "nightly"`},
+	} {
+		got, err := evalExpr(t, tt.src)
+		if tt.msg == "" {
+			// Booleans render as strings for regex matching
+			if err != nil {
+				t.Errorf("%s: %v", tt.src, err)
+			}
+			continue
+		}
+		if err == nil || got || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%s = %v, %v; want error %q", tt.src, got, err, tt.msg)
+		}
+	}
+}
+
+// A logical operand that fails to evaluate only matters when the other
+// side doesn't decide the result.
+func TestExprLogicalOperandErrors(t *testing.T) {
+	const missing = "metrics.missing is missing, not a number"
+	for _, tt := range []struct {
+		src  string
+		want bool
+		msg  string // "" for no error
+	}{
+		{"metrics.missing > 1 || true", true, ""},
+		{"true || metrics.missing > 1", true, ""},
+		{"metrics.missing > 1 || false", false, missing},
+		{"false || metrics.missing > 1", false, missing},
+		{"metrics.missing > 1 && false", false, ""},
+		{"false && metrics.missing > 1", false, ""},
+		{"metrics.missing > 1 && true", false, missing},
+		{"true && metrics.missing > 1", false, missing},
+		{"metrics.missing > 1 || metrics.zero / 0 > 1", false, missing},
+		{"metrics.missing > 1 && metrics.zero / 0 > 1", false, missing},
+		{"metrics.rows_in && false", false, ""},
+		{"metrics.rows_in || true", true, ""},
+		{"!(metrics.missing > 1 || true)", false, ""},
+	} {
+		got, err := evalExpr(t, tt.src)
+		if got != tt.want || (tt.msg == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.msg)) {
+			t.Errorf("%s = %v, %v; want %v, %q", tt.src, got, err, tt.want, tt.msg)
+		}
+	}
+}
+
+// The rule from the README fires on a slow run even when the row
+// metrics are missing.
+func TestExprSlowRunWithoutMetrics(t *testing.T) {
+	const src = "metrics.rows_in > 0 && metrics.rows_out / metrics.rows_in < 0.9 || duration_ms > 600000"
+	rule := models.Rule{RuleType: RuleExpression, Expression: src}
+
+	for _, tt := range []struct {
+		durationMs int
+		want       bool
+	}{
+		{700000, true},
+		{1000, false},
+	} {
+		run := models.JobRun{Status: "ok", DurationMs: tt.durationMs, Metrics: map[string]interface{}{}}
+		if got, _ := EvaluateRule(run, rule); got != tt.want {
+			t.Errorf("duration_ms=%d: violated = %v, want %v", tt.durationMs, got, tt.want)
+		}
+	}
+}
+
+// Expression rules fail open: a run the expression cannot be evaluated
+// for does not violate the rule, and the values read are still reported.
+func TestEvaluateExpressionRule(t *testing.T) {
+	run := exprTestRun()
+	for _, tt := range []struct {
+		expr string
+		want bool
+	}{
+		{"metrics.rows_out / metrics.rows_in < 0.9", true},
+		{"metrics.rows_out / metrics.zero < 0.9", false},
+		{"metrics.rows_out < ", false}, // invalid, never saved
+	} {
+		got, val := EvaluateRule(run, models.Rule{RuleType: RuleExpression, Expression: tt.expr})
+		if got != tt.want {
+			t.Errorf("%s: violated = %v, want %v", tt.expr, got, tt.want)
+		}
+		if values, ok := val.(map[string]interface{}); ok && values["metrics.rows_out"] != float64(80) {
+			t.Errorf("%s: values = %v", tt.expr, values)
+		}
+	}
+}
+
+func TestCompiledExpressionCached(t *testing.T) {
+	src := "metrics.rows_in > 0 && duration_ms < 100000"
+	a, err := compiledExpression(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := compiledExpression(src)
+	if err != nil || a != b {
+		t.Errorf("second compile = %p, %v; want the cached %p", b, err, a)
+	}
+	if _, err := compiledExpression("metrics.rows_in >"); err == nil {
+		t.Error("invalid expression compiled")
+	}
+
+	// Saving a rule compiles its expression
+	rule := models.Rule{RuleType: RuleExpression, Expression: "exit_code != 0 && duration_ms > 42"}
+	if err := ValidateRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	exprCache.Lock()
+	_, ok := exprCache.m[rule.Expression]
+	exprCache.Unlock()
+	if !ok {
+		t.Error("validated expression not cached")
+	}
+}
+
+func FuzzCompile(f *testing.F) {
+	for _, seed := range []string{
+		"metrics.rows_in > 0 && metrics.rows_out / metrics.rows_in < 0.9 || duration_ms > 600000",
+		`stderr =~ "(?i)timeout" && !has(metrics.retry)`,
+		`metrics["db"]["primary"].lag >= 3 && metrics.tables[1] == "orders"`,
+		"len(metrics.name) == 7 && abs(-3) == min(3, max(1, 2)) + 1",
+		"exit_code == null || status != \"ok\"",
+		"-(-(1)) % 2 == 1.5e3",
+		`"é\n\"" < "z"`,
+		"((((true))))",
+		"",
+	} {
+		f.Add(seed)
+	}
+	run := exprTestRun()
+	f.Fuzz(func(t *testing.T, src string) {
+		e, err := CompileExpression(src)
+		if err != nil {
+			var exprErr *ExprError
+			if !errors.As(err, &exprErr) {
+				t.Fatalf("%q: error %v is not an *ExprError", src, err)
+			}
+			if exprErr.Pos < 1 || exprErr.Pos > len(src)+1 {
+				t.Fatalf("%q: error column %d out of range", src, exprErr.Pos)
+			}
+			return
+		}
+		// Anything that compiles evaluates without panicking
+		e.Eval(run)
+		e.Eval(models.JobRun{})
+	})
+}
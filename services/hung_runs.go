@@ -0,0 +1,108 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"fmt"
+	"time"
+)
+
+const hungRunAlertMsg = "Job started but did not finish within max runtime"
+
+// CheckForHungRuns alerts on runs opened by a start ping that never
+// received a finish ping within the job's max_runtime_minutes.
+// Each hung run alerts once.
+func CheckForHungRuns() {
+	// Safety: Never panic
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("CheckForHungRuns panic: %v\n", r)
+		}
+	}()
+
+	conn := db.GetDB()
+	rows, err := conn.Query(`
+		SELECT r.id, r.started_at, j.id, j.name, j.max_runtime_minutes
+		FROM job_runs r
+		JOIN jobs j ON j.id = r.job_id
+		WHERE r.status = 'running'
+		AND j.max_runtime_minutes > 0
+		AND r.started_at < NOW() - make_interval(mins => j.max_runtime_minutes)
+		AND NOT EXISTS (
+			SELECT 1 FROM alerts a WHERE a.run_id = r.id AND a.message = $1
+		)
+	`, hungRunAlertMsg)
+	if err != nil {
+		fmt.Printf("Error fetching running jobs for check: %v\n", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var job models.Job
+		var run models.JobRun
+		var startedAt time.Time
+		if err := rows.Scan(&run.ID, &startedAt, &job.ID, &job.Name, &job.MaxRuntimeMinutes); err != nil {
+			fmt.Printf("Error scanning running job: %v\n", err)
+			continue
+		}
+		run.JobID = job.ID
+		run.Status = "running"
+		run.StartedAt = &startedAt
+		run.CreatedAt = startedAt
+
+		// Alert once the window ends if the run is still hung
+		if AlertsSuppressed(job.ID) {
+			continue
+		}
+
+		fmt.Printf("Hung run detected for %s (Run ID: %s)\n", job.Name, run.ID)
+		triggerHungRunAlert(job, run)
+	}
+}
+
+func triggerHungRunAlert(job models.Job, run models.JobRun) {
+	var alertID string
+	err := db.GetDB().QueryRow(`
+		INSERT INTO alerts (job_id, run_id, message)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, job.ID, run.ID, hungRunAlertMsg).Scan(&alertID)
+	if err != nil {
+		// Without the alert row we'd re-send every tick; retry next tick instead
+		fmt.Printf("Error inserting hung run alert: %v\n", err)
+		return
+	}
+
+	TransitionJobState(job, JobStateDown, "run hung", &run)
+
+	NotifyJob(Notification{
+		AlertID:     alertID,
+		Job:         job,
+		Run:         &run,
+		LastSuccess: lastSuccessfulRun(job.ID, run.CreatedAt),
+		Subject:     fmt.Sprintf("[CRITICAL] %s appears hung", job.Name),
+		Body:        hungRunBody(job, run),
+		Text:        slackAlertText(job, run, hungRunAlertMsg),
+	})
+}
+
+func hungRunBody(job models.Job, run models.JobRun) string {
+	return fmt.Sprintf(`Job: %s
+
+This job sent a start ping but has not reported completion.
+
+Started at:
+%s
+
+Max runtime:
+%d minutes
+
+This usually means:
+- The script crashed before reporting
+- The process is stuck or deadlocked
+- The host was restarted mid-run
+
+---
+Run ID: %s`, job.Name, run.StartedAt.Format(time.RFC3339), job.MaxRuntimeMinutes, run.ID)
+}
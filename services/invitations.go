@@ -0,0 +1,147 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const invitationTTL = 7 * 24 * time.Hour
+
+// Errors returned by AcceptInvitation.
+var (
+	ErrInvitationInvalid = errors.New("invitation is invalid, expired or already used")
+	ErrInvitationEmail   = errors.New("invitation was sent to a different email address")
+)
+
+const invitationColumns = `id, org_id, email, role, invited_by, expires_at, accepted_at, created_at`
+
+func scanInvitation(row rowScanner) (models.OrgInvitation, error) {
+	var inv models.OrgInvitation
+	err := row.Scan(&inv.ID, &inv.OrgID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.ExpiresAt, &inv.AcceptedAt, &inv.CreatedAt)
+	return inv, err
+}
+
+// CreateInvitation stores an invitation and returns it with the plaintext
+// Token set. Like API tokens, only a SHA-256 hash of the token is kept.
+func CreateInvitation(orgID, email, role, invitedBy string) (models.OrgInvitation, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return models.OrgInvitation{}, err
+	}
+	token := hex.EncodeToString(b)
+
+	inv, err := scanInvitation(db.GetDB().QueryRow(`
+		INSERT INTO org_invitations (org_id, email, role, token_hash, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)
+		RETURNING `+invitationColumns,
+		orgID, strings.ToLower(email), role, hashToken(token), invitedBy, time.Now().Add(invitationTTL)))
+	inv.Token = token
+	return inv, err
+}
+
+// ListInvitations returns the org's pending invitations.
+func ListInvitations(orgID string) ([]models.OrgInvitation, error) {
+	rows, err := db.GetDB().Query(`
+		SELECT `+invitationColumns+`
+		FROM org_invitations
+		WHERE org_id = $1 AND accepted_at IS NULL AND expires_at > NOW()
+		ORDER BY created_at DESC
+	`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []models.OrgInvitation{}
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// RevokeInvitation deletes a pending invitation. Returns false if there
+// is none with that id.
+func RevokeInvitation(orgID, id string) (bool, error) {
+	res, err := db.GetDB().Exec(`
+		DELETE FROM org_invitations
+		WHERE id::text = $1 AND org_id = $2 AND accepted_at IS NULL
+	`, id, orgID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// AcceptInvitation adds the user to the invitation's org. The token is
+// single-use and only valid for the invited email address.
+func AcceptInvitation(token, userID, email string) (models.Org, error) {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return models.Org{}, err
+	}
+	defer tx.Rollback()
+
+	inv, err := scanInvitation(tx.QueryRow(`
+		SELECT `+invitationColumns+`
+		FROM org_invitations
+		WHERE token_hash = $1 AND accepted_at IS NULL AND expires_at > NOW()
+		FOR UPDATE
+	`, hashToken(token)))
+	if err == sql.ErrNoRows {
+		return models.Org{}, ErrInvitationInvalid
+	} else if err != nil {
+		return models.Org{}, err
+	}
+	if !strings.EqualFold(inv.Email, email) {
+		return models.Org{}, ErrInvitationEmail
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (org_id, user_id) DO NOTHING
+	`, inv.OrgID, userID, inv.Role)
+	if err != nil {
+		return models.Org{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Org{}, ErrAlreadyMember
+	}
+	if _, err := tx.Exec("UPDATE org_invitations SET accepted_at = NOW() WHERE id = $1", inv.ID); err != nil {
+		return models.Org{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return models.Org{}, err
+	}
+
+	org, err := LoadOrg(inv.OrgID)
+	org.Role = inv.Role
+	return org, err
+}
+
+// SendInvitationEmail emails the invitation token to the invitee.
+func SendInvitationEmail(inv models.OrgInvitation, orgName, invitedBy string) error {
+	body := fmt.Sprintf("%s invited you to join %s on AfterRun as %s.\n\n", invitedBy, orgName, inv.Role)
+	if base := strings.TrimRight(os.Getenv("APP_URL"), "/"); base != "" {
+		body += fmt.Sprintf("Sign in (or sign up with this address) at %s, then accept the invitation with:\n\n", base)
+	} else {
+		body += "Sign in (or sign up with this address), then accept the invitation with:\n\n"
+	}
+	body += fmt.Sprintf("POST /api/invitations/accept {\"token\": \"%s\"}\n\nThe invitation expires on %s.",
+		inv.Token, inv.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"))
+
+	_, err := SendEmail(inv.Email, fmt.Sprintf("You're invited to %s on AfterRun", orgName), body)
+	return err
+}
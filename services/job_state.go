@@ -0,0 +1,155 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Job lifecycle states.
+//
+//	new    -> no ping yet (since creation or resume)
+//	up     -> last run OK and on schedule
+//	late   -> expected fire time passed, still within grace
+//	down   -> failed, hung, violated a rule or missed its window
+//	paused -> monitoring silenced; only changed explicitly
+const (
+	JobStateNew    = "new"
+	JobStateUp     = "up"
+	JobStateLate   = "late"
+	JobStateDown   = "down"
+	JobStatePaused = "paused"
+)
+
+// TransitionJobState moves a job to a new state and records the change.
+// No-op if the job is already in that state or is paused.
+// A down -> up transition sends recovery notifications; any move to up
+// resolves the job's open and acknowledged alerts.
+func TransitionJobState(job models.Job, to, reason string, run *models.JobRun) (from string, changed bool) {
+	var downSince time.Time
+	err := db.GetDB().QueryRow(`
+		WITH prev AS (
+			SELECT id, state, state_changed_at FROM jobs WHERE id = $1 FOR UPDATE
+		)
+		UPDATE jobs j
+		SET state = $2, state_changed_at = NOW()
+		FROM prev
+		WHERE j.id = prev.id
+		AND prev.state IS DISTINCT FROM $2
+		AND prev.state IS DISTINCT FROM 'paused'
+		RETURNING COALESCE(prev.state, 'new'), COALESCE(prev.state_changed_at, NOW())
+	`, job.ID, to).Scan(&from, &downSince)
+
+	if err == sql.ErrNoRows {
+		return "", false
+	} else if err != nil {
+		fmt.Printf("Error updating job state: %v\n", err)
+		return "", false
+	}
+
+	recordStateTransition(job.ID, from, to, reason, run)
+	fmt.Printf("Job %s: %s -> %s (%s)\n", job.Name, from, to, reason)
+
+	if to == JobStateUp {
+		resolveJobAlerts(job.ID, "system: job recovered")
+	}
+
+	if from == JobStateDown && to == JobStateUp && run != nil && !InMaintenance(job.ID, time.Now()) {
+		NotifyJob(Notification{
+			Job:     job,
+			Run:     run,
+			Subject: fmt.Sprintf("[RECOVERED] %s is back to normal", job.Name),
+			Body:    recoveryBody(job, *run, downSince),
+			Text:    slackRecoveryText(job, *run, downSince),
+		})
+	}
+
+	return from, true
+}
+
+// UpdateJobStreak counts consecutive unhealthy runs (failed, or with any
+// violated rule even below its repeat threshold); a healthy run resets it.
+func UpdateJobStreak(jobID string, unhealthy bool) {
+	_, err := db.GetDB().Exec(`
+		UPDATE jobs SET streak = CASE WHEN $2 THEN streak + 1 ELSE 0 END WHERE id = $1
+	`, jobID, unhealthy)
+	if err != nil {
+		fmt.Printf("Error updating job streak: %v\n", err)
+	}
+}
+
+// PauseJob silences monitoring for a job until ResumeJob.
+// Returns false if the job was already paused.
+func PauseJob(job models.Job, reason string) (bool, error) {
+	var from string
+	err := db.GetDB().QueryRow(`
+		WITH prev AS (
+			SELECT id, state FROM jobs WHERE id = $1 FOR UPDATE
+		)
+		UPDATE jobs j
+		SET state = 'paused', state_changed_at = NOW()
+		FROM prev
+		WHERE j.id = prev.id AND prev.state <> 'paused'
+		RETURNING prev.state
+	`, job.ID).Scan(&from)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	recordStateTransition(job.ID, from, JobStatePaused, reason, nil)
+	return true, nil
+}
+
+// ResumeJob re-enables monitoring. The job restarts as "new" and fire
+// times that passed while it was paused are not expected.
+// Returns false if the job was not paused.
+func ResumeJob(job models.Job, reason string) (bool, error) {
+	res, err := db.GetDB().Exec(`
+		UPDATE jobs
+		SET state = 'new', state_changed_at = NOW(), resumed_at = NOW()
+		WHERE id = $1 AND state = 'paused'
+	`, job.ID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	recordStateTransition(job.ID, JobStatePaused, JobStateNew, reason, nil)
+	return true, nil
+}
+
+func recordStateTransition(jobID, from, to, reason string, run *models.JobRun) {
+	var runID interface{}
+	if run != nil && run.ID != "" {
+		runID = run.ID
+	}
+
+	_, err := db.GetDB().Exec(`
+		INSERT INTO job_state_transitions (job_id, from_state, to_state, reason, run_id)
+		VALUES ($1, $2, $3, $4, $5)
+	`, jobID, from, to, reason, runID)
+	if err != nil {
+		fmt.Printf("Error recording state transition: %v\n", err)
+	}
+}
+
+func recoveryBody(job models.Job, run models.JobRun, downSince time.Time) string {
+	return fmt.Sprintf(`Job: %s
+
+This job reported a successful run after being down.
+
+Down since:
+%s
+
+Recovered at:
+%s
+
+---
+Run ID: %s`, job.Name, downSince.Format(time.RFC3339), run.CreatedAt.Format(time.RFC3339), run.ID)
+}
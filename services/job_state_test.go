@@ -0,0 +1,156 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"testing"
+	"time"
+)
+
+// setJobState puts a job in state without recording a transition.
+func setJobState(t *testing.T, jobID, state string) {
+	t.Helper()
+	if _, err := db.GetDB().Exec(
+		"UPDATE jobs SET state = $2, state_changed_at = NOW() - INTERVAL '1 hour' WHERE id = $1", jobID, state,
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recoveries counts the [RECOVERED] notifications queued for a job.
+func recoveries(t *testing.T, jobID string) int {
+	t.Helper()
+	var n int
+	if err := db.GetDB().QueryRow(`
+		SELECT COUNT(*) FROM notification_outbox
+		WHERE job_id = $1 AND payload->>'subject' LIKE '[RECOVERED]%'
+	`, jobID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestTransitionJobState(t *testing.T) {
+	testDB(t)
+	// The owner's verified address is the fallback channel
+	userID, _ := testUser(t, "example.com", true)
+	orgID := personalOrg(t, userID)
+
+	tests := []struct {
+		name        string
+		from        string
+		to          string
+		withRun     bool
+		maintenance bool
+		changed     bool
+		recovered   bool
+	}{
+		{"down to up recovers", JobStateDown, JobStateUp, true, false, true, true},
+		{"down to up without a run", JobStateDown, JobStateUp, false, false, true, false},
+		{"down to up in maintenance", JobStateDown, JobStateUp, true, true, true, false},
+		{"late to up", JobStateLate, JobStateUp, true, false, true, false},
+		{"new to up", JobStateNew, JobStateUp, true, false, true, false},
+		{"up to down", JobStateUp, JobStateDown, true, false, true, false},
+		{"same state", JobStateDown, JobStateDown, true, false, false, false},
+		{"paused to up", JobStatePaused, JobStateUp, true, false, false, false},
+		{"paused to down", JobStatePaused, JobStateDown, false, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobID := testJob(t, userID, orgID)
+			job := models.Job{ID: jobID, Name: "test"}
+			setJobState(t, jobID, tt.from)
+			if tt.maintenance {
+				if _, err := db.GetDB().Exec(`
+					INSERT INTO maintenance_windows (user_id, org_id, job_id, starts_at, ends_at)
+					VALUES ($1, $2, $3, NOW() - INTERVAL '1 hour', NOW() + INTERVAL '1 hour')
+				`, userID, orgID, jobID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var run *models.JobRun
+			if tt.withRun {
+				r := testRun(t, jobID)
+				r.CreatedAt = time.Now()
+				run = &r
+			}
+
+			from, changed := TransitionJobState(job, tt.to, "test", run)
+			if changed != tt.changed {
+				t.Fatalf("changed = %v, want %v", changed, tt.changed)
+			}
+
+			var state string
+			var transitions int
+			db.GetDB().QueryRow("SELECT state FROM jobs WHERE id = $1", jobID).Scan(&state)
+			db.GetDB().QueryRow("SELECT COUNT(*) FROM job_state_transitions WHERE job_id = $1", jobID).Scan(&transitions)
+			if tt.changed {
+				if from != tt.from || state != tt.to || transitions != 1 {
+					t.Errorf("from %q, state %q, %d transitions; want %q, %q, 1", from, state, transitions, tt.from, tt.to)
+				}
+			} else if state != tt.from || transitions != 0 {
+				t.Errorf("state %q, %d transitions; want %q unchanged", state, transitions, tt.from)
+			}
+
+			if got := recoveries(t, jobID); (got > 0) != tt.recovered {
+				t.Errorf("%d recovery notifications, want recovered=%v", got, tt.recovered)
+			}
+		})
+	}
+}
+
+func TestTransitionJobStateResolvesAlerts(t *testing.T) {
+	testDB(t)
+	userID, _ := testUser(t, "example.com", true)
+	jobID := testJob(t, userID, personalOrg(t, userID))
+	job := models.Job{ID: jobID, Name: "test"}
+	// alerts.job_id does not cascade
+	t.Cleanup(func() { db.GetDB().Exec("DELETE FROM alerts WHERE job_id = $1", jobID) })
+
+	insertAlert := func(status string) string {
+		t.Helper()
+		var id string
+		if err := db.GetDB().QueryRow(
+			"INSERT INTO alerts (job_id, message, status) VALUES ($1, 'test', $2) RETURNING id", jobID, status,
+		).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	open := insertAlert(AlertOpen)
+	acked := insertAlert(AlertAcknowledged)
+	if _, err := db.GetDB().Exec(
+		"UPDATE alerts SET status = 'resolved', resolved_at = NOW(), resolved_by = 'someone' WHERE id = $1", insertAlert(AlertOpen),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other moves leave alerts alone
+	setJobState(t, jobID, JobStateUp)
+	TransitionJobState(job, JobStateLate, "test", nil)
+	var unresolved int
+	db.GetDB().QueryRow("SELECT COUNT(*) FROM alerts WHERE job_id = $1 AND status <> 'resolved'", jobID).Scan(&unresolved)
+	if unresolved != 2 {
+		t.Fatalf("%d unresolved alerts after late, want 2", unresolved)
+	}
+
+	if _, changed := TransitionJobState(job, JobStateUp, "run ok", nil); !changed {
+		t.Fatal("late -> up did not change the state")
+	}
+	rows, err := db.GetDB().Query("SELECT id, status, COALESCE(resolved_by, '') FROM alerts WHERE job_id = $1", jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, status, by string
+		rows.Scan(&id, &status, &by)
+		want := "someone"
+		if id == open || id == acked {
+			want = "system: job recovered"
+		}
+		if status != AlertResolved || by != want {
+			t.Errorf("alert %s: %s by %q, want resolved by %q", id, status, by, want)
+		}
+	}
+}
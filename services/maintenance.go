@@ -0,0 +1,129 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// LoadMaintenanceWindows returns the job's own windows plus the
+// org-level windows of its org.
+func LoadMaintenanceWindows(jobID string) ([]models.MaintenanceWindow, error) {
+	rows, err := db.GetDB().Query(`
+		SELECT w.id, w.org_id, w.job_id, w.name, w.starts_at, w.ends_at,
+			COALESCE(w.schedule, ''), COALESCE(w.duration_minutes, 0), COALESCE(w.timezone, 'UTC'), w.created_at
+		FROM maintenance_windows w
+		WHERE w.job_id = $1
+		OR (w.job_id IS NULL AND w.org_id = (SELECT org_id FROM jobs WHERE id = $1))
+	`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var windows []models.MaintenanceWindow
+	for rows.Next() {
+		var w models.MaintenanceWindow
+		if err := rows.Scan(&w.ID, &w.OrgID, &w.JobID, &w.Name, &w.StartsAt, &w.EndsAt,
+			&w.Schedule, &w.DurationMinutes, &w.Timezone, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, rows.Err()
+}
+
+// MaintenancePeriodAt returns the occurrence of w that is active at t,
+// or else the next one starting after t. ok is false if neither exists.
+func MaintenancePeriodAt(w models.MaintenanceWindow, t time.Time) (models.MaintenancePeriod, bool) {
+	period := models.MaintenancePeriod{WindowID: w.ID, Name: w.Name}
+
+	if w.Schedule == "" {
+		// One-off
+		if w.StartsAt == nil || w.EndsAt == nil || !w.EndsAt.After(t) {
+			return period, false
+		}
+		period.StartsAt = *w.StartsAt
+		period.EndsAt = *w.EndsAt
+		period.Active = !w.StartsAt.After(t)
+		return period, true
+	}
+
+	// Recurring
+	schedule, err := ParseCron(w.Schedule)
+	if err != nil || w.DurationMinutes <= 0 {
+		return period, false
+	}
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	duration := time.Duration(w.DurationMinutes) * time.Minute
+
+	if start := schedule.Prev(t.In(loc)); !start.IsZero() && start.Add(duration).After(t) {
+		period.StartsAt = start
+		period.EndsAt = start.Add(duration)
+		period.Active = true
+		return period, true
+	}
+
+	start := schedule.Next(t.In(loc))
+	if start.IsZero() {
+		return period, false
+	}
+	period.StartsAt = start
+	period.EndsAt = start.Add(duration)
+	return period, true
+}
+
+// CurrentOrNextMaintenance returns the active maintenance period covering
+// the job at t (the one ending last), or else the next one to start.
+func CurrentOrNextMaintenance(jobID string, t time.Time) *models.MaintenancePeriod {
+	windows, err := LoadMaintenanceWindows(jobID)
+	if err != nil {
+		fmt.Printf("Error loading maintenance windows: %v\n", err)
+		return nil
+	}
+
+	var best *models.MaintenancePeriod
+	for _, w := range windows {
+		p, ok := MaintenancePeriodAt(w, t)
+		if !ok {
+			continue
+		}
+		switch {
+		case best == nil:
+		case p.Active && !best.Active:
+		case p.Active && best.Active && p.EndsAt.After(best.EndsAt):
+		case !p.Active && !best.Active && p.StartsAt.Before(best.StartsAt):
+		default:
+			continue
+		}
+		period := p
+		best = &period
+	}
+	return best
+}
+
+// InMaintenance reports whether alerts for the job are silenced at t.
+// Fails open (not in maintenance) on database errors.
+func InMaintenance(jobID string, t time.Time) bool {
+	p := CurrentOrNextMaintenance(jobID, t)
+	return p != nil && p.Active
+}
+
+// AlertsSuppressed reports whether a job is paused or in maintenance now.
+// Runs are still recorded; only notifications are skipped.
+func AlertsSuppressed(jobID string) bool {
+	var state string
+	err := db.GetDB().QueryRow("SELECT state FROM jobs WHERE id = $1", jobID).Scan(&state)
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Printf("Error fetching job state: %v\n", err)
+	}
+	if state == JobStatePaused {
+		return true
+	}
+	return InMaintenance(jobID, time.Now())
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"cronmonitor/models"
+	"testing"
+	"time"
+)
+
+func TestMaintenancePeriodAtOneOff(t *testing.T) {
+	at := func(s string) *time.Time {
+		v := cronTime(t, time.UTC, s)
+		return &v
+	}
+	w := models.MaintenanceWindow{
+		ID:       "w1",
+		StartsAt: at("2026-05-10 02:00:00 +0000"),
+		EndsAt:   at("2026-05-10 04:00:00 +0000"),
+	}
+
+	tests := []struct {
+		name   string
+		t      string
+		ok     bool
+		active bool
+	}{
+		{"before", "2026-05-10 01:00:00 +0000", true, false},
+		{"at start", "2026-05-10 02:00:00 +0000", true, true},
+		{"during", "2026-05-10 03:59:00 +0000", true, true},
+		{"at end", "2026-05-10 04:00:00 +0000", false, false},
+		{"after", "2026-05-11 00:00:00 +0000", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, ok := MaintenancePeriodAt(w, cronTime(t, time.UTC, tt.t))
+			if ok != tt.ok || p.Active != tt.active {
+				t.Fatalf("ok=%v active=%v, want ok=%v active=%v", ok, p.Active, tt.ok, tt.active)
+			}
+			if ok && (!p.StartsAt.Equal(*w.StartsAt) || !p.EndsAt.Equal(*w.EndsAt) || p.WindowID != "w1") {
+				t.Errorf("period = %+v", p)
+			}
+		})
+	}
+
+	if _, ok := MaintenancePeriodAt(models.MaintenanceWindow{StartsAt: w.StartsAt}, *w.StartsAt); ok {
+		t.Error("window without ends_at matched")
+	}
+}
+
+func TestMaintenancePeriodAtRecurring(t *testing.T) {
+	ny := newYork(t)
+
+	tests := []struct {
+		name   string
+		window models.MaintenanceWindow
+		t      string
+		ok     bool
+		active bool
+		start  string
+		end    string
+	}{
+		{
+			name:   "before today's window",
+			window: models.MaintenanceWindow{Schedule: "0 2 * * *", DurationMinutes: 60, Timezone: "UTC"},
+			t:      "2026-05-10 01:00:00 +0000",
+			ok:     true, active: false,
+			start: "2026-05-10 02:00:00 +0000", end: "2026-05-10 03:00:00 +0000",
+		},
+		{
+			name:   "inside window",
+			window: models.MaintenanceWindow{Schedule: "0 2 * * *", DurationMinutes: 60, Timezone: "UTC"},
+			t:      "2026-05-10 02:30:00 +0000",
+			ok:     true, active: true,
+			start: "2026-05-10 02:00:00 +0000", end: "2026-05-10 03:00:00 +0000",
+		},
+		{
+			name:   "end is exclusive",
+			window: models.MaintenanceWindow{Schedule: "0 2 * * *", DurationMinutes: 60, Timezone: "UTC"},
+			t:      "2026-05-10 03:00:00 +0000",
+			ok:     true, active: false,
+			start: "2026-05-11 02:00:00 +0000", end: "2026-05-11 03:00:00 +0000",
+		},
+		{
+			name:   "spans midnight",
+			window: models.MaintenanceWindow{Schedule: "30 23 * * *", DurationMinutes: 90, Timezone: "UTC"},
+			t:      "2026-05-11 00:45:00 +0000",
+			ok:     true, active: true,
+			start: "2026-05-10 23:30:00 +0000", end: "2026-05-11 01:00:00 +0000",
+		},
+		{
+			name:   "local timezone",
+			window: models.MaintenanceWindow{Schedule: "0 22 * * *", DurationMinutes: 180, Timezone: "America/New_York"},
+			t:      "2026-05-11 03:00:00 +0000",
+			ok:     true, active: true,
+			start: "2026-05-10 22:00:00 -0400", end: "2026-05-11 01:00:00 -0400",
+		},
+		{
+			// 01:30 EST plus two real hours is 04:30 EDT on the day DST starts
+			name:   "duration across DST start",
+			window: models.MaintenanceWindow{Schedule: "30 1 * * *", DurationMinutes: 120, Timezone: "America/New_York"},
+			t:      "2026-03-08 04:00:00 -0400",
+			ok:     true, active: true,
+			start: "2026-03-08 01:30:00 -0500", end: "2026-03-08 04:30:00 -0400",
+		},
+		{
+			// 02:30 does not exist on 2026-03-08 in New York
+			name:   "skipped wall time",
+			window: models.MaintenanceWindow{Schedule: "30 2 * * *", DurationMinutes: 30, Timezone: "America/New_York"},
+			t:      "2026-03-08 03:00:00 -0400",
+			ok:     true, active: false,
+			start: "2026-03-09 02:30:00 -0400", end: "2026-03-09 03:00:00 -0400",
+		},
+		{
+			name:   "invalid timezone falls back to UTC",
+			window: models.MaintenanceWindow{Schedule: "0 2 * * *", DurationMinutes: 60, Timezone: "Mars/Olympus"},
+			t:      "2026-05-10 02:30:00 +0000",
+			ok:     true, active: true,
+			start: "2026-05-10 02:00:00 +0000", end: "2026-05-10 03:00:00 +0000",
+		},
+		{
+			name:   "invalid schedule",
+			window: models.MaintenanceWindow{Schedule: "61 * * * *", DurationMinutes: 60, Timezone: "UTC"},
+			t:      "2026-05-10 02:30:00 +0000",
+		},
+		{
+			name:   "zero duration",
+			window: models.MaintenanceWindow{Schedule: "0 2 * * *", Timezone: "UTC"},
+			t:      "2026-05-10 02:30:00 +0000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, ok := MaintenancePeriodAt(tt.window, cronTime(t, ny, tt.t))
+			if ok != tt.ok || p.Active != tt.active {
+				t.Fatalf("ok=%v active=%v, want ok=%v active=%v", ok, p.Active, tt.ok, tt.active)
+			}
+			if !ok {
+				return
+			}
+			start, end := cronTime(t, time.UTC, tt.start), cronTime(t, time.UTC, tt.end)
+			if !p.StartsAt.Equal(start) || !p.EndsAt.Equal(end) {
+				t.Errorf("period %v - %v, want %v - %v", p.StartsAt, p.EndsAt, start, end)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LookupMetric resolves a metric name against a run's metrics.
+// Besides plain top-level keys it accepts dotted / JSONPath-style paths:
+//
+//	tables.users.rows
+//	$.tables.users.rows
+//	tables["users.v2"].rows
+//	batches[0].rows   (or batches.0.rows)
+//
+// An exact top-level key always wins, so existing metric names that
+// contain dots keep working.
+func LookupMetric(metrics map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := metrics[name]; ok {
+		return v, true
+	}
+
+	segments, err := parseMetricPath(name)
+	if err != nil {
+		return nil, false
+	}
+
+	var current interface{} = metrics
+	for _, seg := range segments {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			v, ok := node[seg]
+			if !ok {
+				return nil, false
+			}
+			current = v
+		case []interface{}:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			current = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// parseMetricPath splits a path into keys / indices.
+func parseMetricPath(path string) ([]string, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return nil, fmt.Errorf("empty metric path")
+	}
+
+	var segments []string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			segments = append(segments, current.String())
+			current.Reset()
+		}
+	}
+
+	for i := 0; i < len(path); i++ {
+		switch ch := path[i]; ch {
+		case '.':
+			if current.Len() == 0 && (i == 0 || path[i-1] != ']') {
+				return nil, fmt.Errorf("empty segment at position %d", i)
+			}
+			flush()
+		case '[':
+			flush()
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ at position %d", i)
+			}
+			inner := path[i+1 : i+end]
+			if len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0] {
+				inner = inner[1 : len(inner)-1]
+			} else if _, err := strconv.Atoi(inner); err != nil {
+				return nil, fmt.Errorf("invalid index %q at position %d", inner, i)
+			}
+			segments = append(segments, inner)
+			i += end
+		default:
+			current.WriteByte(ch)
+		}
+	}
+	if strings.HasSuffix(path, ".") {
+		return nil, fmt.Errorf("path ends with '.'")
+	}
+	flush()
+	return segments, nil
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestLookupMetric(t *testing.T) {
+	var metrics map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"rows": 10,
+		"a.b": "literal",
+		"a": {"b": "nested"},
+		"tables": {"users": {"rows": 5}, "users.v2": {"rows": 7}},
+		"batches": [{"rows": 1}, {"rows": 2}],
+		"empty": null
+	}`), &metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want interface{}
+		ok   bool
+	}{
+		{"rows", float64(10), true},
+		{"$.rows", float64(10), true},
+		{"a.b", "literal", true}, // exact key wins
+		{"$.a.b", "nested", true},
+		{"a[\"b\"]", "nested", true},
+		{"tables.users.rows", float64(5), true},
+		{"$.tables.users.rows", float64(5), true},
+		{`tables["users.v2"].rows`, float64(7), true},
+		{`tables['users.v2'].rows`, float64(7), true},
+		{"batches[1].rows", float64(2), true},
+		{"batches.0.rows", float64(1), true},
+		{"tables.users", map[string]interface{}{"rows": float64(5)}, true},
+		{"empty", nil, true},
+
+		{"missing", nil, false},
+		{"tables.orders.rows", nil, false},
+		{"tables.users.rows.count", nil, false},
+		{"batches[2].rows", nil, false},
+		{"batches[-1].rows", nil, false},
+		{"batches.x.rows", nil, false},
+		{"rows.value", nil, false},
+		{"tables..users", nil, false},
+		{"tables[users", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := LookupMetric(metrics, tt.path)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LookupMetric(%q) = %#v, %v, want %#v, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	if _, ok := LookupMetric(nil, "a.b"); ok {
+		t.Error("lookup in nil metrics succeeded")
+	}
+}
+
+func TestParseMetricPathErrors(t *testing.T) {
+	for _, path := range []string{"", "$", "$.", "a..b", "a.", "a[", "a[x]", "a[1.5]"} {
+		if segs, err := parseMetricPath(path); err == nil {
+			t.Errorf("parseMetricPath(%q) = %q, want an error", path, segs)
+		}
+	}
+}
@@ -5,11 +5,7 @@ import (
 	"cronmonitor/models"
 	"database/sql"
 	"fmt"
-	"os"
 	"time"
-
-	"github.com/sendgrid/sendgrid-go"
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
 func CheckForMissedRuns() {
@@ -23,88 +19,183 @@ func CheckForMissedRuns() {
 	fmt.Println("Running Missed Run Check...")
 
 	conn := db.GetDB()
-	rows, err := conn.Query("SELECT id, name, created_at, ping_key FROM jobs")
+	rows, err := conn.Query(`
+		SELECT id, name, created_at, ping_key, COALESCE(schedule, ''), COALESCE(timezone, 'UTC'), COALESCE(grace_minutes, 30), state
+		FROM jobs
+	`)
 	if err != nil {
 		fmt.Printf("Error fetching jobs for check: %v\n", err)
 		return
 	}
 	defer rows.Close()
 
-	// Hardcoded threshold per requirements
-	threshold := 2 * time.Minute
+	now := time.Now()
 
 	for rows.Next() {
 		var job models.Job
-		if err := rows.Scan(&job.ID, &job.Name, &job.CreatedAt, &job.PingKey); err != nil {
+		if err := rows.Scan(&job.ID, &job.Name, &job.CreatedAt, &job.PingKey, &job.Schedule, &job.Timezone, &job.GraceMinutes, &job.State); err != nil {
 			fmt.Printf("Error scanning job: %v\n", err)
 			continue
 		}
 
-		var lastKnownRunStr string
-		var missed bool
+		fmt.Printf("Checking Job: %s (ID: %s)\n", job.Name, job.ID)
 
-		// Check last run elapsed time (in seconds)
-		// We use Postgres to calculate the difference to avoid Timezone mismatches between Go and PG.
-		var secondsSinceLastRun float64
-		err := conn.QueryRow(`
-			SELECT EXTRACT(EPOCH FROM (NOW() - created_at)) 
-			FROM job_runs 
-			WHERE job_id = $1 
-			ORDER BY created_at DESC LIMIT 1
-		`, job.ID).Scan(&secondsSinceLastRun)
+		if job.State == JobStatePaused {
+			fmt.Println("  -> Skipped: paused")
+			continue
+		}
+		if InMaintenance(job.ID, now) {
+			fmt.Println("  -> Skipped: in maintenance window")
+			continue
+		}
 
-		fmt.Printf("Checking Job: %s (ID: %s)\n", job.Name, job.ID)
+		expected, ok := lastExpectedRun(job, now)
+		if !ok {
+			continue
+		}
+
+		// Fire times that fell inside a maintenance window are not expected
+		if InMaintenance(job.ID, expected) {
+			fmt.Println("  -> Status: OK (expected run fell in maintenance window)")
+			continue
+		}
+
+		// Jobs created (or resumed) after the expected fire time have nothing to miss yet.
+		// Comparisons happen in Postgres (::timestamptz) to avoid timezone mismatches
+		// between Go and the TIMESTAMP columns.
+		var createdAfter bool
+		if err := conn.QueryRow("SELECT COALESCE(resumed_at, created_at) > $2::timestamptz FROM jobs WHERE id = $1", job.ID, expected).Scan(&createdAfter); err != nil {
+			fmt.Printf("Error checking creation time for job %s: %v\n", job.Name, err)
+			continue
+		}
+		if createdAfter {
+			fmt.Println("  -> Status: OK (created after last expected run)")
+			continue
+		}
 
-		if err == sql.ErrNoRows {
-			// No runs ever. Check job creation time.
-			// Also calc via DB
-			var secondsSinceCreation float64
-			conn.QueryRow("SELECT EXTRACT(EPOCH FROM (NOW() - created_at)) FROM jobs WHERE id = $1", job.ID).Scan(&secondsSinceCreation)
-
-			fmt.Printf("  No previous runs. CreatedAt (seconds ago): %f, Threshold: %f\n", secondsSinceCreation, threshold.Seconds())
-			if secondsSinceCreation > threshold.Seconds() {
-				missed = true
-				lastKnownRunStr = "Never ran"
-			}
-		} else if err != nil {
+		var pinged bool
+		err := conn.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM job_runs
+				WHERE job_id = $1 AND created_at >= $2::timestamptz
+			)
+		`, job.ID, expected).Scan(&pinged)
+		if err != nil {
 			fmt.Printf("Error fetching last run for job %s: %v\n", job.Name, err)
 			continue
-		} else {
-			// Has run. Check time since last run.
-			fmt.Printf("  Last Run (seconds ago): %f, Threshold: %f\n", secondsSinceLastRun, threshold.Seconds())
-			if secondsSinceLastRun > threshold.Seconds() {
-				missed = true
-				// Fetch pretty timestamp for display only
-				var ts time.Time
-				conn.QueryRow("SELECT created_at FROM job_runs WHERE job_id = $1 ORDER BY created_at DESC LIMIT 1", job.ID).Scan(&ts)
-				lastKnownRunStr = ts.Format(time.RFC3339)
-			}
 		}
 
-		if missed {
-			fmt.Println("  -> Status: MISSED. Triggering alert...")
-			triggerMissedRunAlert(job, lastKnownRunStr, threshold)
-		} else {
+		fmt.Printf("  Expected at: %s, Grace: %dm, Pinged: %v\n", expected.Format(time.RFC3339), job.GraceMinutes, pinged)
+		if pinged {
 			fmt.Println("  -> Status: OK")
+			markLateIfOverdue(job, now)
+			continue
 		}
+
+		lastKnownRunStr := "Never ran"
+		var ts time.Time
+		err = conn.QueryRow("SELECT created_at FROM job_runs WHERE job_id = $1 ORDER BY created_at DESC LIMIT 1", job.ID).Scan(&ts)
+		if err == nil {
+			lastKnownRunStr = ts.Format(time.RFC3339)
+		} else if err != sql.ErrNoRows {
+			fmt.Printf("Error fetching last run for job %s: %v\n", job.Name, err)
+		}
+
+		fmt.Println("  -> Status: MISSED. Triggering alert...")
+		TransitionJobState(job, JobStateDown, "missed run expected at "+expected.Format(time.RFC3339), nil)
+		triggerMissedRunAlert(job, lastKnownRunStr, expected)
+	}
+}
+
+// markLateIfOverdue flags a healthy job as late when its latest fire time
+// has passed without a ping but the grace period is still running.
+// A down job stays down until it reports OK.
+func markLateIfOverdue(job models.Job, now time.Time) {
+	if job.State != JobStateUp && job.State != JobStateNew {
+		return
+	}
+
+	schedule, err := ParseCron(job.Schedule)
+	if err != nil {
+		return
 	}
+	loc, err := time.LoadLocation(job.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	latest := schedule.Prev(now.In(loc))
+	if latest.IsZero() {
+		return
+	}
+
+	var overdue bool
+	err = db.GetDB().QueryRow(`
+		SELECT COALESCE(resumed_at, created_at) < $2::timestamptz AND NOT EXISTS (
+			SELECT 1 FROM job_runs
+			WHERE job_id = $1 AND created_at >= $2::timestamptz
+		)
+		FROM jobs WHERE id = $1
+	`, job.ID, latest).Scan(&overdue)
+	if err != nil {
+		fmt.Printf("Error checking late status for job %s: %v\n", job.Name, err)
+		return
+	}
+
+	if overdue {
+		fmt.Println("  -> Status: LATE (within grace)")
+		TransitionJobState(job, JobStateLate, "no ping since "+latest.Format(time.RFC3339), nil)
+	}
+}
+
+// lastExpectedRun returns the most recent scheduled fire time whose grace
+// period has fully elapsed, in the job's timezone.
+// Jobs without a usable schedule are skipped (fail-open).
+func lastExpectedRun(job models.Job, now time.Time) (time.Time, bool) {
+	if job.Schedule == "" {
+		fmt.Println("  -> Skipped: no schedule configured")
+		return time.Time{}, false
+	}
+
+	schedule, err := ParseCron(job.Schedule)
+	if err != nil {
+		fmt.Printf("  -> Skipped: invalid schedule %q: %v\n", job.Schedule, err)
+		return time.Time{}, false
+	}
+
+	loc, err := time.LoadLocation(job.Timezone)
+	if err != nil {
+		fmt.Printf("  Unknown timezone %q, falling back to UTC\n", job.Timezone)
+		loc = time.UTC
+	}
+
+	grace := time.Duration(job.GraceMinutes) * time.Minute
+	expected := schedule.Prev(now.Add(-grace).In(loc))
+	if expected.IsZero() {
+		fmt.Println("  -> Skipped: schedule has no recent fire time")
+		return time.Time{}, false
+	}
+	return expected, true
 }
 
-func triggerMissedRunAlert(job models.Job, lastKnownRunStr string, threshold time.Duration) {
+func triggerMissedRunAlert(job models.Job, lastKnownRunStr string, expected time.Time) {
 	conn := db.GetDB()
 	alertMsg := "Job did not run within expected window"
 
 	// Deduplication
-	// Query alerts for this job with same message sent recently
+	// One alert per missed fire time: anything sent since it was expected covers it.
+	// An acknowledged alert silences further misses until it is resolved
+	// (or its snooze lapses).
 	var count int
-	// PG syntax: $2 is timestamp
-	dedupeTime := time.Now().Add(-threshold)
 	err := conn.QueryRow(`
 		SELECT count(*) FROM alerts 
 		WHERE job_id = $1 
 		AND message = $2 
-		AND sent_at > $3
-	`, job.ID, alertMsg, dedupeTime).Scan(&count)
+		AND (
+			sent_at >= $3::timestamptz
+			OR (status = 'acknowledged' AND (snoozed_until IS NULL OR snoozed_until > NOW()))
+		)
+	`, job.ID, alertMsg, expected).Scan(&count)
 
 	if err == nil && count > 0 {
 		fmt.Printf("  -> Duplicate alert suppressed (Count: %d). \n", count)
@@ -112,10 +203,12 @@ func triggerMissedRunAlert(job models.Job, lastKnownRunStr string, threshold tim
 	}
 
 	// Insert Alert (run_id is NULL)
-	_, err = conn.Exec(`
+	var alertID string
+	err = conn.QueryRow(`
 		INSERT INTO alerts (job_id, run_id, message) 
 		VALUES ($1, NULL, $2)
-	`, job.ID, alertMsg)
+		RETURNING id
+	`, job.ID, alertMsg).Scan(&alertID)
 
 	if err != nil {
 		fmt.Printf("Error inserting missed run alert: %v\n", err)
@@ -123,28 +216,26 @@ func triggerMissedRunAlert(job models.Job, lastKnownRunStr string, threshold tim
 		fmt.Printf("Missed run detected for %s. Alert saved.\n", job.Name)
 	}
 
-	// Send Email
-	sendMissedRunEmail(job, lastKnownRunStr)
-
-	// Send Slack (if configured)
+	// Notify subscribed channels
 	// We pass empty JobRun since there is no specific run
-	go SendSlackAlert(job, models.JobRun{}, alertMsg)
+	NotifyJob(Notification{
+		AlertID:     alertID,
+		Job:         job,
+		LastSuccess: lastSuccessfulRun(job.ID, time.Now()),
+		Subject:     fmt.Sprintf("[CRITICAL] %s did not run", job.Name),
+		Body:        missedRunBody(job, lastKnownRunStr, expected),
+		Text:        slackAlertText(job, models.JobRun{}, alertMsg),
+	})
 }
 
-func sendMissedRunEmail(job models.Job, lastKnownRunStr string) {
-	apiKey := os.Getenv("SENDGRID_API_KEY")
-	alertEmail := os.Getenv("ALERT_EMAIL")
-
-	if apiKey == "" || alertEmail == "" {
-		// Silent skip
-		return
-	}
-
-	subject := fmt.Sprintf("[CRITICAL] %s did not run", job.Name)
-	plainTextContent := fmt.Sprintf(`Job: %s
+func missedRunBody(job models.Job, lastKnownRunStr string, expected time.Time) string {
+	return fmt.Sprintf(`Job: %s
 
 This job did not report any runs within the expected time window.
 
+Expected at:
+%s (grace period: %d minutes)
+
 Last known run:
 %s
 
@@ -153,15 +244,5 @@ This usually means:
 - Server was down
 - Script failed before startup
 
-Please investigate immediately.`, job.Name, lastKnownRunStr)
-
-	from := mail.NewEmail("CronMonitor", alertEmail)
-	to := mail.NewEmail("Admin", alertEmail)
-	message := mail.NewSingleEmail(from, subject, to, plainTextContent, plainTextContent)
-	client := sendgrid.NewSendClient(apiKey)
-
-	_, err := client.Send(message)
-	if err != nil {
-		fmt.Printf("Error sending missed run email: %v\n", err)
-	}
+Please investigate immediately.`, job.Name, expected.Format(time.RFC3339), job.GraceMinutes, lastKnownRunStr)
 }
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+)
+
+// Notification is one message about a job, rendered for every channel type.
+// It is stored as JSON in the outbox until delivered, and is also the
+// context for webhook templates.
+type Notification struct {
+	AlertID     string         `json:"alert_id,omitempty"` // empty for recoveries
+	Job         models.Job     `json:"job"`
+	Run         *models.JobRun `json:"run,omitempty"`          // nil for missed runs
+	Rule        *models.Rule   `json:"rule,omitempty"`         // violated rule, if any
+	ActualValue interface{}    `json:"actual_value,omitempty"` // value that violated Rule
+	LastSuccess *models.JobRun `json:"last_success,omitempty"` // last OK run before Run
+	AckURL      string         `json:"ack_url,omitempty"`      // signed one-click ack link
+	Subject     string         `json:"subject"`                // Email subject
+	Body        string         `json:"body"`                   // Full plain-text body (email)
+	Text        string         `json:"text"`                   // Short message (chat)
+}
+
+// Notifier delivers a notification to one destination.
+// statusCode is the remote response code, or 0 if there was no response.
+type Notifier interface {
+	Notify(n Notification) (statusCode int, err error)
+}
+
+const (
+	ChannelEmail   = "email"
+	ChannelSlack   = "slack"
+	ChannelWebhook = "webhook"
+)
+
+// NotifierForChannel builds the Notifier for a stored channel.
+func NotifierForChannel(ch models.NotificationChannel) (Notifier, error) {
+	switch ch.Type {
+	case ChannelEmail:
+		return EmailNotifier{To: ch.Config.Email}, nil
+	case ChannelSlack:
+		return SlackNotifier{WebhookURL: ch.Config.WebhookURL}, nil
+	case ChannelWebhook:
+		return WebhookNotifier{
+			URL:      ch.Config.WebhookURL,
+			Template: ch.Config.Template,
+			Headers:  ch.Config.Headers,
+			Secret:   ch.Config.Secret,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown channel type %q", ch.Type)
+	}
+}
+
+// ValidateChannel checks the type and required config keys of a channel.
+func ValidateChannel(ch models.NotificationChannel) error {
+	switch ch.Type {
+	case ChannelEmail:
+		if _, err := mail.ParseAddress(ch.Config.Email); err != nil {
+			return fmt.Errorf("email channels need a valid config.email")
+		}
+	case ChannelSlack:
+		u, err := url.Parse(ch.Config.WebhookURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("slack channels need an https config.webhook_url")
+		}
+	case ChannelWebhook:
+		return validateWebhookConfig(ch.Config)
+	default:
+		return fmt.Errorf("unknown channel type %q (expected email, slack or webhook)", ch.Type)
+	}
+	return nil
+}
+
+// NotifyJob queues n in the outbox for every channel the job is
+// subscribed to; DispatchOutbox delivers it.
+// Jobs without subscriptions use all of their org's channels; orgs
+// without channels fall back to their owners' verified emails (see
+// fallbackChannels). Email channels with an unconfirmed address are skipped.
+// Queueing is best-effort: failures are logged, never returned.
+func NotifyJob(n Notification) {
+	channels, err := channelsForJob(n.Job.ID)
+	if err != nil {
+		fmt.Printf("Error loading notification channels: %v\n", err)
+	}
+	if err == nil && len(channels) == 0 {
+		if channels, err = fallbackChannels(n.Job.ID); err != nil {
+			fmt.Printf("Error loading fallback channels: %v\n", err)
+		}
+	}
+
+	for _, ch := range channels {
+		if ch.Type == ChannelEmail && ch.ID != "" && ch.VerifiedAt == nil {
+			fmt.Printf("Skipping unverified email channel %s (%s)\n", ch.ID, ch.Config.Email)
+			continue
+		}
+		if err := enqueueNotification(withAckLink(n, channelRecipient(ch)), ch); err != nil {
+			fmt.Printf("Error queueing notification for %s: %v\n", n.Job.Name, err)
+		}
+	}
+}
+
+func channelsForJob(jobID string) ([]models.NotificationChannel, error) {
+	// Subscribed channels, or every channel of the job's org when there are none
+	rows, err := db.GetDB().Query(`
+		SELECT c.id, c.org_id, c.type, c.name, c.config, c.created_at, c.verified_at
+		FROM notification_channels c
+		WHERE c.id IN (SELECT channel_id FROM job_channels WHERE job_id = $1)
+		OR (
+			NOT EXISTS (SELECT 1 FROM job_channels WHERE job_id = $1)
+			AND c.org_id = (SELECT org_id FROM jobs WHERE id = $1)
+		)
+	`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []models.NotificationChannel
+	for rows.Next() {
+		ch, err := ScanChannel(rows)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, ch)
+	}
+	return channels, rows.Err()
+}
+
+// channelRecipient names who a channel delivers to, for audit fields.
+func channelRecipient(ch models.NotificationChannel) string {
+	if ch.Type == ChannelEmail {
+		return ch.Config.Email
+	}
+	return ch.Type + ":" + ch.Name
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// ScanChannel reads a notification_channels row selected as
+// id, org_id, type, name, config, created_at, verified_at.
+func ScanChannel(row rowScanner) (models.NotificationChannel, error) {
+	var ch models.NotificationChannel
+	var configRaw []byte
+	if err := row.Scan(&ch.ID, &ch.OrgID, &ch.Type, &ch.Name, &configRaw, &ch.CreatedAt, &ch.VerifiedAt); err != nil {
+		return ch, err
+	}
+	if err := json.Unmarshal(configRaw, &ch.Config); err != nil {
+		return ch, fmt.Errorf("channel %s: invalid config: %w", ch.ID, err)
+	}
+	return ch, nil
+}
+
+// fallbackChannels is where alerts of an org without channels go. Jobs of
+// the system user (AUTH_ENABLED=false and pre-auth installs) keep using
+// the operator's ALERT_EMAIL/SLACK_WEBHOOK_URL. Every other org gets its
+// owners' verified addresses, never the operator's, which would leak
+// tenants' alerts to the operator.
+// These pseudo-channels have no ID.
+func fallbackChannels(jobID string) ([]models.NotificationChannel, error) {
+	var system bool
+	err := db.GetDB().QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM jobs j
+			JOIN organizations o ON o.id = j.org_id
+			JOIN users u ON u.id = o.personal_user_id
+			WHERE j.id = $1 AND u.email = $2
+		)
+	`, jobID, SystemUserEmail).Scan(&system)
+	if err != nil {
+		return nil, err
+	}
+	if system {
+		return envChannels(), nil
+	}
+
+	rows, err := db.GetDB().Query(`
+		SELECT u.email
+		FROM jobs j
+		JOIN org_members m ON m.org_id = j.org_id AND m.role = $2
+		JOIN users u ON u.id = m.user_id
+		WHERE j.id = $1 AND u.email_verified_at IS NOT NULL
+		ORDER BY u.email
+	`, jobID, RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []models.NotificationChannel
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		channels = append(channels, models.NotificationChannel{
+			Type:   ChannelEmail,
+			Name:   "owner",
+			Config: models.ChannelConfig{Email: email},
+		})
+	}
+	return channels, rows.Err()
+}
+
+// Operator-level config (pre-channel behaviour), for the system user only.
+func envChannels() []models.NotificationChannel {
+	var channels []models.NotificationChannel
+	if alertEmail := os.Getenv("ALERT_EMAIL"); alertEmail != "" {
+		channels = append(channels, models.NotificationChannel{
+			Type:   ChannelEmail,
+			Name:   "ALERT_EMAIL",
+			Config: models.ChannelConfig{Email: alertEmail},
+		})
+	}
+	if webhookURL := os.Getenv("SLACK_WEBHOOK_URL"); webhookURL != "" {
+		channels = append(channels, models.NotificationChannel{
+			Type:   ChannelSlack,
+			Name:   "SLACK_WEBHOOK_URL",
+			Config: models.ChannelConfig{WebhookURL: webhookURL},
+		})
+	}
+	return channels
+}
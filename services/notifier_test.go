@@ -0,0 +1,52 @@
+package services
+
+import (
+	"testing"
+)
+
+func TestFallbackChannels(t *testing.T) {
+	testDB(t)
+	t.Setenv("ALERT_EMAIL", "operator@afterrun.test")
+	t.Setenv("SLACK_WEBHOOK_URL", "")
+
+	owner, ownerEmail := testUser(t, "tenant.test", true)
+	unverified, _ := testUser(t, "tenant.test", false)
+	orgID := testOrg(t, owner)
+	if _, err := testDB(t).Exec(
+		"INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)", orgID, unverified, RoleOwner,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// A tenant's alerts go to its verified owners, never to ALERT_EMAIL
+	channels, err := fallbackChannels(testJob(t, owner, orgID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0].Config.Email != ownerEmail {
+		t.Fatalf("tenant fallback = %+v, want only %s", channels, ownerEmail)
+	}
+
+	// No verified owner: nothing
+	lonely, _ := testUser(t, "tenant.test", false)
+	channels, err = fallbackChannels(testJob(t, lonely, personalOrg(t, lonely)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 0 {
+		t.Fatalf("unverified fallback = %+v, want none", channels)
+	}
+
+	// The system user keeps the operator-wide settings
+	var systemID string
+	if err := testDB(t).QueryRow("SELECT id FROM users WHERE email = $1", SystemUserEmail).Scan(&systemID); err != nil {
+		t.Fatal(err)
+	}
+	channels, err = fallbackChannels(testJob(t, systemID, personalOrg(t, systemID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0].Config.Email != "operator@afterrun.test" {
+		t.Fatalf("system fallback = %+v, want ALERT_EMAIL", channels)
+	}
+}
@@ -0,0 +1,492 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OpenID Connect single sign-on (authorization code flow with PKCE).
+// Configured with OIDC_ISSUER, OIDC_CLIENT_ID and, for confidential
+// clients, OIDC_CLIENT_SECRET. The redirect URI is APP_URL + OIDCCallbackPath.
+
+const OIDCCallbackPath = "/auth/oidc/callback"
+
+const (
+	oidcDiscoveryTTL = time.Hour
+	// Unknown key ids trigger a JWKS refetch, at most this often
+	oidcJWKSMinRefresh = time.Minute
+)
+
+var (
+	ErrOIDCNotConfigured = errors.New("single sign-on is not configured")
+	ErrOIDCEmailMissing  = errors.New("the identity provider did not return an email address")
+	// Linking to an existing account or creating one needs a verified email
+	ErrOIDCEmailUnverified = errors.New("the identity provider has not verified the email address")
+)
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+type oidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+	Scopes       string
+}
+
+func loadOIDCConfig() (oidcConfig, error) {
+	cfg := oidcConfig{
+		Issuer:       strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		Scopes:       os.Getenv("OIDC_SCOPES"),
+	}
+	base := strings.TrimRight(os.Getenv("APP_URL"), "/")
+	if cfg.Issuer == "" || cfg.ClientID == "" || base == "" {
+		return cfg, ErrOIDCNotConfigured
+	}
+	cfg.RedirectURI = base + OIDCCallbackPath
+	if cfg.Scopes == "" {
+		cfg.Scopes = "openid email profile"
+	}
+	return cfg, nil
+}
+
+// OIDCEnabled reports whether the login page offers single sign-on.
+func OIDCEnabled() bool {
+	_, err := loadOIDCConfig()
+	return err == nil
+}
+
+// oidcProvider caches the issuer's discovery document and signing keys.
+type oidcProvider struct {
+	mu         sync.Mutex
+	issuer     string
+	fetchedAt  time.Time
+	authURL    string
+	tokenURL   string
+	jwksURL    string
+	keys       map[string]interface{}
+	keysLoaded time.Time
+}
+
+var provider oidcProvider
+
+// discover fetches /.well-known/openid-configuration when it is missing,
+// stale or for another issuer. Callers hold p.mu.
+func (p *oidcProvider) discover(issuer string) error {
+	if p.issuer == issuer && time.Since(p.fetchedAt) < oidcDiscoveryTTL {
+		return nil
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := getJSON(issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return fmt.Errorf("OIDC discovery: %w", err)
+	}
+	// The document must be the issuer's own (OpenID Connect Discovery 4.3)
+	if strings.TrimRight(doc.Issuer, "/") != issuer {
+		return fmt.Errorf("OIDC discovery: issuer %q does not match %q", doc.Issuer, issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return errors.New("OIDC discovery: document lacks authorization, token or jwks endpoint")
+	}
+
+	if p.issuer != issuer || p.jwksURL != doc.JWKSURI {
+		p.keys = nil
+	}
+	p.issuer = issuer
+	p.fetchedAt = time.Now()
+	p.authURL = doc.AuthorizationEndpoint
+	p.tokenURL = doc.TokenEndpoint
+	p.jwksURL = doc.JWKSURI
+	return nil
+}
+
+// key returns the signing key with kid, refetching the JWKS when the key
+// is unknown (the issuer may have rotated). Callers hold p.mu.
+func (p *oidcProvider) key(kid string) (interface{}, error) {
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if p.keys != nil && time.Since(p.keysLoaded) < oidcJWKSMinRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(p.jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("OIDC JWKS: %w", err)
+	}
+	p.keys = map[string]interface{}{}
+	p.keysLoaded = time.Now()
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if k, err := jwk.publicKey(); err == nil {
+			p.keys[jwk.Kid] = k
+		}
+	}
+
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes RSA and P-256/P-384 EC keys.
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := oidcHTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// OIDCLoginState is kept by the browser between the redirect to the
+// issuer and the callback; the caller stores it in a signed cookie.
+type OIDCLoginState struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// BeginOIDCLogin returns the issuer's authorization URL and the state to
+// check on the callback.
+func BeginOIDCLogin() (string, OIDCLoginState, error) {
+	var st OIDCLoginState
+	cfg, err := loadOIDCConfig()
+	if err != nil {
+		return "", st, err
+	}
+
+	provider.mu.Lock()
+	err = provider.discover(cfg.Issuer)
+	authURL := provider.authURL
+	provider.mu.Unlock()
+	if err != nil {
+		return "", st, err
+	}
+
+	for _, s := range []*string{&st.State, &st.Nonce, &st.CodeVerifier} {
+		if *s, err = randomString(); err != nil {
+			return "", st, err
+		}
+	}
+	challenge := sha256.Sum256([]byte(st.CodeVerifier))
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", cfg.ClientID)
+	q.Set("redirect_uri", cfg.RedirectURI)
+	q.Set("scope", cfg.Scopes)
+	q.Set("state", st.State)
+	q.Set("nonce", st.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(authURL, "?") {
+		sep = "&"
+	}
+	return authURL + sep + q.Encode(), st, nil
+}
+
+// OIDCIdentity holds the claims of a verified ID token that AfterRun uses.
+type OIDCIdentity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// CompleteOIDCLogin exchanges the authorization code and verifies the ID
+// token: signature against the issuer's JWKS, issuer, audience, expiry
+// and nonce.
+func CompleteOIDCLogin(code string, st OIDCLoginState) (OIDCIdentity, error) {
+	var id OIDCIdentity
+	cfg, err := loadOIDCConfig()
+	if err != nil {
+		return id, err
+	}
+
+	provider.mu.Lock()
+	err = provider.discover(cfg.Issuer)
+	tokenURL := provider.tokenURL
+	provider.mu.Unlock()
+	if err != nil {
+		return id, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", cfg.RedirectURI)
+	form.Set("client_id", cfg.ClientID)
+	form.Set("code_verifier", st.CodeVerifier)
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return id, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return id, fmt.Errorf("OIDC token request: %w", err)
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return id, fmt.Errorf("OIDC token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return id, fmt.Errorf("OIDC token request: status %d %s", resp.StatusCode, tok.Error)
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tok.IDToken, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		provider.mu.Lock()
+		defer provider.mu.Unlock()
+		return provider.key(kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384"}),
+		jwt.WithIssuer(cfg.Issuer),
+		jwt.WithAudience(cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return id, fmt.Errorf("OIDC ID token: %w", err)
+	}
+
+	if nonce, _ := claims["nonce"].(string); nonce == "" || nonce != st.Nonce {
+		return id, errors.New("OIDC ID token: nonce mismatch")
+	}
+	// With several audiences, the token must have been issued to us
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != cfg.ClientID {
+			return id, errors.New("OIDC ID token: azp mismatch")
+		}
+	}
+
+	id.Issuer = cfg.Issuer
+	id.Subject, _ = claims.GetSubject()
+	id.Email, _ = claims["email"].(string)
+	id.Email = strings.TrimSpace(id.Email)
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		id.EmailVerified = v
+	case string: // some providers send "true"
+		id.EmailVerified = v == "true"
+	}
+	if id.Subject == "" {
+		return id, errors.New("OIDC ID token: no subject")
+	}
+	if id.Email == "" {
+		return id, ErrOIDCEmailMissing
+	}
+	return id, nil
+}
+
+// OIDCUser finds or creates the account of an SSO identity and returns
+// its id and email. Known identities sign in to their linked account. A
+// new identity is linked to the account with its email, or gets a new
+// account, but only if the provider verified that address; otherwise
+// anyone could claim an email on a provider that does not check it.
+// Every login then applies the email-domain rules.
+func OIDCUser(id OIDCIdentity) (userID, email string, err error) {
+	err = db.GetDB().QueryRow(`
+		SELECT u.id, u.email FROM user_identities i
+		JOIN users u ON u.id = i.user_id
+		WHERE i.issuer = $1 AND i.subject = $2
+	`, id.Issuer, id.Subject).Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		userID, email, err = linkOIDCUser(id)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	if id.EmailVerified {
+		if err := applyDomainRules(userID, id.Email); err != nil {
+			fmt.Printf("Error applying SSO domain rules for %s: %v\n", id.Email, err)
+		}
+	}
+	return userID, email, nil
+}
+
+func linkOIDCUser(id OIDCIdentity) (userID, email string, err error) {
+	err = db.GetDB().QueryRow(
+		"SELECT id, email FROM users WHERE lower(email) = lower($1)", id.Email,
+	).Scan(&userID, &email)
+	switch {
+	case err != nil && err != sql.ErrNoRows:
+		return "", "", err
+	case !id.EmailVerified:
+		return "", "", ErrOIDCEmailUnverified
+	case err == sql.ErrNoRows:
+		// Just-in-time account; it has no password until one is reset
+		email = id.Email
+		if userID, err = CreateUser(email, "sso"); err != nil {
+			return "", "", err
+		}
+	}
+
+	if _, err := db.GetDB().Exec(`
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW())
+		WHERE id = $1 AND lower(email) = lower($2)
+	`, userID, id.Email); err != nil {
+		return "", "", err
+	}
+	if _, err := db.GetDB().Exec(`
+		INSERT INTO user_identities (user_id, issuer, subject, email) VALUES ($1, $2, $3, $4)
+	`, userID, id.Issuer, id.Subject, id.Email); err != nil {
+		return "", "", err
+	}
+	return userID, email, nil
+}
+
+// domainRule adds users whose email is at Domain to an org.
+type domainRule struct {
+	Domain string
+	OrgID  string
+	Role   string
+}
+
+// parseDomainRules reads OIDC_DOMAIN_ORGS, a comma-separated list of
+// domain=org_id or domain=org_id:role (default viewer). Owner cannot be
+// granted this way. Malformed entries are skipped with a log line.
+func parseDomainRules(s string) []domainRule {
+	var rules []domainRule
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		domain, target, _ := strings.Cut(entry, "=")
+		orgID, role, _ := strings.Cut(target, ":")
+		if role == "" {
+			role = RoleViewer
+		}
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" || !uuidPattern.MatchString(orgID) || !ValidRole(role) || role == RoleOwner {
+			fmt.Printf("Ignoring OIDC_DOMAIN_ORGS entry %q\n", entry)
+			continue
+		}
+		rules = append(rules, domainRule{Domain: domain, OrgID: orgID, Role: role})
+	}
+	return rules
+}
+
+// applyDomainRules adds the user to the orgs mapped to their email
+// domain. Existing memberships, and their roles, are left alone.
+func applyDomainRules(userID, email string) error {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return nil
+	}
+	domain := strings.ToLower(email[at+1:])
+
+	for _, rule := range parseDomainRules(os.Getenv("OIDC_DOMAIN_ORGS")) {
+		if rule.Domain != domain {
+			continue
+		}
+		if _, err := db.GetDB().Exec(`
+			INSERT INTO org_members (org_id, user_id, role)
+			SELECT id, $2, $3 FROM organizations WHERE id = $1 AND personal_user_id IS NULL
+			ON CONFLICT (org_id, user_id) DO NOTHING
+		`, rule.OrgID, userID, rule.Role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,532 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const stubClientID = "afterrun-test"
+
+// stubIssuer is an OpenID provider whose token endpoint returns an ID
+// token built by the test.
+type stubIssuer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	published   map[string]*rsa.PrivateKey // in the JWKS, by kid
+	idToken     string
+	docIssuer   string // issuer in the discovery document, if not URL
+	verifier    string // code_verifier of the last token request
+	jwksFetches int
+}
+
+// newStubIssuer starts an issuer publishing kid "k1" and configures
+// AfterRun to use it.
+func newStubIssuer(t *testing.T) *stubIssuer {
+	t.Helper()
+	s := &stubIssuer{published: map[string]*rsa.PrivateKey{"k1": rsaKey(t)}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		issuer := s.docIssuer
+		s.mu.Unlock()
+		if issuer == "" {
+			issuer = s.URL
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.jwksFetches++
+		var keys []map[string]string
+		for kid, k := range s.published {
+			keys = append(keys, map[string]string{
+				"kty": "RSA", "use": "sig", "alg": "RS256", "kid": kid,
+				"n": base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.PostFormValue("code") != "good-code" || r.PostFormValue("client_id") != stubClientID ||
+			r.PostFormValue("redirect_uri") != "https://afterrun.test"+OIDCCallbackPath {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		s.verifier = r.PostFormValue("code_verifier")
+		json.NewEncoder(w).Encode(map[string]string{"id_token": s.idToken, "token_type": "Bearer"})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	t.Setenv("OIDC_ISSUER", s.URL)
+	t.Setenv("OIDC_CLIENT_ID", stubClientID)
+	t.Setenv("OIDC_CLIENT_SECRET", "")
+	t.Setenv("OIDC_SCOPES", "")
+	t.Setenv("APP_URL", "https://afterrun.test/")
+	resetOIDCProvider()
+	t.Cleanup(resetOIDCProvider)
+	return s
+}
+
+func resetOIDCProvider() {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	provider.issuer = ""
+	provider.fetchedAt = time.Time{}
+	provider.keys = nil
+	provider.keysLoaded = time.Time{}
+}
+
+func rsaKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// claims returns valid ID token claims for nonce.
+func (s *stubIssuer) claims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            s.URL,
+		"aud":            stubClientID,
+		"sub":            "subject-1",
+		"email":          "Ada@Example.com ",
+		"email_verified": true,
+		"nonce":          nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+	}
+}
+
+// issue makes the token endpoint return claims signed with key under kid.
+func (s *stubIssuer) issue(t *testing.T, claims jwt.MapClaims, kid string, key *rsa.PrivateKey) {
+	t.Helper()
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = kid
+	signed, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.idToken = signed
+	s.mu.Unlock()
+}
+
+func (s *stubIssuer) fetches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jwksFetches
+}
+
+// beginLogin starts a login like the browser would and returns its state.
+func beginLogin(t *testing.T) OIDCLoginState {
+	t.Helper()
+	authURL, st, err := BeginOIDCLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	sum := sha256.Sum256([]byte(st.CodeVerifier))
+	if q.Get("state") != st.State || q.Get("nonce") != st.Nonce ||
+		q.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(sum[:]) || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("authorization URL %s does not match state %+v", authURL, st)
+	}
+	if q.Get("client_id") != stubClientID || q.Get("scope") != "openid email profile" ||
+		q.Get("redirect_uri") != "https://afterrun.test"+OIDCCallbackPath {
+		t.Fatalf("authorization URL %s", authURL)
+	}
+	return st
+}
+
+func TestCompleteOIDCLogin(t *testing.T) {
+	s := newStubIssuer(t)
+	st := beginLogin(t)
+	s.issue(t, s.claims(st.Nonce), "k1", s.published["k1"])
+
+	id, err := CompleteOIDCLogin("good-code", st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := OIDCIdentity{Issuer: s.URL, Subject: "subject-1", Email: "Ada@Example.com", EmailVerified: true}
+	if id != want {
+		t.Errorf("identity = %+v, want %+v", id, want)
+	}
+	if s.verifier != st.CodeVerifier {
+		t.Errorf("code_verifier = %q, want %q", s.verifier, st.CodeVerifier)
+	}
+
+	if _, err := CompleteOIDCLogin("bad-code", st); err == nil {
+		t.Error("rejected code accepted")
+	}
+}
+
+func TestCompleteOIDCLoginRejects(t *testing.T) {
+	s := newStubIssuer(t)
+	other := rsaKey(t)
+
+	tests := []struct {
+		name   string
+		modify func(c jwt.MapClaims)
+		kid    string
+		key    *rsa.PrivateKey
+		want   string
+	}{
+		{"bad signature", nil, "k1", other, "signature"},
+		{"wrong issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.test" }, "", nil, "issuer"},
+		{"wrong audience", func(c jwt.MapClaims) { c["aud"] = "someone-else" }, "", nil, "audience"},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }, "", nil, "expired"},
+		{"no expiry", func(c jwt.MapClaims) { delete(c, "exp") }, "", nil, "exp"},
+		{"issued in the future", func(c jwt.MapClaims) { c["iat"] = time.Now().Add(10 * time.Minute).Unix() }, "", nil, "before issued"},
+		{"nonce mismatch", func(c jwt.MapClaims) { c["nonce"] = "other" }, "", nil, "nonce"},
+		{"no nonce", func(c jwt.MapClaims) { delete(c, "nonce") }, "", nil, "nonce"},
+		{"several audiences without azp", func(c jwt.MapClaims) { c["aud"] = []string{stubClientID, "other"} }, "", nil, "azp"},
+		{"azp of another client", func(c jwt.MapClaims) {
+			c["aud"] = []string{stubClientID, "other"}
+			c["azp"] = "other"
+		}, "", nil, "azp"},
+		{"no subject", func(c jwt.MapClaims) { delete(c, "sub") }, "", nil, "subject"},
+		{"no email", func(c jwt.MapClaims) { delete(c, "email") }, "", nil, ErrOIDCEmailMissing.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := beginLogin(t)
+			c := s.claims(st.Nonce)
+			if tt.modify != nil {
+				tt.modify(c)
+			}
+			kid, key := tt.kid, tt.key
+			if key == nil {
+				kid, key = "k1", s.published["k1"]
+			}
+			s.issue(t, c, kid, key)
+
+			_, err := CompleteOIDCLogin("good-code", st)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("HMAC with the public key", func(t *testing.T) {
+		st := beginLogin(t)
+		tok := jwt.NewWithClaims(jwt.SigningMethodHS256, s.claims(st.Nonce))
+		tok.Header["kid"] = "k1"
+		signed, _ := tok.SignedString(s.published["k1"].N.Bytes())
+		s.mu.Lock()
+		s.idToken = signed
+		s.mu.Unlock()
+
+		if _, err := CompleteOIDCLogin("good-code", st); err == nil {
+			t.Error("HS256 token accepted")
+		}
+	})
+}
+
+func TestCompleteOIDCLoginOptionalClaims(t *testing.T) {
+	s := newStubIssuer(t)
+	for _, tt := range []struct {
+		name     string
+		modify   func(c jwt.MapClaims)
+		verified bool
+	}{
+		{"verified as string", func(c jwt.MapClaims) { c["email_verified"] = "true" }, true},
+		{"unverified", func(c jwt.MapClaims) { c["email_verified"] = false }, false},
+		{"no email_verified", func(c jwt.MapClaims) { delete(c, "email_verified") }, false},
+		{"several audiences with azp", func(c jwt.MapClaims) {
+			c["aud"] = []string{"other", stubClientID}
+			c["azp"] = stubClientID
+		}, true},
+		{"within leeway", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-30 * time.Second).Unix() }, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			st := beginLogin(t)
+			c := s.claims(st.Nonce)
+			tt.modify(c)
+			s.issue(t, c, "k1", s.published["k1"])
+
+			id, err := CompleteOIDCLogin("good-code", st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.EmailVerified != tt.verified {
+				t.Errorf("EmailVerified = %v, want %v", id.EmailVerified, tt.verified)
+			}
+		})
+	}
+}
+
+func TestCompleteOIDCLoginKeyRotation(t *testing.T) {
+	s := newStubIssuer(t)
+	st := beginLogin(t)
+	s.issue(t, s.claims(st.Nonce), "k1", s.published["k1"])
+	if _, err := CompleteOIDCLogin("good-code", st); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.fetches(); n != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", n)
+	}
+
+	// Cached keys are reused
+	st = beginLogin(t)
+	s.issue(t, s.claims(st.Nonce), "k1", s.published["k1"])
+	if _, err := CompleteOIDCLogin("good-code", st); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.fetches(); n != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", n)
+	}
+
+	// The issuer rotates to k2. Right after a fetch, unknown kids are
+	// rejected without hitting the issuer again.
+	k2 := rsaKey(t)
+	s.mu.Lock()
+	s.published["k2"] = k2
+	s.mu.Unlock()
+
+	st = beginLogin(t)
+	s.issue(t, s.claims(st.Nonce), "k2", k2)
+	if _, err := CompleteOIDCLogin("good-code", st); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Fatalf("err = %v, want unknown signing key", err)
+	}
+	if n := s.fetches(); n != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", n)
+	}
+
+	// Once the keys are older than the refresh interval, the unknown kid
+	// triggers a refetch
+	provider.mu.Lock()
+	provider.keysLoaded = time.Now().Add(-oidcJWKSMinRefresh - time.Second)
+	provider.mu.Unlock()
+
+	st = beginLogin(t)
+	s.issue(t, s.claims(st.Nonce), "k2", k2)
+	if _, err := CompleteOIDCLogin("good-code", st); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.fetches(); n != 2 {
+		t.Fatalf("JWKS fetched %d times, want 2", n)
+	}
+
+	// A kid the issuer does not publish still fails after the refetch
+	provider.mu.Lock()
+	provider.keysLoaded = time.Now().Add(-oidcJWKSMinRefresh - time.Second)
+	provider.mu.Unlock()
+
+	st = beginLogin(t)
+	s.issue(t, s.claims(st.Nonce), "k3", rsaKey(t))
+	if _, err := CompleteOIDCLogin("good-code", st); err == nil {
+		t.Fatal("token with unpublished kid accepted")
+	}
+	if n := s.fetches(); n != 3 {
+		t.Fatalf("JWKS fetched %d times, want 3", n)
+	}
+}
+
+func TestCompleteOIDCLoginIssuerMismatch(t *testing.T) {
+	s := newStubIssuer(t)
+	s.docIssuer = "https://evil.test"
+	if _, _, err := BeginOIDCLogin(); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("err = %v, want issuer mismatch", err)
+	}
+}
+
+func TestParseDomainRules(t *testing.T) {
+	const org = "0b6f7e43-9a1c-4b7d-8e2f-5a6b7c8d9e0f"
+	got := parseDomainRules(" Example.com=" + org + ", ops.example.com=" + org + ":admin," +
+		"bad=not-a-uuid, x.com=" + org + ":owner, y.com=" + org + ":root, =" + org + ",,")
+	want := []domainRule{
+		{Domain: "example.com", OrgID: org, Role: RoleViewer},
+		{Domain: "ops.example.com", OrgID: org, Role: RoleAdmin},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("rules = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("rule %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// cleanupUserByEmail deletes an account created during the test.
+func cleanupUserByEmail(t *testing.T, email string) {
+	t.Cleanup(func() { db.GetDB().Exec("DELETE FROM users WHERE lower(email) = lower($1)", email) })
+}
+
+func TestOIDCUserLinking(t *testing.T) {
+	testDB(t)
+	issuer := "https://idp-" + randomHex(t, 4) + ".test"
+
+	t.Run("unverified email does not link", func(t *testing.T) {
+		userID, email := testUser(t, "example.com", true)
+		_, _, err := OIDCUser(OIDCIdentity{Issuer: issuer, Subject: randomHex(t, 8), Email: strings.ToUpper(email)})
+		if err != ErrOIDCEmailUnverified {
+			t.Fatalf("err = %v, want ErrOIDCEmailUnverified", err)
+		}
+		var n int
+		db.GetDB().QueryRow("SELECT COUNT(*) FROM user_identities WHERE user_id = $1", userID).Scan(&n)
+		if n != 0 {
+			t.Errorf("%d identities linked", n)
+		}
+	})
+
+	t.Run("verified email links", func(t *testing.T) {
+		userID, email := testUser(t, "example.com", false)
+		id := OIDCIdentity{Issuer: issuer, Subject: randomHex(t, 8), Email: strings.ToUpper(email), EmailVerified: true}
+		got, gotEmail, err := OIDCUser(id)
+		if err != nil || got != userID || gotEmail != email {
+			t.Fatalf("OIDCUser = %s, %s, %v; want %s, %s", got, gotEmail, err, userID, email)
+		}
+		var verified bool
+		db.GetDB().QueryRow("SELECT email_verified_at IS NOT NULL FROM users WHERE id = $1", userID).Scan(&verified)
+		if !verified {
+			t.Error("email not marked verified")
+		}
+
+		// The linked identity signs in even once its email no longer matches
+		id.Email, id.EmailVerified = "renamed@example.net", false
+		if got, _, err := OIDCUser(id); err != nil || got != userID {
+			t.Errorf("second login = %s, %v; want %s", got, err, userID)
+		}
+	})
+
+	t.Run("new verified email gets an account", func(t *testing.T) {
+		email := "new-" + randomHex(t, 6) + "@example.com"
+		cleanupUserByEmail(t, email)
+		userID, got, err := OIDCUser(OIDCIdentity{Issuer: issuer, Subject: randomHex(t, 8), Email: email, EmailVerified: true})
+		if err != nil || got != email {
+			t.Fatalf("OIDCUser = %s, %s, %v", userID, got, err)
+		}
+		var verified bool
+		db.GetDB().QueryRow("SELECT email_verified_at IS NOT NULL FROM users WHERE id = $1", userID).Scan(&verified)
+		if !verified {
+			t.Error("SSO-created account not marked verified")
+		}
+	})
+
+	t.Run("new unverified email gets no account", func(t *testing.T) {
+		email := "new-" + randomHex(t, 6) + "@example.com"
+		cleanupUserByEmail(t, email)
+		if _, _, err := OIDCUser(OIDCIdentity{Issuer: issuer, Subject: randomHex(t, 8), Email: email}); err != ErrOIDCEmailUnverified {
+			t.Fatalf("err = %v, want ErrOIDCEmailUnverified", err)
+		}
+		var n int
+		db.GetDB().QueryRow("SELECT COUNT(*) FROM users WHERE lower(email) = lower($1)", email).Scan(&n)
+		if n != 0 {
+			t.Errorf("%d accounts created", n)
+		}
+	})
+}
+
+func TestOIDCDomainOrgs(t *testing.T) {
+	testDB(t)
+	ownerID, _ := testUser(t, "example.com", true)
+	viewOrg := testOrg(t, ownerID)
+	editOrg := testOrg(t, ownerID)
+	domain := "corp-" + randomHex(t, 4) + ".test"
+	t.Setenv("OIDC_DOMAIN_ORGS", domain+"="+viewOrg+","+strings.ToUpper(domain)+"="+editOrg+":editor,"+
+		domain+"="+personalOrg(t, ownerID)+":admin,other.test="+viewOrg)
+	issuer := "https://idp-" + randomHex(t, 4) + ".test"
+
+	email := "dev-" + randomHex(t, 4) + "@" + domain
+	cleanupUserByEmail(t, email)
+	id := OIDCIdentity{Issuer: issuer, Subject: randomHex(t, 8), Email: email, EmailVerified: true}
+	userID, _, err := OIDCUser(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for org, want := range map[string]string{viewOrg: RoleViewer, editOrg: RoleEditor, personalOrg(t, ownerID): ""} {
+		if role, err := OrgRole(userID, org); err != nil || role != want {
+			t.Errorf("role in %s = %q, %v; want %q", org, role, err, want)
+		}
+	}
+
+	// Later logins keep a role an admin changed
+	if _, err := db.GetDB().Exec("UPDATE org_members SET role = $3 WHERE org_id = $1 AND user_id = $2", viewOrg, userID, RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := OIDCUser(id); err != nil {
+		t.Fatal(err)
+	}
+	if role, _ := OrgRole(userID, viewOrg); role != RoleAdmin {
+		t.Errorf("role after relogin = %q, want admin", role)
+	}
+
+	// An identity linked while verified keeps signing in if the provider
+	// later reports the address unverified, but gets no new memberships
+	if _, err := db.GetDB().Exec("DELETE FROM org_members WHERE org_id = $1 AND user_id = $2", editOrg, userID); err != nil {
+		t.Fatal(err)
+	}
+	id.EmailVerified = false
+	if _, _, err := OIDCUser(id); err != nil {
+		t.Fatal(err)
+	}
+	if role, _ := OrgRole(userID, editOrg); role != "" {
+		t.Errorf("unverified login got role %q", role)
+	}
+}
+
+// An identity provider that does not verify addresses must not let
+// anyone sign up as any email.
+func TestOIDCLoginUnverifiedEmail(t *testing.T) {
+	testDB(t)
+	s := newStubIssuer(t)
+	st := beginLogin(t)
+	email := "new-" + randomHex(t, 6) + "@example.com"
+	cleanupUserByEmail(t, email)
+	claims := s.claims(st.Nonce)
+	claims["sub"] = randomHex(t, 8)
+	claims["email"] = email
+	claims["email_verified"] = false
+	s.issue(t, claims, "k1", s.published["k1"])
+
+	id, err := CompleteOIDCLogin("good-code", st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.EmailVerified {
+		t.Fatal("email_verified false read as verified")
+	}
+	if _, _, err := OIDCUser(id); err != ErrOIDCEmailUnverified {
+		t.Fatalf("err = %v, want ErrOIDCEmailUnverified", err)
+	}
+	var users, identities int
+	db.GetDB().QueryRow("SELECT COUNT(*) FROM users WHERE lower(email) = lower($1)", email).Scan(&users)
+	db.GetDB().QueryRow("SELECT COUNT(*) FROM user_identities WHERE issuer = $1 AND subject = $2", id.Issuer, id.Subject).Scan(&identities)
+	if users != 0 || identities != 0 {
+		t.Errorf("%d accounts and %d identities created", users, identities)
+	}
+}
@@ -0,0 +1,271 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Org roles, from most to least privileged. Each role can do everything
+// the roles below it can:
+//   - viewer: read jobs, runs, rules, channels and alerts
+//   - editor: create and change jobs, rules, channels and maintenance
+//     windows, acknowledge and resolve alerts
+//   - admin: invite and remove members, change roles (except owner)
+//   - owner: grant or revoke owner, change the plan, delete the org
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleAdmin: 3, RoleOwner: 4}
+
+// Errors returned by the membership changes.
+var (
+	ErrLastOwner     = errors.New("an organization needs at least one owner")
+	ErrPersonalOrg   = errors.New("personal organizations cannot be shared or deleted")
+	ErrOrgHasJobs    = errors.New("organization still has jobs")
+	ErrAlreadyMember = errors.New("already a member")
+)
+
+func ValidRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+// RoleAtLeast reports whether role grants min.
+func RoleAtLeast(role, min string) bool {
+	return roleRank[role] > 0 && roleRank[role] >= roleRank[min]
+}
+
+// OrgRole returns the user's role in the org, or "" if they are not a
+// member (or the org does not exist).
+func OrgRole(userID, orgID string) (string, error) {
+	if !uuidPattern.MatchString(orgID) || !uuidPattern.MatchString(userID) {
+		return "", nil
+	}
+	var role string
+	err := db.GetDB().QueryRow(
+		"SELECT role FROM org_members WHERE org_id = $1 AND user_id = $2",
+		orgID, userID,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// PersonalOrgID returns the org created for the user at signup.
+func PersonalOrgID(userID string) (string, error) {
+	var id string
+	err := db.GetDB().QueryRow("SELECT id FROM organizations WHERE personal_user_id::text = $1", userID).Scan(&id)
+	return id, err
+}
+
+// createPersonalOrg creates the user's personal org with them as owner.
+func createPersonalOrg(tx *sql.Tx, userID, email string) error {
+	var orgID string
+	err := tx.QueryRow(`
+		INSERT INTO organizations (name, personal_user_id) VALUES ($1, $2)
+		RETURNING id
+	`, email, userID).Scan(&orgID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)", orgID, userID, RoleOwner)
+	return err
+}
+
+const orgColumns = `o.id, o.name, o.personal_user_id IS NOT NULL, COALESCE(o.subscription_tier, 'free'), COALESCE(o.subscription_status, 'active'), o.created_at`
+
+func scanOrg(row rowScanner, extra ...interface{}) (models.Org, error) {
+	var o models.Org
+	dest := append([]interface{}{&o.ID, &o.Name, &o.Personal, &o.SubscriptionTier, &o.SubscriptionStatus, &o.CreatedAt}, extra...)
+	err := row.Scan(dest...)
+	return o, err
+}
+
+// CreateOrg creates a shared org owned by the user.
+func CreateOrg(userID, name string) (models.Org, error) {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return models.Org{}, err
+	}
+	defer tx.Rollback()
+
+	o, err := scanOrg(tx.QueryRow(`
+		INSERT INTO organizations AS o (name) VALUES ($1)
+		RETURNING `+orgColumns, name))
+	if err != nil {
+		return o, err
+	}
+	if _, err := tx.Exec("INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)", o.ID, userID, RoleOwner); err != nil {
+		return o, err
+	}
+	o.Role = RoleOwner
+	return o, tx.Commit()
+}
+
+func LoadOrg(orgID string) (models.Org, error) {
+	return scanOrg(db.GetDB().QueryRow("SELECT "+orgColumns+" FROM organizations o WHERE o.id::text = $1", orgID))
+}
+
+// ListUserOrgs returns the orgs the user belongs to, personal org first.
+func ListUserOrgs(userID string) ([]models.Org, error) {
+	rows, err := db.GetDB().Query(`
+		SELECT `+orgColumns+`, m.role
+		FROM organizations o
+		JOIN org_members m ON m.org_id = o.id
+		WHERE m.user_id = $1
+		ORDER BY o.personal_user_id IS NULL, o.created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []models.Org{}
+	for rows.Next() {
+		var role string
+		o, err := scanOrg(rows, &role)
+		if err != nil {
+			return nil, err
+		}
+		o.Role = role
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+func RenameOrg(orgID, name string) error {
+	_, err := db.GetDB().Exec("UPDATE organizations SET name = $1 WHERE id = $2", name, orgID)
+	return err
+}
+
+// DeleteOrg removes a shared org with its channels, maintenance windows
+// and invitations. Jobs have to be deleted first.
+func DeleteOrg(orgID string) error {
+	o, err := LoadOrg(orgID)
+	if err != nil {
+		return err
+	}
+	if o.Personal {
+		return ErrPersonalOrg
+	}
+	var jobs int
+	if err := db.GetDB().QueryRow("SELECT COUNT(*) FROM jobs WHERE org_id = $1", orgID).Scan(&jobs); err != nil {
+		return err
+	}
+	if jobs > 0 {
+		return ErrOrgHasJobs
+	}
+	_, err = db.GetDB().Exec("DELETE FROM organizations WHERE id = $1", orgID)
+	return err
+}
+
+func ListOrgMembers(orgID string) ([]models.OrgMember, error) {
+	rows, err := db.GetDB().Query(`
+		SELECT m.user_id, u.email, m.role, m.created_at
+		FROM org_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.org_id = $1
+		ORDER BY m.created_at
+	`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.OrgMember{}
+	for rows.Next() {
+		var m models.OrgMember
+		if err := rows.Scan(&m.UserID, &m.Email, &m.Role, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// SetMemberRole changes a member's role. Returns false if the user is
+// not a member, ErrLastOwner if it would leave the org without an owner.
+func SetMemberRole(orgID, userID, role string) (bool, error) {
+	return changeMember(orgID, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec("UPDATE org_members SET role = $3 WHERE org_id = $1 AND user_id::text = $2", orgID, userID, role)
+	})
+}
+
+// RemoveMember removes a user from a shared org. Their jobs stay with
+// the org.
+func RemoveMember(orgID, userID string) (bool, error) {
+	o, err := LoadOrg(orgID)
+	if err != nil {
+		return false, err
+	}
+	if o.Personal {
+		return false, ErrPersonalOrg
+	}
+	return changeMember(orgID, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec("DELETE FROM org_members WHERE org_id = $1 AND user_id::text = $2", orgID, userID)
+	})
+}
+
+// changeMember applies a membership change, rolling it back if no owner
+// would be left. Owner rows are locked so concurrent demotions cannot
+// both pass the check.
+func changeMember(orgID string, change func(tx *sql.Tx) (sql.Result, error)) (bool, error) {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT 1 FROM org_members WHERE org_id = $1 AND role = $2 FOR UPDATE", orgID, RoleOwner); err != nil {
+		return false, err
+	}
+
+	res, err := change(tx)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	var owners int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM org_members WHERE org_id = $1 AND role = $2", orgID, RoleOwner).Scan(&owners); err != nil {
+		return false, err
+	}
+	if owners == 0 {
+		return false, ErrLastOwner
+	}
+	return true, tx.Commit()
+}
+
+// OrgJobUsage returns the org's plan, job count and job limit.
+func OrgJobUsage(orgID string) (tier string, count, limit int, err error) {
+	err = db.GetDB().QueryRow(`
+		SELECT COALESCE(o.subscription_tier, 'free'), (SELECT COUNT(*) FROM jobs WHERE org_id = o.id)
+		FROM organizations o
+		WHERE o.id::text = $1
+	`, orgID).Scan(&tier, &count)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return tier, count, GetJobLimit(tier), nil
+}
+
+// SetOrgPlan changes the org's subscription.
+func SetOrgPlan(orgID, tier, status string) error {
+	_, err := db.GetDB().Exec(
+		"UPDATE organizations SET subscription_tier = $1, subscription_status = $2 WHERE id::text = $3",
+		strings.ToLower(tier), status, orgID,
+	)
+	return err
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"testing"
+)
+
+func TestRoleAtLeast(t *testing.T) {
+	roles := []string{RoleViewer, RoleEditor, RoleAdmin, RoleOwner}
+	for i, role := range roles {
+		for j, min := range roles {
+			if got := RoleAtLeast(role, min); got != (i >= j) {
+				t.Errorf("RoleAtLeast(%s, %s) = %v", role, min, got)
+			}
+		}
+		if !ValidRole(role) {
+			t.Errorf("ValidRole(%s) = false", role)
+		}
+	}
+	for _, role := range []string{"", "root", "Owner", " viewer"} {
+		if ValidRole(role) {
+			t.Errorf("ValidRole(%q) = true", role)
+		}
+		if RoleAtLeast(role, RoleViewer) {
+			t.Errorf("RoleAtLeast(%q, viewer) = true", role)
+		}
+	}
+}
+
+func addMember(t *testing.T, orgID, userID, role string) {
+	t.Helper()
+	if _, err := db.GetDB().Exec(
+		"INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)", orgID, userID, role,
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOrgMembership(t *testing.T) {
+	testDB(t)
+	ownerID, _ := testUser(t, "example.com", true)
+	memberID, _ := testUser(t, "example.com", true)
+	outsiderID, _ := testUser(t, "example.com", true)
+	orgID := testOrg(t, ownerID)
+	addMember(t, orgID, memberID, RoleEditor)
+
+	for _, tt := range []struct {
+		userID, orgID, want string
+	}{
+		{ownerID, orgID, RoleOwner},
+		{memberID, orgID, RoleEditor},
+		{outsiderID, orgID, ""},
+		{ownerID, personalOrg(t, ownerID), RoleOwner},
+		{memberID, personalOrg(t, ownerID), ""},
+		{ownerID, "not-a-uuid", ""},
+		{"not-a-uuid", orgID, ""},
+	} {
+		if got, err := OrgRole(tt.userID, tt.orgID); err != nil || got != tt.want {
+			t.Errorf("OrgRole(%s, %s) = %q, %v; want %q", tt.userID, tt.orgID, got, err, tt.want)
+		}
+	}
+
+	// The last owner cannot be demoted or removed
+	if _, err := SetMemberRole(orgID, ownerID, RoleAdmin); err != ErrLastOwner {
+		t.Errorf("demoting the last owner: err = %v, want ErrLastOwner", err)
+	}
+	if _, err := RemoveMember(orgID, ownerID); err != ErrLastOwner {
+		t.Errorf("removing the last owner: err = %v, want ErrLastOwner", err)
+	}
+	if role, _ := OrgRole(ownerID, orgID); role != RoleOwner {
+		t.Errorf("owner's role after rollback = %q", role)
+	}
+
+	// With a second owner they can
+	if ok, err := SetMemberRole(orgID, memberID, RoleOwner); !ok || err != nil {
+		t.Fatalf("promoting: %v, %v", ok, err)
+	}
+	if ok, err := SetMemberRole(orgID, ownerID, RoleViewer); !ok || err != nil {
+		t.Errorf("demoting one of two owners: %v, %v", ok, err)
+	}
+	if ok, err := RemoveMember(orgID, ownerID); !ok || err != nil {
+		t.Errorf("removing a former owner: %v, %v", ok, err)
+	}
+
+	if ok, err := SetMemberRole(orgID, outsiderID, RoleViewer); ok || err != nil {
+		t.Errorf("changing a non-member = %v, %v; want false, nil", ok, err)
+	}
+	if _, err := RemoveMember(personalOrg(t, memberID), memberID); err != ErrPersonalOrg {
+		t.Errorf("leaving a personal org: err = %v, want ErrPersonalOrg", err)
+	}
+}
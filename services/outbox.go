@@ -0,0 +1,209 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Outbox delivery: NotifyJob writes one notification_outbox row per
+// channel; DispatchOutbox (background ticker) delivers due rows and logs
+// every attempt in notification_attempts. Rows survive restarts.
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed" // gave up after outboxMaxAttempts
+
+	outboxMaxAttempts = 10
+	outboxBatchSize   = 20
+	outboxBaseBackoff = 30 * time.Second
+	outboxMaxBackoff  = time.Hour
+
+	// A claimed row is not picked up again for this long. The lease is
+	// renewed right before each row is sent, so it only has to outlast
+	// one delivery, not the whole batch.
+	outboxLease = 5 * time.Minute
+)
+
+// Shared by HTTP-based notifiers so a slow endpoint can't stall the dispatcher.
+var deliveryClient = &http.Client{Timeout: 15 * time.Second}
+
+func enqueueNotification(n Notification, ch models.NotificationChannel) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	configJSON, err := json.Marshal(ch.Config)
+	if err != nil {
+		return err
+	}
+
+	// Channel config is snapshotted so env fallbacks (no channel row) work too
+	_, err = db.GetDB().Exec(`
+		INSERT INTO notification_outbox (alert_id, job_id, channel_id, channel_type, channel_config, payload)
+		VALUES (NULLIF($1, '')::uuid, $2, NULLIF($3, '')::uuid, $4, $5, $6)
+	`, n.AlertID, n.Job.ID, ch.ID, ch.Type, configJSON, payload)
+	return err
+}
+
+// DispatchOutbox delivers due notifications. Rows are leased (next_attempt_at
+// pushed forward) while in flight, so a crash mid-delivery just retries later.
+// A row whose lease ran out before its turn in the batch, and that another
+// dispatcher has claimed since, is left to that dispatcher.
+func DispatchOutbox() {
+	// Safety: Never panic
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("DispatchOutbox panic: %v\n", r)
+		}
+	}()
+
+	rows, err := db.GetDB().Query(`
+		WITH due AS (
+			SELECT id FROM notification_outbox
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE notification_outbox o
+		SET next_attempt_at = NOW() + make_interval(secs => $2), attempts = o.attempts + 1
+		FROM due
+		WHERE o.id = due.id
+		RETURNING o.id, COALESCE(o.alert_id::text, ''), o.channel_type, o.channel_config, o.payload, o.attempts
+	`, outboxBatchSize, outboxLease.Seconds())
+	if err != nil {
+		fmt.Printf("Error claiming outbox rows: %v\n", err)
+		return
+	}
+
+	type claimed struct {
+		id, alertID string
+		channel     models.NotificationChannel
+		n           Notification
+		attempt     int
+		decodeErr   error
+	}
+
+	var batch []claimed
+	for rows.Next() {
+		var cl claimed
+		var configRaw, payloadRaw []byte
+		if err := rows.Scan(&cl.id, &cl.alertID, &cl.channel.Type, &configRaw, &payloadRaw, &cl.attempt); err != nil {
+			fmt.Printf("Error scanning outbox row: %v\n", err)
+			continue
+		}
+		if err := json.Unmarshal(configRaw, &cl.channel.Config); err != nil {
+			cl.decodeErr = fmt.Errorf("decoding channel config: %w", err)
+		} else if err := json.Unmarshal(payloadRaw, &cl.n); err != nil {
+			cl.decodeErr = fmt.Errorf("decoding payload: %w", err)
+		}
+		batch = append(batch, cl)
+	}
+	rows.Close()
+
+	// Deliver after releasing the claim query
+	for _, cl := range batch {
+		if ok, err := renewOutboxLease(cl.id, cl.attempt); err != nil {
+			fmt.Printf("Error renewing outbox lease: %v\n", err)
+			continue
+		} else if !ok {
+			continue
+		}
+		// A row that can't be decoded never will be: dead-letter it
+		// instead of sending a zero-valued notification
+		if cl.decodeErr != nil {
+			recordDeliveryAttempt(cl.id, cl.alertID, cl.attempt, 0, cl.decodeErr, true)
+			continue
+		}
+		statusCode, err := deliver(cl.channel, cl.n)
+		recordDeliveryAttempt(cl.id, cl.alertID, cl.attempt, statusCode, err, false)
+	}
+}
+
+// renewOutboxLease extends the lease of a row this dispatcher claimed for
+// attempt. It reports false if the row has been claimed again (or
+// finished) since, in which case it must not be sent.
+func renewOutboxLease(outboxID string, attempt int) (bool, error) {
+	res, err := db.GetDB().Exec(`
+		UPDATE notification_outbox SET next_attempt_at = NOW() + make_interval(secs => $3)
+		WHERE id = $1 AND attempts = $2 AND status = 'pending'
+	`, outboxID, attempt, outboxLease.Seconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func deliver(ch models.NotificationChannel, n Notification) (int, error) {
+	notifier, err := NotifierForChannel(ch)
+	if err != nil {
+		return 0, err
+	}
+	return notifier.Notify(n)
+}
+
+// recordDeliveryAttempt logs an attempt and updates the outbox row.
+// permanent errors fail the row without further retries.
+func recordDeliveryAttempt(outboxID, alertID string, attempt, statusCode int, deliveryErr error, permanent bool) {
+	conn := db.GetDB()
+
+	var statusCodeValue interface{}
+	if statusCode != 0 {
+		statusCodeValue = statusCode
+	}
+	errText := ""
+	if deliveryErr != nil {
+		errText = deliveryErr.Error()
+	}
+
+	_, err := conn.Exec(`
+		INSERT INTO notification_attempts (outbox_id, alert_id, attempt, status_code, error, success)
+		VALUES ($1, NULLIF($2, '')::uuid, $3, $4, NULLIF($5, ''), $6)
+	`, outboxID, alertID, attempt, statusCodeValue, errText, deliveryErr == nil)
+	if err != nil {
+		fmt.Printf("Error recording delivery attempt: %v\n", err)
+	}
+
+	switch {
+	case deliveryErr == nil:
+		_, err = conn.Exec(`
+			UPDATE notification_outbox
+			SET status = 'sent', sent_at = NOW(), last_error = NULL
+			WHERE id = $1
+		`, outboxID)
+	case permanent || attempt >= outboxMaxAttempts:
+		fmt.Printf("Giving up on notification %s after %d attempts: %v\n", outboxID, attempt, deliveryErr)
+		_, err = conn.Exec(`
+			UPDATE notification_outbox
+			SET status = 'failed', last_error = $2
+			WHERE id = $1
+		`, outboxID, errText)
+	default:
+		fmt.Printf("Notification %s failed (attempt %d), retrying: %v\n", outboxID, attempt, deliveryErr)
+		_, err = conn.Exec(`
+			UPDATE notification_outbox
+			SET next_attempt_at = NOW() + make_interval(secs => $2), last_error = $3
+			WHERE id = $1
+		`, outboxID, outboxBackoff(attempt).Seconds(), errText)
+	}
+	if err != nil {
+		fmt.Printf("Error updating outbox row %s: %v\n", outboxID, err)
+	}
+}
+
+// outboxBackoff doubles from 30s per attempt, capped at 1h.
+func outboxBackoff(attempt int) time.Duration {
+	backoff := outboxBaseBackoff
+	for i := 1; i < attempt && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
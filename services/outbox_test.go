@@ -0,0 +1,270 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	for _, tt := range []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{9, time.Hour},
+		{outboxMaxAttempts, time.Hour},
+		{1000, time.Hour},
+	} {
+		if got := outboxBackoff(tt.attempt); got != tt.want {
+			t.Errorf("outboxBackoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+type outboxRow struct {
+	status, lastError string
+	attempts          int
+	retryIn           time.Duration
+}
+
+func loadOutboxRow(t *testing.T, jobID string) outboxRow {
+	t.Helper()
+	var r outboxRow
+	var retrySecs float64
+	err := db.GetDB().QueryRow(`
+		SELECT status, COALESCE(last_error, ''), attempts, EXTRACT(EPOCH FROM next_attempt_at - NOW())
+		FROM notification_outbox WHERE job_id = $1
+	`, jobID).Scan(&r.status, &r.lastError, &r.attempts, &retrySecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.retryIn = time.Duration(retrySecs) * time.Second
+	return r
+}
+
+// makeDue lets DispatchOutbox pick the job's row up again now.
+func makeDue(t *testing.T, jobID string) {
+	t.Helper()
+	if _, err := db.GetDB().Exec(
+		"UPDATE notification_outbox SET next_attempt_at = NOW() - INTERVAL '1 second' WHERE job_id = $1", jobID,
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutboxRetries(t *testing.T) {
+	testDB(t)
+	userID, _ := testUser(t, "example.com", true)
+	jobID := testJob(t, userID, personalOrg(t, userID))
+
+	// The endpoint fails twice, then accepts
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	ch := models.NotificationChannel{Type: ChannelWebhook}
+	ch.Config.WebhookURL = srv.URL
+	ch.Config.Secret = "s3cret"
+	n := Notification{Job: models.Job{ID: jobID, Name: "test"}, Subject: "Job failed", Text: "Job failed"}
+	if err := enqueueNotification(n, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	DispatchOutbox()
+	r := loadOutboxRow(t, jobID)
+	if r.status != OutboxPending || r.attempts != 1 || r.lastError == "" {
+		t.Fatalf("after attempt 1: %+v", r)
+	}
+	if r.retryIn < 25*time.Second || r.retryIn > 30*time.Second {
+		t.Errorf("retry in %s, want about %s", r.retryIn, outboxBackoff(1))
+	}
+
+	// Not due yet: nothing is sent
+	DispatchOutbox()
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("%d calls before the row was due, want 1", got)
+	}
+
+	makeDue(t, jobID)
+	DispatchOutbox()
+	if r = loadOutboxRow(t, jobID); r.status != OutboxPending || r.attempts != 2 {
+		t.Fatalf("after attempt 2: %+v", r)
+	}
+	if r.retryIn < 55*time.Second || r.retryIn > time.Minute {
+		t.Errorf("retry in %s, want about %s", r.retryIn, outboxBackoff(2))
+	}
+
+	makeDue(t, jobID)
+	DispatchOutbox()
+	if r = loadOutboxRow(t, jobID); r.status != OutboxSent || r.attempts != 3 || r.lastError != "" {
+		t.Fatalf("after attempt 3: %+v", r)
+	}
+
+	rows, err := db.GetDB().Query(`
+		SELECT a.attempt, COALESCE(a.status_code, 0), a.success
+		FROM notification_attempts a JOIN notification_outbox o ON o.id = a.outbox_id
+		WHERE o.job_id = $1 ORDER BY a.attempt
+	`, jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	want := []struct {
+		status  int
+		success bool
+	}{{503, false}, {503, false}, {204, true}}
+	i := 0
+	for ; rows.Next(); i++ {
+		var attempt, status int
+		var success bool
+		rows.Scan(&attempt, &status, &success)
+		if i >= len(want) || attempt != i+1 || status != want[i].status || success != want[i].success {
+			t.Errorf("attempt row %d = %d, %d, %v", i, attempt, status, success)
+		}
+	}
+	if i != len(want) {
+		t.Errorf("%d attempts logged, want %d", i, len(want))
+	}
+}
+
+func TestOutboxGivesUp(t *testing.T) {
+	testDB(t)
+	userID, _ := testUser(t, "example.com", true)
+	jobID := testJob(t, userID, personalOrg(t, userID))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	ch := models.NotificationChannel{Type: ChannelWebhook}
+	ch.Config.WebhookURL = srv.URL
+	ch.Config.Secret = "s3cret"
+	if err := enqueueNotification(Notification{Job: models.Job{ID: jobID}, Subject: "x"}, ch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetDB().Exec(
+		"UPDATE notification_outbox SET attempts = $2 WHERE job_id = $1", jobID, outboxMaxAttempts-1,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	DispatchOutbox()
+	if r := loadOutboxRow(t, jobID); r.status != OutboxFailed || r.attempts != outboxMaxAttempts || r.lastError == "" {
+		t.Fatalf("after the last attempt: %+v", r)
+	}
+
+	makeDue(t, jobID)
+	DispatchOutbox()
+	if r := loadOutboxRow(t, jobID); r.attempts != outboxMaxAttempts {
+		t.Errorf("failed row retried: %+v", r)
+	}
+}
+
+func TestOutboxUndecodablePayload(t *testing.T) {
+	testDB(t)
+	userID, _ := testUser(t, "example.com", true)
+	jobID := testJob(t, userID, personalOrg(t, userID))
+
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	ch := models.NotificationChannel{Type: ChannelWebhook}
+	ch.Config.WebhookURL = srv.URL
+	ch.Config.Secret = "s3cret"
+	if err := enqueueNotification(Notification{Job: models.Job{ID: jobID}, Subject: "x"}, ch); err != nil {
+		t.Fatal(err)
+	}
+	// Valid JSON, but not a Notification
+	if _, err := db.GetDB().Exec(
+		`UPDATE notification_outbox SET payload = '["not", "a", "notification"]' WHERE job_id = $1`, jobID,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	DispatchOutbox()
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("undecodable payload sent %d times", got)
+	}
+	r := loadOutboxRow(t, jobID)
+	if r.status != OutboxFailed || r.attempts != 1 || !strings.Contains(r.lastError, "decoding payload") {
+		t.Fatalf("after dispatch: %+v", r)
+	}
+
+	var success bool
+	err := db.GetDB().QueryRow(`
+		SELECT a.success FROM notification_attempts a JOIN notification_outbox o ON o.id = a.outbox_id
+		WHERE o.job_id = $1
+	`, jobID).Scan(&success)
+	if err != nil || success {
+		t.Errorf("attempt log: success=%v err=%v", success, err)
+	}
+}
+
+// A row whose lease ran out mid-batch and was claimed again elsewhere is
+// not sent a second time.
+func TestOutboxLeaseRenewal(t *testing.T) {
+	testDB(t)
+	userID, _ := testUser(t, "example.com", true)
+	jobID := testJob(t, userID, personalOrg(t, userID))
+
+	ch := models.NotificationChannel{Type: ChannelWebhook}
+	ch.Config.WebhookURL = "https://example.com/hook"
+	ch.Config.Secret = "s3cret"
+	if err := enqueueNotification(Notification{Job: models.Job{ID: jobID}, Subject: "x"}, ch); err != nil {
+		t.Fatal(err)
+	}
+	var outboxID string
+	if err := db.GetDB().QueryRow("SELECT id FROM notification_outbox WHERE job_id = $1", jobID).Scan(&outboxID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Claimed for attempt 1, then again (attempt 2) after the lease ran out
+	if _, err := db.GetDB().Exec(
+		"UPDATE notification_outbox SET attempts = 2, next_attempt_at = NOW() + INTERVAL '1 minute' WHERE id = $1", outboxID,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := renewOutboxLease(outboxID, 1); err != nil || ok {
+		t.Errorf("stale claim renewed: %v, %v", ok, err)
+	}
+	if r := loadOutboxRow(t, jobID); r.retryIn > time.Minute {
+		t.Errorf("stale claim moved the lease to %s", r.retryIn)
+	}
+
+	if ok, err := renewOutboxLease(outboxID, 2); err != nil || !ok {
+		t.Fatalf("current claim not renewed: %v, %v", ok, err)
+	}
+	if r := loadOutboxRow(t, jobID); r.retryIn < outboxLease-5*time.Second || r.retryIn > outboxLease {
+		t.Errorf("lease renewed for %s, want about %s", r.retryIn, outboxLease)
+	}
+
+	if _, err := db.GetDB().Exec("UPDATE notification_outbox SET status = 'sent' WHERE id = $1", outboxID); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := renewOutboxLease(outboxID, 2); ok {
+		t.Error("sent row renewed")
+	}
+}
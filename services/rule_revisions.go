@@ -0,0 +1,122 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// ErrRuleVersionConflict means the rule changed since it was loaded.
+var ErrRuleVersionConflict = errors.New("rule was changed concurrently")
+
+// InsertRule creates a validated rule and its first revision.
+func InsertRule(rule *models.Rule, changedBy string) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO rules (job_id, rule_type, target, metric_name, operator, threshold_value, threshold_high, threshold_text, expression,
+			consecutive, window_violations, window_runs, window_minutes, baseline_stat, baseline_factor, baseline_runs, min_samples, seasonality,
+			severity, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, $11, $12, $13, NULLIF($14, ''), $15, $16, $17, NULLIF($18, ''), $19, $20)
+		RETURNING id, version, created_at
+	`, rule.JobID, rule.RuleType, rule.Target, rule.MetricName, rule.Operator, rule.ThresholdValue, rule.ThresholdHigh, rule.ThresholdText, rule.Expression,
+		rule.Consecutive, rule.WindowViolations, rule.WindowRuns, rule.WindowMinutes,
+		rule.Baseline, rule.BaselineFactor, rule.BaselineRuns, rule.MinSamples, rule.Seasonality,
+		rule.Severity, rule.Enabled).Scan(&rule.ID, &rule.Version, &rule.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if err := insertRuleRevision(tx, *rule, changedBy); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateRule saves a changed (and validated) copy of previous as the
+// next version. On success rule holds the new version. Returns
+// ErrRuleVersionConflict if someone else saved first.
+func UpdateRule(previous models.Rule, rule *models.Rule, changedBy string) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Rules created before revisions existed have no snapshot yet
+	if err := insertRuleRevision(tx, previous, ""); err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(`
+		UPDATE rules
+		SET metric_name = $3, operator = $4, threshold_value = $5, threshold_high = $6, threshold_text = $7, expression = NULLIF($8, ''),
+			consecutive = $9, window_violations = $10, window_runs = $11, window_minutes = $12,
+			baseline_factor = $13, baseline_runs = $14, min_samples = $15, seasonality = NULLIF($16, ''),
+			severity = $17, enabled = $18,
+			version = version + 1, updated_at = NOW()
+		WHERE id = $1 AND version = $2
+		RETURNING version, updated_at
+	`, previous.ID, previous.Version, rule.MetricName, rule.Operator, rule.ThresholdValue, rule.ThresholdHigh, rule.ThresholdText, rule.Expression,
+		rule.Consecutive, rule.WindowViolations, rule.WindowRuns, rule.WindowMinutes,
+		rule.BaselineFactor, rule.BaselineRuns, rule.MinSamples, rule.Seasonality,
+		rule.Severity, rule.Enabled).Scan(&rule.Version, &rule.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return ErrRuleVersionConflict
+	} else if err != nil {
+		return err
+	}
+
+	if err := insertRuleRevision(tx, *rule, changedBy); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertRuleRevision(tx *sql.Tx, rule models.Rule, changedBy string) error {
+	rule.Streak = nil
+	definition, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO rule_revisions (rule_id, version, definition, changed_by)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		ON CONFLICT (rule_id, version) DO NOTHING
+	`, rule.ID, rule.Version, definition, changedBy)
+	return err
+}
+
+// ListRuleRevisions returns every version of a rule, newest first.
+func ListRuleRevisions(ruleID string) ([]models.RuleRevision, error) {
+	rows, err := db.GetDB().Query(`
+		SELECT id, rule_id, version, definition, changed_by, created_at
+		FROM rule_revisions
+		WHERE rule_id = $1
+		ORDER BY version DESC
+	`, ruleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []models.RuleRevision{}
+	for rows.Next() {
+		var r models.RuleRevision
+		var definition []byte
+		if err := rows.Scan(&r.ID, &r.RuleID, &r.Version, &definition, &r.ChangedBy, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(definition, &r.Rule); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, rows.Err()
+}
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"fmt"
+)
+
+// Upper bounds for repeat thresholds.
+const (
+	maxRuleConsecutive   = 1000
+	maxRuleWindowRuns    = 1000
+	maxRuleWindowMinutes = 30 * 24 * 60
+)
+
+// validateRuleThreshold checks the optional repeat threshold of a rule:
+// either Consecutive, or WindowViolations with WindowRuns or WindowMinutes.
+func validateRuleThreshold(rule models.Rule) error {
+	if rule.Consecutive < 0 || rule.WindowViolations < 0 || rule.WindowRuns < 0 || rule.WindowMinutes < 0 {
+		return fmt.Errorf("consecutive and window settings must not be negative")
+	}
+	if rule.Consecutive > maxRuleConsecutive {
+		return fmt.Errorf("consecutive must be at most %d", maxRuleConsecutive)
+	}
+
+	windowed := rule.WindowRuns > 0 || rule.WindowMinutes > 0
+	if rule.Consecutive > 0 && (windowed || rule.WindowViolations > 0) {
+		return fmt.Errorf("use either consecutive or window_violations, not both")
+	}
+	if rule.WindowRuns > 0 && rule.WindowMinutes > 0 {
+		return fmt.Errorf("use either window_runs or window_minutes, not both")
+	}
+	if windowed && rule.WindowViolations == 0 {
+		return fmt.Errorf("window_violations is required with window_runs or window_minutes")
+	}
+	if rule.WindowViolations > 0 && !windowed {
+		return fmt.Errorf("window_violations needs window_runs or window_minutes")
+	}
+	if rule.WindowRuns > maxRuleWindowRuns {
+		return fmt.Errorf("window_runs must be at most %d", maxRuleWindowRuns)
+	}
+	if rule.WindowRuns > 0 && rule.WindowViolations > rule.WindowRuns {
+		return fmt.Errorf("window_violations must be <= window_runs")
+	}
+	if rule.WindowMinutes > maxRuleWindowMinutes {
+		return fmt.Errorf("window_minutes must be at most %d", maxRuleWindowMinutes)
+	}
+	return nil
+}
+
+// hasRuleThreshold reports whether a rule waits for repeated violations.
+func hasRuleThreshold(rule models.Rule) bool {
+	return rule.Consecutive > 1 || rule.WindowViolations > 0
+}
+
+// describeRuleThreshold renders the repeat threshold, e.g. " in 3 of the last 5 runs".
+func describeRuleThreshold(rule models.Rule) string {
+	switch {
+	case rule.Consecutive > 1:
+		return fmt.Sprintf(" for %d consecutive runs", rule.Consecutive)
+	case rule.WindowRuns > 0:
+		return fmt.Sprintf(" in %d of the last %d runs", rule.WindowViolations, rule.WindowRuns)
+	case rule.WindowMinutes > 0:
+		return fmt.Sprintf(" %d times within %d minutes", rule.WindowViolations, rule.WindowMinutes)
+	}
+	return ""
+}
+
+// RecordRuleEvaluation stores the outcome of a rule for a run.
+// met reports whether the violation counts (its repeat threshold, if any,
+// is reached); alert reports whether a new alert should go out. Rules with
+// a threshold alert once and stay quiet while that alert is unresolved.
+func RecordRuleEvaluation(run models.JobRun, rule models.Rule, violated bool, actualValue interface{}) (met bool, alert bool) {
+	var actual *string
+	if actualValue != nil {
+		s := FormatMetricValue(actualValue)
+		actual = &s
+	}
+
+	var evaluationID string
+	err := db.GetDB().QueryRow(`
+		INSERT INTO rule_evaluations (rule_id, job_id, run_id, violated, actual_value)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, rule.ID, run.JobID, run.ID, violated, actual).Scan(&evaluationID)
+	if err != nil {
+		fmt.Printf("Error recording rule evaluation: %v\n", err)
+		// Without history a threshold can't be checked; fall back to plain rules
+		return violated, violated
+	}
+
+	if !violated {
+		return false, false
+	}
+	if !hasRuleThreshold(rule) {
+		markThresholdMet(evaluationID)
+		return true, true
+	}
+
+	met, err = ruleThresholdMet(rule)
+	if err != nil {
+		fmt.Printf("Error checking rule threshold: %v\n", err)
+		return false, false
+	}
+	if !met {
+		return false, false
+	}
+	markThresholdMet(evaluationID)
+
+	var open bool
+	err = db.GetDB().QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM alerts WHERE rule_id = $1 AND status <> 'resolved')
+	`, rule.ID).Scan(&open)
+	if err != nil {
+		fmt.Printf("Error checking open rule alerts: %v\n", err)
+	}
+	return true, !open
+}
+
+func markThresholdMet(evaluationID string) {
+	if _, err := db.GetDB().Exec("UPDATE rule_evaluations SET threshold_met = true WHERE id = $1", evaluationID); err != nil {
+		fmt.Printf("Error updating rule evaluation: %v\n", err)
+	}
+}
+
+// ruleThresholdMet counts the recorded violations of a rule (including
+// the one just recorded) against its threshold.
+func ruleThresholdMet(rule models.Rule) (bool, error) {
+	switch {
+	case rule.Consecutive > 1:
+		streak, err := RuleStreak(rule.ID)
+		return streak >= rule.Consecutive, err
+	case rule.WindowRuns > 0:
+		var n int
+		err := db.GetDB().QueryRow(`
+			SELECT COUNT(*) FROM (
+				SELECT violated FROM rule_evaluations
+				WHERE rule_id = $1
+				ORDER BY evaluated_at DESC
+				LIMIT $2
+			) w WHERE violated
+		`, rule.ID, rule.WindowRuns).Scan(&n)
+		return n >= rule.WindowViolations, err
+	case rule.WindowMinutes > 0:
+		var n int
+		err := db.GetDB().QueryRow(`
+			SELECT COUNT(*) FROM rule_evaluations
+			WHERE rule_id = $1 AND violated
+			AND evaluated_at > NOW() - make_interval(mins => $2)
+		`, rule.ID, rule.WindowMinutes).Scan(&n)
+		return n >= rule.WindowViolations, err
+	}
+	return true, nil
+}
+
+// RuleStreak returns the number of consecutive violations of a rule,
+// counting back from its latest evaluation.
+func RuleStreak(ruleID string) (int, error) {
+	var n int
+	err := db.GetDB().QueryRow(`
+		SELECT COUNT(*) FROM rule_evaluations
+		WHERE rule_id = $1 AND violated
+		AND evaluated_at > COALESCE(
+			(SELECT MAX(evaluated_at) FROM rule_evaluations WHERE rule_id = $1 AND NOT violated),
+			'-infinity'
+		)
+	`, ruleID).Scan(&n)
+	return n, err
+}
+
+// ListRuleEvaluations returns the latest evaluations of a rule, newest first.
+func ListRuleEvaluations(ruleID string, limit int) ([]models.RuleEvaluation, error) {
+	rows, err := db.GetDB().Query(`
+		SELECT id, rule_id, run_id, violated, threshold_met, actual_value, evaluated_at
+		FROM rule_evaluations
+		WHERE rule_id = $1
+		ORDER BY evaluated_at DESC
+		LIMIT $2
+	`, ruleID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	evaluations := []models.RuleEvaluation{}
+	for rows.Next() {
+		var e models.RuleEvaluation
+		if err := rows.Scan(&e.ID, &e.RuleID, &e.RunID, &e.Violated, &e.ThresholdMet, &e.ActualValue, &e.EvaluatedAt); err != nil {
+			return nil, err
+		}
+		evaluations = append(evaluations, e)
+	}
+	return evaluations, rows.Err()
+}
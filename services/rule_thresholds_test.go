@@ -0,0 +1,161 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"cronmonitor/models"
+	"strings"
+	"testing"
+)
+
+func TestValidateRuleThreshold(t *testing.T) {
+	tests := []struct {
+		name string
+		rule models.Rule
+		err  string // "" for valid
+	}{
+		{"none", models.Rule{}, ""},
+		{"consecutive", models.Rule{Consecutive: 3}, ""},
+		{"n of m runs", models.Rule{WindowViolations: 3, WindowRuns: 5}, ""},
+		{"n of m equal", models.Rule{WindowViolations: 5, WindowRuns: 5}, ""},
+		{"n in minutes", models.Rule{WindowViolations: 3, WindowMinutes: 60}, ""},
+		{"max consecutive", models.Rule{Consecutive: maxRuleConsecutive}, ""},
+		{"negative", models.Rule{Consecutive: -1}, "must not be negative"},
+		{"negative window", models.Rule{WindowViolations: 1, WindowRuns: -5}, "must not be negative"},
+		{"too many consecutive", models.Rule{Consecutive: maxRuleConsecutive + 1}, "consecutive must be at most"},
+		{"consecutive and window", models.Rule{Consecutive: 2, WindowViolations: 2, WindowRuns: 5}, "not both"},
+		{"consecutive and violations", models.Rule{Consecutive: 2, WindowViolations: 2}, "not both"},
+		{"runs and minutes", models.Rule{WindowViolations: 2, WindowRuns: 5, WindowMinutes: 60}, "window_runs or window_minutes, not both"},
+		{"window without n", models.Rule{WindowRuns: 5}, "window_violations is required"},
+		{"n without window", models.Rule{WindowViolations: 2}, "needs window_runs or window_minutes"},
+		{"n above m", models.Rule{WindowViolations: 6, WindowRuns: 5}, "window_violations must be <= window_runs"},
+		{"too many runs", models.Rule{WindowViolations: 1, WindowRuns: maxRuleWindowRuns + 1}, "window_runs must be at most"},
+		{"too many minutes", models.Rule{WindowViolations: 1, WindowMinutes: maxRuleWindowMinutes + 1}, "window_minutes must be at most"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRuleThreshold(tt.rule)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDescribeRuleThreshold(t *testing.T) {
+	for _, tt := range []struct {
+		rule models.Rule
+		want string
+	}{
+		{models.Rule{}, ""},
+		{models.Rule{Consecutive: 1}, ""},
+		{models.Rule{Consecutive: 3}, " for 3 consecutive runs"},
+		{models.Rule{WindowViolations: 3, WindowRuns: 5}, " in 3 of the last 5 runs"},
+		{models.Rule{WindowViolations: 2, WindowMinutes: 30}, " 2 times within 30 minutes"},
+	} {
+		if got := describeRuleThreshold(tt.rule); got != tt.want {
+			t.Errorf("describeRuleThreshold(%+v) = %q, want %q", tt.rule, got, tt.want)
+		}
+	}
+}
+
+// testRule saves a rule on jobID; it goes away with the job.
+func testRule(t *testing.T, rule models.Rule) models.Rule {
+	t.Helper()
+	rule.RuleType, rule.Target, rule.Severity, rule.Enabled = RuleThreshold, TargetMetric, "critical", true
+	if err := InsertRule(&rule, ""); err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+func testRun(t *testing.T, jobID string) models.JobRun {
+	t.Helper()
+	run := models.JobRun{JobID: jobID, Status: "ok"}
+	if err := db.GetDB().QueryRow(
+		"INSERT INTO job_runs (job_id, status) VALUES ($1, 'ok') RETURNING id", jobID,
+	).Scan(&run.ID); err != nil {
+		t.Fatal(err)
+	}
+	return run
+}
+
+func TestRecordRuleEvaluationThresholds(t *testing.T) {
+	testDB(t)
+	userID, _ := testUser(t, "example.com", true)
+	jobID := testJob(t, userID, personalOrg(t, userID))
+
+	tests := []struct {
+		name     string
+		rule     models.Rule
+		violated []bool
+		met      []bool
+	}{
+		{
+			name:     "plain",
+			rule:     models.Rule{},
+			violated: []bool{true, false, true},
+			met:      []bool{true, false, true},
+		},
+		{
+			name:     "consecutive",
+			rule:     models.Rule{Consecutive: 3},
+			violated: []bool{true, true, false, true, true, true, true},
+			met:      []bool{false, false, false, false, false, true, true},
+		},
+		{
+			name:     "2 of the last 3 runs",
+			rule:     models.Rule{WindowViolations: 2, WindowRuns: 3},
+			violated: []bool{true, false, false, true, false, true, false, false},
+			met:      []bool{false, false, false, false, false, true, false, false},
+		},
+		{
+			name:     "3 within an hour",
+			rule:     models.Rule{WindowViolations: 3, WindowMinutes: 60},
+			violated: []bool{true, false, true, false, true},
+			met:      []bool{false, false, false, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.JobID, tt.rule.MetricName, tt.rule.Operator = jobID, "rows", "=="
+			rule := testRule(t, tt.rule)
+			alerts := 0
+			for i, violated := range tt.violated {
+				met, alert := RecordRuleEvaluation(testRun(t, jobID), rule, violated, float64(0))
+				if met != tt.met[i] {
+					t.Errorf("run %d: met = %v, want %v", i+1, met, tt.met[i])
+				}
+				if alert {
+					alerts++
+				}
+			}
+
+			// Every met evaluation of a plain rule alerts; thresholds alert
+			// again only after the open alert is resolved (none is stored here)
+			want := 0
+			for _, m := range tt.met {
+				if m {
+					want++
+				}
+			}
+			if alerts != want {
+				t.Errorf("%d alerts, want %d", alerts, want)
+			}
+
+			evaluations, err := ListRuleEvaluations(rule.ID, 100)
+			if err != nil || len(evaluations) != len(tt.violated) {
+				t.Fatalf("%d evaluations, %v", len(evaluations), err)
+			}
+			// Newest first
+			for i, e := range evaluations {
+				j := len(tt.violated) - 1 - i
+				if e.Violated != tt.violated[j] || e.ThresholdMet != tt.met[j] {
+					t.Errorf("evaluation %d = %v/%v, want %v/%v", j+1, e.Violated, e.ThresholdMet, tt.violated[j], tt.met[j])
+				}
+			}
+		})
+	}
+}
@@ -1,9 +1,65 @@
 package services
 
 import (
+	"cronmonitor/db"
 	"cronmonitor/models"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
+// Rule types.
+const (
+	RuleThreshold  = "threshold"
+	RuleAbsent     = "absent"     // fires when the metric is missing (or null)
+	RuleExpression = "expression" // fires when Expression is true (see expr.go)
+)
+
+// Rule targets: what a threshold rule reads from the run.
+const (
+	TargetMetric   = "metric"   // run.Metrics[MetricName]
+	TargetDuration = "duration" // duration_ms, numeric operators
+	TargetStatus   = "status"   // == / != against threshold_text (ok, fail)
+	TargetStderr   = "stderr"   // =~, !~, contains, !contains
+)
+
+// Operators describe the violating condition: "rows == 0" alerts on zero
+// rows, "latency between 0 100" alerts when latency is in [0, 100],
+// "latency outside 0 100" alerts when it leaves that range.
+// =~ / !~ alert when a string metric matches / does not match a regex,
+// contains / !contains on a substring.
+var ruleOperators = map[string]bool{
+	"==": true, "!=": true,
+	"<": true, "<=": true,
+	">": true, ">=": true,
+	"between": true, "outside": true,
+	"=~": true, "!~": true,
+	"contains": true, "!contains": true,
+}
+
+// Operators that compare against threshold_text instead of threshold_value.
+func isTextOperator(op string) bool {
+	return op == "==" || op == "!=" || isRegexOperator(op) || isSubstringOperator(op)
+}
+
+func isSubstringOperator(op string) bool {
+	return op == "contains" || op == "!contains"
+}
+
+func isRegexOperator(op string) bool {
+	return op == "=~" || op == "!~"
+}
+
+func isRangeOperator(op string) bool {
+	return op == "between" || op == "outside"
+}
+
+// toFloat64 accepts JSON numbers and numeric strings ("42", " 3.5 ").
+// "NaN" and "Inf" strings are not numbers: they would poison the median
+// of every baseline they were sampled into.
 func toFloat64(v interface{}) (float64, bool) {
 	switch t := v.(type) {
 	case float64:
@@ -12,20 +68,235 @@ func toFloat64(v interface{}) (float64, bool) {
 		return float64(t), true
 	case int64:
 		return float64(t), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, false
+		}
+		return f, true
 	default:
 		return 0, false
 	}
 }
 
-func EvaluateRule(metrics map[string]interface{}, rule models.Rule) (bool, float64) {
-	value, ok := metrics[rule.MetricName]
-	if !ok {
-		return false, 0
+// metricString renders a scalar metric for string comparison.
+// Objects and arrays are not comparable.
+func metricString(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case bool:
+		return strconv.FormatBool(t), true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	default:
+		return "", false
+	}
+}
+
+// ValidateRule checks the rule type, operator and thresholds.
+// An empty RuleType is treated as a threshold rule. Expression errors are
+// returned as *ExprError with the column of the problem.
+func ValidateRule(rule models.Rule) error {
+	if err := validateRuleThreshold(rule); err != nil {
+		return err
+	}
+	if rule.RuleType == RuleExpression {
+		if rule.MetricName != "" || rule.Operator != "" || rule.ThresholdHigh != nil || rule.ThresholdText != nil ||
+			(rule.Target != "" && rule.Target != TargetMetric) {
+			return fmt.Errorf("expression rules take only an expression")
+		}
+		_, err := compiledExpression(rule.Expression)
+		return err
+	}
+	if rule.Expression != "" {
+		return fmt.Errorf("expression is only used by rule_type expression")
+	}
+	if rule.RuleType == RuleBaseline {
+		if err := validateBaselineRule(rule); err != nil {
+			return err
+		}
+	} else if rule.Baseline != "" || rule.BaselineFactor != 0 || rule.BaselineRuns != 0 || rule.MinSamples != 0 || rule.Seasonality != "" {
+		return fmt.Errorf("baseline, factor, baseline_runs, min_samples and seasonality are only used by rule_type baseline")
+	}
+
+	switch rule.Target {
+	case "", TargetMetric:
+		if rule.MetricName == "" {
+			return fmt.Errorf("metric_name is required")
+		}
+		if _, err := parseMetricPath(rule.MetricName); err != nil {
+			return fmt.Errorf("invalid metric_name: %v", err)
+		}
+	case TargetDuration, TargetStatus, TargetStderr:
+		if rule.MetricName != "" {
+			return fmt.Errorf("metric_name is only used by target metric")
+		}
+		if rule.RuleType == RuleAbsent {
+			return fmt.Errorf("absent rules need target metric")
+		}
+		if err := validateTargetOperator(rule); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown target %q (expected metric, duration, status or stderr)", rule.Target)
+	}
+
+	switch rule.RuleType {
+	case RuleAbsent:
+		if rule.Operator != "" || rule.ThresholdHigh != nil || rule.ThresholdText != nil {
+			return fmt.Errorf("absent rules take no operator or thresholds")
+		}
+		return nil
+	case RuleBaseline:
+		return nil
+	case "", RuleThreshold:
+	default:
+		return fmt.Errorf("unknown rule_type %q (expected threshold, absent, expression or baseline)", rule.RuleType)
+	}
+
+	if !ruleOperators[rule.Operator] {
+		return fmt.Errorf("unknown operator %q (expected ==, !=, <, <=, >, >=, between, outside, =~, !~, contains or !contains)", rule.Operator)
+	}
+	if rule.ThresholdText != nil && !isTextOperator(rule.Operator) {
+		return fmt.Errorf("threshold_text is only used by ==, !=, =~, !~, contains and !contains")
+	}
+	if isSubstringOperator(rule.Operator) && (rule.ThresholdText == nil || *rule.ThresholdText == "") {
+		return fmt.Errorf("operator %s needs the text to look for in threshold_text", rule.Operator)
+	}
+	if isRegexOperator(rule.Operator) {
+		if rule.ThresholdText == nil {
+			return fmt.Errorf("operator %s needs a regular expression in threshold_text", rule.Operator)
+		}
+		if _, err := regexp.Compile(*rule.ThresholdText); err != nil {
+			return fmt.Errorf("invalid regular expression: %v", err)
+		}
+	}
+	if isRangeOperator(rule.Operator) {
+		if rule.ThresholdHigh == nil {
+			return fmt.Errorf("operator %s needs threshold_value (low) and threshold_high", rule.Operator)
+		}
+		if *rule.ThresholdHigh < rule.ThresholdValue {
+			return fmt.Errorf("threshold_high must be >= threshold_value")
+		}
+	} else if rule.ThresholdHigh != nil {
+		return fmt.Errorf("threshold_high is only used by between and outside")
+	}
+	return nil
+}
+
+// validateTargetOperator restricts operators for the built-in targets.
+func validateTargetOperator(rule models.Rule) error {
+	switch rule.Target {
+	case TargetDuration:
+		if rule.ThresholdText != nil || isRegexOperator(rule.Operator) || isSubstringOperator(rule.Operator) {
+			return fmt.Errorf("duration rules compare threshold_value (milliseconds) with a numeric operator")
+		}
+	case TargetStatus:
+		if rule.Operator != "==" && rule.Operator != "!=" {
+			return fmt.Errorf("status rules use == or !=")
+		}
+		if rule.ThresholdText == nil || (*rule.ThresholdText != "ok" && *rule.ThresholdText != "fail") {
+			return fmt.Errorf("status rules need threshold_text ok or fail")
+		}
+	case TargetStderr:
+		if !isRegexOperator(rule.Operator) && !isSubstringOperator(rule.Operator) {
+			return fmt.Errorf("stderr rules use =~, !~, contains or !contains")
+		}
+	}
+	return nil
+}
+
+// RuleSubject names what a rule reads: the metric name or the target.
+func RuleSubject(rule models.Rule) string {
+	switch rule.Target {
+	case TargetDuration:
+		return "duration_ms"
+	case TargetStatus, TargetStderr:
+		return rule.Target
+	default:
+		return rule.MetricName
+	}
+}
+
+// DescribeRule renders the violating condition, e.g. "rows between 1 and 5",
+// followed by the repeat threshold if there is one.
+func DescribeRule(rule models.Rule) string {
+	return describeCondition(rule) + describeRuleThreshold(rule)
+}
+
+func describeCondition(rule models.Rule) string {
+	subject := RuleSubject(rule)
+	switch {
+	case rule.RuleType == RuleExpression:
+		return rule.Expression
+	case rule.RuleType == RuleAbsent:
+		return fmt.Sprintf("%s is absent", subject)
+	case rule.RuleType == RuleBaseline:
+		return describeBaselineCondition(rule)
+	case rule.ThresholdText != nil:
+		return fmt.Sprintf("%s %s %q", subject, rule.Operator, *rule.ThresholdText)
+	case isRangeOperator(rule.Operator) && rule.ThresholdHigh != nil:
+		return fmt.Sprintf("%s %s %f and %f", subject, rule.Operator, rule.ThresholdValue, *rule.ThresholdHigh)
+	default:
+		return fmt.Sprintf("%s %s %f", subject, rule.Operator, rule.ThresholdValue)
+	}
+}
+
+// ruleValue reads the value a threshold or absent rule checks.
+func ruleValue(run models.JobRun, rule models.Rule) (interface{}, bool) {
+	switch rule.Target {
+	case TargetDuration:
+		return float64(run.DurationMs), true
+	case TargetStatus:
+		return run.Status, true
+	case TargetStderr:
+		return run.Stderr, true
+	default:
+		return LookupMetric(run.Metrics, rule.MetricName)
+	}
+}
+
+// EvaluateRule reports whether the run violates the rule and the value it
+// was checked against (nil for absent rules; the variables read for
+// expression rules). Metric names may be dotted paths (see LookupMetric).
+// Threshold rules never fire on missing or incomparable metrics; use an
+// absent rule to catch those.
+func EvaluateRule(run models.JobRun, rule models.Rule) (bool, interface{}) {
+	if rule.RuleType == RuleExpression {
+		return evaluateExpressionRule(run, rule)
+	}
+	if rule.RuleType == RuleBaseline {
+		return evaluateBaselineRule(run, rule)
+	}
+
+	value, ok := ruleValue(run, rule)
+
+	if rule.RuleType == RuleAbsent {
+		return !ok || value == nil, nil
+	}
+
+	if !ok || value == nil {
+		return false, nil
+	}
+
+	if rule.ThresholdText != nil {
+		violated := evaluateTextRule(value, rule)
+		if rule.Target == TargetStderr {
+			// Report the matching line, not the whole stderr
+			return violated, stderrExcerpt(run.Stderr, rule)
+		}
+		return violated, value
 	}
 
 	numValue, ok := toFloat64(value)
 	if !ok {
-		return false, 0
+		return false, value
+	}
+
+	high := rule.ThresholdValue
+	if rule.ThresholdHigh != nil {
+		high = *rule.ThresholdHigh
 	}
 
 	violated := false
@@ -38,7 +309,168 @@ func EvaluateRule(metrics map[string]interface{}, rule models.Rule) (bool, float
 		violated = (numValue > rule.ThresholdValue)
 	case "!=":
 		violated = (numValue != rule.ThresholdValue)
+	case "<=":
+		violated = (numValue <= rule.ThresholdValue)
+	case ">=":
+		violated = (numValue >= rule.ThresholdValue)
+	case "between":
+		violated = (numValue >= rule.ThresholdValue && numValue <= high)
+	case "outside":
+		violated = (numValue < rule.ThresholdValue || numValue > high)
 	}
 
 	return violated, numValue
 }
+
+// evaluateExpressionRule fails open: an expression that cannot be
+// evaluated for this run (missing metric, division by zero) does not fire.
+func evaluateExpressionRule(run models.JobRun, rule models.Rule) (bool, interface{}) {
+	expr, err := compiledExpression(rule.Expression)
+	if err != nil {
+		fmt.Printf("Rule %s: invalid expression: %v\n", rule.ID, err)
+		return false, nil
+	}
+	violated, values, err := expr.Eval(run)
+	if err != nil {
+		fmt.Printf("Rule %s: expression not evaluated: %v\n", rule.ID, err)
+		return false, values
+	}
+	return violated, values
+}
+
+// evaluateTextRule handles string, boolean and regex comparisons.
+// Numbers (and numeric strings) compare numerically when the threshold
+// is numeric too, so "1.0" == 1.
+func evaluateTextRule(value interface{}, rule models.Rule) bool {
+	text := *rule.ThresholdText
+
+	if isRegexOperator(rule.Operator) {
+		str, ok := metricString(value)
+		if !ok {
+			return false
+		}
+		re, err := regexp.Compile(text)
+		if err != nil {
+			return false
+		}
+		return re.MatchString(str) == (rule.Operator == "=~")
+	}
+
+	if isSubstringOperator(rule.Operator) {
+		str, ok := metricString(value)
+		if !ok {
+			return false
+		}
+		return strings.Contains(str, text) == (rule.Operator == "contains")
+	}
+
+	var equal bool
+	if b, isBool := value.(bool); isBool {
+		want, err := strconv.ParseBool(text)
+		equal = err == nil && b == want
+	} else if num, ok := toFloat64(value); ok {
+		if want, err := strconv.ParseFloat(strings.TrimSpace(text), 64); err == nil {
+			equal = num == want
+		} else {
+			str, _ := metricString(value)
+			equal = str == text
+		}
+	} else if str, ok := metricString(value); ok {
+		equal = str == text
+	} else {
+		return false
+	}
+
+	if rule.Operator == "==" {
+		return equal
+	}
+	return !equal
+}
+
+// stderrExcerpt returns the first stderr line matching a stderr rule,
+// trimmed to stderrExcerptMax bytes. Negated rules report an empty string.
+func stderrExcerpt(stderr string, rule models.Rule) string {
+	const stderrExcerptMax = 200
+	if rule.ThresholdText == nil || rule.Operator == "!~" || rule.Operator == "!contains" {
+		return ""
+	}
+
+	var re *regexp.Regexp
+	if isRegexOperator(rule.Operator) {
+		re, _ = regexp.Compile(*rule.ThresholdText)
+	}
+	for _, line := range strings.Split(stderr, "\n") {
+		if (re != nil && re.MatchString(line)) || (re == nil && strings.Contains(line, *rule.ThresholdText)) {
+			if len(line) > stderrExcerptMax {
+				line = line[:stderrExcerptMax] + "..."
+			}
+			return line
+		}
+	}
+	// Multi-line match: fall back to the start of stderr
+	if len(stderr) > stderrExcerptMax {
+		return stderr[:stderrExcerptMax] + "..."
+	}
+	return stderr
+}
+
+// FormatMetricValue renders an actual value for alert messages.
+func FormatMetricValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "(missing)"
+	case float64:
+		return fmt.Sprintf("%f", t)
+	case string:
+		return strconv.Quote(t)
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(t)
+		if err != nil {
+			return fmt.Sprintf("%v", t)
+		}
+		return string(b)
+	default:
+		return fmt.Sprintf("%v", t)
+	}
+}
+
+// ruleColumns matches ScanRule.
+const ruleColumns = "id, job_id, rule_type, target, metric_name, operator, threshold_value, threshold_high, threshold_text, COALESCE(expression, ''), consecutive, window_violations, window_runs, window_minutes, COALESCE(baseline_stat, ''), baseline_factor, baseline_runs, min_samples, COALESCE(seasonality, ''), COALESCE(severity, 'critical'), enabled, version, created_at, updated_at"
+
+// ScanRule reads a rules row selected with ruleColumns.
+func ScanRule(row rowScanner) (models.Rule, error) {
+	var r models.Rule
+	err := row.Scan(&r.ID, &r.JobID, &r.RuleType, &r.Target, &r.MetricName, &r.Operator, &r.ThresholdValue, &r.ThresholdHigh, &r.ThresholdText, &r.Expression,
+		&r.Consecutive, &r.WindowViolations, &r.WindowRuns, &r.WindowMinutes,
+		&r.Baseline, &r.BaselineFactor, &r.BaselineRuns, &r.MinSamples, &r.Seasonality, &r.Severity, &r.Enabled, &r.Version, &r.CreatedAt, &r.UpdatedAt)
+	if err == nil && r.RuleType == RuleExpression {
+		// Compile now rather than on the first run; a bad expression is
+		// reported when the rule is evaluated
+		compiledExpression(r.Expression)
+	}
+	return r, err
+}
+
+// LoadRule returns one rule (sql.ErrNoRows if it does not exist).
+func LoadRule(id string) (models.Rule, error) {
+	return ScanRule(db.GetDB().QueryRow("SELECT "+ruleColumns+" FROM rules WHERE id = $1", id))
+}
+
+// LoadJobRules returns every rule of a job, disabled ones included.
+func LoadJobRules(jobID string) ([]models.Rule, error) {
+	rows, err := db.GetDB().Query("SELECT "+ruleColumns+" FROM rules WHERE job_id = $1 ORDER BY created_at", jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []models.Rule
+	for rows.Next() {
+		r, err := ScanRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
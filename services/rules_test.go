@@ -0,0 +1,304 @@
+package services
+
+import (
+	"cronmonitor/models"
+	"strings"
+	"testing"
+)
+
+func float(v float64) *float64 { return &v }
+
+func text(s string) *string { return &s }
+
+func metricRun(metrics map[string]interface{}) models.JobRun {
+	return models.JobRun{Status: "ok", Metrics: metrics}
+}
+
+func TestEvaluateRuleOperators(t *testing.T) {
+	tests := []struct {
+		op    string
+		value float64
+		high  *float64
+		rows  float64
+		want  bool
+	}{
+		{"==", 0, nil, 0, true},
+		{"==", 0, nil, 1, false},
+		{"!=", 0, nil, 1, true},
+		{"!=", 0, nil, 0, false},
+		{"<", 10, nil, 9, true},
+		{"<", 10, nil, 10, false},
+		{"<=", 10, nil, 10, true},
+		{"<=", 10, nil, 11, false},
+		{">", 10, nil, 11, true},
+		{">", 10, nil, 10, false},
+		{">=", 10, nil, 10, true},
+		{">=", 10, nil, 9, false},
+		{"between", 10, float(20), 10, true},
+		{"between", 10, float(20), 20, true},
+		{"between", 10, float(20), 15, true},
+		{"between", 10, float(20), 9.9, false},
+		{"between", 10, float(20), 20.1, false},
+		{"outside", 10, float(20), 9.9, true},
+		{"outside", 10, float(20), 20.1, true},
+		{"outside", 10, float(20), 10, false},
+		{"outside", 10, float(20), 20, false},
+		{"between", 5, float(5), 5, true},
+	}
+	for _, tt := range tests {
+		rule := models.Rule{MetricName: "rows", Operator: tt.op, ThresholdValue: tt.value, ThresholdHigh: tt.high}
+		got, actual := EvaluateRule(metricRun(map[string]interface{}{"rows": tt.rows}), rule)
+		if got != tt.want {
+			t.Errorf("rows=%v %s: violated = %v, want %v", tt.rows, DescribeRule(rule), got, tt.want)
+		}
+		if actual != tt.rows {
+			t.Errorf("rows=%v %s: actual = %v", tt.rows, DescribeRule(rule), actual)
+		}
+	}
+}
+
+func TestEvaluateRuleMissingMetric(t *testing.T) {
+	threshold := models.Rule{MetricName: "rows", Operator: "==", ThresholdValue: 0}
+	absent := models.Rule{RuleType: RuleAbsent, MetricName: "rows"}
+
+	tests := []struct {
+		name    string
+		metrics map[string]interface{}
+		absent  bool
+	}{
+		{"present", map[string]interface{}{"rows": float64(0)}, false},
+		{"missing", map[string]interface{}{"other": float64(0)}, true},
+		{"null", map[string]interface{}{"rows": nil}, true},
+		{"no metrics", nil, true},
+	}
+	for _, tt := range tests {
+		run := metricRun(tt.metrics)
+		if got, actual := EvaluateRule(run, absent); got != tt.absent || actual != nil {
+			t.Errorf("%s: absent rule = %v, %v, want %v", tt.name, got, actual, tt.absent)
+		}
+		// Threshold rules never fire on a missing metric
+		if got, _ := EvaluateRule(run, threshold); got == tt.absent {
+			t.Errorf("%s: threshold rule violated = %v", tt.name, got)
+		}
+	}
+}
+
+func TestValidateRuleOperators(t *testing.T) {
+	tests := []struct {
+		name string
+		rule models.Rule
+		err  string // "" for valid
+	}{
+		{"comparison", models.Rule{MetricName: "rows", Operator: ">="}, ""},
+		{"between", models.Rule{MetricName: "rows", Operator: "between", ThresholdValue: 1, ThresholdHigh: float(5)}, ""},
+		{"outside equal bounds", models.Rule{MetricName: "rows", Operator: "outside", ThresholdValue: 5, ThresholdHigh: float(5)}, ""},
+		{"absent", models.Rule{RuleType: RuleAbsent, MetricName: "rows"}, ""},
+		{"unknown operator", models.Rule{MetricName: "rows", Operator: "=>"}, "unknown operator"},
+		{"no operator", models.Rule{MetricName: "rows"}, "unknown operator"},
+		{"no metric", models.Rule{Operator: ">"}, "metric_name is required"},
+		{"between without high", models.Rule{MetricName: "rows", Operator: "between", ThresholdValue: 1}, "needs threshold_value (low) and threshold_high"},
+		{"outside reversed", models.Rule{MetricName: "rows", Operator: "outside", ThresholdValue: 5, ThresholdHigh: float(1)}, "threshold_high must be >= threshold_value"},
+		{"high without range", models.Rule{MetricName: "rows", Operator: ">", ThresholdHigh: float(1)}, "only used by between and outside"},
+		{"absent with operator", models.Rule{RuleType: RuleAbsent, MetricName: "rows", Operator: "=="}, "absent rules take no operator"},
+		{"absent with high", models.Rule{RuleType: RuleAbsent, MetricName: "rows", ThresholdHigh: float(1)}, "absent rules take no operator"},
+		{"unknown type", models.Rule{RuleType: "sometimes", MetricName: "rows", Operator: ">"}, "unknown rule_type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateRule(tt.rule)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestEvaluateRuleTextValues(t *testing.T) {
+	metrics := map[string]interface{}{
+		"count":   "42",
+		"padded":  " 3.5 ",
+		"ratio":   float64(1),
+		"env":     "prod",
+		"healthy": false,
+		"host":    "db-eu-1.internal",
+		"tables":  []interface{}{"users"},
+		"nan":     "NaN",
+		"inf":     "+Infinity",
+		"neginf":  "-Inf",
+	}
+	tests := []struct {
+		name  string
+		rule  models.Rule
+		want  bool
+		value interface{}
+	}{
+		// Numeric strings compare as numbers
+		{"numeric string >", models.Rule{MetricName: "count", Operator: ">", ThresholdValue: 40}, true, float64(42)},
+		{"numeric string between", models.Rule{MetricName: "padded", Operator: "between", ThresholdValue: 3, ThresholdHigh: float(4)}, true, 3.5},
+		{"numeric string == text", models.Rule{MetricName: "count", Operator: "==", ThresholdText: text("42.0")}, true, "42"},
+		{"number == text", models.Rule{MetricName: "ratio", Operator: "==", ThresholdText: text("1.0")}, true, float64(1)},
+		{"non-numeric string >", models.Rule{MetricName: "env", Operator: ">", ThresholdValue: 1}, false, "prod"},
+
+		// NaN and infinities are not numbers
+		{"NaN string <", models.Rule{MetricName: "nan", Operator: "<", ThresholdValue: 1}, false, "NaN"},
+		{"NaN string !=", models.Rule{MetricName: "nan", Operator: "!=", ThresholdValue: 1}, false, "NaN"},
+		{"Infinity string >", models.Rule{MetricName: "inf", Operator: ">", ThresholdValue: 1}, false, "+Infinity"},
+		{"-Inf string outside", models.Rule{MetricName: "neginf", Operator: "outside", ThresholdValue: 0, ThresholdHigh: float(1)}, false, "-Inf"},
+		{"NaN string == text", models.Rule{MetricName: "nan", Operator: "==", ThresholdText: text("NaN")}, true, "NaN"},
+
+		// Strings and booleans
+		{"string ==", models.Rule{MetricName: "env", Operator: "==", ThresholdText: text("prod")}, true, "prod"},
+		{"string !=", models.Rule{MetricName: "env", Operator: "!=", ThresholdText: text("prod")}, false, "prod"},
+		{"string case matters", models.Rule{MetricName: "env", Operator: "==", ThresholdText: text("PROD")}, false, "prod"},
+		{"bool ==", models.Rule{MetricName: "healthy", Operator: "==", ThresholdText: text("false")}, true, false},
+		{"bool != ", models.Rule{MetricName: "healthy", Operator: "!=", ThresholdText: text("true")}, true, false},
+		{"bool vs non-bool text", models.Rule{MetricName: "healthy", Operator: "==", ThresholdText: text("no")}, false, false},
+
+		// Regex and substring
+		{"=~ match", models.Rule{MetricName: "host", Operator: "=~", ThresholdText: text(`^db-eu-\d+`)}, true, "db-eu-1.internal"},
+		{"=~ no match", models.Rule{MetricName: "host", Operator: "=~", ThresholdText: text(`^db-us-`)}, false, "db-eu-1.internal"},
+		{"!~ no match", models.Rule{MetricName: "host", Operator: "!~", ThresholdText: text(`^db-us-`)}, true, "db-eu-1.internal"},
+		{"=~ on number", models.Rule{MetricName: "ratio", Operator: "=~", ThresholdText: text(`^1$`)}, true, float64(1)},
+		{"contains", models.Rule{MetricName: "host", Operator: "contains", ThresholdText: text("eu")}, true, "db-eu-1.internal"},
+		{"!contains", models.Rule{MetricName: "host", Operator: "!contains", ThresholdText: text("eu")}, false, "db-eu-1.internal"},
+
+		// Arrays and objects are not comparable
+		{"array ==", models.Rule{MetricName: "tables", Operator: "==", ThresholdText: text("users")}, false, nil},
+		{"array =~", models.Rule{MetricName: "tables", Operator: "=~", ThresholdText: text("users")}, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, value := EvaluateRule(metricRun(metrics), tt.rule)
+			if got != tt.want {
+				t.Errorf("violated = %v, want %v", got, tt.want)
+			}
+			if tt.value != nil && value != tt.value {
+				t.Errorf("value = %#v, want %#v", value, tt.value)
+			}
+		})
+	}
+
+	// Baselines (mad and backtests too) never sample them
+	for _, name := range []string{"nan", "inf", "neginf"} {
+		if f, ok := ruleSample(metricRun(metrics), models.Rule{MetricName: name}); ok {
+			t.Errorf("%s sampled as %g", name, f)
+		}
+	}
+}
+
+func TestValidateRuleText(t *testing.T) {
+	tests := []struct {
+		name string
+		rule models.Rule
+		err  string
+	}{
+		{"string ==", models.Rule{MetricName: "env", Operator: "==", ThresholdText: text("prod")}, ""},
+		{"nested path", models.Rule{MetricName: `tables["users.v2"].rows`, Operator: ">"}, ""},
+		{"regex", models.Rule{MetricName: "host", Operator: "=~", ThresholdText: text(`^db-`)}, ""},
+		{"bad regex", models.Rule{MetricName: "host", Operator: "=~", ThresholdText: text(`(`)}, "invalid regular expression"},
+		{"regex without text", models.Rule{MetricName: "host", Operator: "!~"}, "needs a regular expression"},
+		{"empty substring", models.Rule{MetricName: "host", Operator: "contains", ThresholdText: text("")}, "needs the text to look for"},
+		{"text with <", models.Rule{MetricName: "env", Operator: "<", ThresholdText: text("prod")}, "threshold_text is only used by"},
+		{"bad path", models.Rule{MetricName: "tables..rows", Operator: ">"}, "invalid metric_name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateRule(tt.rule)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestEvaluateRuleTargets(t *testing.T) {
+	run := models.JobRun{
+		Status:     "fail",
+		DurationMs: 90000,
+		Stderr:     "connecting\nERROR: disk full on /var\nretrying",
+	}
+	tests := []struct {
+		name  string
+		rule  models.Rule
+		want  bool
+		value interface{}
+	}{
+		{"duration >", models.Rule{Target: TargetDuration, Operator: ">", ThresholdValue: 60000}, true, float64(90000)},
+		{"duration between", models.Rule{Target: TargetDuration, Operator: "between", ThresholdValue: 0, ThresholdHigh: float(60000)}, false, float64(90000)},
+		{"status == fail", models.Rule{Target: TargetStatus, Operator: "==", ThresholdText: text("fail")}, true, "fail"},
+		{"status != fail", models.Rule{Target: TargetStatus, Operator: "!=", ThresholdText: text("fail")}, false, "fail"},
+
+		// stderr rules report the first matching line
+		{"stderr contains", models.Rule{Target: TargetStderr, Operator: "contains", ThresholdText: text("disk full")}, true, "ERROR: disk full on /var"},
+		{"stderr =~", models.Rule{Target: TargetStderr, Operator: "=~", ThresholdText: text(`(?m)^ERROR:`)}, true, "ERROR: disk full on /var"},
+		{"stderr =~ no match", models.Rule{Target: TargetStderr, Operator: "=~", ThresholdText: text(`panic`)}, false, nil},
+		{"stderr !contains", models.Rule{Target: TargetStderr, Operator: "!contains", ThresholdText: text("panic")}, true, ""},
+		{"stderr !~ matching", models.Rule{Target: TargetStderr, Operator: "!~", ThresholdText: text(`disk`)}, false, ""},
+		{"stderr multi-line match", models.Rule{Target: TargetStderr, Operator: "=~", ThresholdText: text(`connecting\nERROR`)}, true, run.Stderr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, value := EvaluateRule(run, tt.rule)
+			if got != tt.want || (tt.value != nil && value != tt.value) {
+				t.Errorf("EvaluateRule = %v, %#v; want %v, %#v", got, value, tt.want, tt.value)
+			}
+		})
+	}
+
+	// Empty stderr only matches negated rules
+	quiet := models.JobRun{Status: "ok"}
+	if got, _ := EvaluateRule(quiet, models.Rule{Target: TargetStderr, Operator: "contains", ThresholdText: text("ERROR")}); got {
+		t.Error("contains matched empty stderr")
+	}
+	if got, _ := EvaluateRule(quiet, models.Rule{Target: TargetStderr, Operator: "!contains", ThresholdText: text("ERROR")}); !got {
+		t.Error("!contains did not match empty stderr")
+	}
+}
+
+func TestStderrExcerptTruncates(t *testing.T) {
+	long := "ERROR " + strings.Repeat("x", 300)
+	rule := models.Rule{Target: TargetStderr, Operator: "contains", ThresholdText: text("ERROR")}
+	_, value := EvaluateRule(models.JobRun{Stderr: "ok\n" + long}, rule)
+	excerpt, _ := value.(string)
+	if len(excerpt) != 203 || !strings.HasPrefix(excerpt, "ERROR x") || !strings.HasSuffix(excerpt, "...") {
+		t.Errorf("excerpt = %q (%d bytes)", excerpt, len(excerpt))
+	}
+}
+
+func TestValidateRuleTargets(t *testing.T) {
+	tests := []struct {
+		name string
+		rule models.Rule
+		err  string
+	}{
+		{"duration", models.Rule{Target: TargetDuration, Operator: ">", ThresholdValue: 1000}, ""},
+		{"status", models.Rule{Target: TargetStatus, Operator: "==", ThresholdText: text("fail")}, ""},
+		{"stderr", models.Rule{Target: TargetStderr, Operator: "=~", ThresholdText: text("ERROR")}, ""},
+		{"unknown target", models.Rule{Target: "exit_code", Operator: ">"}, "unknown target"},
+		{"target with metric", models.Rule{Target: TargetDuration, MetricName: "rows", Operator: ">"}, "metric_name is only used by target metric"},
+		{"absent duration", models.Rule{RuleType: RuleAbsent, Target: TargetDuration}, "absent rules need target metric"},
+		{"duration with text", models.Rule{Target: TargetDuration, Operator: "==", ThresholdText: text("1")}, "numeric operator"},
+		{"duration regex", models.Rule{Target: TargetDuration, Operator: "=~", ThresholdText: text("1")}, "numeric operator"},
+		{"status <", models.Rule{Target: TargetStatus, Operator: "<", ThresholdText: text("ok")}, "status rules use == or !="},
+		{"status running", models.Rule{Target: TargetStatus, Operator: "==", ThresholdText: text("running")}, "threshold_text ok or fail"},
+		{"stderr ==", models.Rule{Target: TargetStderr, Operator: "==", ThresholdText: text("x")}, "stderr rules use"},
+		{"stderr bad regex", models.Rule{Target: TargetStderr, Operator: "=~", ThresholdText: text("[")}, "invalid regular expression"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateRule(tt.rule)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Seasonality splits a baseline into buckets by the run's local time
+// (in the job's timezone), so Monday runs are compared with Mondays.
+// The last day of a month gets its own "last" bucket for month-end jobs.
+const (
+	SeasonWeekday    = "weekday"      // weekday:0 (Sunday) .. weekday:6
+	SeasonHour       = "hour"         // hour:0 .. hour:23
+	SeasonDayOfMonth = "day_of_month" // day_of_month:1 .. day_of_month:30, day_of_month:last
+)
+
+func validSeasonality(kind string) bool {
+	return kind == SeasonWeekday || kind == SeasonHour || kind == SeasonDayOfMonth
+}
+
+// seasonBucket returns the bucket of t (already in the job's timezone).
+func seasonBucket(kind string, t time.Time) string {
+	switch kind {
+	case SeasonWeekday:
+		return fmt.Sprintf("%s:%d", kind, int(t.Weekday()))
+	case SeasonHour:
+		return fmt.Sprintf("%s:%d", kind, t.Hour())
+	case SeasonDayOfMonth:
+		if t.AddDate(0, 0, 1).Month() != t.Month() {
+			return kind + ":last"
+		}
+		return fmt.Sprintf("%s:%d", kind, t.Day())
+	}
+	return ""
+}
+
+// DescribeBucket renders a bucket for alerts, e.g. "Mondays".
+func DescribeBucket(bucket string) string {
+	kind, value, _ := strings.Cut(bucket, ":")
+	n, _ := strconv.Atoi(value)
+	switch kind {
+	case SeasonWeekday:
+		return time.Weekday(n).String() + "s"
+	case SeasonHour:
+		return fmt.Sprintf("%02d:00-%02d:59", n, n)
+	case SeasonDayOfMonth:
+		if value == "last" {
+			return "the last day of the month"
+		}
+		return fmt.Sprintf("day %d of the month", n)
+	}
+	return "all runs"
+}
+
+// jobLocation returns the job's timezone (UTC if unset or invalid).
+func jobLocation(jobID string) *time.Location {
+	var tz string
+	if err := db.GetDB().QueryRow("SELECT COALESCE(timezone, 'UTC') FROM jobs WHERE id = $1", jobID).Scan(&tz); err != nil {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
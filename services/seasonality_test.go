@@ -0,0 +1,62 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeasonBucket(t *testing.T) {
+	ny := newYork(t)
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("no tzdata: %v", err)
+	}
+
+	// Monday 2026-06-01 02:30 UTC is Sunday evening in New York and
+	// Monday morning in Tokyo
+	instant := time.Date(2026, 6, 1, 2, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		kind string
+		t    time.Time
+		want string
+	}{
+		{"weekday UTC", SeasonWeekday, instant, "weekday:1"},
+		{"weekday New York", SeasonWeekday, instant.In(ny), "weekday:0"},
+		{"weekday Tokyo", SeasonWeekday, instant.In(tokyo), "weekday:1"},
+		{"hour UTC", SeasonHour, instant, "hour:2"},
+		{"hour New York", SeasonHour, instant.In(ny), "hour:22"},
+		{"hour Tokyo", SeasonHour, instant.In(tokyo), "hour:11"},
+		{"day UTC", SeasonDayOfMonth, instant, "day_of_month:1"},
+		{"last day in New York", SeasonDayOfMonth, instant.In(ny), "day_of_month:last"},
+		{"day 30 of 31", SeasonDayOfMonth, time.Date(2026, 5, 30, 12, 0, 0, 0, time.UTC), "day_of_month:30"},
+		{"day 30 of 30", SeasonDayOfMonth, time.Date(2026, 4, 30, 12, 0, 0, 0, time.UTC), "day_of_month:last"},
+		{"February", SeasonDayOfMonth, time.Date(2026, 2, 28, 23, 59, 0, 0, time.UTC), "day_of_month:last"},
+		{"leap February", SeasonDayOfMonth, time.Date(2028, 2, 28, 12, 0, 0, 0, time.UTC), "day_of_month:28"},
+		// 01:30 happens twice on 2026-11-01 in New York; both are hour 1
+		{"repeated DST hour", SeasonHour, cronTime(t, ny, "2026-11-01 01:30:00 -0500"), "hour:1"},
+		{"after DST start", SeasonHour, cronTime(t, ny, "2026-03-08 03:00:00 -0400"), "hour:3"},
+		{"unknown", "month", instant, ""},
+	}
+	for _, tt := range tests {
+		if got := seasonBucket(tt.kind, tt.t); got != tt.want {
+			t.Errorf("%s: seasonBucket(%s, %v) = %q, want %q", tt.name, tt.kind, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestDescribeBucket(t *testing.T) {
+	for bucket, want := range map[string]string{
+		"weekday:1":         "Mondays",
+		"weekday:0":         "Sundays",
+		"hour:7":            "07:00-07:59",
+		"day_of_month:15":   "day 15 of the month",
+		"day_of_month:last": "the last day of the month",
+		"":                  "all runs",
+	} {
+		if got := DescribeBucket(bucket); got != want {
+			t.Errorf("DescribeBucket(%q) = %q, want %q", bucket, got, want)
+		}
+	}
+}
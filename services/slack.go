@@ -5,50 +5,59 @@ import (
 	"cronmonitor/models"
 	"encoding/json"
 	"fmt"
-	"net/http"
-	"os"
+	"time"
 )
 
-func SendSlackAlert(job models.Job, run models.JobRun, message string) {
+// SlackNotifier posts n.Text to an incoming webhook.
+type SlackNotifier struct {
+	WebhookURL string
+}
+
+func (s SlackNotifier) Notify(n Notification) (statusCode int, err error) {
 	// Safety: Recover from any panic to avoid crashing the worker
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Printf("Slack panic recovered: %v\n", r)
+			err = fmt.Errorf("slack panic recovered: %v", r)
 		}
 	}()
 
-	webhookURL := os.Getenv("SLACK_WEBHOOK_URL")
-	if webhookURL == "" {
-		fmt.Println("Slack skipped: SLACK_WEBHOOK_URL not set")
-		return
-	}
-
 	payload := map[string]string{
-		"text": fmt.Sprintf("🚨 Cron Alert\n\nJob: %s\nStatus: %s\nTime: %s\n\nIssue:\n%s\n\nRun ID: %s",
-			job.Name,
-			run.Status,
-			run.CreatedAt,
-			message,
-			run.ID,
-		),
+		"text": n.Text,
 	}
 
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
-		fmt.Printf("Error marshaling Slack payload: %v\n", err)
-		return
+		return 0, fmt.Errorf("marshaling Slack payload: %w", err)
 	}
 
-	resp, err := http.Post(webhookURL, "application/json", bytes.NewBuffer(jsonPayload))
+	resp, err := deliveryClient.Post(s.WebhookURL, "application/json", bytes.NewBuffer(jsonPayload))
 	if err != nil {
-		fmt.Printf("Error sending Slack request: %v\n", err)
-		return
+		return 0, fmt.Errorf("sending Slack request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		fmt.Printf("Slack API error: Status %d\n", resp.StatusCode)
-	} else {
-		fmt.Println("Slack alert sent successfully")
+		return resp.StatusCode, fmt.Errorf("slack API error: status %d", resp.StatusCode)
 	}
+	fmt.Println("Slack alert sent successfully")
+	return resp.StatusCode, nil
+}
+
+func slackAlertText(job models.Job, run models.JobRun, message string) string {
+	return fmt.Sprintf("🚨 Cron Alert\n\nJob: %s\nStatus: %s\nTime: %s\n\nIssue:\n%s\n\nRun ID: %s",
+		job.Name,
+		run.Status,
+		run.CreatedAt,
+		message,
+		run.ID,
+	)
+}
+
+func slackRecoveryText(job models.Job, run models.JobRun, downSince time.Time) string {
+	return fmt.Sprintf("✅ Cron Recovered\n\nJob: %s\nDown since: %s\nRecovered at: %s\n\nRun ID: %s",
+		job.Name,
+		downSince.Format(time.RFC3339),
+		run.CreatedAt.Format(time.RFC3339),
+		run.ID,
+	)
 }
@@ -0,0 +1,371 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238 defaults, which every authenticator app supports).
+const (
+	totpIssuer = "AfterRun"
+	totpPeriod = 30 // seconds
+	totpDigits = 6
+	// Codes of the previous and next step are accepted for clock skew
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	loginChallengeTTL      = 5 * time.Minute
+	loginChallengeAttempts = 5
+
+	// Wrong codes are also counted per user, across challenges, since a
+	// password lets anyone start as many challenges as they like
+	secondFactorMaxFailures = 10
+	secondFactorLockout     = 15 * time.Minute
+)
+
+var (
+	ErrTOTPEnabled        = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrTOTPNotSetUp       = errors.New("two-factor authentication has not been set up")
+	ErrInvalidCode        = errors.New("invalid authentication code")
+	ErrChallengeInvalid   = errors.New("login challenge is invalid or expired")
+	ErrSecondFactorLocked = errors.New("too many wrong codes, try again later")
+)
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode returns the code of secret for a 30-second step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+// checkTOTP looks for code among the steps around now that come after
+// lastStep, and returns the matching step.
+func checkTOTP(encodedSecret string, lastStep sql.NullInt64, code string) (int64, bool) {
+	secret, err := base32NoPad.DecodeString(encodedSecret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if lastStep.Valid && step <= lastStep.Int64 {
+			continue // already used
+		}
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeCode strips the spaces and dashes people type or paste.
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// BeginTOTPSetup stores a new secret for the user and returns it with its
+// otpauth:// provisioning URI (rendered as a QR code by the client). The
+// secret is only enforced after EnableTOTP confirms a code.
+func BeginTOTPSetup(userID, email string) (secret, uri string, err error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret = base32NoPad.EncodeToString(b)
+
+	res, err := db.GetDB().Exec(`
+		UPDATE users SET totp_secret = $2
+		WHERE id::text = $1 AND totp_enabled_at IS NULL
+	`, userID, secret)
+	if err != nil {
+		return "", "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", "", ErrTOTPEnabled
+	}
+
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	uri = "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + q.Encode()
+	return secret, uri, nil
+}
+
+// EnableTOTP turns on two-factor authentication once the user proves
+// their app has the secret, and returns a fresh set of recovery codes.
+func EnableTOTP(userID, code string) ([]string, error) {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	var enabledAt sql.NullTime
+	var lastStep sql.NullInt64
+	err = tx.QueryRow(`
+		SELECT totp_secret, totp_enabled_at, totp_last_step FROM users WHERE id::text = $1 FOR UPDATE
+	`, userID).Scan(&secret, &enabledAt, &lastStep)
+	if err != nil {
+		return nil, err
+	}
+	if enabledAt.Valid {
+		return nil, ErrTOTPEnabled
+	}
+	if !secret.Valid {
+		return nil, ErrTOTPNotSetUp
+	}
+
+	step, ok := checkTOTP(secret.String, lastStep, normalizeCode(code))
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	if _, err := tx.Exec(`
+		UPDATE users SET totp_enabled_at = NOW(), totp_last_step = $2 WHERE id::text = $1
+	`, userID, step); err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// DisableTOTP turns off two-factor authentication after checking a code.
+func DisableTOTP(userID, code string) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := verifySecondFactor(tx, userID, code); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL WHERE id::text = $1
+	`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id::text = $1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes after
+// checking a code. Earlier codes stop working.
+func RegenerateRecoveryCodes(userID, code string) ([]string, error) {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := verifySecondFactor(tx, userID, code); err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// replaceRecoveryCodes stores new recovery codes and returns them in
+// plaintext (xxxx-xxxx-xxxx-xxxx); only their hashes are kept.
+func replaceRecoveryCodes(tx *sql.Tx, userID string) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id::text = $1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(base32NoPad.EncodeToString(b))
+		codes[i] = s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16]
+
+		if _, err := tx.Exec(`
+			INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1::uuid, $2)
+		`, userID, hashToken(normalizeCode(codes[i]))); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// verifySecondFactor accepts a current TOTP code or an unused recovery
+// code, and uses it up. The user row is locked so that concurrent
+// requests cannot both accept the same code.
+func verifySecondFactor(tx *sql.Tx, userID, code string) error {
+	var secret string
+	var lastStep sql.NullInt64
+	err := tx.QueryRow(`
+		SELECT totp_secret, totp_last_step FROM users
+		WHERE id::text = $1 AND totp_enabled_at IS NOT NULL
+		FOR UPDATE
+	`, userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return ErrTOTPNotEnabled
+	} else if err != nil {
+		return err
+	}
+
+	code = normalizeCode(code)
+	if step, ok := checkTOTP(secret, lastStep, code); ok {
+		_, err := tx.Exec("UPDATE users SET totp_last_step = $2 WHERE id::text = $1", userID, step)
+		return err
+	}
+
+	res, err := tx.Exec(`
+		UPDATE recovery_codes SET used_at = NOW()
+		WHERE user_id::text = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, hashToken(code))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// TOTPEnabled reports whether logging in needs a second factor, and how
+// many unused recovery codes the user has left.
+func TOTPEnabled(userID string) (enabled bool, recoveryCodesLeft int, err error) {
+	err = db.GetDB().QueryRow(`
+		SELECT u.totp_enabled_at IS NOT NULL,
+			(SELECT COUNT(*) FROM recovery_codes r WHERE r.user_id = u.id AND r.used_at IS NULL)
+		FROM users u WHERE u.id::text = $1
+	`, userID).Scan(&enabled, &recoveryCodesLeft)
+	return enabled, recoveryCodesLeft, err
+}
+
+// CreateLoginChallenge issues the short-lived token that stands in for a
+// session between the password and the second factor.
+func CreateLoginChallenge(userID, email string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	_, err := db.GetDB().Exec(`
+		INSERT INTO auth_tokens (purpose, user_id, email, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, TokenLoginChallenge, userID, email, hashToken(token), time.Now().Add(loginChallengeTTL))
+	return token, err
+}
+
+// CompleteLoginChallenge checks the second factor of a login. Each call
+// counts as an attempt, whether or not the code is right, and a challenge
+// allows only a few, so codes cannot be guessed. Wrong codes also count
+// against the user, and after secondFactorMaxFailures of them the second
+// factor is locked for secondFactorLockout. On success the challenge is
+// used up, the user's failures are cleared, and the user's id and email
+// are returned.
+func CompleteLoginChallenge(token, code string) (userID, email string, err error) {
+	err = db.GetDB().QueryRow(`
+		UPDATE auth_tokens SET attempts = attempts + 1
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL
+		AND expires_at > NOW() AND attempts < $3
+		RETURNING user_id, email
+	`, hashToken(token), TokenLoginChallenge, loginChallengeAttempts).Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		return "", "", ErrChallengeInvalid
+	} else if err != nil {
+		return "", "", err
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	err = tx.QueryRow(`
+		SELECT COALESCE(totp_locked_until > NOW(), false) FROM users
+		WHERE id::text = $1
+		FOR UPDATE
+	`, userID).Scan(&locked)
+	if err != nil {
+		return "", "", err
+	}
+	if locked {
+		return "", "", ErrSecondFactorLocked
+	}
+
+	err = verifySecondFactor(tx, userID, code)
+	if err == ErrInvalidCode {
+		if err := recordSecondFactorFailure(tx, userID); err != nil {
+			return "", "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return "", "", err
+		}
+		return "", "", ErrInvalidCode
+	} else if err != nil {
+		return "", "", err
+	}
+	_, err = tx.Exec(`
+		UPDATE users SET totp_failed_attempts = 0, totp_locked_until = NULL
+		WHERE id::text = $1
+	`, userID)
+	if err != nil {
+		return "", "", err
+	}
+	res, err := tx.Exec(`
+		UPDATE auth_tokens SET used_at = NOW() WHERE token_hash = $1 AND used_at IS NULL
+	`, hashToken(token))
+	if err != nil {
+		return "", "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", "", ErrChallengeInvalid
+	}
+	return userID, email, tx.Commit()
+}
+
+// recordSecondFactorFailure counts a wrong login code against the user
+// and, once there have been secondFactorMaxFailures in a row, locks the
+// second factor and starts counting again.
+func recordSecondFactorFailure(tx *sql.Tx, userID string) error {
+	_, err := tx.Exec(`
+		UPDATE users SET
+			totp_locked_until = CASE WHEN totp_failed_attempts + 1 >= $2
+				THEN NOW() + $3 * INTERVAL '1 second' ELSE totp_locked_until END,
+			totp_failed_attempts = CASE WHEN totp_failed_attempts + 1 >= $2
+				THEN 0 ELSE totp_failed_attempts + 1 END
+		WHERE id::text = $1
+	`, userID, secondFactorMaxFailures, int(secondFactorLockout.Seconds()))
+	return err
+}
@@ -0,0 +1,279 @@
+package services
+
+import (
+	"cronmonitor/db"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA-1 (secret "12345678901234567890"); the
+// expected codes are the low six digits of the eight-digit values there.
+func TestTOTPCodeRFC6238(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for _, tt := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		if got := totpCode(secret, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+// currentStep returns the current TOTP step, waiting out the last second
+// of a step so that the test cannot straddle two.
+func currentStep(t *testing.T) int64 {
+	t.Helper()
+	if time.Now().Unix()%totpPeriod == totpPeriod-1 {
+		time.Sleep(time.Second)
+	}
+	return time.Now().Unix() / totpPeriod
+}
+
+func TestCheckTOTPWindow(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	encoded := base32NoPad.EncodeToString(secret)
+	now := currentStep(t)
+
+	for _, tt := range []struct {
+		name string
+		step int64
+		ok   bool
+	}{
+		{"current", now, true},
+		{"previous", now - 1, true},
+		{"next", now + 1, true},
+		{"two back", now - 2, false},
+		{"two ahead", now + 2, false},
+	} {
+		step, ok := checkTOTP(encoded, sql.NullInt64{}, totpCode(secret, tt.step))
+		if ok != tt.ok || (ok && step != tt.step) {
+			t.Errorf("%s: checkTOTP = %d, %v; want %d, %v", tt.name, step, ok, tt.step, tt.ok)
+		}
+	}
+
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := checkTOTP(encoded, sql.NullInt64{}, code); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+	if _, ok := checkTOTP("not base32!", sql.NullInt64{}, totpCode(secret, now)); ok {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestCheckTOTPReplay(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	encoded := base32NoPad.EncodeToString(secret)
+	now := currentStep(t)
+	used := sql.NullInt64{Int64: now, Valid: true}
+
+	if _, ok := checkTOTP(encoded, used, totpCode(secret, now)); ok {
+		t.Error("code of the last used step accepted again")
+	}
+	if _, ok := checkTOTP(encoded, used, totpCode(secret, now-1)); ok {
+		t.Error("code of an earlier step accepted after a later one")
+	}
+	if step, ok := checkTOTP(encoded, used, totpCode(secret, now+1)); !ok || step != now+1 {
+		t.Errorf("next step: checkTOTP = %d, %v", step, ok)
+	}
+}
+
+func TestNormalizeCode(t *testing.T) {
+	if got := normalizeCode(" ABCD-efgh 1234-5678 "); got != "abcdefgh12345678" {
+		t.Errorf("normalizeCode = %q", got)
+	}
+}
+
+// enableTestTOTP turns on two-factor authentication for a new user and
+// returns the user, their secret, the step used up by enabling and the
+// recovery codes.
+func enableTestTOTP(t *testing.T) (userID, email string, secret []byte, step int64, codes []string) {
+	t.Helper()
+	userID, email = testUser(t, "example.com", true)
+	encoded, uri, err := BeginTOTPSetup(userID, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(uri, "otpauth://totp/AfterRun:") || !strings.Contains(uri, "secret="+encoded) {
+		t.Errorf("provisioning URI = %s", uri)
+	}
+	if secret, err = base32NoPad.DecodeString(encoded); err != nil {
+		t.Fatal(err)
+	}
+
+	step = currentStep(t)
+	if codes, err = EnableTOTP(userID, totpCode(secret, step)); err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("%d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+	return userID, email, secret, step, codes
+}
+
+func TestTOTPReplayRejected(t *testing.T) {
+	testDB(t)
+	userID, _, secret, step, _ := enableTestTOTP(t)
+
+	// The code that enabled 2FA is used up
+	if _, err := RegenerateRecoveryCodes(userID, totpCode(secret, step)); err != ErrInvalidCode {
+		t.Fatalf("replayed code: err = %v, want ErrInvalidCode", err)
+	}
+	if _, err := RegenerateRecoveryCodes(userID, totpCode(secret, step+1)); err != nil {
+		t.Fatalf("next code: %v", err)
+	}
+	if _, err := RegenerateRecoveryCodes(userID, totpCode(secret, step+1)); err != ErrInvalidCode {
+		t.Fatalf("replayed next code: err = %v, want ErrInvalidCode", err)
+	}
+
+	var last sql.NullInt64
+	db.GetDB().QueryRow("SELECT totp_last_step FROM users WHERE id = $1", userID).Scan(&last)
+	if !last.Valid || last.Int64 != step+1 {
+		t.Errorf("totp_last_step = %v, want %d", last, step+1)
+	}
+}
+
+func TestRecoveryCodesSingleUse(t *testing.T) {
+	testDB(t)
+	userID, email, _, _, codes := enableTestTOTP(t)
+
+	// Codes may be typed in upper case and without dashes
+	typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	for i, want := range []error{nil, ErrInvalidCode} {
+		token, err := CreateLoginChallenge(userID, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := CompleteLoginChallenge(token, typed); err != want {
+			t.Fatalf("use %d: err = %v, want %v", i+1, err, want)
+		}
+	}
+	if _, left, err := TOTPEnabled(userID); err != nil || left != recoveryCodeCount-1 {
+		t.Errorf("recovery codes left = %d, %v; want %d", left, err, recoveryCodeCount-1)
+	}
+
+	// Regenerating invalidates the rest
+	fresh, err := RegenerateRecoveryCodes(userID, codes[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := CreateLoginChallenge(userID, email)
+	if _, _, err := CompleteLoginChallenge(token, codes[2]); err != ErrInvalidCode {
+		t.Errorf("old code: err = %v, want ErrInvalidCode", err)
+	}
+	if _, _, err := CompleteLoginChallenge(token, fresh[0]); err != nil {
+		t.Errorf("new code: %v", err)
+	}
+}
+
+func TestLoginChallengeAttempts(t *testing.T) {
+	testDB(t)
+	userID, email, secret, step, _ := enableTestTOTP(t)
+	good := totpCode(secret, step+1)
+	bad := "000000"
+	if bad == good {
+		bad = "111111"
+	}
+
+	token, err := CreateLoginChallenge(userID, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < loginChallengeAttempts; i++ {
+		if _, _, err := CompleteLoginChallenge(token, bad); err != ErrInvalidCode {
+			t.Fatalf("attempt %d: err = %v, want ErrInvalidCode", i, err)
+		}
+	}
+	// The last allowed attempt still works
+	gotID, gotEmail, err := CompleteLoginChallenge(token, good)
+	if err != nil || gotID != userID || gotEmail != email {
+		t.Fatalf("attempt %d = %s, %s, %v", loginChallengeAttempts, gotID, gotEmail, err)
+	}
+	// and uses the challenge up
+	if _, _, err := CompleteLoginChallenge(token, totpCode(secret, step-1)); err != ErrChallengeInvalid {
+		t.Errorf("used challenge: err = %v, want ErrChallengeInvalid", err)
+	}
+
+	token, _ = CreateLoginChallenge(userID, email)
+	for i := 1; i <= loginChallengeAttempts; i++ {
+		CompleteLoginChallenge(token, bad)
+	}
+	if _, _, err := CompleteLoginChallenge(token, good); err != ErrChallengeInvalid {
+		t.Errorf("attempt %d: err = %v, want ErrChallengeInvalid", loginChallengeAttempts+1, err)
+	}
+
+	if _, _, err := CompleteLoginChallenge("unknown", good); err != ErrChallengeInvalid {
+		t.Errorf("unknown challenge: err = %v, want ErrChallengeInvalid", err)
+	}
+}
+
+func TestSecondFactorLockout(t *testing.T) {
+	testDB(t)
+	userID, email, secret, step, _ := enableTestTOTP(t)
+	good := totpCode(secret, step+1)
+	bad := "000000"
+	if bad == good {
+		bad = "111111"
+	}
+	failures := func() (n int, locked bool) {
+		t.Helper()
+		err := db.GetDB().QueryRow(`
+			SELECT totp_failed_attempts, COALESCE(totp_locked_until > NOW(), false)
+			FROM users WHERE id = $1
+		`, userID).Scan(&n, &locked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n, locked
+	}
+
+	// Wrong codes add up across challenges
+	token := ""
+	for i := 1; i < secondFactorMaxFailures; i++ {
+		if (i-1)%(loginChallengeAttempts-1) == 0 {
+			token, _ = CreateLoginChallenge(userID, email)
+		}
+		if _, _, err := CompleteLoginChallenge(token, bad); err != ErrInvalidCode {
+			t.Fatalf("failure %d: err = %v, want ErrInvalidCode", i, err)
+		}
+	}
+	if n, locked := failures(); n != secondFactorMaxFailures-1 || locked {
+		t.Fatalf("after %d failures: count %d, locked %v", secondFactorMaxFailures-1, n, locked)
+	}
+
+	token, _ = CreateLoginChallenge(userID, email)
+	if _, _, err := CompleteLoginChallenge(token, bad); err != ErrInvalidCode {
+		t.Fatalf("last failure: err = %v, want ErrInvalidCode", err)
+	}
+	if n, locked := failures(); n != 0 || !locked {
+		t.Fatalf("after %d failures: count %d, locked %v", secondFactorMaxFailures, n, locked)
+	}
+
+	// A locked user cannot log in, even with the right code on a new challenge
+	token, _ = CreateLoginChallenge(userID, email)
+	if _, _, err := CompleteLoginChallenge(token, good); err != ErrSecondFactorLocked {
+		t.Fatalf("locked: err = %v, want ErrSecondFactorLocked", err)
+	}
+
+	// Once the lock runs out the right code works and clears the count
+	db.GetDB().Exec("UPDATE users SET totp_locked_until = NOW() - INTERVAL '1 second' WHERE id = $1", userID)
+	if _, _, err := CompleteLoginChallenge(token, bad); err != ErrInvalidCode {
+		t.Fatalf("after lock: err = %v, want ErrInvalidCode", err)
+	}
+	if gotID, _, err := CompleteLoginChallenge(token, good); err != nil || gotID != userID {
+		t.Fatalf("after lock: %s, %v", gotID, err)
+	}
+	if n, locked := failures(); n != 0 || locked {
+		t.Errorf("after success: count %d, locked %v", n, locked)
+	}
+}
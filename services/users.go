@@ -0,0 +1,32 @@
+package services
+
+import (
+	"cronmonitor/db"
+)
+
+// SystemUserEmail is the built-in user that owns everything when
+// AUTH_ENABLED=false, and the jobs created before accounts existed.
+const SystemUserEmail = "system@afterrun.internal"
+
+// CreateUser inserts a user together with their personal org.
+func CreateUser(email, passwordHash string) (string, error) {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRow(
+		`INSERT INTO users (email, password_hash) VALUES ($1, $2) RETURNING id`,
+		email, passwordHash,
+	).Scan(&userID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := createPersonalOrg(tx, userID, email); err != nil {
+		return "", err
+	}
+	return userID, tx.Commit()
+}
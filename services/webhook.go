@@ -0,0 +1,143 @@
+package services
+
+import (
+	"bytes"
+	"cronmonitor/models"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// WebhookSignatureHeader carries "sha256=<hex HMAC-SHA256 of the body>"
+// keyed with the channel secret.
+const WebhookSignatureHeader = "X-AfterRun-Signature"
+
+// WebhookNotifier POSTs a notification to an arbitrary endpoint.
+// The body is Template executed against the Notification, or the
+// Notification as JSON when no template is set.
+type WebhookNotifier struct {
+	URL      string
+	Template string
+	Headers  map[string]string
+	Secret   string
+}
+
+func (w WebhookNotifier) Notify(n Notification) (statusCode int, err error) {
+	// Safety: Recover from any panic to avoid crashing the worker
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("webhook panic recovered: %v", r)
+		}
+	}()
+
+	body, err := renderWebhookBody(w.Template, n)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("building webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "AfterRun-Webhook")
+	for name, value := range w.Headers {
+		req.Header.Set(name, value)
+	}
+	// Set last so custom headers can't override it
+	req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhookBody(w.Secret, body))
+
+	resp, err := deliveryClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("sending webhook request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook error: status %d", resp.StatusCode)
+	}
+	fmt.Println("Webhook alert sent successfully")
+	return resp.StatusCode, nil
+}
+
+// SignWebhookBody returns the hex HMAC-SHA256 of body keyed with secret.
+func SignWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// GenerateWebhookSecret returns a random secret for a new webhook channel.
+func GenerateWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Template helpers: {{json .Job.Name}} emits a quoted, escaped JSON value.
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(webhookFuncs).Option("missingkey=zero").Parse(text)
+}
+
+func renderWebhookBody(text string, n Notification) ([]byte, error) {
+	if text == "" {
+		body, err := json.Marshal(n)
+		if err != nil {
+			return nil, fmt.Errorf("marshaling webhook payload: %w", err)
+		}
+		return body, nil
+	}
+
+	tmpl, err := parseWebhookTemplate(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing webhook template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, n); err != nil {
+		return nil, fmt.Errorf("rendering webhook template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func validateWebhookConfig(cfg models.ChannelConfig) error {
+	u, err := url.Parse(cfg.WebhookURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("webhook channels need an http(s) config.webhook_url")
+	}
+	if cfg.Secret == "" {
+		return fmt.Errorf("webhook channels need a config.secret")
+	}
+	for name, value := range cfg.Headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.EqualFold(name, WebhookSignatureHeader) {
+			return fmt.Errorf("header %s is reserved", WebhookSignatureHeader)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value for header %q", name)
+		}
+	}
+	if cfg.Template != "" {
+		if _, err := parseWebhookTemplate(cfg.Template); err != nil {
+			return fmt.Errorf("invalid config.template: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"cronmonitor/models"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSignWebhookBody(t *testing.T) {
+	tests := []struct {
+		secret string
+		body   string
+		want   string
+	}{
+		// RFC 4231 test case 2
+		{"Jefe", "what do ya want for nothing?", "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{"key", "The quick brown fox jumps over the lazy dog", "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+	}
+	for _, tt := range tests {
+		if got := SignWebhookBody(tt.secret, []byte(tt.body)); got != tt.want {
+			t.Errorf("SignWebhookBody(%q, %q) = %s, want %s", tt.secret, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestRenderWebhookBody(t *testing.T) {
+	rule := &models.Rule{MetricName: "rows", Operator: "<"}
+	n := Notification{
+		Job:         models.Job{Name: `nightly "backup"`},
+		Rule:        rule,
+		ActualValue: map[string]interface{}{"rows": 3},
+		Subject:     "[ALERT] nightly",
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		n        Notification
+		want     string
+		err      string
+	}{
+		{"fields", "{{.Subject}} {{.Rule.Operator}}", n, "[ALERT] nightly <", ""},
+		{"json quotes and escapes", `{"job": {{json .Job.Name}}}`, n, `{"job": "nightly \"backup\""}`, ""},
+		{"json of a value", `{{json .ActualValue}}`, n, `{"rows":3}`, ""},
+		{"missing map key is zero", `{"v": {{json .ActualValue.errors}}}`, n, `{"v": null}`, ""},
+		{"nil field", "{{.Rule.Operator}}", Notification{}, "", "rendering webhook template"},
+		{"unknown field", "{{.Nope}}", n, "", "rendering webhook template"},
+		{"parse error", "{{.Subject", n, "", "parsing webhook template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := renderWebhookBody(tt.template, tt.n)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || string(body) != tt.want {
+				t.Errorf("body = %s, %v; want %s", body, err, tt.want)
+			}
+		})
+	}
+
+	// Without a template the notification is sent as JSON
+	body, err := renderWebhookBody("", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Notification
+	if err := json.Unmarshal(body, &got); err != nil || got.Job.Name != n.Job.Name || got.Subject != n.Subject {
+		t.Errorf("default body = %s, %v", body, err)
+	}
+}
+
+func TestValidateWebhookConfig(t *testing.T) {
+	valid := models.ChannelConfig{
+		WebhookURL: "https://example.com/hook",
+		Secret:     "whsec_test",
+		Headers:    map[string]string{"Authorization": "Bearer x"},
+		Template:   `{"job": {{json .Job.Name}}}`,
+	}
+	with := func(f func(*models.ChannelConfig)) models.ChannelConfig {
+		cfg := valid
+		cfg.Headers = map[string]string{}
+		for k, v := range valid.Headers {
+			cfg.Headers[k] = v
+		}
+		f(&cfg)
+		return cfg
+	}
+
+	tests := []struct {
+		name string
+		cfg  models.ChannelConfig
+		err  string
+	}{
+		{"valid", valid, ""},
+		{"plain http", with(func(c *models.ChannelConfig) { c.WebhookURL = "http://example.com/hook" }), ""},
+		{"no template or headers", models.ChannelConfig{WebhookURL: valid.WebhookURL, Secret: valid.Secret}, ""},
+		{"other scheme", with(func(c *models.ChannelConfig) { c.WebhookURL = "ftp://example.com" }), "http(s) config.webhook_url"},
+		{"no host", with(func(c *models.ChannelConfig) { c.WebhookURL = "https:///hook" }), "http(s) config.webhook_url"},
+		{"no secret", with(func(c *models.ChannelConfig) { c.Secret = "" }), "config.secret"},
+		{"signature header", with(func(c *models.ChannelConfig) { c.Headers[WebhookSignatureHeader] = "sha256=0" }), "is reserved"},
+		{"signature header any case", with(func(c *models.ChannelConfig) { c.Headers["x-afterrun-signature"] = "x" }), "is reserved"},
+		{"CR in value", with(func(c *models.ChannelConfig) { c.Headers["X-Team"] = "ops\rX-Evil: 1" }), "invalid value"},
+		{"LF in value", with(func(c *models.ChannelConfig) { c.Headers["X-Team"] = "ops\nX-Evil: 1" }), "invalid value"},
+		{"colon in name", with(func(c *models.ChannelConfig) { c.Headers["X-Team: ops"] = "" }), "invalid header name"},
+		{"newline in name", with(func(c *models.ChannelConfig) { c.Headers["X-Team\n"] = "ops" }), "invalid header name"},
+		{"empty name", with(func(c *models.ChannelConfig) { c.Headers[""] = "ops" }), "invalid header name"},
+		{"bad template", with(func(c *models.ChannelConfig) { c.Template = "{{.Job" }), "invalid config.template"},
+		{"unknown function", with(func(c *models.ChannelConfig) { c.Template = "{{yaml .Job}}" }), "invalid config.template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateWebhookConfig(tt.cfg)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// The receiver can check the signature over exactly the body it got.
+func TestWebhookNotifierSignature(t *testing.T) {
+	const secret = "whsec_test"
+	type request struct {
+		body      []byte
+		signature string
+		header    http.Header
+	}
+	received := make(chan request, 1)
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- request{body, r.Header.Get(WebhookSignatureHeader), r.Header}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	n := Notification{Job: models.Job{Name: "nightly"}, Subject: "[ALERT] nightly"}
+	tests := []struct {
+		name     string
+		template string
+		headers  map[string]string
+		want     string // body, if templated
+	}{
+		{"default body", "", nil, ""},
+		{"templated body", `{"job": {{json .Job.Name}}}`, nil, `{"job": "nightly"}`},
+		{"custom headers", "", map[string]string{"Authorization": "Bearer x", "x-afterrun-signature": "sha256=forged"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := WebhookNotifier{URL: srv.URL, Template: tt.template, Headers: tt.headers, Secret: secret}
+			if code, err := w.Notify(n); err != nil || code != http.StatusOK {
+				t.Fatalf("Notify = %d, %v", code, err)
+			}
+			r := <-received
+			if want := "sha256=" + SignWebhookBody(secret, r.body); r.signature != want {
+				t.Errorf("signature = %q, want %q", r.signature, want)
+			}
+			if tt.want != "" && string(r.body) != tt.want {
+				t.Errorf("body = %s, want %s", r.body, tt.want)
+			}
+			if got := r.header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q", got)
+			}
+			if got := r.header.Values(WebhookSignatureHeader); len(got) != 1 {
+				t.Errorf("%d signature headers: %q", len(got), got)
+			}
+			for name, value := range tt.headers {
+				if !strings.EqualFold(name, WebhookSignatureHeader) && r.header.Get(name) != value {
+					t.Errorf("header %s = %q, want %q", name, r.header.Get(name), value)
+				}
+			}
+		})
+	}
+
+	status = http.StatusBadGateway
+	w := WebhookNotifier{URL: srv.URL, Secret: secret}
+	if code, err := w.Notify(n); err == nil || code != http.StatusBadGateway {
+		t.Errorf("Notify = %d, %v; want 502 and an error", code, err)
+	}
+	<-received
+}